@@ -0,0 +1,24 @@
+//go:build plan9
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// lockFile holds path open as an exclusive-use (DMEXCL) file, which Plan 9
+// lets only one process open at a time, retrying until lockWait passes.
+func lockFile(path string) (unlock func(), err error) {
+	deadline := time.Now().Add(lockWait)
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600|os.ModeExclusive)
+		if err == nil {
+			return func() { _ = file.Close() }, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(lockPoll)
+	}
+}
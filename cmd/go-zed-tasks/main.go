@@ -3,61 +3,523 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/token"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	env "github.com/caarlos0/env/v11"
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/VashingMachine/go-zed-test/pkg/discovery"
+	"github.com/VashingMachine/go-zed-test/pkg/tasks"
+	"github.com/VashingMachine/go-zed-test/pkg/zed"
 )
 
 const (
-	envPrefix            = "ZED_GO_TASKS_"
-	tasksPathEnvKey      = envPrefix + "TASKS_PATH"
-	debugPathEnvKey      = envPrefix + "DEBUG_PATH"
-	defaultVSTasksPath   = ".vscode/tasks.json"
-	defaultVSDebugPath   = ".vscode/launch.json"
-	defaultVSCodeVersion = "2.0.0"
-	defaultVSLaunchVer   = "0.2.0"
+	envPrefix              = "ZED_GO_TASKS_"
+	tasksPathEnvKey        = envPrefix + "TASKS_PATH"
+	debugPathEnvKey        = envPrefix + "DEBUG_PATH"
+	configPathEnvKey       = envPrefix + "CONFIG_PATH"
+	taskFieldEnvPrefix     = envPrefix + "TASK_FIELD_"
+	defaultConfigPath      = ".zed/go-zed-tasks.env"
+	stateDirPath           = ".zed/.go-zed-tasks/"
+	defaultVSTasksPath     = ".vscode/tasks.json"
+	defaultVSDebugPath     = ".vscode/launch.json"
+	defaultVSCodeVersion   = "2.0.0"
+	defaultVSLaunchVer     = "0.2.0"
+	secretEnvModeReference = "reference"
+	secretEnvModeOmit      = "omit"
+	secretEnvModeInline    = "inline"
+	testNameEnvKey         = "ZED_GO_TEST_NAME"
+	testFileEnvKey         = "ZED_GO_TEST_FILE"
+	packageEnvKey          = "ZED_GO_TEST_PACKAGE"
+	variantEnvKey          = "ZED_GO_TEST_VARIANT"
+	unverifiedEnvKey       = "ZED_GO_TEST_UNVERIFIED"
+	groupEnvKey            = "ZED_GO_TEST_GROUP"
+	composeEnvKey          = "ZED_GO_TEST_COMPOSE"
+	partEnvKey             = "ZED_GO_TEST_PART"
+	aggregateEnvKey        = "ZED_GO_TEST_AGGREGATE"
+	specEnvKey             = "ZED_GO_TEST_SPEC"
+	ginkgoVariantName      = "ginkgo"
+	goldenVariantName      = "update-golden"
+	watchVariantName       = "watch"
+	coverVariantName       = "cover"
+	failfastVariantName    = "failfast"
+	shortVariantName       = "short"
+	taskCwdRoot            = "root"
+	taskCwdPackage         = "package"
 )
 
 type Config struct {
-	TasksPath            string   `env:"TASKS_PATH" envDefault:".zed/tasks.json"`
-	DebugPath            string   `env:"DEBUG_PATH" envDefault:".zed/debug.json"`
-	LabelPrefix          string   `env:"LABEL_PREFIX" envDefault:"go:"`
-	DebugLabelPrefix     string   `env:"DEBUG_LABEL_PREFIX" envDefault:"go:debug:"`
-	GoBinary             string   `env:"GO_BINARY" envDefault:"go"`
-	TestNameRegex        string   `env:"TEST_NAME_REGEX" envDefault:"^Test"`
-	GoListRegex          string   `env:"GO_LIST_REGEX" envDefault:"^Test"`
-	AdditionalGoTestArgs []string `env:"ADDITIONAL_GO_TEST_ARGS" envDefault:"" envSeparator:","`
-	UseNewTerminal       bool     `env:"USE_NEW_TERMINAL" envDefault:"false"`
-	AllowConcurrentRuns  bool     `env:"ALLOW_CONCURRENT_RUNS" envDefault:"false"`
-	Reveal               string   `env:"REVEAL" envDefault:"always"`
-	Hide                 string   `env:"HIDE" envDefault:"never"`
-	PruneGenerated       bool     `env:"PRUNE_GENERATED" envDefault:"true"`
-	GeneratedEnvKey      string   `env:"GENERATED_ENV_KEY" envDefault:"ZED_GO_TEST_TASK_GENERATED"`
-	GeneratedEnvValue    string   `env:"GENERATED_ENV_VALUE" envDefault:"1"`
-	SubtestTimeout       string   `env:"SUBTEST_DISCOVERY_TIMEOUT" envDefault:"30s"`
-}
-
-type mergeStats struct {
-	Added   int
-	Updated int
-	Removed int
-}
-
-type goTestJSONEvent struct {
-	Action string `json:"Action"`
-	Test   string `json:"Test"`
+	TasksPath            string            `env:"TASKS_PATH" envDefault:".zed/tasks.json"`
+	DebugPath            string            `env:"DEBUG_PATH" envDefault:".zed/debug.json"`
+	LabelPrefix          string            `env:"LABEL_PREFIX" envDefault:"go:"`
+	DebugLabelPrefix     string            `env:"DEBUG_LABEL_PREFIX" envDefault:"go:debug:"`
+	LabelTemplate        string            `env:"LABEL_TEMPLATE"`
+	GoBinary             string            `env:"GO_BINARY" envDefault:"go"`
+	TestNameRegex        string            `env:"TEST_NAME_REGEX" envDefault:"^Test"`
+	GoListRegex          string            `env:"GO_LIST_REGEX" envDefault:"^Test"`
+	ExtraTestNameRegex   string            `env:"EXTRA_TEST_NAME_REGEX"`
+	ExcludeTestRegex     string            `env:"EXCLUDE_TEST_REGEX"`
+	BenchmarkNameRegex   string            `env:"BENCHMARK_NAME_REGEX"`
+	FuzzNameRegex        string            `env:"FUZZ_NAME_REGEX"`
+	ExampleNameRegex     string            `env:"EXAMPLE_NAME_REGEX"`
+	AdditionalGoTestArgs []string          `env:"ADDITIONAL_GO_TEST_ARGS" envDefault:"" envSeparator:","`
+	TestBinaryArgs       []string          `env:"TEST_BINARY_ARGS" envDefault:"" envSeparator:","`
+	BuildFlags           []string          `env:"BUILD_FLAGS" envDefault:"" envSeparator:","`
+	GoTestChdir          bool              `env:"GO_TEST_CHDIR" envDefault:"false"`
+	TaskCwd              string            `env:"TASK_CWD"`
+	GoldenUpdateFlag     string            `env:"GOLDEN_UPDATE_FLAG" envDefault:"-update"`
+	CrossCompileVariants bool              `env:"CROSS_COMPILE_VARIANTS" envDefault:"false"`
+	GoldenVariants       bool              `env:"GOLDEN_VARIANTS" envDefault:"true"`
+	GoldenFlagRegex      string            `env:"GOLDEN_FLAG_REGEX" envDefault:"^(update|golden|update[-_]goldens?)$"`
+	UseNewTerminal       bool              `env:"USE_NEW_TERMINAL" envDefault:"false"`
+	AllowConcurrentRuns  bool              `env:"ALLOW_CONCURRENT_RUNS" envDefault:"false"`
+	ConcurrentRunsPolicy string            `env:"CONCURRENT_RUNS_POLICY" envDefault:"global"`
+	SerialPackages       []string          `env:"SERIAL_PACKAGES" envSeparator:","`
+	Reveal               string            `env:"REVEAL" envDefault:"always"`
+	Hide                 string            `env:"HIDE" envDefault:"never"`
+	PruneGenerated       bool              `env:"PRUNE_GENERATED" envDefault:"true"`
+	GeneratedEnvKey      string            `env:"GENERATED_ENV_KEY" envDefault:"ZED_GO_TEST_TASK_GENERATED"`
+	GeneratedEnvValue    string            `env:"GENERATED_ENV_VALUE" envDefault:"1"`
+	SubtestTimeout       string            `env:"SUBTEST_DISCOVERY_TIMEOUT" envDefault:"30s"`
+	DiscoveryStrategies  []string          `env:"DISCOVERY_STRATEGIES" envSeparator:","`
+	TestTimeout          string            `env:"TEST_TIMEOUT"`
+	TestTimeouts         map[string]string `env:"TEST_TIMEOUTS"`
+	TaskEnv              map[string]string `env:"TASK_ENV"`
+	DotenvPath           string            `env:"DOTENV_PATH"`
+	SecretEnvPattern     string            `env:"SECRET_ENV_PATTERN" envDefault:"(?i)(TOKEN|SECRET|PASSWORD)"`
+	SecretEnvMode        string            `env:"SECRET_ENV_MODE" envDefault:"reference"`
+	FileMode             string            `env:"FILE_MODE" envDefault:"0644"`
+	DirMode              string            `env:"DIR_MODE" envDefault:"0755"`
+	TaskExtraFields      string            `env:"TASK_EXTRA_FIELDS"`
+	WatchCommand         string            `env:"WATCH_COMMAND"`
+	CoverageVariants     bool              `env:"COVERAGE_VARIANTS" envDefault:"false"`
+	CoverageDir          string            `env:"COVERAGE_DIR" envDefault:".zed/.go-zed-tasks/cover"`
+	Gotraceback          string            `env:"GOTRACEBACK" envDefault:"all"`
+	Godebug              string            `env:"GODEBUG"`
+	RuntimeEnvInDebug    bool              `env:"RUNTIME_ENV_IN_DEBUG" envDefault:"false"`
+	SanitizerVariants    []string          `env:"SANITIZER_VARIANTS" envSeparator:","`
+	SanitizerCC          string            `env:"SANITIZER_CC" envDefault:"clang"`
+	SanitizerCXX         string            `env:"SANITIZER_CXX" envDefault:"clang++"`
+	CgoEnabled           string            `env:"CGO_ENABLED" envDefault:"1"`
+	CgoCflags            string            `env:"CGO_CFLAGS"`
+	PkgConfigPath        string            `env:"PKG_CONFIG_PATH"`
+	DiscoveryCache       string            `env:"DISCOVERY_CACHE"`
+	DiscoveryCacheMode   string            `env:"DISCOVERY_CACHE_MODE" envDefault:"readwrite"`
+	DiscoveryCacheToken  string            `env:"DISCOVERY_CACHE_TOKEN"`
+	CABundle             string            `env:"CA_BUNDLE"`
+	Offline              bool              `env:"OFFLINE" envDefault:"false"`
+	DiscoveryGomaxprocs  int               `env:"DISCOVERY_GOMAXPROCS"`
+	DiscoveryProcs       int               `env:"DISCOVERY_PROCS"`
+	DiscoveryNice        int               `env:"DISCOVERY_NICE"`
+	MergeStrategy        string            `env:"MERGE_STRATEGY" envDefault:"replace"`
+	AggregateParallel    bool              `env:"AGGREGATE_PARALLEL" envDefault:"false"`
+	SkippedTests         string            `env:"SKIPPED_TESTS" envDefault:"keep"`
+	FailfastVariants     bool              `env:"FAILFAST_VARIANTS" envDefault:"false"`
+	FileOwnership        string            `env:"FILE_OWNERSHIP" envDefault:"shared"`
+	FallbackDir          string            `env:"FALLBACK_DIR"`
+	RunnerScripts        map[string]string `env:"RUNNER_SCRIPTS" envSeparator:";" envKeyValSeparator:"="`
+	MaxRunPattern        int               `env:"MAX_RUN_PATTERN"`
+	Metrics              bool              `env:"METRICS" envDefault:"false"`
+	MetricsPath          string            `env:"METRICS_PATH"`
+	TaskLogs             bool              `env:"TASK_LOGS" envDefault:"false"`
+	ShortVariants        bool              `env:"SHORT_VARIANTS" envDefault:"true"`
+	TaskLogKeep          int               `env:"TASK_LOG_KEEP" envDefault:"3"`
+	KeymapPath           string            `env:"KEYMAP_PATH"`
+	Reproducible         bool              `env:"REPRODUCIBLE" envDefault:"false"`
+	SkipGeneratedFiles   bool              `env:"SKIP_GENERATED_FILES" envDefault:"true"`
+	GeneratedFileGlobs   []string          `env:"GENERATED_FILE_GLOBS" envDefault:"*_gen_test.go,zz_generated*_test.go,mock_*_test.go,*_mock_test.go" envSeparator:","`
+	KeymapBindings       map[string]string `env:"KEYMAP_BINDINGS" envSeparator:";" envKeyValSeparator:"="`
+	KeymapRecent         int               `env:"KEYMAP_RECENT"`
+	KeymapRecentPrefix   string            `env:"KEYMAP_RECENT_PREFIX" envDefault:"alt-g"`
+	AllGeneratedTask     bool              `env:"ALL_GENERATED_TASK" envDefault:"false"`
+	MaxLabelLength       int               `env:"MAX_LABEL_LENGTH" envDefault:"0"`
+	LabelLengthPolicy    string            `env:"LABEL_LENGTH_POLICY" envDefault:"truncate"`
+	GinkgoSpecs          bool              `env:"GINKGO_SPECS" envDefault:"false"`
+	GinkgoLabelPrefix    string            `env:"GINKGO_LABEL_PREFIX" envDefault:"ginkgo:"`
+	GinkgoBinary         string            `env:"GINKGO_BINARY"`
+	AutoSubtestsMaxTime  string            `env:"AUTO_SUBTESTS_MAX_DURATION" envDefault:"10s"`
+	MaxTasks             int               `env:"MAX_TASKS" envDefault:"0"`
+	MaxTasksEviction     string            `env:"MAX_TASKS_EVICTION" envDefault:"generated"`
+	TaskfilePath         string            `env:"TASKFILE_PATH" envDefault:"Taskfile.yml"`
+	TaskfilePrefix       string            `env:"TASKFILE_PREFIX" envDefault:"test:"`
+	MakefilePath         string            `env:"MAKEFILE_PATH" envDefault:"tests.mk"`
+	MakefilePrefix       string            `env:"MAKEFILE_PREFIX" envDefault:"test-"`
+	ExportPath           string            `env:"EXPORT_PATH" envDefault:"go-tests.yaml"`
+
+	// TaskFields are the extra Zed task fields from TASK_EXTRA_FIELDS and
+	// TASK_FIELD_<name>, filled in by loadConfig.
+	TaskFields map[string]json.RawMessage
+	// ConfirmReplace asks whether the interactive merge strategy may
+	// overwrite an entry labeled label, set by loadConfig.
+	ConfirmReplace func(label string) bool
+	// Force prunes generated entries that do not run go, see -force.
+	Force bool
+	// KeptForeign collects the labels prunes kept because of keepsForeign,
+	// set by loadConfig; the command warns about them once it is done.
+	KeptForeign *foreignLabels
+}
+
+// fileModes are the permission bits used when the tool creates files and
+// directories. Existing files keep their mode and owner.
+type fileModes struct {
+	file os.FileMode
+	dir  os.FileMode
+}
+
+func (c Config) fileModes() (fileModes, error) {
+	fileMode, err := parseFileMode(c.FileMode)
+	if err != nil {
+		return fileModes{}, fmt.Errorf("invalid file_mode %q: %w", c.FileMode, err)
+	}
+	dirMode, err := parseFileMode(c.DirMode)
+	if err != nil {
+		return fileModes{}, fmt.Errorf("invalid dir_mode %q: %w", c.DirMode, err)
+	}
+	return fileModes{file: fileMode, dir: dirMode}, nil
+}
+
+func parseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode > 0o777 {
+		return 0, fmt.Errorf("mode must be within 0000-0777")
+	}
+	return os.FileMode(mode), nil
+}
+
+// testTimeoutFor returns the -timeout for tasks of pkgArg. TEST_TIMEOUTS
+// keys are package paths such as ./internal/db, or ./internal/... for a
+// whole subtree. An exact key beats a subtree and deeper subtrees beat
+// shallower ones; without a match TEST_TIMEOUT applies.
+func (c Config) testTimeoutFor(pkgArg string) string {
+	timeout, best := c.TestTimeout, -1
+	for pattern, value := range c.TestTimeouts {
+		if score := packagePatternScore(pattern, pkgArg); score > best {
+			timeout, best = strings.TrimSpace(value), score
+		}
+	}
+	return timeout
+}
+
+// packagePatternScore matches pkgArg against a package path such as
+// ./internal/db or a subtree such as ./internal/.... It returns -1 without
+// a match and otherwise a score that is higher for more specific patterns.
+func packagePatternScore(pattern, pkgArg string) int {
+	pkg := strings.TrimPrefix(pkgArg, "./")
+	key := strings.TrimPrefix(strings.TrimSpace(pattern), "./")
+	if subtree, ok := strings.CutSuffix(key, "..."); ok {
+		subtree = strings.TrimSuffix(strings.TrimSuffix(subtree, "/"), ".")
+		if subtree == "" || pkg == subtree || strings.HasPrefix(pkg, subtree+"/") {
+			return len(subtree)
+		}
+		return -1
+	}
+	if key == pkg {
+		return len(pkg) + 1
+	}
+	return -1
+}
+
+const (
+	concurrentRunsGlobal = "global"
+	concurrentRunsAuto   = "auto"
+)
+
+// allowConcurrentRuns is the allow_concurrent_runs of a task running tests
+// of pkgArgs in variant ("" for the plain task). The global policy applies
+// ALLOW_CONCURRENT_RUNS to every task. The auto policy lets plain unit test
+// tasks overlap but keeps tasks serial when they touch shared resources:
+// packages matching SERIAL_PACKAGES, golden updates writing testdata, and
+// long-running watchers.
+func (c Config) allowConcurrentRuns(variant string, pkgArgs ...string) bool {
+	if c.ConcurrentRunsPolicy != concurrentRunsAuto {
+		return c.AllowConcurrentRuns
+	}
+	if variant == goldenVariantName || variant == watchVariantName {
+		return false
+	}
+	for _, pkgArg := range pkgArgs {
+		for _, pattern := range c.SerialPackages {
+			if packagePatternScore(pattern, pkgArg) >= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+const (
+	skippedKeep     = "keep"
+	skippedAnnotate = "annotate"
+	skippedExclude  = "exclude"
+)
+
+const (
+	labelLengthTruncate = "truncate"
+	labelLengthFail     = "fail"
+)
+
+// minMaxLabelLength leaves room for some of the label around the ellipsis
+// and hash that truncateLabel adds.
+const minMaxLabelLength = 20
+
+type mergeStats = tasks.Stats
+
+const (
+	mergeReplace     = "replace"
+	mergeAppendOnly  = "append-only"
+	mergeInteractive = "interactive"
+)
+
+// MAX_TASKS_EVICTION orders: evict the tasks generated, or run, longest
+// ago first.
+const (
+	evictionGenerated = "generated"
+	evictionRun       = "run"
+)
+
+const (
+	ownershipShared    = "shared"
+	ownershipExclusive = "exclusive"
+)
+
+// exclusivePaths lists the editors' own tasks and debug files, which
+// FILE_OWNERSHIP=exclusive refuses to take over.
+var exclusivePaths = []string{zed.TasksPath, zed.DebugPath, defaultVSTasksPath, defaultVSDebugPath}
+
+// checkExclusivePaths rejects FILE_OWNERSHIP=exclusive for a file that
+// also holds hand-written entries.
+func (c Config) checkExclusivePaths() error {
+	if c.FileOwnership != ownershipExclusive {
+		return nil
+	}
+	for _, path := range []string{c.TasksPath, c.DebugPath} {
+		if slices.Contains(exclusivePaths, filepath.ToSlash(filepath.Clean(path))) {
+			return fmt.Errorf("file_ownership=exclusive would overwrite %s; point TASKS_PATH and DEBUG_PATH at separate files such as .zed/tasks.generated.json", path)
+		}
+	}
+	return nil
+}
+
+// prunes reports whether a merge drops an existing generated entry.
+// append-only never drops entries, and interactive keeps the ones that are
+// regenerated under the same label so replacing them can be confirmed.
+// Entries that do not run go are kept unless forced, see keepsForeign.
+// A file owned exclusively holds generated entries only: everything else
+// is dropped and the merge strategy does not apply.
+func (c Config) prunes(label string, generated, owned bool, regenerated map[string]struct{}) bool {
+	if c.FileOwnership == ownershipExclusive {
+		return !generated || c.PruneGenerated
+	}
+	if !c.PruneGenerated || !generated {
+		return false
+	}
+	switch c.MergeStrategy {
+	case mergeAppendOnly:
+		return false
+	case mergeInteractive:
+		if _, ok := regenerated[label]; ok {
+			return false
+		}
+	}
+	if c.keepsForeign(owned) {
+		c.KeptForeign.add(label)
+		return false
+	}
+	return true
+}
+
+// entryOwner returns a func reporting whether an entry looks like one this
+// tool writes: a task running GO_BINARY or the WATCH_COMMAND runner, or a
+// Delve debug config. The generated marker alone is not enough, because
+// another tool may use the same env key. The runners are worked out once,
+// so callers checking many entries keep the func.
+func (c Config) entryOwner() func(entry map[string]any) bool {
+	runners := c.entryRunners()
+	return func(entry map[string]any) bool {
+		if command, ok := entry["command"].(string); ok {
+			if inner, ok := tasks.Untee(command); ok {
+				command = inner
+			}
+			fields := strings.Fields(command)
+			if len(fields) == 0 {
+				return false
+			}
+			runner := filepath.Base(strings.Trim(fields[0], `'"`))
+			return slices.Contains(runners, runner)
+		}
+		if adapter, ok := entry["adapter"].(string); ok {
+			return strings.EqualFold(adapter, zed.DelveAdapter)
+		}
+		kind, _ := entry["type"].(string)
+		return kind == "go"
+	}
+}
+
+// entryRunners are the base names of the commands generated tasks start.
+func (c Config) entryRunners() []string {
+	goBinary := c.GoBinary
+	if goBinary == "" {
+		goBinary = "go"
+	}
+	runners := []string{filepath.Base(goBinary)}
+	for _, text := range c.RunnerScripts {
+		var command bytes.Buffer
+		if tmpl, err := parseRunnerTemplate(text); err == nil && tmpl.Execute(&command, runnerTemplateSample) == nil {
+			if fields := strings.Fields(command.String()); len(fields) > 0 {
+				runners = append(runners, filepath.Base(strings.Trim(fields[0], `'"`)))
+			}
+		}
+	}
+	// loadConfig already rejected templates that do not execute.
+	if tmpl, _ := parseWatchTemplate(c.WatchCommand); tmpl != nil {
+		var command bytes.Buffer
+		sample := watchTemplateData{Command: shellQuote(c.GoBinary) + " test", Args: "test", Go: shellQuote(c.GoBinary)}
+		if tmpl.Execute(&command, sample) == nil {
+			if fields := strings.Fields(command.String()); len(fields) > 0 {
+				runners = append(runners, filepath.Base(strings.Trim(fields[0], `'"`)))
+			}
+		}
+	}
+	return runners
+}
+
+// keepsForeign reports whether an entry with the generated marker must be
+// kept because it does not run go. -force prunes it.
+func (c Config) keepsForeign(owned bool) bool {
+	return !owned && !c.Force
+}
+
+// foreignLabels are the labels of entries kept by keepsForeign, in the
+// order they were first kept.
+type foreignLabels struct {
+	labels []string
+	seen   map[string]struct{}
+}
+
+func (f *foreignLabels) add(label string) {
+	if f == nil {
+		return
+	}
+	if _, ok := f.seen[label]; ok {
+		return
+	}
+	if f.seen == nil {
+		f.seen = make(map[string]struct{})
+	}
+	f.seen[label] = struct{}{}
+	f.labels = append(f.labels, label)
+}
+
+// warn prints one warning per label kept since the last call.
+func (f *foreignLabels) warn(cfg Config) {
+	if f == nil {
+		return
+	}
+	for _, label := range f.labels {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: kept %q: it has %s=%s but does not run %s; use -force to remove it\n", label, cfg.GeneratedEnvKey, cfg.GeneratedEnvValue, cfg.GoBinary)
+	}
+	f.labels = nil
+}
+
+// replaces reports whether a merge overwrites the existing entry labeled
+// label with generated.
+func (c Config) replaces(label string, existing, generated any) bool {
+	if c.FileOwnership == ownershipExclusive {
+		return true
+	}
+	switch c.MergeStrategy {
+	case mergeAppendOnly:
+		return false
+	case mergeInteractive:
+		return sameJSON(existing, generated) || (c.ConfirmReplace != nil && c.ConfirmReplace(label))
+	}
+	return true
+}
+
+// sameJSON reports whether a and b encode the same JSON value, ignoring key
+// order and formatting.
+func sameJSON(a, b any) bool {
+	var values [2]any
+	for i, v := range []any{a, b} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return false
+		}
+		if err := json.Unmarshal(data, &values[i]); err != nil {
+			return false
+		}
+	}
+	return reflect.DeepEqual(values[0], values[1])
+}
+
+// newReplacePrompt asks on out and reads y (replace), n (keep, the default)
+// or a (replace this and all remaining) answers from in. It reads byte by
+// byte so prompts for several files can share one stdin.
+func newReplacePrompt(in io.Reader, out io.Writer) func(label string) bool {
+	all := false
+	return func(label string) bool {
+		if all {
+			return true
+		}
+		_, _ = fmt.Fprintf(out, "Replace existing %q? [y/N/a] ", label)
+		var answer []byte
+		buf := make([]byte, 1)
+		for {
+			n, err := in.Read(buf)
+			if n == 1 && buf[0] != '\n' {
+				answer = append(answer, buf[0])
+			}
+			if err != nil || (n == 1 && buf[0] == '\n') {
+				break
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(string(answer))) {
+		case "y", "yes":
+			return true
+		case "a", "all":
+			all = true
+			return true
+		}
+		return false
+	}
 }
 
 type commonOptions struct {
@@ -65,15 +527,186 @@ type commonOptions struct {
 	tasksPathArg string
 	debugPathArg string
 	editor       editorKind
+	outPath      string
 	dryRun       bool
+	// offline forces Config.Offline, see -offline.
+	offline bool
+	// mergeStrategy overrides Config.MergeStrategy, see -merge-strategy.
+	mergeStrategy string
+	// force sets Config.Force.
+	force bool
+	// includeGenerated clears Config.SkipGeneratedFiles, see
+	// -include-generated.
+	includeGenerated bool
+	// maxTasks overrides Config.MaxTasks when positive, see -max-tasks.
+	maxTasks int
+	// keptForeign sets Config.KeptForeign. The copies made for each
+	// editor share it, so a run warns about each label once.
+	keptForeign *foreignLabels
 }
 
 type generateOptions struct {
 	commonOptions
-	goFilePath       string
-	goTestArgs       stringSliceFlag
-	subtestTimeout   string
-	discoverSubtests bool
+	editors           []editorKind
+	editorArg         string
+	goFilePath        string
+	filesFrom         string
+	goTestArgs        stringSliceFlag
+	buildFlags        stringSliceFlag
+	subtestTimeout    string
+	targetsArg        string
+	testBinaryArgs    stringSliceFlag
+	discoverSubtests  bool
+	staticSubtests    bool
+	autoSubtests      bool
+	goldenUpdate      bool
+	verbose           bool
+	includeUnverified bool
+	group             string
+	noDiscoveryCache  bool
+	// onlyTest and onlyLine select a single test of -file, which label
+	// may rename.
+	onlyTest string
+	onlyLine int
+	label    string
+	// readOnly keeps discovery from writing workspace state, for query.
+	readOnly bool
+	// counting marks discovery for stats, which counts tests instead of
+	// generating entries for them.
+	counting bool
+	// format selects the editor files or another tool's file, see
+	// -format.
+	format string
+	// output is the -output format of the summary, "" for text.
+	output string
+}
+
+// -format values: the -editor files, a Taskfile.yml for go-task, a
+// makefile to include, or a YAML export for other tools.
+const (
+	formatEditor   = "editor"
+	formatTaskfile = "taskfile"
+	formatMakefile = "makefile"
+	formatYAML     = "yaml"
+)
+
+// discoveryBinaryArgs are the test binary args used while discovering
+// subtests. The golden update flag is left out so discovery never rewrites
+// golden files.
+func (o generateOptions) discoveryBinaryArgs(cfg Config) []string {
+	args := make([]string, 0, len(cfg.TestBinaryArgs)+len(o.testBinaryArgs))
+	args = append(args, cfg.TestBinaryArgs...)
+	args = append(args, o.testBinaryArgs...)
+	return args
+}
+
+// resolvePaths validates -file and returns it and the workspace root as
+// absolute paths, auto-detecting the root from the file when unset.
+func (o *generateOptions) resolvePaths() (absFilePath, absRootPath string, err error) {
+	if o.goFilePath == "" {
+		return "", "", fmt.Errorf("missing required flag: -file")
+	}
+	absFilePaths, absRootPath, err := o.resolveBatchPaths([]string{o.goFilePath})
+	if err != nil {
+		return "", "", err
+	}
+	return absFilePaths[0], absRootPath, nil
+}
+
+// resolveBatchPaths is resolvePaths for several files, given in order and
+// without duplicates. The root is auto-detected from the first one.
+func (o *generateOptions) resolveBatchPaths(paths []string) (absFilePaths []string, absRootPath string, err error) {
+	seen := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		absFilePath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("resolve file path: %w", err)
+		}
+		if _, ok := seen[absFilePath]; ok {
+			continue
+		}
+		seen[absFilePath] = struct{}{}
+
+		info, err := os.Stat(absFilePath)
+		if err != nil {
+			return nil, "", fmt.Errorf("stat file %q: %w", absFilePath, err)
+		}
+
+		if info.IsDir() {
+			return nil, "", fmt.Errorf("file path points to a directory: %q", absFilePath)
+		}
+
+		if filepath.Ext(absFilePath) != ".go" {
+			return nil, "", fmt.Errorf("file must have .go extension: %q", absFilePath)
+		}
+		absFilePaths = append(absFilePaths, absFilePath)
+	}
+	if len(absFilePaths) == 0 {
+		return nil, "", fmt.Errorf("no files to generate")
+	}
+
+	if o.rootPath == "" {
+		o.rootPath = zed.DetectWorkspaceRoot(filepath.Dir(absFilePaths[0]))
+	}
+
+	absRootPath, err = filepath.Abs(o.rootPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("resolve root path: %w", err)
+	}
+	return absFilePaths, absRootPath, nil
+}
+
+// readFilesFrom reads the -files-from list, one path per line, from path
+// or from stdin for "-". Blank lines and # comments are skipped.
+func readFilesFrom(path string, stdin io.Reader) ([]string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read -files-from: %w", err)
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// resolveGoArgs combines configured and CLI go test args (including extra
+// args such as those after --) and splits them into build flags and go
+// test flags. Args after -args are added to the test binary args.
+func (o *generateOptions) resolveGoArgs(cfg Config, extra []string) (buildFlags, goTestFlags []string) {
+	allExtraGoTestArgs := make([]string, 0, len(cfg.AdditionalGoTestArgs)+len(o.goTestArgs)+len(extra))
+	allExtraGoTestArgs = append(allExtraGoTestArgs, cfg.AdditionalGoTestArgs...)
+	allExtraGoTestArgs = append(allExtraGoTestArgs, o.goTestArgs...)
+	allExtraGoTestArgs = append(allExtraGoTestArgs, extra...)
+	splitBuildFlags, goTestFlags, tailBinaryArgs := splitGoTestArgs(allExtraGoTestArgs)
+
+	buildFlags = make([]string, 0, len(cfg.BuildFlags)+len(o.buildFlags)+len(splitBuildFlags))
+	buildFlags = append(buildFlags, cfg.BuildFlags...)
+	buildFlags = append(buildFlags, o.buildFlags...)
+	buildFlags = append(buildFlags, splitBuildFlags...)
+	o.testBinaryArgs = append(o.testBinaryArgs, tailBinaryArgs...)
+	if hasGoFlag(goTestFlags, "skip") || hasGoFlag(goTestFlags, "fullpath") {
+		goTestFlags = cfg.toolchain().goTestArgs(goTestFlags)
+	}
+	return buildFlags, goTestFlags
+}
+
+// allTestBinaryArgs are the test binary args written into generated entries.
+func (o generateOptions) allTestBinaryArgs(cfg Config) []string {
+	args := o.discoveryBinaryArgs(cfg)
+	if o.goldenUpdate {
+		args = append(args, cfg.GoldenUpdateFlag)
+	}
+	return args
 }
 
 type stringSliceFlag []string
@@ -94,6 +727,10 @@ func main() {
 }
 
 func run(args []string) error {
+	args, err := parseConfigOverrideFlags(args, os.Stdin)
+	if err != nil {
+		return err
+	}
 	if len(args) == 0 {
 		return runGenerate(args, generateTargetTasks)
 	}
@@ -103,10 +740,44 @@ func run(args []string) error {
 		return runGenerate(args[1:], generateTargetTasks)
 	case "generate-debug":
 		return runGenerate(args[1:], generateTargetDebug)
+	case "generate-package":
+		return runGeneratePackage(args[1:])
+	case "watch":
+		return runWatch(args[1:])
 	case "debug":
 		return runGenerate(args[1:], generateTargetDebug)
 	case "clear":
 		return runClear(args[1:])
+	case "prune":
+		return runPrune(args[1:])
+	case "list":
+		return runList(args[1:])
+	case "init":
+		return runInit(args[1:])
+	case "selftest":
+		return runSelftest(args[1:])
+	case "query":
+		return runQuery(args[1:])
+	case "validate":
+		return runValidate(args[1:])
+	case "which":
+		return runWhich(args[1:])
+	case "pattern":
+		return runPrintPattern(args[1:])
+	case "compose":
+		return runCompose(args[1:])
+	case "doctor":
+		return runDoctor(args[1:])
+	case "stats":
+		return runStats(args[1:])
+	case "metrics":
+		return runMetrics(args[1:])
+	case "logs":
+		return runLogs(args[1:])
+	case completeCommand:
+		return runComplete(args[1:], os.Stdout)
+	case editorProtocolFlag, editorProtocolFlag[1:]:
+		return runEditorProtocol(os.Stdin, os.Stdout)
 	case "help", "-h", "--help":
 		printUsage()
 		return nil
@@ -132,593 +803,8372 @@ const (
 
 func runGenerate(args []string, target generateTarget) error {
 	var opts generateOptions
-	editorArg := string(editorKindZed)
-	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
-	fs.SetOutput(os.Stderr)
+	fs := opts.newFlagSet("generate", target)
 	fs.StringVar(&opts.goFilePath, "file", "", "Path to the Go file currently open in the editor (required).")
-	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
-	fs.StringVar(&opts.tasksPathArg, "tasks", "", "Override tasks JSON path.")
-	fs.StringVar(&opts.debugPathArg, "debug", "", "Override debug JSON path.")
-	fs.StringVar(&editorArg, "editor", editorArg, "Editor target. Supported: zed, vscode.")
-	fs.Var(&opts.goTestArgs, "go-test-arg", "Extra go test argument (repeatable). Example: -go-test-arg=-v -go-test-arg=-count=1")
-	fs.StringVar(&opts.subtestTimeout, "subtest-timeout", "", "Timeout for discover-subtests test execution (e.g. 30s, 2m).")
-	fs.BoolVar(&opts.discoverSubtests, "discover-subtests", false, "Run tests with go test -json and include discovered subtests.")
-	fs.BoolVar(&opts.dryRun, "dry-run", false, "Print resulting tasks JSON instead of writing it.")
-	if err := fs.Parse(args); err != nil {
-		return err
-	}
-	editor, err := parseEditorKind(editorArg)
+	fs.StringVar(&opts.filesFrom, "files-from", "", "Generate every file listed in this file (- for stdin), one path per line, in one merged write.")
+	fs.StringVar(&opts.onlyTest, "test", "", "Generate only this test of -file (and its subtests).")
+	fs.IntVar(&opts.onlyLine, "line", 0, "Generate only the test of -file declared around this 1-based line.")
+	fs.StringVar(&opts.label, "label", "", "Label of the entry for the test selected with -test or -line, instead of the generated one.")
+	fs.StringVar(&opts.group, "group", "", "Generate one task running every test tagged // zed:group <name> in the workspace (no -file needed).")
+	fs.BoolVar(&opts.includeGenerated, "include-generated", false, "Let -group scan machine-generated test files too (see SKIP_GENERATED_FILES).")
+	targets, err := opts.parse(fs, args)
 	if err != nil {
 		return err
 	}
-	opts.editor = editor
-
-	if opts.goFilePath == "" {
-		return fmt.Errorf("missing required flag: -file")
+	if opts.group != "" && opts.filesFrom != "" {
+		return fmt.Errorf("-group and -files-from cannot be combined")
 	}
-
-	absFilePath, err := filepath.Abs(opts.goFilePath)
-	if err != nil {
-		return fmt.Errorf("resolve file path: %w", err)
+	if opts.group != "" && opts.format != "" && opts.format != formatEditor {
+		return fmt.Errorf("-group only writes editor files (expected -format %s)", formatEditor)
 	}
-
-	info, err := os.Stat(absFilePath)
-	if err != nil {
-		return fmt.Errorf("stat file %q: %w", absFilePath, err)
+	if opts.group != "" && opts.output != "" {
+		return fmt.Errorf("-group prints a text summary only; drop -output")
 	}
-
-	if info.IsDir() {
-		return fmt.Errorf("file path points to a directory: %q", absFilePath)
+	if opts.onlyTest != "" || opts.onlyLine != 0 || opts.label != "" {
+		if err := opts.checkSingleTest(); err != nil {
+			return err
+		}
 	}
-
-	if filepath.Ext(absFilePath) != ".go" {
-		return fmt.Errorf("file must have .go extension: %q", absFilePath)
+	if opts.group != "" {
+		return runGenerateGroup(opts, targets, fs.Args())
 	}
-
-	if opts.rootPath == "" {
-		opts.rootPath = detectWorkspaceRoot(filepath.Dir(absFilePath))
+	if opts.filesFrom != "" {
+		return runGenerateBatch(opts, targets, fs.Args())
 	}
 
-	absRootPath, err := filepath.Abs(opts.rootPath)
+	absFilePath, absRootPath, err := opts.resolvePaths()
 	if err != nil {
-		return fmt.Errorf("resolve root path: %w", err)
+		return err
 	}
-
 	cfg, err := loadConfig(opts.commonOptions)
 	if err != nil {
 		return err
 	}
-
-	allExtraGoTestArgs := make([]string, 0, len(cfg.AdditionalGoTestArgs)+len(opts.goTestArgs)+len(fs.Args()))
-	allExtraGoTestArgs = append(allExtraGoTestArgs, cfg.AdditionalGoTestArgs...)
-	allExtraGoTestArgs = append(allExtraGoTestArgs, opts.goTestArgs...)
-	// Support passing args after `--`, e.g. -- -v -count=1.
-	allExtraGoTestArgs = append(allExtraGoTestArgs, fs.Args()...)
-
-	testNamePattern, err := regexp.Compile(cfg.TestNameRegex)
-	if err != nil {
-		return fmt.Errorf("invalid test_name_regex %q: %w", cfg.TestNameRegex, err)
+	if (opts.format == "" || opts.format == formatEditor) && hasNoTests(cfg, absFilePath) {
+		return pruneFileEntries(opts, absRootPath, absFilePath, targets)
 	}
 
-	testsInFile, err := findTestsInFile(absFilePath, testNamePattern)
+	result, reports, err := generateFile(opts, targets, fs.Args())
 	if err != nil {
-		return fmt.Errorf("find tests in file: %w", err)
+		return err
 	}
-
-	packageDir := filepath.Dir(absFilePath)
-	testsListedByGo, err := listTestsWithGo(cfg.GoBinary, packageDir, cfg.GoListRegex)
-	if err != nil {
-		return fmt.Errorf("list tests with go: %w", err)
+	if opts.dryRun || opts.outPath == "-" {
+		return nil
 	}
+	return printGenerateSummary([]discoveryResult{result}, reports, len(opts.editors) > 1, opts)
+}
 
-	runnableTests := intersectTests(testsInFile, testsListedByGo)
-	sort.Strings(runnableTests)
-
-	pkgArg, err := packageArg(absRootPath, packageDir)
+// hasNoTests reports whether generate would find nothing in absFilePath
+// without asking go test: it is not a _test.go file, or it declares no
+// test TEST_NAME_REGEX accepts and, with GINKGO_SPECS, no Ginkgo spec. A
+// file that does not parse is left to discovery to report.
+func hasNoTests(cfg Config, absFilePath string) bool {
+	if !strings.HasSuffix(absFilePath, "_test.go") {
+		return true
+	}
+	nameFilter, err := cfg.testNameFilter()
 	if err != nil {
-		return fmt.Errorf("build package argument: %w", err)
+		return false
 	}
+	if decls, err := findTestDeclsInFile(absFilePath, nameFilter); err != nil || len(decls) > 0 {
+		return false
+	}
+	if cfg.GinkgoSpecs {
+		if specs, err := discovery.FindGinkgoSpecs(absFilePath); err != nil || len(specs) > 0 {
+			return false
+		}
+	}
+	return true
+}
 
+// pruneFileEntries is generate for a file without tests: it removes the
+// generated entries recorded for that file from every editor and target,
+// as the merge would prune them, and leaves the entries of other files
+// alone, which a merge of no tests would drop too.
+func pruneFileEntries(opts generateOptions, absRootPath, absFilePath string, targets []generateTarget) error {
 	relFilePath := absFilePath
-	if rel, relErr := filepath.Rel(absRootPath, absFilePath); relErr == nil {
+	if rel, err := rootRelPath(absRootPath, absFilePath); err == nil {
 		relFilePath = filepath.ToSlash(rel)
 	}
+	opts.keptForeign = &foreignLabels{}
+	cfg, err := loadConfig(opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	defer cfg.KeptForeign.warn(cfg)
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return err
+	}
+	defer lockState(absRootPath, modes)()
 
-	selectedTests := append([]string(nil), runnableTests...)
-	discoveredTests := []string{}
-	discoveredNewCount := 0
-	subtestDiscoveryTimeout := time.Duration(0)
-	if opts.discoverSubtests {
-		subtestDiscoveryTimeout, err = resolveSubtestTimeout(cfg.SubtestTimeout, opts.subtestTimeout)
+	times, err := readGeneratedTimes(absRootPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	var tx fileTransaction
+	defer tx.rollback()
+	var updated []string
+	removed := 0
+	report := generateReport{Files: []generateFileReport{{File: relFilePath, Tests: []string{}, Strategies: []generateStrategyReport{}}}, Outputs: []generateOutputReport{}}
+	for _, editor := range opts.editors {
+		editorOpts := opts.commonOptions
+		editorOpts.editor = editor
+		editorCfg, err := loadConfig(editorOpts)
 		if err != nil {
 			return err
 		}
-
-		discoveredTests, err = discoverSubtestsWithGo(
-			cfg.GoBinary,
-			packageDir,
-			runnableTests,
-			subtestDiscoveryTimeout,
-			allExtraGoTestArgs,
-		)
-		if err != nil {
-			return fmt.Errorf("discover subtests: %w", err)
-		}
-
-		selectedTests = mergeUniqueTests(runnableTests, discoveredTests)
-		sort.Strings(selectedTests)
-		discoveredNewCount = countUniqueNotInBase(runnableTests, discoveredTests)
-	}
-
-	if target == generateTargetTasks {
-		tasksAbsPath := resolvePath(absRootPath, cfg.TasksPath)
-		stats := mergeStats{}
-		var output []byte
-
-		if opts.editor == editorKindVSCode {
-			generatedTasks := makeGeneratedVSCodeTasks(selectedTests, pkgArg, relFilePath, cfg, allExtraGoTestArgs)
-			mergedDoc, mergedStats, err := mergeVSCodeTasks(tasksAbsPath, generatedTasks, cfg)
+		for _, target := range targets {
+			adapter, err := newOutputAdapter(editor, target, editorCfg, absRootPath)
 			if err != nil {
-				return fmt.Errorf("merge tasks: %w", err)
+				return err
 			}
-			stats = mergedStats
-			output, err = marshalDocument(mergedDoc)
+			output, labels, err := removeFileEntries(editor, target, editorCfg, adapter.path, relFilePath)
 			if err != nil {
 				return err
 			}
-		} else {
-			generatedTasks := makeGeneratedTasks(selectedTests, pkgArg, relFilePath, cfg, allExtraGoTestArgs)
-			mergedTasks, mergedStats, err := mergeTasks(tasksAbsPath, generatedTasks, cfg)
-			if err != nil {
-				return fmt.Errorf("merge tasks: %w", err)
+
+			destination := adapter.path
+			if opts.outPath != "" {
+				destination = resolveOutPath(opts.outPath)
+			}
+			if opts.dryRun || destination == "-" {
+				_, _ = os.Stdout.Write(output)
+				continue
+			}
+			if len(labels) == 0 && opts.outPath == "" {
+				continue
 			}
-			stats = mergedStats
-			output, err = marshalTasks(mergedTasks)
+			destination, err = tx.stageWithFallback(cfg, absRootPath, destination, output, adapter.modes)
 			if err != nil {
-				return err
+				return fmt.Errorf("write %s file: %w", target, err)
+			}
+			updated = append(updated, destination)
+			removed += len(labels)
+			report.Outputs = append(report.Outputs, generateOutputReport{Path: destination, Editor: string(editor), Target: string(target), Removed: len(labels), Labels: []string{}})
+			if times != nil && opts.outPath == "" {
+				times.forget(absRootPath, adapter.path, labels)
 			}
 		}
+	}
+	if opts.dryRun || opts.outPath == "-" {
+		return nil
+	}
+	if times != nil && removed > 0 {
+		times.stage(absRootPath, &tx, modes)
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return report.print()
+	}
+	for _, path := range updated {
+		fmt.Printf("Updated %s\n", path)
+	}
+	fmt.Printf("No tests in %s; removed %d generated entries recorded for it\n", relFilePath, removed)
+	return nil
+}
 
-		if opts.dryRun {
-			_, _ = os.Stdout.Write(output)
-			return nil
+// removeFileEntries returns the editor file at path without the generated
+// entries recorded for relFilePath that the merge would prune, and their
+// labels.
+func removeFileEntries(editor editorKind, target generateTarget, cfg Config, path, relFilePath string) ([]byte, []string, error) {
+	owns := cfg.entryOwner()
+	prunes := func(entry map[string]any) bool {
+		if file, _ := tasks.EnvValue(tasks.EnvOf(entry), testFileEnvKey); !isGenerated(entry, cfg) || file != relFilePath {
+			return false
 		}
+		label, _ := entryLabel(entry)
+		return cfg.prunes(label, true, owns(entry), nil)
+	}
 
-		if err := writeTasks(tasksAbsPath, output); err != nil {
-			return fmt.Errorf("write tasks file: %w", err)
+	var labels []string
+	if editor == editorKindVSCode {
+		read, key := readVSCodeTasksDocument, "tasks"
+		if target == generateTargetDebug {
+			read, key = readVSCodeLaunchDocument, "configurations"
 		}
-
-		fmt.Printf("Updated %s\n", tasksAbsPath)
-		fmt.Printf("Discovered in file: %d, runnable with go test -list: %d\n", len(testsInFile), len(runnableTests))
-		if opts.discoverSubtests {
-			fmt.Printf("Discovered by runtime execution: %d (new: %d, timeout %s)\n", len(discoveredTests), discoveredNewCount, subtestDiscoveryTimeout)
+		doc, existing, err := read(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s %q: %w", target, path, err)
+		}
+		kept := make([]map[string]any, 0, len(existing))
+		for _, entry := range existing {
+			if prunes(entry) {
+				label, _ := entryLabel(entry)
+				labels = append(labels, label)
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		if target == generateTargetTasks {
+			kept = syncAllGeneratedVSCodeTask(kept, cfg)
 		}
-		fmt.Printf("Tasks added: %d, updated: %d, removed: %d\n", stats.Added, stats.Updated, stats.Removed)
-		for _, testName := range selectedTests {
-			fmt.Printf("Generated task: %s%s\n", cfg.LabelPrefix, testName)
+		doc[key] = kept
+		output, err := marshalDocument(doc)
+		return output, labels, err
+	}
+
+	file, err := tasks.ReadFile(path, cfg.mergePolicy())
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s %q: %w", target, path, err)
+	}
+	for _, entry := range file.Values() {
+		if prunes(entry) {
+			label, _ := entryLabel(entry)
+			labels = append(labels, label)
 		}
+	}
+	for _, label := range labels {
+		file.RemoveGenerated(label)
+	}
+	if target == generateTargetTasks {
+		syncAllGeneratedTask(file, cfg)
+	}
+	output, err := file.Marshal()
+	return output, labels, err
+}
+
+// checkSingleTest checks the -test, -line and -label flags.
+func (o *generateOptions) checkSingleTest() error {
+	switch {
+	case o.onlyTest != "" && o.onlyLine != 0:
+		return fmt.Errorf("-test and -line cannot be combined")
+	case o.onlyLine < 0:
+		return fmt.Errorf("invalid -line %d (expected a line number)", o.onlyLine)
+	case o.group != "" || o.filesFrom != "":
+		return fmt.Errorf("-test, -line and -label select a test of -file and cannot be combined with -group or -files-from")
+	case o.label != "" && o.onlyTest == "" && o.onlyLine == 0:
+		return fmt.Errorf("-label requires -test or -line")
+	case o.label != "" && strings.TrimSpace(o.label) == "":
+		return fmt.Errorf("-label must not be blank")
+	}
+	return nil
+}
+
+// runGenerateBatch generates the -files-from files, plus -file if set, as
+// one batch: every editor file is written once with the entries of all of
+// them, so an editor never sees some files regenerated and others not.
+func runGenerateBatch(opts generateOptions, targets []generateTarget, extra []string) error {
+	paths, err := readFilesFrom(opts.filesFrom, os.Stdin)
+	if err != nil {
+		return err
+	}
+	if opts.goFilePath != "" {
+		paths = append([]string{opts.goFilePath}, paths...)
+	}
+	absFilePaths, absRootPath, err := opts.resolveBatchPaths(paths)
+	if err != nil {
+		return err
+	}
+	results, reports, err := generateFiles(opts, absRootPath, absFilePaths, targets, extra)
+	if err != nil {
+		return err
+	}
+	if opts.dryRun || opts.outPath == "-" {
 		return nil
 	}
+	return printGenerateSummary(results, reports, len(opts.editors) > 1, opts)
+}
 
-	if target == generateTargetDebug {
-		debugAbsPath := resolvePath(absRootPath, cfg.DebugPath)
-		stats := mergeStats{}
-		var output []byte
+// runGeneratePackage generates the entries of every test file of one
+// package directory in a single merge, as if they were one -file.
+func runGeneratePackage(args []string) error {
+	var opts generateOptions
+	var pkgArg string
+	fs := opts.newFlagSet("generate-package", generateTargetTasks)
+	fs.StringVar(&pkgArg, "package", "", "Package directory whose test files to generate, relative to the workspace root (required). Example: ./internal/foo")
+	fs.BoolVar(&opts.includeGenerated, "include-generated", false, "Also generate machine-generated test files of the package (see SKIP_GENERATED_FILES).")
+	targets, err := opts.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if pkgArg == "" {
+		return fmt.Errorf("missing required flag: -package")
+	}
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+	cfg, err := loadConfig(opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	files, err := cfg.packageTestFiles(resolvePath(absRootPath, pkgArg))
+	if err != nil {
+		return err
+	}
 
-		if opts.editor == editorKindVSCode {
-			generatedDebugConfigs := makeGeneratedVSCodeDebugConfigs(selectedTests, pkgArg, relFilePath, cfg, allExtraGoTestArgs)
-			mergedDoc, mergedStats, err := mergeVSCodeDebugConfigs(debugAbsPath, generatedDebugConfigs, cfg)
-			if err != nil {
-				return fmt.Errorf("merge debug configs: %w", err)
-			}
-			stats = mergedStats
-			output, err = marshalDocument(mergedDoc)
+	results, reports, err := generateFiles(opts, absRootPath, files, targets, fs.Args())
+	if err != nil {
+		return err
+	}
+	if opts.dryRun || opts.outPath == "-" {
+		return nil
+	}
+	return printGenerateSummary(results, reports, len(opts.editors) > 1, opts)
+}
+
+// runWatch regenerates the entries of each test file saved under the
+// workspace root, until interrupted.
+func runWatch(args []string) error {
+	var opts generateOptions
+	var debounce time.Duration
+	fs := opts.newFlagSet("watch", generateTargetTasks)
+	fs.DurationVar(&debounce, "debounce", 300*time.Millisecond, "Wait this long after the last change before regenerating, so one save of several files is one merge.")
+	targets, err := opts.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if debounce <= 0 {
+		return fmt.Errorf("invalid -debounce %s: must be positive", debounce)
+	}
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, terminationSignals...)
+	defer signal.Stop(signals)
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	fmt.Printf("Watching %s for test file changes (Ctrl-C to stop)\n", absRootPath)
+	return watchWorkspace(opts, absRootPath, debounce, targets, fs.Args(), stop)
+}
+
+// watchWorkspace watches the directories walkTestFiles visits and, debounce
+// after the last write to a _test.go file, generates the changed files in
+// one merge. Directories created later are watched too, and their test
+// files generated. When the content of one of the moduleFiles changes, the
+// files that have generated entries are regenerated as well, so tests
+// that start or stop compiling with the new dependencies are verified
+// again. A generate error is printed and watching goes on, since a file
+// being edited often does not parse. It returns when stop is closed.
+func watchWorkspace(opts generateOptions, absRootPath string, debounce time.Duration, targets []generateTarget, extra []string, stop <-chan struct{}) error {
+	cfg, err := loadConfig(opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("start watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	pending := make(map[string]struct{})
+	watchTree := func(dir string, collect bool) error {
+		return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
-		} else {
-			generatedDebugConfigs := makeGeneratedDebugConfigs(selectedTests, pkgArg, relFilePath, cfg, allExtraGoTestArgs)
-			mergedDebug, mergedStats, err := mergeTasks(debugAbsPath, generatedDebugConfigs, cfg)
+			if !d.IsDir() {
+				if collect && strings.HasSuffix(path, "_test.go") {
+					pending[path] = struct{}{}
+				}
+				return nil
+			}
+			if path != absRootPath && skipWorkspaceDir(path, d.Name()) {
+				return filepath.SkipDir
+			}
+			return watcher.Add(path)
+		})
+	}
+	if err := watchTree(absRootPath, false); err != nil {
+		return fmt.Errorf("watch %s: %w", absRootPath, err)
+	}
+	recorded := moduleFileHashes(absRootPath)
+	moduleChanged := false
+
+	var flush <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			_, _ = fmt.Fprintf(os.Stderr, "warning: watch: %v\n", err)
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Dir(event.Name) == absRootPath && slices.Contains(moduleFiles, filepath.Base(event.Name)) {
+				// Removing go.work changes the build as much as editing it.
+				moduleChanged = true
+				flush = time.After(debounce)
+				continue
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+				if skipWorkspaceDir(event.Name, info.Name()) {
+					continue
+				}
+				if err := watchTree(event.Name, true); err != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "warning: watch %s: %v\n", event.Name, err)
+				}
+			} else if strings.HasSuffix(event.Name, "_test.go") {
+				pending[event.Name] = struct{}{}
+			}
+			if len(pending) > 0 {
+				flush = time.After(debounce)
+			}
+		case <-flush:
+			flush = nil
+			if moduleChanged {
+				moduleChanged = false
+				if hashes := moduleFileHashes(absRootPath); !maps.Equal(hashes, recorded) {
+					recorded = hashes
+					generated, err := generatedTestFiles(opts, absRootPath, targets)
+					if err != nil {
+						_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+					} else {
+						fmt.Printf("Module files changed; verifying the %d test files with generated entries again\n", len(generated))
+					}
+					for _, path := range generated {
+						pending[path] = struct{}{}
+					}
+				}
+			}
+			files := make([]string, 0, len(pending))
+			for path := range pending {
+				if fileExists(path) && !(cfg.SkipGeneratedFiles && cfg.isGeneratedTestFile(path)) {
+					files = append(files, path)
+				}
+			}
+			clear(pending)
+			if len(files) == 0 {
+				continue
+			}
+			sort.Strings(files)
+			results, reports, err := generateFiles(opts, absRootPath, files, targets, extra)
 			if err != nil {
-				return fmt.Errorf("merge debug configs: %w", err)
+				_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				continue
+			}
+			if !opts.dryRun && opts.outPath != "-" {
+				if err := printGenerateSummary(results, reports, len(opts.editors) > 1, opts); err != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				}
 			}
-			stats = mergedStats
-			output, err = marshalTasks(mergedDebug)
+		}
+	}
+}
+
+// moduleFiles are the files at the workspace root that decide which
+// dependencies, and so which tests, compile.
+var moduleFiles = []string{"go.mod", "go.sum", "go.work", "go.work.sum"}
+
+// moduleFileHashes hashes the moduleFiles in absRootPath. A missing file
+// has no entry, so creating or removing one is a change too.
+func moduleFileHashes(absRootPath string) map[string]string {
+	hashes := make(map[string]string)
+	for _, name := range moduleFiles {
+		data, err := os.ReadFile(filepath.Join(absRootPath, name))
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		hashes[name] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+// generatedTestFiles returns the existing test files that the generated
+// entries of targets in the files of opts.editors were generated from.
+func generatedTestFiles(opts generateOptions, absRootPath string, targets []generateTarget) ([]string, error) {
+	seen := make(map[string]struct{})
+	for _, editor := range opts.editors {
+		editorOpts := opts.commonOptions
+		editorOpts.editor = editor
+		cfg, err := loadConfig(editorOpts)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			entries, err := readEditorEntries(editor, target, cfg, absRootPath)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			for _, entry := range entries {
+				file, _ := tasks.EnvValue(tasks.EnvOf(entry), testFileEnvKey)
+				if path := resolvePath(absRootPath, filepath.FromSlash(file)); isGenerated(entry, cfg) && file != "" && fileExists(path) {
+					seen[path] = struct{}{}
+				}
 			}
 		}
+	}
+	return slices.Sorted(maps.Keys(seen)), nil
+}
+
+// packageTestFiles lists the _test.go files directly in dir, without the
+// machine-generated ones unless SKIP_GENERATED_FILES is off.
+func (c Config) packageTestFiles(dir string) ([]string, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read package directory: %w", err)
+	}
+	var files []string
+	for _, entry := range dirEntries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), "_test.go") || c.SkipGeneratedFiles && c.isGeneratedTestFile(path) {
+			continue
+		}
+		files = append(files, path)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no test files in %s", dir)
+	}
+	return files, nil
+}
+
+// newFlagSet registers the flags generate and generate-package share.
+func (opts *generateOptions) newFlagSet(name string, target generateTarget) *flag.FlagSet {
+	opts.editorArg = string(editorKindZed)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.StringVar(&opts.tasksPathArg, "tasks", "", "Override tasks JSON path.")
+	fs.StringVar(&opts.debugPathArg, "debug", "", "Override debug JSON path.")
+	fs.StringVar(&opts.editorArg, "editor", opts.editorArg, "Editor target(s), comma-separated. Supported: zed, vscode.")
+	fs.Var(&opts.goTestArgs, "go-test-arg", "Extra go test argument (repeatable). Example: -go-test-arg=-v -go-test-arg=-count=1")
+	fs.Var(&opts.buildFlags, "build-flag", "Go build flag (repeatable), also passed to Delve as buildFlags. Example: -build-flag=-tags=integration")
+	fs.Var(&opts.testBinaryArgs, "test-binary-arg", "Test binary argument passed after -args (repeatable). Example: -test-binary-arg=-update-golden")
+	fs.BoolVar(&opts.goldenUpdate, "golden-update", false, "Append the golden update flag (GOLDEN_UPDATE_FLAG) to the test binary args.")
+	fs.StringVar(&opts.subtestTimeout, "subtest-timeout", "", "Timeout for discover-subtests test execution (e.g. 30s, 2m).")
+	fs.BoolVar(&opts.discoverSubtests, "discover-subtests", false, "Run tests with go test -json and include discovered subtests.")
+	fs.BoolVar(&opts.staticSubtests, "static-subtests", false, "Include subtests run with a literal name, t.Run(\"name\", ...), found without running anything.")
+	fs.BoolVar(&opts.autoSubtests, "auto-subtests", false, "Find subtests statically, and by running the tests that call t.Run when the package's tests last ran under AUTO_SUBTESTS_MAX_DURATION.")
+	fs.StringVar(&opts.targetsArg, "targets", string(target), "Comma-separated outputs to generate from one discovery run. Supported: tasks, debug.")
+	fs.StringVar(&opts.outPath, "out", "", "Write the resulting JSON to this path instead of the editor file (- for stdout).")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "Print resulting tasks JSON instead of writing it.")
+	fs.BoolVar(&opts.verbose, "verbose", false, "List the tests each discovery strategy dropped, and why.")
+	fs.BoolVar(&opts.includeUnverified, "include-unverified", false, "Generate entries for tests found in the file that go test -list does not report.")
+	fs.BoolVar(&opts.offline, "offline", false, "Disable all network access, e.g. an HTTP DISCOVERY_CACHE (same as OFFLINE=true).")
+	fs.BoolVar(&opts.noDiscoveryCache, "no-discovery-cache", false, "Run subtest discovery even when DISCOVERY_CACHE has a manifest for the package.")
+	fs.StringVar(&opts.mergeStrategy, "merge-strategy", "", "How to merge with existing entries: replace, append-only or interactive (default MERGE_STRATEGY, replace).")
+	fs.BoolVar(&opts.force, "force", false, "Prune entries with the generated marker even when they do not run go.")
+	fs.StringVar(&opts.format, "format", formatEditor, "Output format: editor (the -editor files), taskfile (TASKFILE_PATH for go-task), makefile (MAKEFILE_PATH to include) or yaml (EXPORT_PATH for other tools); all but editor write tasks only.")
+	fs.IntVar(&opts.maxTasks, "max-tasks", 0, "Keep at most this many generated tasks per tasks file, evicting the least recently used (default MAX_TASKS, no limit).")
+	fs.StringVar(&opts.output, "output", "", "Print the summary in this format instead of text. Supported: json.")
+	return fs
+}
+
+// parse parses args with fs and checks the editors and targets they name.
+func (opts *generateOptions) parse(fs *flag.FlagSet, args []string) ([]generateTarget, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	editors, err := parseEditorKinds(opts.editorArg)
+	if err != nil {
+		return nil, err
+	}
+	opts.editor = editors[0]
+	opts.editors = editors
+	if len(editors) > 1 && (opts.tasksPathArg != "" || opts.debugPathArg != "") {
+		return nil, fmt.Errorf("-tasks and -debug overrides require a single -editor")
+	}
+
+	targets, err := parseGenerateTargets(opts.targetsArg)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.format {
+	case formatEditor:
+		if opts.outPath != "" && len(editors)*len(targets) > 1 {
+			return nil, fmt.Errorf("-out requires a single -editor and a single target")
+		}
+	case formatTaskfile, formatMakefile, formatYAML:
+		if len(targets) != 1 || targets[0] != generateTargetTasks {
+			return nil, fmt.Errorf("-format %s only writes tasks (expected -targets tasks)", opts.format)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported -format %q (expected editor, taskfile, makefile or yaml)", opts.format)
+	}
+	switch {
+	case opts.output != "" && opts.output != "json":
+		return nil, fmt.Errorf("unsupported -output %q (expected json)", opts.output)
+	case opts.output != "" && (opts.dryRun || opts.outPath == "-"):
+		return nil, fmt.Errorf("-output prints the summary, which -dry-run and -out - leave out")
+	}
+	return targets, nil
+}
+
+// generateFile discovers the tests of -file once and writes them to every
+// editor and target. With -dry-run or -out - the JSON goes to stdout and no
+// reports are returned.
+func generateFile(opts generateOptions, targets []generateTarget, extra []string) (discoveryResult, []adapterReport, error) {
+	absFilePath, absRootPath, err := opts.resolvePaths()
+	if err != nil {
+		return discoveryResult{}, nil, err
+	}
+	results, reports, err := generateFiles(opts, absRootPath, []string{absFilePath}, targets, extra)
+	if err != nil {
+		return discoveryResult{}, nil, err
+	}
+	return results[0], reports, nil
+}
+
+// generateFiles is generateFile for several test files: it discovers each
+// one and merges all their entries into every editor and target at once,
+// so pruning sees the entries of every file as regenerated.
+func generateFiles(opts generateOptions, absRootPath string, absFilePaths []string, targets []generateTarget, extra []string) ([]discoveryResult, []adapterReport, error) {
+	started := time.Now()
+	opts.keptForeign = &foreignLabels{}
+	cfg, err := loadConfig(opts.commonOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cfg.KeptForeign.warn(cfg)
+
+	// Support passing args after `--`, e.g. -- -v -count=1 -tags=e2e -args -update.
+	allBuildFlags, goTestFlags := opts.resolveGoArgs(cfg, extra)
+
+	for _, key := range secretEnvKeys(cfg) {
+		switch cfg.SecretEnvMode {
+		case secretEnvModeOmit:
+			_, _ = fmt.Fprintf(os.Stderr, "warning: omitted secret-looking env %s from generated entries\n", key)
+		case secretEnvModeReference:
+			_, _ = fmt.Fprintf(os.Stderr, "warning: wrote secret-looking env %s as an env reference instead of its value\n", key)
+		}
+	}
+
+	discoveryStarted := time.Now()
+	results := make([]discoveryResult, 0, len(absFilePaths))
+	for _, absFilePath := range absFilePaths {
+		fileStarted := time.Now()
+		result, err := discoverTests(opts, cfg, absRootPath, absFilePath, allBuildFlags, goTestFlags, opts.allTestBinaryArgs(cfg))
+		if err != nil {
+			return nil, nil, err
+		}
+		result.elapsed = time.Since(fileStarted)
+		results = append(results, result)
+	}
+	if err := checkLabelLengths(results, cfg); err != nil {
+		return nil, nil, err
+	}
+	writeStarted := time.Now()
+
+	adapters, err := outputAdapters(opts, cfg, absRootPath, targets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Runs started by saving several files at once would otherwise read
+	// the same tasks file and each drop the others' entries.
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lockState(absRootPath, modes)()
+
+	// Stage every file first so a failed write leaves all of them as they
+	// were instead of tasks and debug configs that disagree.
+	var tx fileTransaction
+	defer tx.rollback()
+	reports := make([]adapterReport, 0, len(adapters))
+	for _, adapter := range adapters {
+		adapterStarted := time.Now()
+		output, stats, err := adapter.render(results...)
+		if err != nil {
+			return nil, nil, err
+		}
 
-		if opts.dryRun {
+		destination := adapter.path
+		if opts.outPath != "" {
+			destination = resolveOutPath(opts.outPath)
+		}
+		if opts.dryRun || destination == "-" {
 			_, _ = os.Stdout.Write(output)
-			return nil
+			continue
+		}
+
+		destination, err = tx.stageWithFallback(cfg, absRootPath, destination, output, adapter.modes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("write %s file: %w", adapter.target, err)
+		}
+		reports = append(reports, adapterReport{adapter: adapter, path: destination, stats: stats, elapsed: time.Since(adapterStarted)})
+	}
+
+	if opts.dryRun || opts.outPath == "-" {
+		return results, nil, nil
+	}
+	if cfg.CoverageVariants && slices.Contains(targets, generateTargetTasks) {
+		// -test.gocoverdir must exist before the first [cover] run.
+		modes, err := cfg.fileModes()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := os.MkdirAll(resolvePath(absRootPath, cfg.CoverageDir), modes.dir); err != nil {
+			return nil, nil, fmt.Errorf("create coverage dir: %w", err)
+		}
+	}
+
+	recordEnvFingerprint(cfg, absRootPath, &tx)
+	if times, err := readGeneratedTimes(absRootPath); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	} else if modes, err := cfg.fileModes(); err == nil && opts.outPath == "" {
+		now := time.Now().UTC().Truncate(time.Second)
+		for _, report := range reports {
+			times.forget(absRootPath, report.adapter.path, report.stats.Evicted)
+			times.touch(absRootPath, report.adapter.path, report.labels(results...), now)
+		}
+		times.stage(absRootPath, &tx, modes)
+		for _, report := range reports {
+			if report.adapter.editor == editorKindZed && report.adapter.target == generateTargetTasks {
+				recent := recentLabels(times[times.key(absRootPath, report.adapter.path)], cfg.KeymapRecent)
+				if err := stageKeymap(cfg, absRootPath, recent, &tx, modes); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	if err := tx.commit(); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Metrics {
+		phases := map[string]float64{
+			metricsPhaseDiscovery: millis(writeStarted.Sub(discoveryStarted)),
+			metricsPhaseWrite:     millis(time.Since(writeStarted)),
+			metricsPhaseTotal:     millis(time.Since(started)),
+		}
+		tests := 0
+		for _, result := range results {
+			for _, strategy := range result.strategies {
+				phases[metricsPhaseDiscovery+"/"+strategy.name] += millis(strategy.elapsed)
+			}
+			tests += len(result.selectedTests)
+		}
+		recordMetrics(cfg, metricsRecord{
+			Time:     time.Now().UTC().Truncate(time.Hour),
+			Phases:   phases,
+			Tests:    tests,
+			Settings: cfg.metricsSettings(opts, results[0]),
+		})
+	}
+	return results, reports, nil
+}
+
+// outputAdapters are the files generate writes with -format: one per
+// editor and target, or the file of another tool.
+func outputAdapters(opts generateOptions, cfg Config, absRootPath string, targets []generateTarget) ([]outputAdapter, error) {
+	switch opts.format {
+	case formatTaskfile:
+		adapter, err := newTaskfileAdapter(cfg, absRootPath)
+		if err != nil {
+			return nil, err
+		}
+		return []outputAdapter{adapter}, nil
+	case formatMakefile:
+		adapter, err := newMakefileAdapter(cfg, absRootPath)
+		if err != nil {
+			return nil, err
+		}
+		return []outputAdapter{adapter}, nil
+	case formatYAML:
+		adapter, err := newExportAdapter(cfg, absRootPath)
+		if err != nil {
+			return nil, err
+		}
+		return []outputAdapter{adapter}, nil
+	}
+	var adapters []outputAdapter
+	for _, editor := range opts.editors {
+		editorOpts := opts.commonOptions
+		editorOpts.editor = editor
+		editorCfg, err := loadConfig(editorOpts)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			adapter, err := newOutputAdapter(editor, target, editorCfg, absRootPath)
+			if err != nil {
+				return nil, err
+			}
+			adapters = append(adapters, adapter)
+		}
+	}
+	return adapters, nil
+}
+
+// runGenerateGroup writes one task per editor that runs every test tagged
+// with the -group comment, across all packages of the workspace.
+func runGenerateGroup(opts generateOptions, targets []generateTarget, extra []string) error {
+	if len(targets) != 1 || targets[0] != generateTargetTasks {
+		return fmt.Errorf("-group only generates tasks; debug configs cannot span packages")
+	}
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+
+	opts.keptForeign = &foreignLabels{}
+	cfg, err := loadConfig(opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	defer cfg.KeptForeign.warn(cfg)
+	buildFlags, goTestFlags := opts.resolveGoArgs(cfg, extra)
+	members, err := findGroupTests(absRootPath, cfg, opts.group)
+	if err != nil {
+		return err
+	}
+	if len(members.tests) == 0 {
+		return fmt.Errorf("no tests tagged // zed:group %s under %s", opts.group, absRootPath)
+	}
+
+	var tx fileTransaction
+	defer tx.rollback()
+	var summary []string
+	for _, editor := range opts.editors {
+		editorOpts := opts.commonOptions
+		editorOpts.editor = editor
+		editorCfg, err := loadConfig(editorOpts)
+		if err != nil {
+			return err
+		}
+		modes, err := editorCfg.fileModes()
+		if err != nil {
+			return err
 		}
 
-		if err := writeTasks(debugAbsPath, output); err != nil {
-			return fmt.Errorf("write debug file: %w", err)
+		label := editorCfg.LabelPrefix + "group:" + opts.group
+		parts := members.split(editorCfg.runPatternLimit())
+		var tasks []aggregateTask
+		var args []string
+		for i, part := range parts {
+			partArgs := groupTaskArgs(editorCfg, part, buildFlags, goTestFlags, opts.allTestBinaryArgs(editorCfg))
+			env := addRuntimeEnv(editorCfg, injectedTaskEnv(editorCfg, editor))
+			env[editorCfg.GeneratedEnvKey] = editorCfg.GeneratedEnvValue
+			env[groupEnvKey] = opts.group
+			task := aggregateTask{label: label, args: partArgs, env: env}
+			if len(parts) > 1 {
+				number := fmt.Sprintf("%d/%d", i+1, len(parts))
+				task.label += " [part " + number + "]"
+				env[partEnvKey] = number
+			}
+			if i == 0 {
+				args = partArgs
+			}
+			tasks = append(tasks, task)
+			if editorCfg.FailfastVariants {
+				tasks = append(tasks, failfastAggregateTask(task, editorCfg, part, buildFlags, goTestFlags, opts.allTestBinaryArgs(editorCfg)))
+			}
+		}
+
+		path := resolvePath(absRootPath, editorCfg.TasksPath)
+		output, err := mergeAggregateTasks(editor, editorCfg, path, tasks, members.packages)
+		if err != nil {
+			return err
+		}
+
+		destination := path
+		if opts.outPath != "" {
+			destination = resolveOutPath(opts.outPath)
+		}
+		if opts.dryRun || destination == "-" {
+			_, _ = os.Stdout.Write(output)
+			continue
+		}
+		destination, err = tx.stageWithFallback(editorCfg, absRootPath, destination, output, modes)
+		if err != nil {
+			return fmt.Errorf("write tasks file: %w", err)
+		}
+		summary = append(summary,
+			fmt.Sprintf("Updated %s", destination),
+			fmt.Sprintf("Group %s: %d tests in %d packages", opts.group, len(members.tests), len(members.packages)))
+		if parallel := members.describeParallelism(editorCfg, args); parallel != "" {
+			summary = append(summary, parallel)
 		}
+		if len(parts) > 1 {
+			summary = append(summary, fmt.Sprintf("Warning: the -run pattern of group %s is %d bytes, over the %d byte limit; split into %d tasks",
+				opts.group, len(discovery.AlternationPattern(members.tests)), editorCfg.runPatternLimit(), len(parts)))
+		}
+		for _, task := range tasks {
+			summary = append(summary, fmt.Sprintf("Generated task: %s", task.label))
+		}
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	for _, line := range summary {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// runCompose writes one task, labeled LABEL_PREFIX plus -name, that runs the
+// given tests and generated labels together, e.g. a personal focus task.
+// The task has no generated marker, so regenerating never prunes it.
+func runCompose(args []string) error {
+	var opts generateOptions
+	var name string
+	var appendTests bool
+	editorArg := string(editorKindZed)
+	fs := flag.NewFlagSet("compose", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&name, "name", "", "Name of the composed task; its label is LABEL_PREFIX plus name (required).")
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.StringVar(&opts.tasksPathArg, "tasks", "", "Override tasks JSON path.")
+	fs.StringVar(&editorArg, "editor", editorArg, "Editor target. Supported: zed, vscode.")
+	fs.BoolVar(&appendTests, "append", false, "Add the tests to the ones the task already runs instead of replacing them.")
+	fs.Var(&opts.goTestArgs, "go-test-arg", "Extra go test argument (repeatable).")
+	fs.StringVar(&opts.outPath, "out", "", "Write the resulting JSON to this path instead of the tasks file (- for stdout).")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "Print resulting tasks JSON instead of writing it.")
+	fs.BoolVar(&opts.includeGenerated, "include-generated", false, "Also look for tests in machine-generated test files (see SKIP_GENERATED_FILES).")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("missing required flag: -name")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("name at least one test or generated label to compose")
+	}
+	editor, err := parseEditorKind(editorArg)
+	if err != nil {
+		return err
+	}
+	opts.editor = editor
+
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+	cfg, err := loadConfig(opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	label := cfg.LabelPrefix + strings.TrimPrefix(strings.TrimSpace(name), cfg.LabelPrefix)
+
+	entries, err := readEditorEntries(editor, generateTargetTasks, cfg, absRootPath)
+	if err != nil {
+		return err
+	}
+	selected := make(map[composedTest]struct{})
+	if appendTests {
+		for _, entry := range entries {
+			if entryName, _ := entryLabel(entry); entryName == label {
+				value, _ := tasks.EnvValue(tasks.EnvOf(entry), composeEnvKey)
+				for _, test := range parseComposedTests(value) {
+					selected[test] = struct{}{}
+				}
+			}
+		}
+	}
+	for _, selection := range fs.Args() {
+		tests, err := resolveComposeSelection(selection, entries, absRootPath, cfg)
+		if err != nil {
+			return err
+		}
+		for _, test := range tests {
+			selected[test] = struct{}{}
+		}
+	}
+
+	tests := slices.SortedFunc(maps.Keys(selected), func(a, b composedTest) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	var members groupMembers
+	for _, test := range tests {
+		if !slices.Contains(members.tests, test.name) {
+			members.tests = append(members.tests, test.name)
+		}
+		if !slices.Contains(members.packages, test.pkg) {
+			members.packages = append(members.packages, test.pkg)
+		}
+	}
+	sort.Strings(members.tests)
+	sort.Strings(members.packages)
+
+	buildFlags, goTestFlags := opts.resolveGoArgs(cfg, nil)
+	encoded := make([]string, 0, len(tests))
+	for _, test := range tests {
+		encoded = append(encoded, test.String())
+	}
+	env := addRuntimeEnv(cfg, injectedTaskEnv(cfg, editor))
+	env[composeEnvKey] = strings.Join(encoded, ",")
+
+	// Composing is explicit, so it replaces the task whatever the merge
+	// strategy and leaves generated entries alone.
+	cfg.PruneGenerated = false
+	cfg.MergeStrategy = mergeReplace
+	path := resolvePath(absRootPath, cfg.TasksPath)
+	if pattern, limit := discovery.AlternationPattern(members.tests), cfg.runPatternLimit(); len(pattern) > limit {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: the -run pattern of %s is %d bytes, over the %d byte limit; the task may fail to start, so compose fewer tests or tag them with // zed:group\n",
+			label, len(pattern), limit)
+	}
+	task := aggregateTask{label: label, args: groupTaskArgs(cfg, members, buildFlags, goTestFlags, opts.allTestBinaryArgs(cfg)), env: env}
+	output, err := mergeAggregateTasks(editor, cfg, path, []aggregateTask{task}, members.packages)
+	if err != nil {
+		return err
+	}
+
+	destination := path
+	if opts.outPath != "" {
+		destination = resolveOutPath(opts.outPath)
+	}
+	if opts.dryRun || destination == "-" {
+		_, err := os.Stdout.Write(output)
+		return err
+	}
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return err
+	}
+	var tx fileTransaction
+	defer tx.rollback()
+	destination, err = tx.stageWithFallback(cfg, absRootPath, destination, output, modes)
+	if err != nil {
+		return fmt.Errorf("write tasks file: %w", err)
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s\n", destination)
+	fmt.Printf("Composed task %s: %d tests in %d packages\n", label, len(members.tests), len(members.packages))
+	return nil
+}
+
+// composedTest is one top-level test of a composed task.
+type composedTest struct {
+	pkg  string
+	name string
+}
+
+func (t composedTest) String() string { return t.pkg + ":" + t.name }
+
+// parseComposedTests reads the composeEnvKey value, a comma-separated list
+// of <package>:<test>.
+func parseComposedTests(value string) []composedTest {
+	var tests []composedTest
+	for _, part := range strings.Split(value, ",") {
+		pkg, name, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if ok && pkg != "" && name != "" {
+			tests = append(tests, composedTest{pkg: pkg, name: name})
+		}
+	}
+	return tests
+}
+
+// resolveComposeSelection maps a generated task label, or a test name
+// declared somewhere in the workspace, to the tests it selects. -run
+// alternations cannot select single subtests of several tests, so a subtest
+// composes its whole top-level test.
+func resolveComposeSelection(selection string, entries []map[string]any, absRootPath string, cfg Config) ([]composedTest, error) {
+	topLevel := func(test string) string {
+		top, _, found := strings.Cut(test, "/")
+		if found {
+			_, _ = fmt.Fprintf(os.Stderr, "note: composing all of %s for %s\n", top, selection)
+		}
+		return top
+	}
+	for _, entry := range entries {
+		if name, _ := entryLabel(entry); name != selection {
+			continue
+		}
+		env := tasks.EnvOf(entry)
+		test, hasTest := tasks.EnvValue(env, testNameEnvKey)
+		pkg, hasPkg := tasks.EnvValue(env, packageEnvKey)
+		if !hasTest || !hasPkg {
+			return nil, fmt.Errorf("task %q does not run a single generated test", selection)
+		}
+		return []composedTest{{pkg: pkg, name: topLevel(test)}}, nil
+	}
+
+	name := topLevel(selection)
+	if !token.IsIdentifier(name) {
+		return nil, fmt.Errorf("no generated task labeled %q", selection)
+	}
+	nameFilter, err := cfg.testNameFilter()
+	if err != nil {
+		return nil, err
+	}
+	var tests []composedTest
+	err = cfg.walkAuthoredTestFiles(absRootPath, func(path string) error {
+		decls, err := findTestDeclsInFile(path, nameFilter)
+		if err != nil {
+			return nil
+		}
+		for _, decl := range decls {
+			if decl.name != name {
+				continue
+			}
+			pkg, err := packageArg(absRootPath, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			tests = append(tests, composedTest{pkg: pkg, name: name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tests) == 0 {
+		return nil, fmt.Errorf("no generated task labeled %q and no test %s under %s", selection, name, absRootPath)
+	}
+	return tests, nil
+}
+
+// aggregateTask is one task running tests of several packages.
+type aggregateTask struct {
+	label string
+	args  []string
+	env   map[string]string
+}
+
+// failfastAggregateTask is the [failfast] variant of a group task: the same
+// tests with -failfast, so a run stops at the first failing test.
+func failfastAggregateTask(task aggregateTask, cfg Config, members groupMembers, buildFlags, goTestFlags, testBinaryArgs []string) aggregateTask {
+	if !hasGoFlag(goTestFlags, "failfast") {
+		goTestFlags = append(slices.Clone(goTestFlags), "-failfast")
+	}
+	env := maps.Clone(task.env)
+	env[variantEnvKey] = failfastVariantName
+	return aggregateTask{
+		label: task.label + " [" + failfastVariantName + "]",
+		args:  groupTaskArgs(cfg, members, buildFlags, goTestFlags, testBinaryArgs),
+		env:   env,
+	}
+}
+
+// mergeAggregateTasks merges tasks running tests of several packages into
+// the tasks file at path and returns the new file content.
+func mergeAggregateTasks(editor editorKind, cfg Config, path string, aggregates []aggregateTask, packages []string) ([]byte, error) {
+	if editor == editorKindVSCode {
+		entries := make([]map[string]any, 0, len(aggregates))
+		for _, task := range aggregates {
+			entries = append(entries, map[string]any{
+				"label":   task.label,
+				"type":    "shell",
+				"command": cfg.GoBinary,
+				"args":    task.args,
+				"group":   "test",
+				"options": map[string]any{"env": task.env},
+			})
+		}
+		doc, _, err := mergeVSCodeTasks(path, entries, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("merge tasks: %w", err)
+		}
+		return marshalDocument(doc)
+	}
+	entries := make([]Task, 0, len(aggregates))
+	for _, task := range aggregates {
+		entry := Task{
+			Label:               task.label,
+			Command:             cfg.GoBinary,
+			Args:                task.args,
+			Env:                 task.env,
+			AllowConcurrentRuns: cfg.allowConcurrentRuns("", packages...),
+		}
+		_ = cfg.taskSettings().Apply(&entry)
+		entries = append(entries, entry)
+	}
+	merged, _, err := tasks.MergeFile(path, entries, cfg.mergePolicy())
+	if err != nil {
+		return nil, fmt.Errorf("merge tasks: %w", err)
+	}
+	syncAllGeneratedTask(merged, cfg)
+	return merged.Marshal()
+}
+
+const allGeneratedTaskName = "all-generated"
+
+// allGeneratedPackages returns the sorted packages of the generated
+// entries that run a single package, leaving out the aggregate task.
+func allGeneratedPackages(entries []map[string]any, cfg Config) []string {
+	seen := make(map[string]struct{})
+	for _, entry := range entries {
+		if !isGenerated(entry, cfg) {
+			continue
+		}
+		env := tasks.EnvOf(entry)
+		if _, ok := tasks.EnvValue(env, aggregateEnvKey); ok {
+			continue
+		}
+		if pkg, ok := tasks.EnvValue(env, packageEnvKey); ok && pkg != "" {
+			seen[pkg] = struct{}{}
+		}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// allGeneratedTask runs go test over packages, the packages that have
+// generated tasks.
+func allGeneratedTask(cfg Config, editor editorKind, packages []string) aggregateTask {
+	args := []string{"test"}
+	if cfg.TestTimeout != "" {
+		args = append(args, "-timeout="+cfg.TestTimeout)
+	}
+	args = append(args, cfg.skipArgs()...)
+	args = append(args, packages...)
+	env := addRuntimeEnv(cfg, injectedTaskEnv(cfg, editor))
+	env[cfg.GeneratedEnvKey] = cfg.GeneratedEnvValue
+	env[aggregateEnvKey] = allGeneratedTaskName
+	return aggregateTask{label: cfg.LabelPrefix + allGeneratedTaskName, args: args, env: env}
+}
+
+// syncAllGeneratedTask rewrites the ALL_GENERATED_TASK task of a Zed tasks
+// file after a merge: in place when it exists, appended otherwise, and
+// dropped once no generated task is left.
+func syncAllGeneratedTask(f *tasks.File, cfg Config) {
+	if !cfg.AllGeneratedTask {
+		return
+	}
+	label := cfg.LabelPrefix + allGeneratedTaskName
+	packages := allGeneratedPackages(f.Values(), cfg)
+	if len(packages) == 0 {
+		f.RemoveGenerated(label)
+		return
+	}
+	aggregate := allGeneratedTask(cfg, editorKindZed, packages)
+	task := Task{
+		Label:               aggregate.label,
+		Command:             cfg.GoBinary,
+		Args:                aggregate.args,
+		Env:                 aggregate.env,
+		AllowConcurrentRuns: cfg.allowConcurrentRuns("", packages...),
+	}
+	_ = cfg.taskSettings().Apply(&task)
+	f.SetGenerated(label, task)
+}
+
+// syncAllGeneratedVSCodeTask is syncAllGeneratedTask for VS Code tasks.
+func syncAllGeneratedVSCodeTask(tasks []map[string]any, cfg Config) []map[string]any {
+	if !cfg.AllGeneratedTask {
+		return tasks
+	}
+	label := cfg.LabelPrefix + allGeneratedTaskName
+	packages := allGeneratedPackages(tasks, cfg)
+	index := slices.IndexFunc(tasks, func(task map[string]any) bool { return task["label"] == label && isGenerated(task, cfg) })
+	if len(packages) == 0 {
+		if index >= 0 {
+			tasks = slices.Delete(tasks, index, index+1)
+		}
+		return tasks
+	}
+	aggregate := allGeneratedTask(cfg, editorKindVSCode, packages)
+	task := map[string]any{
+		"label":   aggregate.label,
+		"type":    "shell",
+		"command": cfg.GoBinary,
+		"args":    aggregate.args,
+		"group":   "test",
+		"options": map[string]any{"env": aggregate.env},
+	}
+	if index >= 0 {
+		tasks[index] = task
+		return tasks
+	}
+	return append(tasks, task)
+}
+
+// groupMembers are the tests tagged with one group and their packages.
+type groupMembers struct {
+	tests    []string
+	packages []string
+	// parallelCalls counts the t.Parallel() call sites of the tests,
+	// including the ones in their subtests.
+	parallelCalls int
+}
+
+// parallelism is the -parallel of a task running members with
+// AGGREGATE_PARALLEL, or 0 to keep the go default: every test calling
+// t.Parallel() may run at once, up to four per CPU since parallel tests
+// are often waiting on I/O. Without any t.Parallel() call the flag has no
+// effect and is left out.
+func (m groupMembers) parallelism(cfg Config) int {
+	if !cfg.AggregateParallel || m.parallelCalls == 0 {
+		return 0
+	}
+	return min(m.parallelCalls, 4*runtime.NumCPU())
+}
+
+// split divides the members into parts whose -run pattern fits in limit
+// bytes, in test order. A test whose own pattern is over the limit still
+// gets a part of its own.
+func (m groupMembers) split(limit int) []groupMembers {
+	if len(discovery.AlternationPattern(m.tests)) <= limit {
+		return []groupMembers{m}
+	}
+	var parts []groupMembers
+	var tests []string
+	for _, test := range m.tests {
+		if len(tests) > 0 && len(discovery.AlternationPattern(append(tests, test))) > limit {
+			parts = append(parts, groupMembers{tests: tests, packages: m.packages, parallelCalls: m.parallelCalls})
+			tests = nil
+		}
+		tests = append(tests, test)
+	}
+	return append(parts, groupMembers{tests: tests, packages: m.packages, parallelCalls: m.parallelCalls})
+}
+
+// describeParallelism explains the -parallel value for the summary.
+func (m groupMembers) describeParallelism(cfg Config, args []string) string {
+	calls := fmt.Sprintf("%d t.Parallel() calls in %d tests", m.parallelCalls, len(m.tests))
+	switch n := m.parallelism(cfg); {
+	case !cfg.AggregateParallel:
+		return ""
+	case n == 0:
+		return "Parallel: no t.Parallel() calls; -parallel not set"
+	case !slices.Contains(args, "-parallel="+strconv.Itoa(n)):
+		return "Parallel: " + calls + "; kept the -parallel from the go test args"
+	case n < m.parallelCalls:
+		return fmt.Sprintf("Parallel: %s; -parallel=%d (4 per CPU)", calls, n)
+	default:
+		return fmt.Sprintf("Parallel: %s; -parallel=%d", calls, n)
+	}
+}
+
+// findGroupTests walks the workspace for test functions whose doc comment
+// has a `// zed:group <name>` line naming group.
+func findGroupTests(absRootPath string, cfg Config, group string) (groupMembers, error) {
+	nameFilter, err := cfg.testNameFilter()
+	if err != nil {
+		return groupMembers{}, err
+	}
+	tests := make(map[string]struct{})
+	packages := make(map[string]struct{})
+	parallelCalls := 0
+	err = cfg.walkAuthoredTestFiles(absRootPath, func(path string) error {
+		decls, err := findTestDeclsInFile(path, nameFilter)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		for _, decl := range decls {
+			if !slices.Contains(decl.groups, group) {
+				continue
+			}
+			pkgArg, err := packageArg(absRootPath, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			tests[decl.name] = struct{}{}
+			packages[pkgArg] = struct{}{}
+			parallelCalls += decl.parallelCalls
+		}
+		return nil
+	})
+	if err != nil {
+		return groupMembers{}, err
+	}
+
+	members := groupMembers{parallelCalls: parallelCalls}
+	for test := range tests {
+		members.tests = append(members.tests, test)
+	}
+	for pkg := range packages {
+		members.packages = append(members.packages, pkg)
+	}
+	sort.Strings(members.tests)
+	sort.Strings(members.packages)
+	return members, nil
+}
+
+// walkTestFiles calls fn for every _test.go file of the workspace module.
+// Hidden, vendor and testdata directories and nested modules are skipped.
+func walkTestFiles(absRootPath string, fn func(path string) error) error {
+	return filepath.WalkDir(absRootPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != absRootPath && skipWorkspaceDir(path, d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// skipWorkspaceDir reports whether walkTestFiles skips the directory at
+// path: hidden, vendor and testdata directories and nested modules.
+func skipWorkspaceDir(path, name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "vendor" || name == "testdata" || fileExists(filepath.Join(path, "go.mod"))
+}
+
+// walkAuthoredTestFiles is walkTestFiles without the machine-generated
+// test files, unless SKIP_GENERATED_FILES is off.
+func (c Config) walkAuthoredTestFiles(absRootPath string, fn func(path string) error) error {
+	return walkTestFiles(absRootPath, func(path string) error {
+		if c.SkipGeneratedFiles && c.isGeneratedTestFile(path) {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// isGeneratedTestFile reports whether the file at path matches one of
+// GENERATED_FILE_GLOBS or starts with the standard "Code generated ... DO
+// NOT EDIT." comment.
+func (c Config) isGeneratedTestFile(path string) bool {
+	for _, glob := range c.GeneratedFileGlobs {
+		if matched, _ := filepath.Match(strings.TrimSpace(glob), filepath.Base(path)); matched {
+			return true
+		}
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly|parser.ParseComments)
+	return err == nil && ast.IsGenerated(file)
+}
+
+// groupTaskArgs runs all group tests with one alternation -run pattern. A
+// same-named untagged test in another group package matches too.
+func groupTaskArgs(cfg Config, members groupMembers, buildFlags, goTestFlags, testBinaryArgs []string) []string {
+	args := []string{"test"}
+	args = append(args, buildFlags...)
+	args = append(args, goTestFlags...)
+	if cfg.TestTimeout != "" && !hasGoFlag(args, "timeout") {
+		args = append(args, "-timeout="+cfg.TestTimeout)
+	}
+	if n := members.parallelism(cfg); n > 0 && !hasGoFlag(args, "parallel") {
+		args = append(args, "-parallel="+strconv.Itoa(n))
+	}
+	args = append(args, members.packages...)
+	args = append(args, "-run", discovery.AlternationPattern(members.tests))
+	args = append(args, cfg.skipArgs()...)
+	if len(testBinaryArgs) > 0 {
+		args = append(args, "-args")
+		args = append(args, testBinaryArgs...)
+	}
+	return args
+}
+
+// runPatternLimit is the longest -run pattern an aggregate task may pass:
+// MAX_RUN_PATTERN, or a default that leaves room for the rest of the
+// command line. Windows caps a whole cmd.exe command line at 8191
+// characters; Linux caps every single argument at 128 KiB, which also
+// keeps well under the macOS and BSD ARG_MAX. REPRODUCIBLE uses the
+// Windows limit everywhere, so groups split the same way on every OS.
+func (c Config) runPatternLimit() int {
+	switch {
+	case c.MaxRunPattern > 0:
+		return c.MaxRunPattern
+	case runtime.GOOS == "windows" || c.Reproducible:
+		return 6 << 10
+	default:
+		return 128<<10 - 1
+	}
+}
+
+// selectOnly narrows the selection to the test named by -test, or the one
+// declared around -line, with its subtests, and gives it the -label.
+func (r *discoveryResult) selectOnly(opts generateOptions) error {
+	test := opts.onlyTest
+	if opts.onlyLine > 0 {
+		for _, decl := range r.testDecls {
+			if decl.line <= opts.onlyLine && opts.onlyLine <= decl.endLine {
+				test = decl.name
+			}
+		}
+		if test == "" {
+			return fmt.Errorf("no test declared at line %d of %s", opts.onlyLine, r.relFilePath)
+		}
+	}
+	if test == "" {
+		return nil
+	}
+	var selected []string
+	for _, name := range r.selectedTests {
+		if name == test || strings.HasPrefix(name, test+"/") {
+			selected = append(selected, name)
+		}
+	}
+	if !slices.Contains(selected, test) {
+		if reason, ok := r.dropReasons[test]; ok {
+			return fmt.Errorf("no entry for %s: %s", test, reason)
+		}
+		return fmt.Errorf("test %q not found in %s", test, r.relFilePath)
+	}
+	r.selectedTests = selected
+	if opts.label != "" {
+		r.labels = map[string]string{test: opts.label}
+	}
+	return nil
+}
+
+// discoveryResult is the in-memory test model shared by every output adapter
+// of one generate invocation.
+type discoveryResult struct {
+	testsInFile []string
+	testDecls   map[string]testDecl
+	testTimeout string
+	// cgoEnv is set for packages with cgo files and applies to discovery
+	// subprocesses and generated entries alike.
+	cgoEnv          map[string]string
+	runnableTests   []string
+	discoveredTests []string
+	discoveredNew   int
+	selectedTests   []string
+	pkgArg          string
+	relFilePath     string
+	buildFlags      []string
+	extraGoTestArgs []string
+	testBinaryArgs  []string
+	variants        []taskVariant
+	constraint      buildConstraint
+	unverified      bool
+	diagnostics     []discovery.Diagnostic
+	subtestTimeout  time.Duration
+	strategies      []strategyReport
+	// elapsed is the time discovery of the file took, set by
+	// generateFiles.
+	elapsed time.Duration
+	// unverifiedTests are tests kept by -include-unverified although go
+	// test -list did not report them.
+	unverifiedTests map[string]struct{}
+	// dropReasons explains, per test, why a strategy dropped it.
+	dropReasons map[string]string
+	// skippedTests are the tests that reported skip during runtime
+	// discovery, mapped to their skip message.
+	skippedTests map[string]string
+	// annotateSkipped adds the skip message to the labels of skipped tests.
+	annotateSkipped bool
+	// maxLabelLength is MAX_LABEL_LENGTH, the rune budget of the test part
+	// of labels.
+	maxLabelLength int
+	// labels are the -label overrides by test name.
+	labels map[string]string
+	// ginkgoSpecs are the Ginkgo containers and specs of the file, and
+	// ginkgoSuite the TestXxx of the package that calls RunSpecs, with
+	// GINKGO_SPECS.
+	ginkgoSpecs []discovery.GinkgoSpec
+	ginkgoSuite string
+	// autoMode is how the auto strategy found subtests: static or runtime.
+	autoMode string
+	// testAttributes and testArtifacts are the t.Attr pairs and artifact
+	// directories tests reported during runtime discovery.
+	testAttributes map[string]map[string]string
+	testArtifacts  map[string]string
+	// discoveryCache is "hit" or "miss" when runtime discovery looked in
+	// DISCOVERY_CACHE.
+	discoveryCache string
+	// runtimeSkipped is why runtime discovery did not run go test, if it
+	// was asked to but skipped the file.
+	runtimeSkipped string
+}
+
+// strategyReport is what one discovery strategy did to the selected tests.
+type strategyReport struct {
+	name    string
+	elapsed time.Duration
+	tests   int
+	added   []string
+	dropped []droppedTest
+}
+
+type droppedTest struct {
+	name   string
+	reason string
+}
+
+// buildConstraint describes whether a file is part of the host build and,
+// when it is not, a GOOS/GOARCH pair that does include it.
+type buildConstraint struct {
+	matchesHost bool
+	target      buildTarget
+}
+
+type buildTarget struct {
+	goos   string
+	goarch string
+}
+
+func (t buildTarget) String() string {
+	return t.goos + "/" + t.goarch
+}
+
+func (c buildConstraint) describeTarget() string {
+	if c.target.goos == "" {
+		return ""
+	}
+	return " (builds for " + c.target.String() + ")"
+}
+
+var (
+	knownGOOS = []string{
+		"aix", "android", "darwin", "dragonfly", "freebsd", "hurd", "illumos", "ios", "js",
+		"linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows", "zos",
+	}
+	knownGOARCH = []string{
+		"386", "amd64", "arm", "arm64", "loong64", "mips", "mips64", "mips64le", "mipsle",
+		"ppc64", "ppc64le", "riscv64", "s390x", "wasm",
+	}
+)
+
+// checkBuildConstraints evaluates the file name suffix and //go:build lines
+// of path for the host platform, then searches known platforms for one that
+// includes the file when the host does not.
+func checkBuildConstraints(path string, buildTags []string) (buildConstraint, error) {
+	dir, name := filepath.Split(path)
+	ctx := build.Default
+	ctx.BuildTags = append(append([]string(nil), ctx.BuildTags...), buildTags...)
+	ctx.CgoEnabled = true
+
+	matches, err := ctx.MatchFile(dir, name)
+	if err != nil {
+		return buildConstraint{}, err
+	}
+	if matches {
+		return buildConstraint{matchesHost: true}, nil
+	}
+
+	// Prefer keeping the host architecture, then any known pair.
+	candidates := make([]buildTarget, 0, len(knownGOOS)*(1+len(knownGOARCH)))
+	for _, goos := range knownGOOS {
+		candidates = append(candidates, buildTarget{goos: goos, goarch: runtime.GOARCH})
+	}
+	for _, goos := range knownGOOS {
+		for _, goarch := range knownGOARCH {
+			candidates = append(candidates, buildTarget{goos: goos, goarch: goarch})
+		}
+	}
+	for _, candidate := range candidates {
+		ctx.GOOS = candidate.goos
+		ctx.GOARCH = candidate.goarch
+		if ok, err := ctx.MatchFile(dir, name); err == nil && ok {
+			return buildConstraint{target: candidate}, nil
+		}
+	}
+	return buildConstraint{}, nil
+}
+
+// buildTagsFromArgs extracts -tags values from go test args.
+func buildTagsFromArgs(args []string) []string {
+	var tags []string
+	for i, arg := range args {
+		value := ""
+		switch {
+		case arg == "-tags" && i+1 < len(args):
+			value = args[i+1]
+		case strings.HasPrefix(arg, "-tags="):
+			value = strings.TrimPrefix(arg, "-tags=")
+		default:
+			continue
+		}
+		for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func discoverTests(opts generateOptions, cfg Config, absRootPath, absFilePath string, buildFlags, extraGoTestArgs, testBinaryArgs []string) (discoveryResult, error) {
+	result := discoveryResult{
+		discoveredTests: []string{},
+		buildFlags:      buildFlags,
+		extraGoTestArgs: extraGoTestArgs,
+		testBinaryArgs:  testBinaryArgs,
+	}
+
+	pipeline, err := newDiscoveryPipeline(opts, cfg)
+	if err != nil {
+		return result, err
+	}
+
+	packageDir := filepath.Dir(absFilePath)
+	constraint, err := checkBuildConstraints(absFilePath, buildTagsFromArgs(buildFlags))
+	if err != nil {
+		return result, fmt.Errorf("check build constraints: %w", err)
+	}
+	result.constraint = constraint
+
+	result.pkgArg, err = packageArg(absRootPath, packageDir)
+	if err != nil {
+		return result, fmt.Errorf("build package argument: %w", err)
+	}
+	result.testTimeout = cfg.testTimeoutFor(result.pkgArg)
+	if usesCgo(packageDir, buildTagsFromArgs(buildFlags)) {
+		result.cgoEnv = cfg.cgoEnv()
+	}
+
+	result.relFilePath = absFilePath
+	if rel, relErr := rootRelPath(absRootPath, absFilePath); relErr == nil {
+		result.relFilePath = filepath.ToSlash(rel)
+	}
+
+	in := discoveryInput{
+		opts:            opts,
+		cfg:             cfg,
+		absRootPath:     absRootPath,
+		absFilePath:     absFilePath,
+		packageDir:      packageDir,
+		buildFlags:      buildFlags,
+		extraGoTestArgs: extraGoTestArgs,
+		env:             result.cgoEnv,
+		runner:          cfg.goRunner(result.cgoEnv),
+	}
+	for _, discoverer := range pipeline {
+		before := result.selectedTests
+		started := time.Now()
+		if err := discoverer.Discover(in, &result); err != nil {
+			return result, err
+		}
+		result.strategies = append(result.strategies, newStrategyReport(discoverer.Name(), time.Since(started), before, result))
+	}
+
+	if cfg.CrossCompileVariants && !constraint.matchesHost && constraint.target.goos != "" {
+		result.variants = append(result.variants, taskVariant{
+			name: constraint.target.String(),
+			env: map[string]string{
+				"GOOS":   constraint.target.goos,
+				"GOARCH": constraint.target.goarch,
+			},
+		})
+	}
+
+	result.maxLabelLength = cfg.MaxLabelLength
+	for _, name := range result.selectedTests {
+		if decl := result.testDecls[name]; decl.cwd != "" {
+			if _, ok := result.testCwd(name); !ok {
+				_, _ = fmt.Fprintf(os.Stderr, "warning: ignoring // zed:cwd %s on %s: it leaves the workspace root\n", decl.cwd, name)
+			}
+		}
+	}
+
+	if cfg.ShortVariants && !hasGoFlag(extraGoTestArgs, "short") {
+		tests := make(map[string]struct{})
+		for name, decl := range result.testDecls {
+			if decl.callsShort {
+				tests[name] = struct{}{}
+			}
+		}
+		if len(tests) > 0 {
+			result.variants = append(result.variants, taskVariant{
+				name:       shortVariantName,
+				goTestArgs: []string{"-short"},
+				tests:      tests,
+			})
+		}
+	}
+
+	if cfg.CoverageVariants {
+		result.variants = append(result.variants, taskVariant{
+			name:       coverVariantName,
+			goTestArgs: []string{"-cover"},
+			coverDir:   cfg.CoverageDir,
+		})
+	}
+
+	for _, name := range cfg.SanitizerVariants {
+		variant, err := sanitizerVariant(cfg, name)
+		if err != nil {
+			return result, err
+		}
+		result.variants = append(result.variants, variant)
+	}
+
+	if cfg.GoldenVariants && !opts.goldenUpdate {
+		goldenPattern, err := regexp.Compile(cfg.GoldenFlagRegex)
+		if err != nil {
+			return result, fmt.Errorf("invalid golden_flag_regex %q: %w", cfg.GoldenFlagRegex, err)
+		}
+		flagName, err := findGoldenFlag(packageDir, goldenPattern)
+		if err != nil {
+			return result, fmt.Errorf("detect golden flag: %w", err)
+		}
+		if flagName != "" {
+			result.variants = append(result.variants, taskVariant{
+				name:       goldenVariantName,
+				binaryArgs: []string{"-" + flagName},
+			})
+		}
+	}
+
+	if err := result.excludeTests(cfg); err != nil {
+		return result, err
+	}
+	if err := result.selectOnly(opts); err != nil {
+		return result, err
+	}
+	if cfg.GinkgoSpecs {
+		if result.ginkgoSpecs, err = discovery.FindGinkgoSpecs(absFilePath); err != nil {
+			return result, fmt.Errorf("find Ginkgo specs: %w", err)
+		}
+		if len(result.ginkgoSpecs) > 0 {
+			result.ginkgoSuite = discovery.FindGinkgoSuite(packageDir)
+		}
+	}
+	return result, nil
+}
+
+// sanitizerPlatforms are the host platforms on which go test supports each
+// sanitizer flag.
+var sanitizerPlatforms = map[string][]string{
+	"asan": {"linux/amd64", "linux/arm64", "linux/loong64", "linux/ppc64le", "linux/riscv64"},
+	"msan": {"linux/amd64", "linux/arm64", "linux/loong64", "freebsd/amd64"},
+}
+
+// sanitizerVariant builds the [asan]/[msan] variant. The sanitizers need
+// cgo and a C toolchain that supports them, so generation fails early when
+// the host cannot run the variant instead of leaving a task that fails to
+// link.
+func sanitizerVariant(cfg Config, name string) (taskVariant, error) {
+	host := runtime.GOOS + "/" + runtime.GOARCH
+	if !slices.Contains(sanitizerPlatforms[name], host) {
+		return taskVariant{}, fmt.Errorf("-%s is not supported on %s (supported: %s)", name, host, strings.Join(sanitizerPlatforms[name], ", "))
+	}
+	for _, compiler := range []string{cfg.SanitizerCC, cfg.SanitizerCXX} {
+		if _, err := exec.LookPath(compiler); err != nil {
+			return taskVariant{}, fmt.Errorf("-%s needs a C toolchain: %w (set SANITIZER_CC/SANITIZER_CXX)", name, err)
+		}
+	}
+	return taskVariant{
+		name:       name,
+		goTestArgs: []string{"-" + name},
+		env: map[string]string{
+			"CGO_ENABLED": "1",
+			"CC":          cfg.SanitizerCC,
+			"CXX":         cfg.SanitizerCXX,
+		},
+	}, nil
+}
+
+// discoveryInput is what every discovery strategy gets to work with.
+type discoveryInput struct {
+	opts            generateOptions
+	cfg             Config
+	absRootPath     string
+	absFilePath     string
+	packageDir      string
+	buildFlags      []string
+	extraGoTestArgs []string
+	// env is added to the environment of go subprocesses.
+	env    map[string]string
+	runner discovery.Runner
+}
+
+// goRunner starts the go commands discovery runs, limited by
+// DISCOVERY_GOMAXPROCS, DISCOVERY_PROCS and DISCOVERY_NICE so generating in
+// the background does not slow down the editor or a running build. Runtime
+// discovery runs as a process tree, see runProcessTree.
+func (c Config) goRunner(env map[string]string) discovery.Runner {
+	if c.DiscoveryGomaxprocs > 0 {
+		env = maps.Clone(env)
+		if env == nil {
+			env = make(map[string]string, 1)
+		}
+		env["GOMAXPROCS"] = strconv.Itoa(c.DiscoveryGomaxprocs)
+	}
+	return discovery.Runner{Binary: c.GoBinary, Env: env, Procs: c.DiscoveryProcs, Nice: c.DiscoveryNice, Run: runProcessTree}
+}
+
+// usesCgo reports whether the package in dir has files that import "C"
+// under the host platform and buildTags.
+func usesCgo(dir string, buildTags []string) bool {
+	ctx := build.Default
+	ctx.BuildTags = append(append([]string(nil), ctx.BuildTags...), buildTags...)
+	ctx.CgoEnabled = true
+	pkg, err := ctx.ImportDir(dir, 0)
+	if err != nil {
+		return false
+	}
+	return len(pkg.CgoFiles) > 0
+}
+
+// cgoEnv is the env cgo packages need to build from the editor. Unset
+// CGO_CFLAGS and PKG_CONFIG_PATH fall back to the generating shell's values,
+// which editors launched from a desktop session often lack.
+func (c Config) cgoEnv() map[string]string {
+	env := make(map[string]string, 3)
+	if c.CgoEnabled != "" {
+		env["CGO_ENABLED"] = c.CgoEnabled
+	}
+	for key, value := range map[string]string{"CGO_CFLAGS": c.CgoCflags, "PKG_CONFIG_PATH": c.PkgConfigPath} {
+		if value == "" {
+			value = os.Getenv(key)
+		}
+		if value != "" {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// Discoverer is one test discovery strategy. Strategies run in pipeline
+// order and refine the shared result: each one leaves testsInFile,
+// runnableTests and selectedTests consistent for the next.
+type Discoverer interface {
+	Name() string
+	Discover(in discoveryInput, result *discoveryResult) error
+}
+
+const (
+	discovererAST     = "ast"
+	discovererGoList  = "go-list"
+	discovererStatic  = "static"
+	discovererAuto    = "auto"
+	discovererRuntime = "runtime"
+)
+
+// newDiscoveryPipeline composes the strategies named by
+// DISCOVERY_STRATEGIES, by default the AST scan verified with go test
+// -list. -static-subtests and -auto-subtests add their strategies ahead of
+// any runtime one, and -discover-subtests appends the runtime strategy.
+func newDiscoveryPipeline(opts generateOptions, cfg Config) ([]Discoverer, error) {
+	names := cfg.DiscoveryStrategies
+	if len(names) == 0 {
+		names = []string{discovererAST, discovererGoList}
+	}
+	for _, added := range []struct {
+		name string
+		set  bool
+	}{{discovererStatic, opts.staticSubtests}, {discovererAuto, opts.autoSubtests}} {
+		if !added.set || slices.Contains(names, added.name) {
+			continue
+		}
+		at := len(names)
+		if i := slices.Index(names, discovererRuntime); i >= 0 {
+			at = i
+		}
+		names = slices.Insert(slices.Clone(names), at, added.name)
+	}
+	if opts.discoverSubtests && !slices.Contains(names, discovererRuntime) {
+		names = append(slices.Clone(names), discovererRuntime)
+	}
+
+	pipeline := make([]Discoverer, 0, len(names))
+	for i, name := range names {
+		var discoverer Discoverer
+		switch strings.TrimSpace(name) {
+		case discovererAST:
+			discoverer = astDiscoverer{}
+		case discovererGoList:
+			discoverer = goListDiscoverer{}
+		case discovererStatic:
+			discoverer = staticDiscoverer{}
+		case discovererAuto:
+			discoverer = autoDiscoverer{}
+		case discovererRuntime:
+			discoverer = runtimeDiscoverer{}
+		default:
+			return nil, fmt.Errorf("unknown discovery strategy %q (expected %s, %s, %s, %s or %s)", name, discovererAST, discovererGoList, discovererStatic, discovererAuto, discovererRuntime)
+		}
+		if i == 0 && discoverer.Name() != discovererAST {
+			return nil, fmt.Errorf("discovery strategies must start with %s", discovererAST)
+		}
+		pipeline = append(pipeline, discoverer)
+	}
+	return pipeline, nil
+}
+
+// newStrategyReport diffs the selected tests before and after a strategy.
+func newStrategyReport(name string, elapsed time.Duration, before []string, result discoveryResult) strategyReport {
+	report := strategyReport{name: name, elapsed: elapsed.Round(10 * time.Microsecond), tests: len(result.selectedTests)}
+	after := make(map[string]struct{}, len(result.selectedTests))
+	for _, test := range result.selectedTests {
+		after[test] = struct{}{}
+	}
+	previous := make(map[string]struct{}, len(before))
+	for _, test := range before {
+		previous[test] = struct{}{}
+		if _, ok := after[test]; !ok {
+			reason := result.dropReasons[test]
+			if reason == "" {
+				reason = "dropped by " + name
+			}
+			report.dropped = append(report.dropped, droppedTest{name: test, reason: reason})
+		}
+	}
+	for _, test := range result.selectedTests {
+		if _, ok := previous[test]; !ok {
+			report.added = append(report.added, test)
+		}
+	}
+	return report
+}
+
+// astDiscoverer finds top-level test functions declared in the file. On its
+// own it cannot tell whether they build, so the result is unverified.
+type astDiscoverer struct{}
+
+func (astDiscoverer) Name() string { return discovererAST }
+
+func (astDiscoverer) Discover(in discoveryInput, result *discoveryResult) error {
+	nameFilter, err := in.cfg.testNameFilter()
+	if err != nil {
+		return err
+	}
+
+	decls, err := findTestDeclsInFile(in.absFilePath, nameFilter)
+	if err != nil {
+		return fmt.Errorf("find tests in file: %w", err)
+	}
+	result.testDecls = make(map[string]testDecl, len(decls))
+	for _, decl := range decls {
+		result.testDecls[decl.name] = decl
+		if decl.compileOnly {
+			_, _ = fmt.Fprintf(os.Stderr, "note: skipping %s: %s\n", decl.name, decl.problem)
+			result.dropReason(decl.name, decl.problem)
+			continue
+		}
+		result.testsInFile = append(result.testsInFile, decl.name)
+	}
+
+	result.unverified = true
+	result.runnableTests = append([]string(nil), result.testsInFile...)
+	sort.Strings(result.runnableTests)
+	result.selectedTests = append([]string(nil), result.runnableTests...)
+	return nil
+}
+
+// unlistedTestReason guesses why go test -list left out a test found in
+// the file.
+func unlistedTestReason(decl testDecl, goListRegex string) string {
+	if decl.problem != "" {
+		return decl.problem
+	}
+	if listPattern, err := regexp.Compile(goListRegex); err == nil && !listPattern.MatchString(decl.name) {
+		return fmt.Sprintf("name does not match GO_LIST_REGEX %q", goListRegex)
+	}
+	return "not reported by go test -list; check build tags and -build-flag"
+}
+
+func (r *discoveryResult) markUnverified(test string) {
+	if r.unverifiedTests == nil {
+		r.unverifiedTests = make(map[string]struct{})
+	}
+	r.unverifiedTests[test] = struct{}{}
+}
+
+// unverifiedReason says why go test -list did not verify the file's tests
+// when the result is unverified.
+func (r discoveryResult) unverifiedReason() string {
+	switch {
+	case len(r.diagnostics) > 0:
+		return "package does not compile"
+	case !r.constraint.matchesHost:
+		return fmt.Sprintf("excluded by build constraints on %s/%s", runtime.GOOS, runtime.GOARCH)
+	default:
+		return "go test -list did not run"
+	}
+}
+
+// isUnverified reports whether go test -list did not confirm test, or the
+// top-level test of a subtest.
+func (r discoveryResult) isUnverified(test string) bool {
+	if r.unverified {
+		return true
+	}
+	top, _, _ := strings.Cut(test, "/")
+	_, ok := r.unverifiedTests[top]
+	return ok
+}
+
+func (r *discoveryResult) dropReason(test, reason string) {
+	if r.dropReasons == nil {
+		r.dropReasons = make(map[string]string)
+	}
+	r.dropReasons[test] = reason
+}
+
+// goListDiscoverer keeps the tests go test -list reports for the package.
+// Files excluded from the host build and packages that do not compile keep
+// the AST list, still unverified.
+type goListDiscoverer struct{}
+
+func (goListDiscoverer) Name() string { return discovererGoList }
+
+func (goListDiscoverer) Discover(in discoveryInput, result *discoveryResult) error {
+	if !result.constraint.matchesHost {
+		// go test -list would build and run a binary for the host, which never
+		// includes this file, so trust the AST instead.
+		_, _ = fmt.Fprintf(os.Stderr, "note: %s is excluded by build constraints on %s/%s%s; skipping go test -list verification\n",
+			filepath.Base(in.absFilePath), runtime.GOOS, runtime.GOARCH, result.constraint.describeTarget())
+		return nil
+	}
+
+	listRegex := in.cfg.goListRegex()
+	testsListedByGo, err := discovery.ListTests(in.runner, in.packageDir, discovery.ListOptions{
+		Regex:          listRegex,
+		ExtraNameRegex: in.cfg.ExtraTestNameRegex,
+		BuildFlags:     in.buildFlags,
+		JSON:           probeGoToolchain(in.runner.Binary).listJSON,
+	})
+	var listErr *discovery.ListError
+	switch {
+	case errors.As(err, &listErr) && len(listErr.Diagnostics) > 0:
+		// Keep the task list stable while the package does not compile.
+		result.diagnostics = listErr.Diagnostics
+		if in.opts.counting {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: %s counted from source only; package does not compile\n", filepath.Base(in.absFilePath))
+		} else {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: package does not compile; generating unverified entries from %s\n", filepath.Base(in.absFilePath))
+		}
+		for _, diagnostic := range listErr.Diagnostics {
+			_, _ = fmt.Fprintf(os.Stderr, "error: %s\n", diagnostic)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("list tests with go: %w", err)
+	}
+
+	result.unverified = false
+	result.runnableTests = intersectTests(result.testsInFile, testsListedByGo)
+	for _, test := range result.testsInFile {
+		if _, ok := testsListedByGo[test]; ok {
+			continue
+		}
+		reason := unlistedTestReason(result.testDecls[test], listRegex)
+		if in.opts.includeUnverified {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: %s is not listed by go test -list (%s); including it unverified\n", test, reason)
+			result.runnableTests = append(result.runnableTests, test)
+			result.markUnverified(test)
+			continue
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "warning: %s is not listed by go test -list (%s); use -include-unverified to generate it anyway\n", test, reason)
+		result.dropReason(test, reason)
+	}
+	sort.Strings(result.runnableTests)
+	result.selectedTests = append([]string(nil), result.runnableTests...)
+	return nil
+}
+
+// staticDiscoverer adds the subtests the runnable tests start with a
+// literal name, t.Run("name", func(t *testing.T) { ... }), nested ones
+// included, without building or running anything. Subtests named at run
+// time, e.g. from a table, need the runtime strategy.
+type staticDiscoverer struct{}
+
+func (staticDiscoverer) Name() string { return discovererStatic }
+
+func (staticDiscoverer) Discover(in discoveryInput, result *discoveryResult) error {
+	subtests, err := discovery.StaticSubtests(in.absFilePath, result.runnableTests)
+	if err != nil {
+		return fmt.Errorf("find subtests in file: %w", err)
+	}
+	result.discoveredTests = mergeUniqueTests(result.discoveredTests, subtests)
+	result.mergeDiscovered()
+	return nil
+}
+
+// autoDiscoverer finds subtests statically, then runs the tests that call
+// t.Run to find the rest, but only when the package's tests last ran for
+// less than AUTO_SUBTESTS_MAX_DURATION during runtime discovery. Packages
+// with no recorded run, or a slow one, keep the static result, so saving a
+// file never starts a long integration test.
+type autoDiscoverer struct{}
+
+func (autoDiscoverer) Name() string { return discovererAuto }
+
+func (autoDiscoverer) Discover(in discoveryInput, result *discoveryResult) error {
+	if err := (staticDiscoverer{}).Discover(in, result); err != nil {
+		return err
+	}
+	result.autoMode = discovererStatic
+	tests, err := discovery.TestsCallingRun(in.absFilePath, result.runnableTests)
+	if err != nil {
+		return fmt.Errorf("find subtests in file: %w", err)
+	}
+	if len(tests) == 0 {
+		return nil
+	}
+	// loadConfig validated the duration.
+	limit, _ := time.ParseDuration(in.cfg.AutoSubtestsMaxTime)
+	durations, err := readTestDurations(in.absRootPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		return nil
+	}
+	recorded, ok := durations[result.pkgArg]
+	switch {
+	case !ok:
+		_, _ = fmt.Fprintf(os.Stderr, "note: static subtest discovery for %s: no recorded test duration yet; generate once with -discover-subtests to record it\n", result.pkgArg)
+	case recorded.duration() >= limit:
+		_, _ = fmt.Fprintf(os.Stderr, "note: static subtest discovery for %s: its tests last ran for %s, over auto_subtests_max_duration %s\n", result.pkgArg, recorded.duration(), limit)
+	default:
+		err := runtimeDiscoverer{}.discover(in, result, tests)
+		if result.runtimeSkipped == "" {
+			result.autoMode = discovererRuntime
+		}
+		return err
+	}
+	return nil
+}
+
+// testDurationsPath records how long each package's tests ran during
+// runtime subtest discovery, for -auto-subtests.
+const testDurationsPath = stateDirPath + "durations.json"
+
+// testDurations maps a package argument to its last recorded run.
+type testDurations map[string]testDuration
+
+type testDuration struct {
+	Seconds float64   `json:"seconds"`
+	Time    time.Time `json:"time"`
+}
+
+func (d testDuration) duration() time.Duration {
+	return time.Duration(d.Seconds * float64(time.Second)).Round(time.Millisecond)
+}
+
+func readTestDurations(absRootPath string) (testDurations, error) {
+	durations := testDurations{}
+	data, err := os.ReadFile(filepath.Join(absRootPath, testDurationsPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return durations, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read test durations: %w", err)
+	}
+	if err := json.Unmarshal(data, &durations); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", testDurationsPath, err)
+	}
+	return durations, nil
+}
+
+// recordTestDuration stores elapsed as the last run of pkgArg's tests.
+// Failing to record it only warns.
+func recordTestDuration(cfg Config, absRootPath, pkgArg string, elapsed time.Duration) {
+	durations, err := readTestDurations(absRootPath)
+	if err == nil {
+		durations[pkgArg] = testDuration{Seconds: elapsed.Seconds(), Time: time.Now().UTC()}
+		err = writeTestDurations(cfg, absRootPath, durations)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: record test duration: %v\n", err)
+	}
+}
+
+func writeTestDurations(cfg Config, absRootPath string, durations testDurations) error {
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(durations, "", "  ")
+	if err != nil {
+		return err
+	}
+	var tx fileTransaction
+	defer tx.rollback()
+	if err := tx.stage(filepath.Join(absRootPath, testDurationsPath), append(data, '\n'), modes); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// runtimeDiscoverer runs the selected tests with go test -json and adds the
+// subtests they report.
+type runtimeDiscoverer struct{}
+
+func (runtimeDiscoverer) Name() string { return discovererRuntime }
+
+func (d runtimeDiscoverer) Discover(in discoveryInput, result *discoveryResult) error {
+	return d.discover(in, result, result.runnableTests)
+}
+
+// discover runs tests, some of the runnable tests, to find their subtests.
+func (runtimeDiscoverer) discover(in discoveryInput, result *discoveryResult, tests []string) error {
+	if len(result.diagnostics) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "note: skipping subtest discovery because the package does not compile\n")
+		result.runtimeSkipped = "package does not compile"
+		return nil
+	}
+	if !result.constraint.matchesHost {
+		_, _ = fmt.Fprintf(os.Stderr, "note: skipping subtest discovery for %s because it cannot run on %s/%s\n",
+			filepath.Base(in.absFilePath), runtime.GOOS, runtime.GOARCH)
+		result.runtimeSkipped = fmt.Sprintf("cannot run on %s/%s", runtime.GOOS, runtime.GOARCH)
+		return nil
+	}
+
+	var err error
+	result.subtestTimeout, err = resolveSubtestTimeout(in.cfg.SubtestTimeout, in.opts.subtestTimeout)
+	if err != nil {
+		return err
+	}
+	goTestArgs := append(append([]string(nil), in.buildFlags...), in.extraGoTestArgs...)
+	goTestArgs = append(goTestArgs, in.cfg.skipArgs()...)
+	binaryArgs := in.opts.discoveryBinaryArgs(in.cfg)
+
+	store, err := newManifestStore(in.cfg, in.absRootPath)
+	if err != nil {
+		return err
+	}
+	var key string
+	if store != nil {
+		key, err = discoveryCacheKey(in.absRootPath, in.packageDir, tests, goTestArgs, binaryArgs, in.env)
+		if err != nil {
+			return fmt.Errorf("hash package for discovery cache: %w", err)
+		}
+	}
+	if store != nil && in.cfg.DiscoveryCacheMode != cacheModeWrite && !in.opts.noDiscoveryCache {
+		result.discoveryCache = "miss"
+		manifest, err := store.get(key)
+		switch {
+		case err != nil:
+			_, _ = fmt.Fprintf(os.Stderr, "warning: read discovery cache: %v\n", err)
+		case manifest != nil:
+			_, _ = fmt.Fprintf(os.Stderr, "note: using cached subtest discovery %s from %s\n", key[:12], store)
+			result.discoveryCache = "hit"
+			result.discoveredTests = manifest.Discovered
+			result.skippedTests = manifest.Skipped
+			result.testAttributes = manifest.Attributes
+			result.mergeDiscovered()
+			result.applySkipped(in.cfg.SkippedTests)
+			return nil
+		}
+	}
+
+	events, err := discovery.RunTests(in.runner, in.packageDir, tests, discovery.RunOptions{
+		Timeout:    result.subtestTimeout,
+		GoTestArgs: sanitizeDiscoveryGoTestArgs(goTestArgs),
+		BinaryArgs: binaryArgs,
+	})
+	if err != nil {
+		return fmt.Errorf("discover subtests: %w", err)
+	}
+	if events.Elapsed > 0 && !in.opts.readOnly && !in.opts.dryRun {
+		recordTestDuration(in.cfg, in.absRootPath, result.pkgArg, events.Elapsed)
+	}
+	result.discoveredTests = events.Tests
+	result.skippedTests = events.Skipped
+	result.testAttributes = events.Attributes
+	result.testArtifacts = events.Artifacts
+	result.mergeDiscovered()
+
+	if store != nil && in.cfg.DiscoveryCacheMode != cacheModeRead {
+		manifest := discoveryManifest{Key: key, Package: result.pkgArg, Tests: tests, Discovered: result.discoveredTests, Skipped: result.skippedTests, Attributes: result.testAttributes}
+		if err := store.put(manifest); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: write discovery cache: %v\n", err)
+		}
+	}
+	result.applySkipped(in.cfg.SkippedTests)
+	return nil
+}
+
+// excludeTests drops the selected tests and subtests go test -skip
+// EXCLUDE_TEST_REGEX would skip. Top-level tests never get this far, see
+// testNameFilter, but subtests found by discovery do.
+func (r *discoveryResult) excludeTests(cfg Config) error {
+	pattern, err := discovery.CompileSkip(cfg.ExcludeTestRegex)
+	if err != nil || pattern == nil {
+		return err
+	}
+	selected := r.selectedTests[:0]
+	for _, test := range r.selectedTests {
+		if pattern.Skips(test) {
+			r.dropReason(test, fmt.Sprintf("matches EXCLUDE_TEST_REGEX %q", cfg.ExcludeTestRegex))
+			continue
+		}
+		selected = append(selected, test)
+	}
+	r.selectedTests = selected
+	return nil
+}
+
+// mergeDiscovered adds the runtime-discovered tests to the selection.
+func (r *discoveryResult) mergeDiscovered() {
+	r.selectedTests = mergeUniqueTests(r.runnableTests, r.discoveredTests)
+	sort.Strings(r.selectedTests)
+	r.discoveredNew = countUniqueNotInBase(r.runnableTests, r.discoveredTests)
+}
+
+// applySkipped handles the tests that skipped during discovery according to
+// SKIPPED_TESTS: keep leaves them alone, annotate marks their labels and
+// exclude drops them from the selection.
+func (r *discoveryResult) applySkipped(mode string) {
+	switch mode {
+	case skippedAnnotate:
+		r.annotateSkipped = len(r.skippedTests) > 0
+	case skippedExclude:
+		selected := r.selectedTests[:0]
+		for _, test := range r.selectedTests {
+			message, skipped := r.skippedTests[test]
+			if !skipped {
+				selected = append(selected, test)
+				continue
+			}
+			reason := "skipped during discovery"
+			if message != "" {
+				reason += ": " + message
+			}
+			r.dropReason(test, reason)
+		}
+		r.selectedTests = selected
+	}
+}
+
+const (
+	cacheModeRead      = "read"
+	cacheModeWrite     = "write"
+	cacheModeReadWrite = "readwrite"
+)
+
+// discoveryManifest is the cached outcome of runtime subtest discovery for
+// one package state.
+type discoveryManifest struct {
+	Key        string   `json:"key"`
+	Package    string   `json:"package"`
+	Tests      []string `json:"tests"`
+	Discovered []string `json:"discovered"`
+	// Skipped maps the tests that reported skip to their skip message.
+	Skipped map[string]string `json:"skipped,omitempty"`
+	// Attributes are the t.Attr pairs per test. Artifact directories are
+	// not cached since they belong to one run.
+	Attributes map[string]map[string]string `json:"attributes,omitempty"`
+}
+
+// manifestStore is a shared location for discovery manifests. get returns
+// nil without error on a miss.
+type manifestStore interface {
+	get(key string) (*discoveryManifest, error)
+	put(manifest discoveryManifest) error
+	String() string
+}
+
+// newManifestStore picks the store for DISCOVERY_CACHE: an http(s) URL,
+// which also covers S3 and GCS through presigned or public bucket URLs, or
+// a directory, relative to the workspace root, that can be committed.
+func newManifestStore(cfg Config, absRootPath string) (manifestStore, error) {
+	location := cfg.DiscoveryCache
+	switch {
+	case location == "":
+		return nil, nil
+	case strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://"):
+		if cfg.Offline {
+			_, _ = fmt.Fprintf(os.Stderr, "note: offline; not using discovery cache %s\n", location)
+			return nil, nil
+		}
+		client, err := newHTTPClient(cfg, absRootPath)
+		if err != nil {
+			return nil, err
+		}
+		return httpManifestStore{baseURL: strings.TrimSuffix(location, "/"), token: cfg.DiscoveryCacheToken, client: client}, nil
+	case strings.Contains(location, "://"):
+		return nil, fmt.Errorf("unsupported discovery_cache %q (expected a directory or an http(s) URL)", location)
+	default:
+		modes, err := cfg.fileModes()
+		if err != nil {
+			return nil, err
+		}
+		return dirManifestStore{dir: resolvePath(absRootPath, location), modes: modes}, nil
+	}
+}
+
+// discoveryCacheKey hashes everything that decides which subtests a run
+// reports: the Go files of the package, go.mod and go.sum, the tests run,
+// their args and env, and the host platform.
+func discoveryCacheKey(absRootPath, packageDir string, tests, goTestArgs, binaryArgs []string, env map[string]string) (string, error) {
+	hash := sha256.New()
+	entries, err := os.ReadDir(packageDir)
+	if err != nil {
+		return "", err
+	}
+	files := []string{filepath.Join(absRootPath, "go.mod"), filepath.Join(absRootPath, "go.sum")}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".go") {
+			files = append(files, filepath.Join(packageDir, entry.Name()))
+		}
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, _ = fmt.Fprintf(hash, "file %s %d\n", filepath.Base(file), len(data))
+		_, _ = hash.Write(data)
+	}
+	_, _ = fmt.Fprintf(hash, "platform %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	_, _ = fmt.Fprintf(hash, "tests %q\nargs %q\nbinary %q\n", tests, goTestArgs, binaryArgs)
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(hash, "env %s=%s\n", key, env[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type dirManifestStore struct {
+	dir   string
+	modes fileModes
+}
+
+func (s dirManifestStore) String() string { return s.dir }
+
+func (s dirManifestStore) get(key string) (*discoveryManifest, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, key+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(key, data)
+}
+
+func (s dirManifestStore) put(manifest discoveryManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeTasks(filepath.Join(s.dir, manifest.Key+".json"), append(data, '\n'), s.modes)
+}
+
+// httpManifestStore GETs and PUTs <base>/<key>.json, sending
+// DISCOVERY_CACHE_TOKEN as a bearer token when set.
+type httpManifestStore struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func (s httpManifestStore) String() string { return s.baseURL }
+
+func (s httpManifestStore) get(key string) (*discoveryManifest, error) {
+	resp, err := s.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", resp.Request.URL, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(key, data)
+}
+
+func (s httpManifestStore) put(manifest discoveryManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPut, manifest.Key, data)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s: %s", resp.Request.URL, resp.Status)
+	}
+	return nil
+}
+
+func (s httpManifestStore) do(method, key string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.baseURL+"/"+key+".json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	return s.client.Do(req)
+}
+
+// newHTTPClient is the client of every network feature. It goes through
+// HTTPS_PROXY/HTTP_PROXY unless NO_PROXY matches, and trusts CA_BUNDLE in
+// addition to the system roots. A relative CA_BUNDLE is resolved against
+// the workspace root.
+func newHTTPClient(cfg Config, absRootPath string) (*http.Client, error) {
+	if cfg.Offline {
+		return nil, errors.New("network access is disabled by -offline")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(resolvePath(absRootPath, cfg.CABundle))
+		if err != nil {
+			return nil, fmt.Errorf("read ca_bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_bundle %q has no PEM certificates", cfg.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}, nil
+}
+
+func decodeManifest(key string, data []byte) (*discoveryManifest, error) {
+	var manifest discoveryManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("decode manifest %s: %w", key, err)
+	}
+	if manifest.Key != key {
+		return nil, fmt.Errorf("manifest %s has key %q", key, manifest.Key)
+	}
+	return &manifest, nil
+}
+
+// findGoldenFlag looks for a boolean flag registered with the flag package
+// (flag.Bool / flag.BoolVar) whose name matches namePattern, e.g. the
+// common `var update = flag.Bool("update", false, ...)` golden-file idiom.
+// Files that do not parse are skipped with a warning, so a package that does
+// not compile still gets its unverified tasks.
+func findGoldenFlag(packageDir string, namePattern *regexp.Regexp) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(packageDir, "*.go"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+
+	fset := token.NewFileSet()
+	for _, path := range paths {
+		parsed, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: golden flag detection skipped %s: %v\n", filepath.Base(path), err)
+			continue
+		}
+		found := ""
+		ast.Inspect(parsed, func(n ast.Node) bool {
+			if found != "" {
+				return false
+			}
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			pkg, ok := sel.X.(*ast.Ident)
+			if !ok || pkg.Name != "flag" {
+				return true
+			}
+			nameArg := -1
+			switch sel.Sel.Name {
+			case "Bool":
+				nameArg = 0
+			case "BoolVar":
+				nameArg = 1
+			}
+			if nameArg < 0 || len(call.Args) <= nameArg {
+				return true
+			}
+			lit, ok := call.Args[nameArg].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			name, err := strconv.Unquote(lit.Value)
+			if err == nil && namePattern.MatchString(name) {
+				found = name
+			}
+			return true
+		})
+		if found != "" {
+			return found, nil
+		}
+	}
+	return "", nil
+}
+
+// outputAdapter renders the shared discovery result into one editor file.
+type outputAdapter struct {
+	editor      editorKind
+	target      generateTarget
+	path        string
+	labelPrefix string
+	labelTmpl   string
+	modes       fileModes
+	render      func(results ...discoveryResult) ([]byte, mergeStats, error)
+}
+
+type adapterReport struct {
+	adapter outputAdapter
+	path    string
+	stats   mergeStats
+	// elapsed is the time it took to render and stage the file.
+	elapsed time.Duration
+}
+
+func newOutputAdapter(editor editorKind, target generateTarget, cfg Config, absRootPath string) (outputAdapter, error) {
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return outputAdapter{}, err
+	}
+	adapter := outputAdapter{editor: editor, target: target, labelTmpl: cfg.LabelTemplate, modes: modes}
+	switch target {
+	case generateTargetTasks:
+		adapter.path = resolvePath(absRootPath, cfg.TasksPath)
+		adapter.labelPrefix = cfg.LabelPrefix
+	case generateTargetDebug:
+		adapter.path = resolvePath(absRootPath, cfg.DebugPath)
+		adapter.labelPrefix = cfg.DebugLabelPrefix
+	default:
+		return outputAdapter{}, fmt.Errorf("unsupported generate target %q", target)
+	}
+	path := adapter.path
+
+	switch {
+	case editor == editorKindVSCode && target == generateTargetTasks:
+		adapter.render = func(results ...discoveryResult) ([]byte, mergeStats, error) {
+			var generated []map[string]any
+			for _, result := range results {
+				generated = append(generated, makeGeneratedVSCodeTasks(result, cfg)...)
+			}
+			doc, stats, err := mergeVSCodeTasks(path, generated, cfg)
+			if err != nil {
+				return nil, mergeStats{}, fmt.Errorf("merge tasks: %w", err)
+			}
+			if cfg.MaxTasks > 0 {
+				labels := make([]string, 0, len(generated))
+				for _, entry := range generated {
+					label, _ := entryLabel(entry)
+					labels = append(labels, label)
+				}
+				keep, lastUsed := cfg.taskBudget(absRootPath, path, labels)
+				doc["tasks"], stats.Evicted = evictVSCodeTasks(doc["tasks"].([]map[string]any), cfg, keep, lastUsed)
+				doc["tasks"] = syncAllGeneratedVSCodeTask(doc["tasks"].([]map[string]any), cfg)
+			}
+			output, err := marshalDocument(doc)
+			return output, stats, err
+		}
+	case editor == editorKindVSCode && target == generateTargetDebug:
+		adapter.render = func(results ...discoveryResult) ([]byte, mergeStats, error) {
+			var generated []map[string]any
+			for _, result := range results {
+				generated = append(generated, makeGeneratedVSCodeDebugConfigs(result, cfg)...)
+			}
+			doc, stats, err := mergeVSCodeDebugConfigs(path, generated, cfg)
+			if err != nil {
+				return nil, mergeStats{}, fmt.Errorf("merge debug configs: %w", err)
+			}
+			output, err := marshalDocument(doc)
+			return output, stats, err
+		}
+	case target == generateTargetTasks:
+		adapter.render = func(results ...discoveryResult) ([]byte, mergeStats, error) {
+			var generated []Task
+			for _, result := range results {
+				generated = append(generated, makeGeneratedTasks(result, cfg)...)
+			}
+			merged, stats, err := tasks.MergeFile(path, generated, cfg.mergePolicy())
+			if err != nil {
+				return nil, mergeStats{}, fmt.Errorf("merge tasks: %w", err)
+			}
+			if cfg.MaxTasks > 0 {
+				labels := make([]string, 0, len(generated))
+				for _, task := range generated {
+					labels = append(labels, task.Label)
+				}
+				keep, lastUsed := cfg.taskBudget(absRootPath, path, labels)
+				stats.Evicted = merged.Evict(cfg.MaxTasks, keep, lastUsed)
+			}
+			syncAllGeneratedTask(merged, cfg)
+			output, err := merged.Marshal()
+			return output, stats, err
+		}
+	default:
+		adapter.render = func(results ...discoveryResult) ([]byte, mergeStats, error) {
+			var generated []DebugConfig
+			for _, result := range results {
+				generated = append(generated, makeGeneratedDebugConfigs(result, cfg)...)
+			}
+			merged, stats, err := tasks.MergeFile(path, generated, cfg.mergePolicy())
+			if err != nil {
+				return nil, mergeStats{}, fmt.Errorf("merge debug configs: %w", err)
+			}
+			output, err := merged.Marshal()
+			return output, stats, err
+		}
+	}
+	return adapter, nil
+}
+
+// generatedComment starts the comment line before each task this tool
+// writes to a Taskfile or makefile, followed by the test file it came
+// from. Comments are the only place these files keep a marker without the
+// tool that runs them seeing it.
+const generatedComment = "# go-zed-tasks:generated"
+
+// newTaskfileAdapter writes the tasks of the generated Zed tasks to
+// TASKFILE_PATH for go-task, named with TASKFILE_PREFIX instead of
+// LABEL_PREFIX, e.g. task test:TestFoo.
+func newTaskfileAdapter(cfg Config, absRootPath string) (outputAdapter, error) {
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return outputAdapter{}, err
+	}
+	path := resolvePath(absRootPath, cfg.TaskfilePath)
+	taskCfg := cfg
+	taskCfg.LabelPrefix = cfg.TaskfilePrefix
+	return outputAdapter{
+		target:      generateTargetTasks,
+		path:        path,
+		labelPrefix: cfg.TaskfilePrefix,
+		labelTmpl:   cfg.LabelTemplate,
+		modes:       modes,
+		render: func(results ...discoveryResult) ([]byte, mergeStats, error) {
+			var generated []taskfileTask
+			for _, result := range results {
+				for _, task := range makeGeneratedTasks(result, taskCfg) {
+					generated = append(generated, newTaskfileTask(task, result.relFilePath))
+				}
+			}
+			data, err := os.ReadFile(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, mergeStats{}, fmt.Errorf("read taskfile %q: %w", path, err)
+			}
+			output, stats, err := mergeTaskfile(data, generated, cfg)
+			if err != nil {
+				return nil, mergeStats{}, fmt.Errorf("merge taskfile %q: %w", path, err)
+			}
+			return output, stats, nil
+		},
+	}, nil
+}
+
+// taskfileTask is a generated Zed task as go-task runs it: one shell
+// command from the Taskfile directory, the workspace root.
+type taskfileTask struct {
+	name    string
+	file    string
+	desc    string
+	dir     string
+	env     map[string]string
+	command string
+}
+
+func newTaskfileTask(task Task, relFilePath string) taskfileTask {
+	// go-task expands {{.ROOT_DIR}} to the directory of the root Taskfile.
+	rooted := func(value string) string {
+		return strings.ReplaceAll(value, "$ZED_WORKTREE_ROOT", "{{.ROOT_DIR}}")
+	}
+	env := make(map[string]string, len(task.Env))
+	for key, value := range task.Env {
+		env[key] = rooted(value)
+	}
+	desc := task.Label
+	if test, ok := task.Env[testNameEnvKey]; ok {
+		desc = test + " in " + task.Env[packageEnvKey]
+	}
+	return taskfileTask{
+		name:    task.Label,
+		file:    relFilePath,
+		desc:    desc,
+		dir:     rooted(task.Cwd),
+		env:     env,
+		command: rooted(shellCommand(task.Command, task.Args)),
+	}
+}
+
+// lines renders t as an entry of the tasks mapping. Strings are written as
+// JSON strings, which YAML reads as double-quoted scalars.
+func (t taskfileTask) lines(indent string) []string {
+	quote := yamlQuote
+	lines := []string{
+		indent + generatedComment + " " + t.file,
+		indent + quote(t.name) + ":",
+		indent + indent + "desc: " + quote(t.desc),
+	}
+	if t.dir != "" {
+		lines = append(lines, indent+indent+"dir: "+quote(t.dir))
+	}
+	if len(t.env) > 0 {
+		lines = append(lines, indent+indent+"env:")
+		for _, key := range slices.Sorted(maps.Keys(t.env)) {
+			lines = append(lines, indent+indent+indent+key+": "+quote(t.env[key]))
+		}
+	}
+	return append(lines, indent+indent+"cmds:", indent+indent+indent+"- "+quote(t.command))
+}
+
+// yamlQuote writes value as a JSON string, which YAML reads as a
+// double-quoted scalar.
+func yamlQuote(value string) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// taskfileSegment is a run of lines of the tasks mapping: a task with the
+// comments before it, or a generated task with its marker.
+type taskfileSegment struct {
+	lines     []string
+	name      string
+	generated bool
+}
+
+// mergeTaskfile merges generated into data, a Taskfile, as tasks.MergeFile does
+// for Zed: generated tasks, the ones after a generatedComment line, are
+// pruned and replaced as the config says, other tasks are left as they
+// are, and new tasks go to the end of the tasks mapping. A hand-written
+// task with the name of a generated one is kept instead of it. Only
+// block-style mappings are supported, as go-task writes them.
+func mergeTaskfile(data []byte, generated []taskfileTask, cfg Config) ([]byte, mergeStats, error) {
+	text := strings.TrimRight(string(data), "\n")
+	if strings.TrimSpace(text) == "" {
+		text = "version: '3'"
+	}
+	lines := strings.Split(text, "\n")
+	start := slices.IndexFunc(lines, func(line string) bool {
+		key, _, _ := strings.Cut(line, "#")
+		return strings.TrimRight(key, " \t") == "tasks:"
+	})
+	if start < 0 {
+		if slices.ContainsFunc(lines, func(line string) bool { return strings.HasPrefix(line, "tasks:") }) {
+			return nil, mergeStats{}, fmt.Errorf("tasks must be a block mapping")
+		}
+		lines = append(lines, "", "tasks:")
+		start = len(lines) - 1
+	}
+	end := start + 1
+	for end < len(lines) && (strings.TrimSpace(lines[end]) == "" || strings.HasPrefix(lines[end], " ") || strings.HasPrefix(lines[end], "\t") || strings.HasPrefix(lines[end], "#")) {
+		end++
+	}
+	// Blank lines and comments in column 0 before the next top-level key
+	// belong to it.
+	for end > start+1 && (strings.TrimSpace(lines[end-1]) == "" || strings.HasPrefix(lines[end-1], "#")) {
+		end--
+	}
+
+	indent := "  "
+	for _, line := range lines[start+1 : end] {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			indent = line[:len(line)-len(trimmed)]
+			break
+		}
+	}
+	var segments []taskfileSegment
+	for _, line := range lines[start+1 : end] {
+		trimmed := strings.TrimPrefix(line, indent)
+		topLevel := trimmed != line && trimmed != "" && trimmed[0] != ' ' && trimmed[0] != '\t'
+		// A task starts with the comments before its key; a generated one
+		// with its marker.
+		var current *taskfileSegment
+		if len(segments) > 0 {
+			current = &segments[len(segments)-1]
+		}
+		pending := current != nil && current.name == ""
+		switch {
+		case !topLevel:
+		case strings.HasPrefix(trimmed, generatedComment):
+			segments = append(segments, taskfileSegment{generated: true})
+		case strings.HasPrefix(trimmed, "#"):
+			if !pending || current.generated {
+				segments = append(segments, taskfileSegment{})
+			}
+		case pending:
+			current.name = taskfileKey(trimmed)
+		default:
+			segments = append(segments, taskfileSegment{name: taskfileKey(trimmed)})
+		}
+		if len(segments) == 0 {
+			segments = append(segments, taskfileSegment{})
+		}
+		last := &segments[len(segments)-1]
+		last.lines = append(last.lines, line)
+	}
+
+	newTasks := make(map[string]taskfileTask, len(generated))
+	regenerated := make(map[string]struct{}, len(generated))
+	for _, task := range generated {
+		newTasks[task.name] = task
+		regenerated[task.name] = struct{}{}
+	}
+	var stats mergeStats
+	var merged []string
+	for _, segment := range segments {
+		task, isNew := newTasks[segment.name]
+		switch {
+		case !segment.generated:
+			if isNew && segment.name != "" {
+				_, _ = fmt.Fprintf(os.Stderr, "warning: kept hand-written task %q in the taskfile instead of the generated one\n", segment.name)
+				stats.Kept++
+				delete(newTasks, segment.name)
+			}
+		case isNew:
+			delete(newTasks, segment.name)
+			blanks := trailingBlankLines(segment.lines)
+			if !cfg.replaces(segment.name, strings.Join(segment.lines[:len(segment.lines)-blanks], "\n"), strings.Join(task.lines(indent), "\n")) {
+				stats.Kept++
+				break
+			}
+			segment.lines = append(task.lines(indent), segment.lines[len(segment.lines)-blanks:]...)
+			stats.Updated++
+		case cfg.prunes(segment.name, true, true, regenerated):
+			stats.Removed++
+			continue
+		}
+		merged = append(merged, segment.lines...)
+	}
+	for _, task := range generated {
+		if _, ok := newTasks[task.name]; ok {
+			if len(merged) > 0 && strings.TrimSpace(merged[len(merged)-1]) != "" {
+				merged = append(merged, "")
+			}
+			merged = append(merged, task.lines(indent)...)
+			stats.Added++
+		}
+	}
+
+	merged = merged[:len(merged)-trailingBlankLines(merged)]
+	out := slices.Concat(lines[:start+1], merged, lines[end:])
+	return []byte(strings.Join(out, "\n") + "\n"), stats, nil
+}
+
+// trailingBlankLines counts the blank lines at the end of lines.
+func trailingBlankLines(lines []string) int {
+	n := 0
+	for n < len(lines) && strings.TrimSpace(lines[len(lines)-1-n]) == "" {
+		n++
+	}
+	return n
+}
+
+// taskfileKey is the task name of a mapping entry line such as
+// `"test:TestFoo":`, `'build': ...` or `lint:`.
+func taskfileKey(line string) string {
+	if strings.HasPrefix(line, `"`) {
+		var key string
+		if err := json.NewDecoder(strings.NewReader(line)).Decode(&key); err == nil {
+			return key
+		}
+	}
+	if rest, ok := strings.CutPrefix(line, "'"); ok {
+		if key, _, ok := strings.Cut(rest, "':"); ok {
+			return strings.ReplaceAll(key, "''", "'")
+		}
+	}
+	if key, _, ok := strings.Cut(line, ": "); ok {
+		return key
+	}
+	return strings.TrimSuffix(strings.TrimSpace(line), ":")
+}
+
+// makefileHeader starts a makefile this tool creates.
+const makefileHeader = "# Test targets written by go-zed-tasks, one per test: make <target>.\n# Include it from the Makefile at the workspace root: include tests.mk\n"
+
+// newMakefileAdapter writes the generated Zed tasks to MAKEFILE_PATH as
+// phony targets named with MAKEFILE_PREFIX instead of LABEL_PREFIX, e.g.
+// make test-TestFoo, so CI runs the -run patterns the editor uses.
+func newMakefileAdapter(cfg Config, absRootPath string) (outputAdapter, error) {
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return outputAdapter{}, err
+	}
+	path := resolvePath(absRootPath, cfg.MakefilePath)
+	taskCfg := cfg
+	taskCfg.LabelPrefix = cfg.MakefilePrefix
+	return outputAdapter{
+		target:      generateTargetTasks,
+		path:        path,
+		labelPrefix: cfg.MakefilePrefix,
+		labelTmpl:   cfg.LabelTemplate,
+		modes:       modes,
+		render: func(results ...discoveryResult) ([]byte, mergeStats, error) {
+			var generated []makeTarget
+			for _, result := range results {
+				for _, task := range makeGeneratedTasks(result, taskCfg) {
+					generated = append(generated, newMakeTarget(task, result.relFilePath))
+				}
+			}
+			data, err := os.ReadFile(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, mergeStats{}, fmt.Errorf("read makefile %q: %w", path, err)
+			}
+			output, stats := mergeMakefile(data, generated, cfg)
+			return output, stats, nil
+		},
+	}, nil
+}
+
+// makeTarget is a generated Zed task as a phony make target: one recipe
+// line run from the directory make runs in, the workspace root.
+type makeTarget struct {
+	name   string
+	file   string
+	recipe string
+}
+
+func newMakeTarget(task Task, relFilePath string) makeTarget {
+	var recipe strings.Builder
+	if task.Cwd != "" {
+		recipe.WriteString("cd " + shellQuote(task.Cwd) + " && ")
+	}
+	for _, key := range slices.Sorted(maps.Keys(task.Env)) {
+		recipe.WriteString(key + "=" + shellQuote(task.Env[key]) + " ")
+	}
+	recipe.WriteString(shellCommand(task.Command, task.Args))
+	// make expands $ before the shell does; $(CURDIR) is where make runs.
+	escaped := strings.ReplaceAll(recipe.String(), "$", "$$")
+	escaped = strings.ReplaceAll(escaped, "$$ZED_WORKTREE_ROOT", "$(CURDIR)")
+	return makeTarget{name: makeTargetName(task.Label), file: relFilePath, recipe: escaped}
+}
+
+// makeTargetName turns a label into a target name: variants become a
+// suffix, as in test-TestFoo-race, and characters make treats specially
+// become underscores.
+func makeTargetName(label string) string {
+	label = strings.NewReplacer(" [", "-", "]", "").Replace(label)
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./", r) {
+			return r
+		}
+		return '_'
+	}, label)
+}
+
+func (t makeTarget) lines() []string {
+	return []string{
+		generatedComment + " " + t.file,
+		".PHONY: " + t.name,
+		t.name + ":",
+		"\t" + t.recipe,
+	}
+}
+
+// mergeMakefile merges generated into data, a makefile, as mergeTaskfile
+// does: a generated target runs from its generatedComment line to the next
+// blank line, and everything else is left as it is. A rule of the makefile
+// itself with the name of a generated target is kept instead of it.
+func mergeMakefile(data []byte, generated []makeTarget, cfg Config) ([]byte, mergeStats) {
+	text := strings.TrimRight(string(data), "\n")
+	if strings.TrimSpace(text) == "" {
+		text = strings.TrimRight(makefileHeader, "\n")
+	}
+	lines := strings.Split(text, "\n")
+
+	newTargets := make(map[string]makeTarget, len(generated))
+	regenerated := make(map[string]struct{}, len(generated))
+	for _, target := range generated {
+		newTargets[target.name] = target
+		regenerated[target.name] = struct{}{}
+	}
+	var stats mergeStats
+	var merged []string
+	handWritten := make(map[string]struct{})
+	for i := 0; i < len(lines); {
+		if !strings.HasPrefix(lines[i], generatedComment) {
+			if name, _, ok := strings.Cut(lines[i], ":"); ok && name != "" && !strings.ContainsAny(name[:1], "\t #.") {
+				handWritten[name] = struct{}{}
+			}
+			merged = append(merged, lines[i])
+			i++
+			continue
+		}
+		end := i + 1
+		for end < len(lines) && strings.TrimSpace(lines[end]) != "" {
+			end++
+		}
+		block := lines[i:end]
+		name := ""
+		if len(block) > 1 {
+			name = strings.TrimPrefix(block[1], ".PHONY: ")
+		}
+		i = end
+		if target, ok := newTargets[name]; ok {
+			delete(newTargets, name)
+			if cfg.replaces(name, strings.Join(block, "\n"), strings.Join(target.lines(), "\n")) {
+				block = target.lines()
+				stats.Updated++
+			} else {
+				stats.Kept++
+			}
+		} else if cfg.prunes(name, true, true, regenerated) {
+			stats.Removed++
+			if i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+				i++
+			}
+			continue
+		}
+		merged = append(merged, block...)
+	}
+
+	merged = merged[:len(merged)-trailingBlankLines(merged)]
+	for _, target := range generated {
+		if _, ok := newTargets[target.name]; !ok {
+			continue
+		}
+		if _, ok := handWritten[target.name]; ok {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: kept the makefile's own %s rule instead of the generated one\n", target.name)
+			stats.Kept++
+			continue
+		}
+		merged = append(merged, "")
+		merged = append(merged, target.lines()...)
+		stats.Added++
+	}
+	return []byte(strings.Join(merged, "\n") + "\n"), stats
+}
+
+// exportHeader starts the -format yaml export.
+const exportHeader = `# Tests and tasks exported by go-zed-tasks generate -format yaml.
+# Paths are relative to the workspace root. Regenerate instead of editing:
+# every run rewrites this file with the files it discovered.
+`
+
+// newExportAdapter writes the discovery results and their generated Zed
+// tasks to EXPORT_PATH as YAML for tools that are neither an editor nor a
+// task runner, e.g. a service catalog or an in-house CI runner.
+func newExportAdapter(cfg Config, absRootPath string) (outputAdapter, error) {
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return outputAdapter{}, err
+	}
+	path := resolvePath(absRootPath, cfg.ExportPath)
+	return outputAdapter{
+		target:      generateTargetTasks,
+		path:        path,
+		labelPrefix: cfg.LabelPrefix,
+		labelTmpl:   cfg.LabelTemplate,
+		modes:       modes,
+		render: func(results ...discoveryResult) ([]byte, mergeStats, error) {
+			data, err := os.ReadFile(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, mergeStats{}, fmt.Errorf("read export %q: %w", path, err)
+			}
+			output, labels := renderExport(results, cfg)
+			return output, exportStats(data, labels), nil
+		},
+	}, nil
+}
+
+// renderExport renders results as the YAML export: one entry per test
+// file, sorted by path, with its tests as query prints them and its tasks
+// as Zed runs them, $ZED_WORKTREE_ROOT written as the root-relative ".".
+// Keys come in a fixed order and env keys sorted, so the same tests always
+// give the same bytes. It also returns the task labels.
+func renderExport(results []discoveryResult, cfg Config) ([]byte, []string) {
+	rooted := func(value string) string {
+		return strings.ReplaceAll(value, "$ZED_WORKTREE_ROOT", ".")
+	}
+	sorted := slices.Clone(results)
+	slices.SortStableFunc(sorted, func(a, b discoveryResult) int {
+		return strings.Compare(a.relFilePath, b.relFilePath)
+	})
+
+	var labels []string
+	lines := []string{strings.TrimRight(exportHeader, "\n"), "files:"}
+	if len(sorted) == 0 {
+		lines[1] += " []"
+	}
+	for _, result := range sorted {
+		tree := result.queryTree()
+		provenance := generatedComment + " " + result.relFilePath
+		if len(result.strategies) > 0 {
+			var names []string
+			for _, strategy := range result.strategies {
+				names = append(names, strategy.name)
+			}
+			provenance += ", discovered by " + strings.Join(names, ", ")
+		}
+		lines = append(lines,
+			"  "+provenance,
+			"  - file: "+yamlQuote(tree.File),
+			"    package: "+yamlQuote(tree.Package),
+		)
+		if tree.Unverified {
+			lines = append(lines, "    unverified: true")
+		}
+		if len(tree.Tests) == 0 {
+			lines = append(lines, "    tests: []")
+		} else {
+			lines = append(lines, "    tests:")
+			lines = appendExportTests(lines, tree.Tests, "      ")
+		}
+
+		tasks := makeGeneratedTasks(result, cfg)
+		if len(tasks) == 0 {
+			lines = append(lines, "    tasks: []")
+			continue
+		}
+		lines = append(lines, "    tasks:")
+		for _, task := range tasks {
+			labels = append(labels, task.Label)
+			lines = append(lines,
+				"      - label: "+yamlQuote(task.Label),
+				"        command: "+yamlQuote(rooted(task.Command)),
+			)
+			if len(task.Args) > 0 {
+				lines = append(lines, "        args:")
+				for _, arg := range task.Args {
+					lines = append(lines, "          - "+yamlQuote(rooted(arg)))
+				}
+			}
+			if task.Cwd != "" {
+				lines = append(lines, "        cwd: "+yamlQuote(rooted(task.Cwd)))
+			}
+			if len(task.Env) > 0 {
+				lines = append(lines, "        env:")
+				for _, key := range slices.Sorted(maps.Keys(task.Env)) {
+					lines = append(lines, "          "+yamlQuote(key)+": "+yamlQuote(rooted(task.Env[key])))
+				}
+			}
+		}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), labels
+}
+
+// appendExportTests appends tests and their subtests as a YAML sequence,
+// each top-level test after a comment with its position.
+func appendExportTests(lines []string, tests []*queryTest, indent string) []string {
+	for _, test := range tests {
+		if test.File != "" && test.Line > 0 {
+			lines = append(lines, fmt.Sprintf("%s# %s:%d", indent, test.File, test.Line))
+		}
+		lines = append(lines,
+			indent+"- name: "+yamlQuote(test.Name),
+			indent+"  kind: "+yamlQuote(test.Kind),
+		)
+		if len(test.Attributes) > 0 {
+			lines = append(lines, indent+"  attributes:")
+			for _, key := range slices.Sorted(maps.Keys(test.Attributes)) {
+				lines = append(lines, indent+"    "+yamlQuote(key)+": "+yamlQuote(test.Attributes[key]))
+			}
+		}
+		if len(test.Subtests) > 0 {
+			lines = append(lines, indent+"  subtests:")
+			lines = appendExportTests(lines, test.Subtests, indent+"    ")
+		}
+	}
+	return lines
+}
+
+// exportStats compares the task labels of data, the previous export, with
+// labels, the ones written now.
+func exportStats(data []byte, labels []string) mergeStats {
+	previous := make(map[string]struct{})
+	for _, line := range strings.Split(string(data), "\n") {
+		quoted, ok := strings.CutPrefix(strings.TrimSpace(line), "- label: ")
+		if !ok {
+			continue
+		}
+		var label string
+		if json.Unmarshal([]byte(quoted), &label) == nil {
+			previous[label] = struct{}{}
+		}
+	}
+	var stats mergeStats
+	for _, label := range labels {
+		if _, ok := previous[label]; ok {
+			delete(previous, label)
+			stats.Updated++
+		} else {
+			stats.Added++
+		}
+	}
+	stats.Removed = len(previous)
+	return stats
+}
+
+func printGenerateSummary(results []discoveryResult, reports []adapterReport, showEditor bool, opts generateOptions) error {
+	if opts.output == "json" {
+		return newGenerateReport(results, reports).print()
+	}
+	for _, report := range reports {
+		fmt.Printf("Updated %s\n", report.path)
+	}
+	for _, result := range results {
+		source := "file"
+		if len(results) > 1 {
+			source = result.relFilePath
+		}
+		if result.unverified {
+			fmt.Printf("Discovered in %s: %d, unverified (%s): %d\n", source, len(result.testsInFile), result.unverifiedReason(), len(result.runnableTests))
+		} else {
+			listed, unverified := 0, 0
+			for _, test := range result.runnableTests {
+				if result.isUnverified(test) {
+					unverified++
+				} else {
+					listed++
+				}
+			}
+			line := fmt.Sprintf("Discovered in %s: %d, runnable with go test -list: %d", source, len(result.testsInFile), listed)
+			if unverified > 0 {
+				line += fmt.Sprintf(", unverified: %d", unverified)
+			}
+			fmt.Println(line)
+		}
+		if opts.autoSubtests && !opts.discoverSubtests {
+			fmt.Printf("Discovered automatically (%s): %d (new: %d)\n", result.autoMode, len(result.discoveredTests), result.discoveredNew)
+		} else if opts.staticSubtests && !opts.discoverSubtests {
+			fmt.Printf("Discovered statically from t.Run calls: %d (new: %d)\n", len(result.discoveredTests), result.discoveredNew)
+		}
+		if opts.discoverSubtests && result.runtimeSkipped != "" {
+			fmt.Printf("Discovered by runtime execution: skipped (%s)\n", result.runtimeSkipped)
+		} else if opts.discoverSubtests {
+			fmt.Printf("Discovered by runtime execution: %d (new: %d, timeout %s)\n", len(result.discoveredTests), result.discoveredNew, result.subtestTimeout)
+			if len(result.skippedTests) > 0 {
+				fmt.Printf("Skipped during discovery: %d\n", len(result.skippedTests))
+			}
+		}
+		for _, strategy := range result.strategies {
+			fmt.Printf("Strategy %s: %d tests (added %d, dropped %d) in %s\n", strategy.name, strategy.tests, len(strategy.added), len(strategy.dropped), strategy.elapsed)
+			if opts.verbose {
+				for _, dropped := range strategy.dropped {
+					fmt.Printf("  dropped %s: %s\n", dropped.name, dropped.reason)
+				}
+			}
+		}
+	}
+	for _, report := range reports {
+		noun := "Tasks"
+		if report.adapter.target == generateTargetDebug {
+			noun = "Debug configs"
+		}
+		suffix := ""
+		if showEditor {
+			suffix = " (" + string(report.adapter.editor) + ")"
+		}
+		kept := ""
+		if report.stats.Kept > 0 {
+			kept = fmt.Sprintf(", kept: %d", report.stats.Kept)
+		}
+		if report.stats.Collapsed > 0 {
+			kept += fmt.Sprintf(", collapsed duplicates: %d", report.stats.Collapsed)
+		}
+		fmt.Printf("%s added: %d, updated: %d, removed: %d%s%s\n", noun, report.stats.Added, report.stats.Updated, report.stats.Removed, kept, suffix)
+		if len(report.stats.Evicted) > 0 {
+			fmt.Printf("Evicted over max_tasks: %s%s\n", strings.Join(report.stats.Evicted, ", "), suffix)
+		}
+	}
+	for _, report := range reports {
+		kind := "task"
+		if report.adapter.target == generateTargetDebug {
+			kind = "debug config"
+		}
+		suffix := ""
+		if showEditor {
+			suffix = " (" + string(report.adapter.editor) + ")"
+		}
+		for _, label := range report.labels(results...) {
+			fmt.Printf("Generated %s: %s%s\n", kind, label, suffix)
+		}
+	}
+	return nil
+}
+
+// generateReport is the summary generate prints with -output json.
+// Durations are in milliseconds.
+type generateReport struct {
+	Files   []generateFileReport   `json:"files"`
+	Outputs []generateOutputReport `json:"outputs"`
+}
+
+// generateFileReport is the discovery of one test file: the tests declared
+// in it, the ones go test -list reported, the subtests found, the tests
+// that got entries and the compile errors of a package that does not
+// build.
+type generateFileReport struct {
+	File        string                   `json:"file"`
+	Package     string                   `json:"package,omitempty"`
+	Unverified  bool                     `json:"unverified,omitempty"`
+	Declared    int                      `json:"declared"`
+	Runnable    int                      `json:"runnable"`
+	Subtests    int                      `json:"subtests"`
+	NewSubtests int                      `json:"newSubtests"`
+	Skipped     int                      `json:"skipped,omitempty"`
+	Tests       []string                 `json:"tests"`
+	Strategies  []generateStrategyReport `json:"strategies"`
+	Diagnostics []discovery.Diagnostic   `json:"diagnostics,omitempty"`
+	DurationMs  float64                  `json:"durationMs"`
+}
+
+type generateStrategyReport struct {
+	Name       string               `json:"name"`
+	Tests      int                  `json:"tests"`
+	Added      []string             `json:"added"`
+	Dropped    []generateDropReport `json:"dropped"`
+	DurationMs float64              `json:"durationMs"`
+}
+
+type generateDropReport struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// generateOutputReport is one file generate wrote, with the merge stats and
+// the labels of the generated entries.
+type generateOutputReport struct {
+	Path       string   `json:"path"`
+	Editor     string   `json:"editor,omitempty"`
+	Target     string   `json:"target"`
+	Added      int      `json:"added"`
+	Updated    int      `json:"updated"`
+	Removed    int      `json:"removed"`
+	Kept       int      `json:"kept"`
+	Collapsed  int      `json:"collapsed"`
+	Evicted    []string `json:"evicted,omitempty"`
+	Labels     []string `json:"labels"`
+	DurationMs float64  `json:"durationMs"`
+}
+
+func newGenerateReport(results []discoveryResult, reports []adapterReport) generateReport {
+	report := generateReport{Files: []generateFileReport{}, Outputs: []generateOutputReport{}}
+	for _, result := range results {
+		file := generateFileReport{
+			File:        result.relFilePath,
+			Package:     result.pkgArg,
+			Unverified:  result.unverified,
+			Declared:    len(result.testsInFile),
+			Runnable:    len(result.runnableTests),
+			Subtests:    len(result.discoveredTests),
+			NewSubtests: result.discoveredNew,
+			Skipped:     len(result.skippedTests),
+			Tests:       append([]string{}, result.selectedTests...),
+			Strategies:  []generateStrategyReport{},
+			Diagnostics: result.diagnostics,
+			DurationMs:  millis(result.elapsed),
+		}
+		for _, strategy := range result.strategies {
+			dropped := make([]generateDropReport, 0, len(strategy.dropped))
+			for _, drop := range strategy.dropped {
+				dropped = append(dropped, generateDropReport{Name: drop.name, Reason: drop.reason})
+			}
+			file.Strategies = append(file.Strategies, generateStrategyReport{
+				Name:       strategy.name,
+				Tests:      strategy.tests,
+				Added:      append([]string{}, strategy.added...),
+				Dropped:    dropped,
+				DurationMs: millis(strategy.elapsed),
+			})
+		}
+		report.Files = append(report.Files, file)
+	}
+	for _, adapterReport := range reports {
+		report.Outputs = append(report.Outputs, generateOutputReport{
+			Path:       adapterReport.path,
+			Editor:     string(adapterReport.adapter.editor),
+			Target:     string(adapterReport.adapter.target),
+			Added:      adapterReport.stats.Added,
+			Updated:    adapterReport.stats.Updated,
+			Removed:    adapterReport.stats.Removed,
+			Kept:       adapterReport.stats.Kept,
+			Collapsed:  adapterReport.stats.Collapsed,
+			Evicted:    adapterReport.stats.Evicted,
+			Labels:     append([]string{}, adapterReport.labels(results...)...),
+			DurationMs: millis(adapterReport.elapsed),
+		})
+	}
+	return report
+}
+
+func (r generateReport) print() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("serialize generate JSON: %w", err)
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
+
+// labels are the labels of the entries the report's adapter generated.
+func (r adapterReport) labels(results ...discoveryResult) []string {
+	var labels []string
+	for _, result := range results {
+		renderer := newLabelRenderer(r.adapter.labelPrefix, r.adapter.labelTmpl, result)
+		if r.adapter.target == generateTargetTasks {
+			for _, spec := range result.taskSpecs() {
+				labels = append(labels, spec.label(renderer))
+			}
+			continue
+		}
+		for _, testName := range result.selectedTests {
+			labels = append(labels, renderer.label(testName))
+		}
+	}
+	return labels
+}
+
+func parseGenerateTargets(value string) ([]generateTarget, error) {
+	seen := make(map[generateTarget]struct{})
+	var targets []generateTarget
+	for _, part := range strings.Split(value, ",") {
+		normalized := strings.ToLower(strings.TrimSpace(part))
+		var target generateTarget
+		switch normalized {
+		case "":
+			continue
+		case string(generateTargetTasks):
+			target = generateTargetTasks
+		case string(generateTargetDebug):
+			target = generateTargetDebug
+		default:
+			return nil, fmt.Errorf("unsupported target %q (expected tasks or debug)", part)
+		}
+		if _, ok := seen[target]; ok {
+			continue
+		}
+		seen[target] = struct{}{}
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("at least one target is required (tasks, debug)")
+	}
+	return targets, nil
+}
+
+func runClear(args []string) error {
+	return clearGenerated("clear", args)
+}
+
+// runPrune removes generated tasks that are older than -older-than and
+// whose test is gone, without rescanning the workspace.
+func runPrune(args []string) error {
+	return clearGenerated("prune", args)
+}
+
+func clearGenerated(command string, args []string) error {
+	var opts commonOptions
+	var matchArg, pkgArg, fileArg, olderThanArg, outputFormat string
+	editorArg := string(editorKindZed)
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.StringVar(&opts.tasksPathArg, "tasks", "", "Override tasks JSON path.")
+	fs.StringVar(&opts.debugPathArg, "debug", "", "Override debug JSON path.")
+	fs.StringVar(&editorArg, "editor", editorArg, "Editor target. Supported: zed, vscode.")
+	fs.StringVar(&opts.outPath, "out", "", "Write the resulting JSON to this path instead of the tasks file (- for stdout).")
+	fs.StringVar(&matchArg, "match", "", "Only remove generated tasks whose label matches this regex.")
+	fs.StringVar(&pkgArg, "pkg", "", "Only remove generated tasks for this package directory, relative to the current directory as for -file.")
+	fs.StringVar(&fileArg, "file", "", "Only remove generated tasks generated from this Go file, relative to the current directory as for generate.")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "List the tasks that would be removed, and why, instead of writing the file.")
+	fs.StringVar(&outputFormat, "output", "", "Print the removed tasks and reasons in this format instead of a summary. Supported: json.")
+	fs.BoolVar(&opts.force, "force", false, "Also remove entries with the generated marker that do not run go.")
+	fs.StringVar(&olderThanArg, "older-than", "", "Only remove generated tasks last generated longer ago than this (e.g. 30d, 2w, 12h) whose test file no longer declares their test.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if command == "prune" && olderThanArg == "" {
+		return fmt.Errorf("missing required flag: -older-than")
+	}
+	if outputFormat != "" && outputFormat != "json" {
+		return fmt.Errorf("unsupported -output %q (expected json)", outputFormat)
+	}
+	editor, err := parseEditorKind(editorArg)
+	if err != nil {
+		return err
+	}
+	opts.editor = editor
+
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+	defer cfg.KeptForeign.warn(cfg)
+
+	filter, err := newClearFilter(absRootPath, matchArg, pkgArg, fileArg)
+	if err != nil {
+		return err
+	}
+
+	tasksAbsPath := resolvePath(absRootPath, cfg.TasksPath)
+	var times generatedTimes
+	if olderThanArg != "" {
+		age, err := parseAge(olderThanArg)
+		if err != nil {
+			return fmt.Errorf("invalid -older-than %q: %w", olderThanArg, err)
+		}
+		if times, err = readGeneratedTimes(absRootPath); err != nil {
+			return err
+		}
+		nameFilter, err := cfg.testNameFilter()
+		if err != nil {
+			return err
+		}
+		filter.age = &ageFilter{
+			olderThan:   olderThanArg,
+			cutoff:      time.Now().Add(-age),
+			times:       times[times.key(absRootPath, tasksAbsPath)],
+			absRootPath: absRootPath,
+			nameFilter:  nameFilter,
+		}
+	}
+	var removals []clearRemoval
+	var output []byte
+	if opts.editor == editorKindVSCode {
+		doc, existing, err := readVSCodeTasksDocument(tasksAbsPath)
+		if err != nil {
+			return fmt.Errorf("read tasks %q: %w", tasksAbsPath, err)
+		}
+		var filtered []map[string]any
+		filtered, removals = filter.apply(existing, cfg)
+		doc["tasks"] = filtered
+		output, err = marshalDocument(doc)
+		if err != nil {
+			return err
+		}
+	} else {
+		existing, err := tasks.ReadArray(tasksAbsPath)
+		if err != nil {
+			return fmt.Errorf("read tasks %q: %w", tasksAbsPath, err)
+		}
+		var filtered []map[string]any
+		filtered, removals = filter.apply(existing, cfg)
+		output, err = marshalTasks(filtered)
+		if err != nil {
+			return err
+		}
+	}
+
+	destination := tasksAbsPath
+	if opts.outPath != "" {
+		destination = resolveOutPath(opts.outPath)
+	}
+	if destination == "-" {
+		_, _ = os.Stdout.Write(output)
+		return nil
+	}
+	report := clearReport{Path: destination, DryRun: opts.dryRun, Removed: removals}
+	if opts.dryRun {
+		return report.print(outputFormat)
+	}
+
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return err
+	}
+	if err := writeTasks(destination, output, modes); err != nil {
+		return fmt.Errorf("write tasks file: %w", err)
+	}
+	if times != nil && destination == tasksAbsPath {
+		removedLabels := make([]string, 0, len(removals))
+		for _, removal := range removals {
+			removedLabels = append(removedLabels, removal.Label)
+		}
+		times.forget(absRootPath, tasksAbsPath, removedLabels)
+		var tx fileTransaction
+		defer tx.rollback()
+		times.stage(absRootPath, &tx, modes)
+		if err := tx.commit(); err != nil {
+			return err
+		}
+	}
+
+	return report.print(outputFormat)
+}
+
+// clearRemoval is one task clear or prune removes, and why.
+type clearRemoval struct {
+	Label   string   `json:"label"`
+	Reasons []string `json:"reasons"`
+}
+
+// clearReport is what clear and prune print: the removed tasks, or with
+// -dry-run the ones they would remove.
+type clearReport struct {
+	Path    string         `json:"path"`
+	DryRun  bool           `json:"dryRun"`
+	Removed []clearRemoval `json:"removed"`
+}
+
+func (r clearReport) print(format string) error {
+	if format == "json" {
+		if r.Removed == nil {
+			r.Removed = []clearRemoval{}
+		}
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return fmt.Errorf("serialize clear JSON: %w", err)
+		}
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	if !r.DryRun {
+		fmt.Printf("Updated %s\n", r.Path)
+		fmt.Printf("Removed generated tasks: %d\n", len(r.Removed))
+		return nil
+	}
+	fmt.Printf("Would remove %d generated tasks from %s\n", len(r.Removed), r.Path)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, removal := range r.Removed {
+		_, _ = fmt.Fprintf(w, "  %s\t%s\n", removal.Label, strings.Join(removal.Reasons, "; "))
+	}
+	return w.Flush()
+}
+
+// apply splits entries into the ones to keep and the generated entries
+// the filter removes, with the reasons for each.
+func (f clearFilter) apply(entries []map[string]any, cfg Config) ([]map[string]any, []clearRemoval) {
+	kept := make([]map[string]any, 0, len(entries))
+	var removals []clearRemoval
+	owns := cfg.entryOwner()
+	for _, entry := range entries {
+		if !isGenerated(entry, cfg) {
+			kept = append(kept, entry)
+			continue
+		}
+		reasons, ok := f.explain(entry)
+		label, _ := entryLabel(entry)
+		owned := owns(entry)
+		if ok && cfg.keepsForeign(owned) {
+			cfg.KeptForeign.add(label)
+			ok = false
+		}
+		if !ok {
+			kept = append(kept, entry)
+			continue
+		}
+		reasons = append([]string{fmt.Sprintf("generated marker %s=%s", cfg.GeneratedEnvKey, cfg.GeneratedEnvValue)}, reasons...)
+		if !owned {
+			reasons = append(reasons, "does not run go (-force)")
+		}
+		removals = append(removals, clearRemoval{Label: label, Reasons: reasons})
+	}
+	return kept, removals
+}
+
+// clearFilter narrows clear to a subset of generated entries. Empty fields
+// match everything.
+type clearFilter struct {
+	labelPattern *regexp.Regexp
+	pkgArg       string
+	relFilePath  string
+	age          *ageFilter
+}
+
+// ageFilter matches generated entries last generated before cutoff whose
+// test is no longer declared in the file they were generated from. An
+// entry without a recorded time counts as old. Entries that name no test
+// file, such as group tasks, never match.
+type ageFilter struct {
+	olderThan   string
+	cutoff      time.Time
+	times       map[string]time.Time
+	absRootPath string
+	nameFilter  testNameFilter
+}
+
+func (f ageFilter) explain(entry map[string]any) ([]string, bool) {
+	label, _ := entryLabel(entry)
+	age := "no recorded generation time"
+	if generated, ok := f.times[label]; ok {
+		if generated.After(f.cutoff) {
+			return nil, false
+		}
+		age = fmt.Sprintf("last generated %s, over %s ago", generated.Local().Format(time.DateOnly), f.olderThan)
+	}
+	env := tasks.EnvOf(entry)
+	file, hasFile := tasks.EnvValue(env, testFileEnvKey)
+	test, hasTest := tasks.EnvValue(env, testNameEnvKey)
+	if !hasFile || !hasTest || file == "" || test == "" {
+		return nil, false
+	}
+	topLevel, _, _ := strings.Cut(test, "/")
+	decls, err := findTestDeclsInFile(resolvePath(f.absRootPath, file), f.nameFilter)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return []string{age, file + " is gone"}, true
+	case err != nil:
+		// An unparsable file no longer declares the test either.
+		return []string{age, file + " does not parse"}, true
+	case slices.ContainsFunc(decls, func(decl testDecl) bool { return decl.name == topLevel }):
+		return nil, false
+	}
+	return []string{age, topLevel + " is no longer declared in " + file}, true
+}
+
+// parseAge parses a time.ParseDuration value, or a whole number of days
+// or weeks such as 30d or 2w.
+func parseAge(value string) (time.Duration, error) {
+	units := []struct {
+		suffix, name string
+		unit         time.Duration
+	}{{"d", "days", 24 * time.Hour}, {"w", "weeks", 7 * 24 * time.Hour}}
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			n, err := strconv.Atoi(number)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("expected a whole number of %s", unit.name)
+			}
+			return time.Duration(n) * unit.unit, nil
+		}
+	}
+	age, err := time.ParseDuration(value)
+	if err == nil && age < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return age, err
+}
+
+// newClearFilter builds the clear filters. Like generate -file, pkg and file
+// are relative to the current directory, not to the workspace root.
+func newClearFilter(absRootPath, match, pkg, file string) (clearFilter, error) {
+	var filter clearFilter
+	if match != "" {
+		pattern, err := regexp.Compile(match)
+		if err != nil {
+			return clearFilter{}, fmt.Errorf("invalid -match regex %q: %w", match, err)
+		}
+		filter.labelPattern = pattern
+	}
+	if pkg != "" {
+		absPkg, err := filepath.Abs(pkg)
+		if err != nil {
+			return clearFilter{}, fmt.Errorf("resolve package path: %w", err)
+		}
+		filter.pkgArg, err = packageArg(absRootPath, absPkg)
+		if err != nil {
+			return clearFilter{}, fmt.Errorf("build package argument: %w", err)
+		}
+	}
+	if file != "" {
+		absFile, err := filepath.Abs(file)
+		if err != nil {
+			return clearFilter{}, fmt.Errorf("resolve file path: %w", err)
+		}
+		filter.relFilePath = absFile
+		if rel, relErr := rootRelPath(absRootPath, absFile); relErr == nil {
+			filter.relFilePath = filepath.ToSlash(rel)
+		}
+	}
+	return filter, nil
+}
+
+// explain reports whether entry passes every filter, and the reason each
+// set filter gives.
+func (f clearFilter) explain(entry map[string]any) ([]string, bool) {
+	var reasons []string
+	if f.labelPattern != nil {
+		label, _ := entryLabel(entry)
+		if !f.labelPattern.MatchString(label) {
+			return nil, false
+		}
+		reasons = append(reasons, "label matches -match "+f.labelPattern.String())
+	}
+	if f.pkgArg != "" {
+		if entryPackageArg(entry) != f.pkgArg {
+			return nil, false
+		}
+		reasons = append(reasons, "package "+f.pkgArg)
+	}
+	if f.relFilePath != "" {
+		file, _ := tasks.EnvValue(tasks.EnvOf(entry), testFileEnvKey)
+		if file != f.relFilePath {
+			return nil, false
+		}
+		reasons = append(reasons, "generated from "+f.relFilePath)
+	}
+	if f.age != nil {
+		ageReasons, ok := f.age.explain(entry)
+		if !ok {
+			return nil, false
+		}
+		reasons = append(reasons, ageReasons...)
+	}
+	return reasons, true
+}
+
+func entryLabel(entry map[string]any) (string, bool) {
+	if label, ok := entry["label"].(string); ok {
+		return label, true
+	}
+	label, ok := entry["name"].(string)
+	return label, ok
+}
+
+// entryPackageArg reports the package a generated entry targets. Entries
+// written before the package env key existed fall back to their args.
+func entryPackageArg(entry map[string]any) string {
+	if pkg, ok := tasks.EnvValue(tasks.EnvOf(entry), packageEnvKey); ok {
+		return pkg
+	}
+	if program, ok := entry["program"].(string); ok {
+		return program
+	}
+	args, _ := entry["args"].([]any)
+	for i, arg := range args {
+		if arg == "-run" && i > 0 {
+			pkg, _ := args[i-1].(string)
+			return pkg
+		}
+	}
+	return ""
+}
+
+func runList(args []string) error {
+	var opts commonOptions
+	var staleOnly bool
+	editorArg := string(editorKindZed)
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.StringVar(&opts.tasksPathArg, "tasks", "", "Override tasks JSON path.")
+	fs.StringVar(&opts.debugPathArg, "debug", "", "Override debug JSON path.")
+	fs.StringVar(&editorArg, "editor", editorArg, "Editor target. Supported: zed, vscode.")
+	fs.BoolVar(&staleOnly, "stale", false, "Only list entries whose source file no longer exists.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	editor, err := parseEditorKind(editorArg)
+	if err != nil {
+		return err
+	}
+	opts.editor = editor
+
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	groups, err := collectProvenance(editor, cfg, absRootPath)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if staleOnly && !group.missing {
+			continue
+		}
+		status := ""
+		if group.missing {
+			status = " (missing)"
+		}
+		fmt.Printf("%s%s: %d tasks, %d debug configs\n", group.file, status, len(group.tasks), len(group.debugConfigs))
+		for _, label := range group.tasks {
+			fmt.Printf("  %s\n", label)
+		}
+		for _, label := range group.debugConfigs {
+			fmt.Printf("  %s\n", label)
+		}
+	}
+	return nil
+}
+
+// runDoctor prints the Go environment tasks are generated for and how it
+// differs from the one recorded by the last generate run.
+func runDoctor(args []string) error {
+	var opts commonOptions
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+	current, err := currentEnvFingerprint(cfg, absRootPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Workspace: %s\n", absRootPath)
+	fmt.Printf("Go:        %s (%s)\n", current.GoVersion, cfg.GoBinary)
+	fmt.Printf("Platform:  %s/%s\n", current.GOOS, current.GOARCH)
+	fmt.Printf("Cgo:       CGO_ENABLED=%s CC=%s\n", current.CgoEnabled, current.CC)
+	if missing := cfg.toolchain().missing(); len(missing) > 0 {
+		fmt.Printf("Missing:   %s\n", strings.Join(missing, ", "))
+	}
+
+	statePath := filepath.Join(absRootPath, envFingerprintPath)
+	recorded, err := readEnvFingerprint(statePath)
+	if err != nil {
+		return err
+	}
+	if recorded == nil {
+		fmt.Println("No environment recorded yet; it is saved by the next generate.")
+		return nil
+	}
+	fmt.Printf("Recorded:  %s\n", recorded.Generated.Format(time.RFC3339))
+	changes := recorded.invalidatingChanges(current)
+	if len(changes) == 0 {
+		fmt.Println("Generated entries match the current environment.")
+		return nil
+	}
+	fmt.Println("Environment changed since the last generate; regenerate tasks for:")
+	for _, change := range changes {
+		fmt.Printf("  %s\n", change)
+	}
+	return nil
+}
+
+// runStats prints a per-package inventory of the workspace: the tests the
+// discovery pipeline keeps for each test file, the benchmarks, fuzz targets
+// and examples declared next to them, and the generated entries that exist.
+func runStats(args []string) error {
+	var opts generateOptions
+	output := "table"
+	editorArg := string(editorKindZed)
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.StringVar(&opts.tasksPathArg, "tasks", "", "Override tasks JSON path.")
+	fs.StringVar(&opts.debugPathArg, "debug", "", "Override debug JSON path.")
+	fs.StringVar(&editorArg, "editor", editorArg, "Editor target. Supported: zed, vscode.")
+	fs.Var(&opts.buildFlags, "build-flag", "Go build flag (repeatable). Example: -build-flag=-tags=integration")
+	fs.BoolVar(&opts.discoverSubtests, "discover-subtests", false, "Run tests with go test -json to count subtests.")
+	fs.BoolVar(&opts.staticSubtests, "static-subtests", false, "Count subtests run with a literal name without running the tests.")
+	fs.BoolVar(&opts.autoSubtests, "auto-subtests", false, "Count subtests statically, running only the tests of packages whose tests last ran under AUTO_SUBTESTS_MAX_DURATION.")
+	fs.StringVar(&output, "output", output, "Output format. Supported: table, json.")
+	fs.BoolVar(&opts.offline, "offline", false, "Disable all network access, e.g. an HTTP DISCOVERY_CACHE (same as OFFLINE=true).")
+	fs.BoolVar(&opts.includeGenerated, "include-generated", false, "Also count tests in machine-generated test files (see SKIP_GENERATED_FILES).")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unsupported -output %q (expected table or json)", output)
+	}
+	editor, err := parseEditorKind(editorArg)
+	if err != nil {
+		return err
+	}
+	opts.editor = editor
+
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+	cfg, err := loadConfig(opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	inventory, err := collectStats(opts, cfg, absRootPath)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		data, err := json.MarshalIndent(inventory, "", "  ")
+		if err != nil {
+			return fmt.Errorf("serialize stats JSON: %w", err)
+		}
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(w, "PACKAGE\tFILES\tTESTS\tSUBTESTS\tBENCHMARKS\tFUZZ\tEXAMPLES\tTASKS\tDEBUG\t")
+	for _, row := range append(inventory.Packages, inventory.Total) {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n",
+			row.Package, row.Files, row.Tests, row.Subtests, row.Benchmarks, row.Fuzz, row.Examples, row.Tasks, row.DebugConfigs)
+	}
+	return w.Flush()
+}
+
+// statsOutput is the inventory stats prints.
+type statsOutput struct {
+	Packages []packageStats `json:"packages"`
+	Total    packageStats   `json:"total"`
+}
+
+// packageStats counts what one package has. Subtests are only counted
+// with -discover-subtests.
+type packageStats struct {
+	Package      string `json:"package"`
+	Files        int    `json:"files"`
+	Tests        int    `json:"tests"`
+	Subtests     int    `json:"subtests"`
+	Benchmarks   int    `json:"benchmarks"`
+	Fuzz         int    `json:"fuzz"`
+	Examples     int    `json:"examples"`
+	Tasks        int    `json:"tasks"`
+	DebugConfigs int    `json:"debugConfigs"`
+}
+
+func (p *packageStats) add(other packageStats) {
+	p.Files += other.Files
+	p.Tests += other.Tests
+	p.Subtests += other.Subtests
+	p.Benchmarks += other.Benchmarks
+	p.Fuzz += other.Fuzz
+	p.Examples += other.Examples
+	p.Tasks += other.Tasks
+	p.DebugConfigs += other.DebugConfigs
+}
+
+// statsDeclPattern matches every kind of test function, whatever the name
+// regexes select for generation.
+var statsDeclPattern = regexp.MustCompile(`^(Test|Benchmark|Fuzz|Example)`)
+
+func collectStats(opts generateOptions, cfg Config, absRootPath string) (statsOutput, error) {
+	packages := make(map[string]*packageStats)
+	stats := func(pkg string) *packageStats {
+		if packages[pkg] == nil {
+			packages[pkg] = &packageStats{Package: pkg}
+		}
+		return packages[pkg]
+	}
+
+	buildFlags, goTestFlags := opts.resolveGoArgs(cfg, nil)
+	err := cfg.walkAuthoredTestFiles(absRootPath, func(path string) error {
+		pkg, err := packageArg(absRootPath, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		row := stats(pkg)
+		row.Files++
+		decls, err := findTestDeclsInFile(path, statsDeclPattern)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: skipping %s: %v\n", path, err)
+			return nil
+		}
+		for _, decl := range decls {
+			switch discovery.Kind(decl.name) {
+			case "benchmark":
+				row.Benchmarks++
+			case "fuzz":
+				row.Fuzz++
+			case "example":
+				row.Examples++
+			}
+		}
+
+		fileOpts := opts
+		fileOpts.goFilePath = path
+		fileOpts.counting = true
+		result, err := discoverTests(fileOpts, cfg, absRootPath, path, buildFlags, goTestFlags, fileOpts.allTestBinaryArgs(cfg))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: discover %s: %v\n", path, err)
+			return nil
+		}
+		for _, test := range result.selectedTests {
+			switch {
+			case strings.Contains(test, "/"):
+				row.Subtests++
+			case discovery.Kind(test) == "test":
+				row.Tests++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return statsOutput{}, err
+	}
+
+	for _, target := range []generateTarget{generateTargetTasks, generateTargetDebug} {
+		entries, err := readEditorEntries(opts.editor, target, cfg, absRootPath)
+		if err != nil {
+			return statsOutput{}, err
+		}
+		for _, entry := range entries {
+			pkg, ok := tasks.EnvValue(tasks.EnvOf(entry), packageEnvKey)
+			if !ok || !isGenerated(entry, cfg) {
+				continue
+			}
+			if target == generateTargetTasks {
+				stats(pkg).Tasks++
+			} else {
+				stats(pkg).DebugConfigs++
+			}
+		}
+	}
+
+	out := statsOutput{Packages: []packageStats{}, Total: packageStats{Package: "total"}}
+	for _, pkg := range slices.Sorted(maps.Keys(packages)) {
+		out.Packages = append(out.Packages, *packages[pkg])
+		out.Total.add(*packages[pkg])
+	}
+	return out, nil
+}
+
+// runMetrics summarizes the timings generate recorded with METRICS=true.
+func runMetrics(args []string) error {
+	var opts commonOptions
+	output := "table"
+	var clear bool
+	fs := flag.NewFlagSet("metrics", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.StringVar(&output, "output", output, "Output format. Supported: table, json.")
+	fs.BoolVar(&clear, "clear", false, "Delete the recorded metrics.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unsupported -output %q (expected table or json)", output)
+	}
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+	path, err := cfg.metricsPath()
+	if err != nil {
+		return err
+	}
+	if clear {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("clear metrics: %w", err)
+		}
+		fmt.Printf("Removed %s\n", path)
+		return nil
+	}
+	records, err := readMetrics(path)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 && !cfg.Metrics {
+		_, _ = fmt.Fprintf(os.Stderr, "note: no metrics recorded; set %sMETRICS=true to record generate timings in %s\n", envPrefix, path)
+	}
+	summary := summarizeMetrics(records)
+
+	if output == "json" {
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return fmt.Errorf("serialize metrics JSON: %w", err)
+		}
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	fmt.Printf("Runs: %d (%s)\n", summary.Runs, path)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(w, "PHASE\tRUNS\tP50\tP95\t")
+	for _, row := range summary.Phases {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%s\t\n", row.Name, row.Runs, formatMillis(row.P50), formatMillis(row.P95))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(summary.Settings) == 0 {
+		return nil
+	}
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(w, "SETTINGS\tRUNS\tP50\tP95\t")
+	for _, row := range summary.Settings {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%s\t\n", row.Name, row.Runs, formatMillis(row.P50), formatMillis(row.P95))
+	}
+	return w.Flush()
+}
+
+// maxMetricsRecords caps the metrics file; older runs are dropped first.
+const maxMetricsRecords = 1000
+
+// Phases of a generate run. Discovery has a sub-phase per strategy, e.g.
+// discovery/go-list.
+const (
+	metricsPhaseDiscovery = "discovery"
+	metricsPhaseWrite     = "write"
+	metricsPhaseTotal     = "total"
+)
+
+// metricsRecord is one generate run. It holds durations, counts and the
+// settings that affect them, and nothing that names the workspace, its
+// files or its tests.
+type metricsRecord struct {
+	Time     time.Time          `json:"time"`
+	Phases   map[string]float64 `json:"phases"`
+	Tests    int                `json:"tests"`
+	Settings map[string]string  `json:"settings,omitempty"`
+}
+
+// metricsSummary is what metrics prints. Durations are in milliseconds.
+type metricsSummary struct {
+	Runs     int            `json:"runs"`
+	Phases   []metricsQuant `json:"phases"`
+	Settings []metricsQuant `json:"settings,omitempty"`
+}
+
+type metricsQuant struct {
+	Name string  `json:"name"`
+	Runs int     `json:"runs"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+}
+
+// metricsPath is METRICS_PATH, or metrics.jsonl in this tool's user state
+// directory, shared by every workspace.
+func (c Config) metricsPath() (string, error) {
+	if c.MetricsPath != "" {
+		return c.MetricsPath, nil
+	}
+	base, err := userStateDir()
+	if err != nil {
+		return "", fmt.Errorf("resolve metrics path: %w", err)
+	}
+	return filepath.Join(base, "go-zed-tasks", "metrics.jsonl"), nil
+}
+
+// metricsSettings are the config values that change how long generate
+// takes, keyed by their env names without the prefix. The cache setting
+// notes whether this run hit it.
+func (c Config) metricsSettings(opts generateOptions, result discoveryResult) map[string]string {
+	strategies := make([]string, 0, len(result.strategies))
+	for _, strategy := range result.strategies {
+		strategies = append(strategies, strategy.name)
+	}
+	settings := map[string]string{"DISCOVERY_STRATEGIES": strings.Join(strategies, ",")}
+	if slices.Contains(strategies, discovererRuntime) {
+		settings["DISCOVERY_CACHE"] = "off"
+		if c.DiscoveryCache != "" && !opts.noDiscoveryCache {
+			settings["DISCOVERY_CACHE"] = c.DiscoveryCacheMode
+		}
+		if result.discoveryCache != "" {
+			settings["DISCOVERY_CACHE"] += " (" + result.discoveryCache + ")"
+		}
+	}
+	if c.DiscoveryProcs > 0 {
+		settings["DISCOVERY_PROCS"] = strconv.Itoa(c.DiscoveryProcs)
+	}
+	if c.DiscoveryGomaxprocs > 0 {
+		settings["DISCOVERY_GOMAXPROCS"] = strconv.Itoa(c.DiscoveryGomaxprocs)
+	}
+	return settings
+}
+
+// recordMetrics appends record to the metrics file, keeping the newest
+// maxMetricsRecords runs. Failing to record only warns.
+func recordMetrics(cfg Config, record metricsRecord) {
+	path, err := cfg.metricsPath()
+	if err == nil {
+		err = appendMetrics(path, record)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: record metrics: %v\n", err)
+	}
+}
+
+func appendMetrics(path string, record metricsRecord) error {
+	records, err := readMetrics(path)
+	if err != nil {
+		return err
+	}
+	records = append(records, record)
+	if len(records) > maxMetricsRecords {
+		records = records[len(records)-maxMetricsRecords:]
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	var tx fileTransaction
+	defer tx.rollback()
+	if err := tx.stage(path, buf.Bytes(), fileModes{file: 0o600, dir: 0o700}); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// readMetrics reads the metrics file, skipping lines it cannot decode.
+// A missing file has no records.
+func readMetrics(path string) ([]metricsRecord, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read metrics: %w", err)
+	}
+	var records []metricsRecord
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var record metricsRecord
+		if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &record) != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// summarizeMetrics computes P50 and P95 per phase, and of the total per
+// distinct combination of settings, so runs with and without a cache or
+// parallelism setting can be compared.
+func summarizeMetrics(records []metricsRecord) metricsSummary {
+	phases := make(map[string][]float64)
+	settings := make(map[string][]float64)
+	for _, record := range records {
+		for name, ms := range record.Phases {
+			phases[name] = append(phases[name], ms)
+		}
+		if total, ok := record.Phases[metricsPhaseTotal]; ok {
+			key := describeMetricsSettings(record.Settings)
+			settings[key] = append(settings[key], total)
+		}
+	}
+	summary := metricsSummary{Runs: len(records)}
+	for _, name := range slices.Sorted(maps.Keys(phases)) {
+		summary.Phases = append(summary.Phases, quantiles(name, phases[name]))
+	}
+	if len(settings) > 1 {
+		for _, name := range slices.Sorted(maps.Keys(settings)) {
+			summary.Settings = append(summary.Settings, quantiles(name, settings[name]))
+		}
+	}
+	return summary
+}
+
+func describeMetricsSettings(settings map[string]string) string {
+	parts := make([]string, 0, len(settings))
+	for _, key := range slices.Sorted(maps.Keys(settings)) {
+		parts = append(parts, key+"="+settings[key])
+	}
+	return strings.Join(parts, " ")
+}
+
+// quantiles uses the nearest-rank method, so P50 and P95 are durations
+// that were actually measured.
+func quantiles(name string, values []float64) metricsQuant {
+	sorted := slices.Sorted(slices.Values(values))
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return sorted[max(i, 0)]
+	}
+	return metricsQuant{Name: name, Runs: len(sorted), P50: rank(0.50), P95: rank(0.95)}
+}
+
+func formatMillis(ms float64) string {
+	return time.Duration(ms * float64(time.Millisecond)).Round(10 * time.Microsecond).String()
+}
+
+// millis is d in fractional milliseconds, the unit of the metrics file.
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// runLogs prints the log a TASK_LOGS task wrote for a label, or lists the
+// labels that have one.
+func runLogs(args []string) error {
+	var opts commonOptions
+	var lines, previous int
+	var follow bool
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.IntVar(&lines, "lines", 0, "Print only the last N lines (0 prints the whole log).")
+	fs.IntVar(&previous, "previous", 0, "Print the log of an earlier run: 1 is the run before the last one.")
+	fs.BoolVar(&follow, "follow", false, "Keep printing output as the task writes it, until interrupted.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("logs takes one task label")
+	}
+	if lines < 0 || previous < 0 {
+		return fmt.Errorf("-lines and -previous must not be negative")
+	}
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(absRootPath, filepath.FromSlash(taskLogDir))
+	if fs.NArg() == 0 {
+		return listTaskLogs(dir)
+	}
+
+	label := fs.Arg(0)
+	path := filepath.Join(dir, tasks.LogFile(label))
+	if previous > 0 {
+		path += "." + strconv.Itoa(previous)
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no log for %q in %s; generate with TASK_LOGS=true and run the task first", label, dir)
+	}
+	if err != nil {
+		return fmt.Errorf("read log: %w", err)
+	}
+	if _, err := os.Stdout.Write(lastLines(data, lines)); err != nil {
+		return err
+	}
+	if follow {
+		return followLog(path, int64(len(data)))
+	}
+	return nil
+}
+
+// listTaskLogs prints the labels with a log, as their file names, and when
+// each was last written.
+func listTaskLogs(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read log directory: %w", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	found := false
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".log")
+		info, err := entry.Info()
+		if !ok || err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		found = true
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d bytes\n", name, info.ModTime().Format(time.DateTime), info.Size())
+	}
+	if !found {
+		fmt.Printf("No task logs in %s\n", dir)
+	}
+	return w.Flush()
+}
+
+// lastLines is the last n lines of data, or all of it when n is 0.
+func lastLines(data []byte, n int) []byte {
+	if n == 0 {
+		return data
+	}
+	end := len(bytes.TrimSuffix(data, []byte("\n")))
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			n--
+			if n == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+	return data
+}
+
+// followLog polls path and prints what is written after offset. A new run
+// of the task rotates the log, so a file shorter than offset is printed
+// again from the start.
+func followLog(path string, offset int64) error {
+	for {
+		time.Sleep(500 * time.Millisecond)
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err == nil && info.Size() < offset {
+			offset = 0
+		}
+		if err == nil && info.Size() > offset {
+			_, err = file.Seek(offset, io.SeekStart)
+			var n int64
+			if err == nil {
+				n, err = io.Copy(os.Stdout, file)
+			}
+			offset += n
+		}
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// generatedTimesPath records when generate last wrote each label.
+const generatedTimesPath = stateDirPath + "generated.json"
+
+// generatedTimes maps a tasks or debug file, relative to the workspace
+// root, to the time each of its generated labels was last written.
+type generatedTimes map[string]map[string]time.Time
+
+func readGeneratedTimes(absRootPath string) (generatedTimes, error) {
+	times := generatedTimes{}
+	data, err := os.ReadFile(filepath.Join(absRootPath, generatedTimesPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return times, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read generation times: %w", err)
+	}
+	if err := json.Unmarshal(data, &times); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", generatedTimesPath, err)
+	}
+	return times, nil
+}
+
+// key is the root-relative slash path of the file at absPath.
+func (g generatedTimes) key(absRootPath, absPath string) string {
+	if rel, err := filepath.Rel(absRootPath, absPath); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(absPath)
+}
+
+func (g generatedTimes) touch(absRootPath, absPath string, labels []string, now time.Time) {
+	key := g.key(absRootPath, absPath)
+	if g[key] == nil {
+		g[key] = make(map[string]time.Time)
+	}
+	for _, label := range labels {
+		g[key][label] = now
+	}
+}
+
+func (g generatedTimes) forget(absRootPath, absPath string, labels []string) {
+	key := g.key(absRootPath, absPath)
+	for _, label := range labels {
+		delete(g[key], label)
+	}
+}
+
+// stage adds the generation times to tx. Failing to record them only
+// warns, since they only matter to prune.
+func (g generatedTimes) stage(absRootPath string, tx *fileTransaction, modes fileModes) {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err == nil {
+		err = tx.stage(filepath.Join(absRootPath, generatedTimesPath), append(data, '\n'), modes)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: record generation times: %v\n", err)
+	}
+}
+
+// taskBudget returns what MAX_TASKS eviction from the tasks file at path
+// needs: the labels it must keep, the ones just generated and the
+// ALL_GENERATED_TASK aggregate, and when a label was last used. That is
+// when it was last generated, or with MAX_TASKS_EVICTION=run when its
+// TASK_LOGS log was last written, if later. Labels with neither are the
+// oldest.
+func (c Config) taskBudget(absRootPath, path string, generated []string) (map[string]struct{}, func(label string) time.Time) {
+	keep := make(map[string]struct{}, len(generated)+1)
+	for _, label := range generated {
+		keep[label] = struct{}{}
+	}
+	if c.AllGeneratedTask {
+		keep[c.LabelPrefix+allGeneratedTaskName] = struct{}{}
+	}
+	times, err := readGeneratedTimes(absRootPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	generatedAt := times[times.key(absRootPath, path)]
+	logDir := filepath.Join(absRootPath, filepath.FromSlash(taskLogDir))
+	return keep, func(label string) time.Time {
+		used := generatedAt[label]
+		if c.MaxTasksEviction == evictionRun {
+			if info, err := os.Stat(filepath.Join(logDir, tasks.LogFile(label))); err == nil && info.ModTime().After(used) {
+				used = info.ModTime()
+			}
+		}
+		return used
+	}
+}
+
+// evictVSCodeTasks is File.Evict for VS Code tasks: it drops the generated
+// tasks over MAX_TASKS and returns the others and the dropped labels.
+func evictVSCodeTasks(entries []map[string]any, cfg Config, keep map[string]struct{}, lastUsed func(label string) time.Time) ([]map[string]any, []string) {
+	var labels []string
+	evictable := make(map[string]bool)
+	owns := cfg.entryOwner()
+	for _, entry := range entries {
+		label, ok := entryLabel(entry)
+		if !ok || !isGenerated(entry, cfg) {
+			continue
+		}
+		labels = append(labels, label)
+		_, kept := keep[label]
+		evictable[label] = owns(entry) && !kept
+	}
+	evicted := tasks.OverBudget(labels, cfg.MaxTasks, func(label string) bool { return evictable[label] }, lastUsed)
+	return slices.DeleteFunc(entries, func(entry map[string]any) bool {
+		label, _ := entryLabel(entry)
+		return isGenerated(entry, cfg) && slices.Contains(evicted, label)
+	}), evicted
+}
+
+// keymapSpawnAction is the Zed action keymap bindings use to run a task.
+const keymapSpawnAction = "task::Spawn"
+
+// recentLabels returns the n labels generated last, newest first.
+func recentLabels(times map[string]time.Time, n int) []string {
+	labels := slices.Collect(maps.Keys(times))
+	slices.SortFunc(labels, func(a, b string) int {
+		if c := times[b].Compare(times[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return labels[:min(n, len(labels))]
+}
+
+// keymapMarker is the comment in front of the keymap section stageKeymap
+// owns. The file is edited as text around it, so other sections and
+// comments are kept byte for byte.
+const keymapMarker = "// go-zed-tasks:generated task bindings"
+
+// stageKeymap adds KEYMAP_PATH to tx with a Workspace section binding the
+// KEYMAP_BINDINGS keystrokes and "<KEYMAP_RECENT_PREFIX> <n>" for the
+// recent labels to task::Spawn. Zed only reads the keymap in its config
+// directory, so KEYMAP_PATH is a snippet inside the workspace to copy from,
+// never the keymap itself.
+func stageKeymap(cfg Config, absRootPath string, recent []string, tx *fileTransaction, modes fileModes) error {
+	if cfg.KeymapPath == "" {
+		return nil
+	}
+	path := resolvePath(absRootPath, cfg.KeymapPath)
+	if rel, err := rootRelPath(absRootPath, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("keymap_path %q is outside the workspace %q; point it at a snippet such as .zed/keymap.json", cfg.KeymapPath, absRootPath)
+	}
+	if _, err := tasks.ReadArray(path); err != nil {
+		return fmt.Errorf("read keymap %q: %w", path, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read keymap %q: %w", path, err)
+	}
+
+	bindings := make(map[string]any, len(cfg.KeymapBindings)+len(recent))
+	for i, label := range recent {
+		bindings[fmt.Sprintf("%s %d", cfg.KeymapRecentPrefix, i+1)] = []any{keymapSpawnAction, map[string]any{"task_name": label}}
+	}
+	for key, label := range cfg.KeymapBindings {
+		bindings[strings.TrimSpace(key)] = []any{keymapSpawnAction, map[string]any{"task_name": strings.TrimSpace(label)}}
+	}
+	var section []byte
+	if len(bindings) > 0 {
+		section, err = json.MarshalIndent(struct {
+			Context  string         `json:"context"`
+			Bindings map[string]any `json:"bindings"`
+		}{"Workspace", bindings}, "  ", "  ")
+		if err != nil {
+			return fmt.Errorf("serialize keymap section: %w", err)
+		}
+	}
+
+	data, err = spliceKeymapSection(data, section)
+	if err != nil {
+		return fmt.Errorf("keymap %s: %w", path, err)
+	}
+	if err := tx.stage(path, data, modes); err != nil {
+		return fmt.Errorf("write keymap %s: %w", path, err)
+	}
+	return nil
+}
+
+// spliceKeymapSection replaces the section after keymapMarker in the keymap
+// array data with section, or removes it when section is nil. Without a
+// marker the section is inserted as the first element.
+func spliceKeymapSection(data, section []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		if section == nil {
+			return data, nil
+		}
+		data = []byte("[\n]\n")
+	}
+
+	if start := bytes.Index(data, []byte(keymapMarker)); start >= 0 {
+		lineEnd := bytes.IndexByte(data[start:], '\n')
+		if lineEnd < 0 {
+			return nil, fmt.Errorf("no section after %q", keymapMarker)
+		}
+		open := scanJSONC(data, start+lineEnd, func(i int) bool { return true })
+		if open < 0 || data[open] != '{' {
+			return nil, fmt.Errorf("no section after %q", keymapMarker)
+		}
+		depth := 0
+		closing := scanJSONC(data, open, func(i int) bool {
+			switch data[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+			}
+			return depth == 0
+		})
+		if closing < 0 {
+			return nil, fmt.Errorf("unterminated section after %q", keymapMarker)
+		}
+		if section != nil {
+			return slices.Concat(data[:open], section, data[closing+1:]), nil
+		}
+
+		// Drop the marker line, the section and its separating comma.
+		from := bytes.LastIndexByte(data[:start], '\n') + 1
+		to := closing + 1
+		if next := scanJSONC(data, to, func(i int) bool { return true }); next >= 0 && data[next] == ',' {
+			to = next + 1
+		}
+		if to < len(data) && data[to] == '\n' {
+			to++
+		}
+		return slices.Concat(data[:from], data[to:]), nil
+	}
+
+	if section == nil {
+		return data, nil
+	}
+	open := scanJSONC(data, 0, func(i int) bool { return true })
+	if open < 0 || data[open] != '[' {
+		return nil, errors.New("not a JSON array")
+	}
+	insert := slices.Concat([]byte("\n  "+keymapMarker+"\n  "), section)
+	if next := scanJSONC(data, open+1, func(i int) bool { return true }); next >= 0 && data[next] != ']' {
+		insert = append(insert, ',')
+	}
+	return slices.Concat(data[:open+1], insert, data[open+1:]), nil
+}
+
+// scanJSONC calls visit with the offset of each byte of data from from on
+// that is not whitespace or inside a string or comment, and returns the
+// first offset visit accepts, or -1. A string is visited at its opening
+// quote only.
+func scanJSONC(data []byte, from int, visit func(int) bool) int {
+	for i := from; i < len(data); i++ {
+		switch ch := data[i]; {
+		case ch == '/' && i+1 < len(data) && data[i+1] == '/':
+			end := bytes.IndexByte(data[i:], '\n')
+			if end < 0 {
+				return -1
+			}
+			i += end
+		case ch == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return -1
+			}
+			i += end + 3
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+		case ch == '"':
+			if visit(i) {
+				return i
+			}
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' {
+					i++
+				}
+			}
+		default:
+			if visit(i) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// envFingerprintPath records the environment of the last generate run.
+const envFingerprintPath = stateDirPath + "environment.json"
+
+// envFingerprint is the part of `go env` generated entries depend on. The
+// JSON keys are the go env names, so `go env -json` decodes into it.
+type envFingerprint struct {
+	GoVersion  string    `json:"GOVERSION"`
+	GOOS       string    `json:"GOOS"`
+	GOARCH     string    `json:"GOARCH"`
+	CgoEnabled string    `json:"CGO_ENABLED"`
+	CC         string    `json:"CC"`
+	Generated  time.Time `json:"generated,omitzero"`
+}
+
+// currentEnvFingerprint asks the go binary in absRootPath, so a toolchain
+// line in go.mod selects the version like it does for the tasks.
+func currentEnvFingerprint(cfg Config, absRootPath string) (envFingerprint, error) {
+	cmd := exec.Command(cfg.GoBinary, "env", "-json", "GOVERSION", "GOOS", "GOARCH", "CGO_ENABLED", "CC")
+	cmd.Dir = absRootPath
+	output, err := cmd.Output()
+	if err != nil {
+		return envFingerprint{}, fmt.Errorf("go env: %w", err)
+	}
+	var fingerprint envFingerprint
+	if err := json.Unmarshal(output, &fingerprint); err != nil {
+		return envFingerprint{}, fmt.Errorf("parse go env output: %w", err)
+	}
+	return fingerprint, nil
+}
+
+func readEnvFingerprint(path string) (*envFingerprint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	var fingerprint envFingerprint
+	if err := json.Unmarshal(data, &fingerprint); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &fingerprint, nil
+}
+
+// invalidatingChanges lists the differences to current that can change what
+// generated entries do: a new Go release (not a patch release), another
+// platform, or other cgo settings.
+func (f envFingerprint) invalidatingChanges(current envFingerprint) []string {
+	var changes []string
+	if goRelease(f.GoVersion) != goRelease(current.GoVersion) {
+		changes = append(changes, fmt.Sprintf("Go %s -> %s", f.GoVersion, current.GoVersion))
+	}
+	if f.GOOS != current.GOOS || f.GOARCH != current.GOARCH {
+		changes = append(changes, fmt.Sprintf("platform %s/%s -> %s/%s", f.GOOS, f.GOARCH, current.GOOS, current.GOARCH))
+	}
+	if f.CgoEnabled != current.CgoEnabled {
+		changes = append(changes, fmt.Sprintf("CGO_ENABLED %s -> %s", f.CgoEnabled, current.CgoEnabled))
+	}
+	if f.CC != current.CC {
+		changes = append(changes, fmt.Sprintf("CC %s -> %s", f.CC, current.CC))
+	}
+	return changes
+}
+
+// skipArgs passes EXCLUDE_TEST_REGEX to go test as -skip. Without -skip,
+// see goToolchain, there is no way to skip subtests by pattern, so
+// excluded subtests run during discovery and are dropped afterwards, and
+// aggregate tasks run them.
+func (c Config) skipArgs() []string {
+	if c.ExcludeTestRegex == "" || !c.toolchain().skip {
+		return nil
+	}
+	return []string{"-skip", c.ExcludeTestRegex}
+}
+
+// goToolchain is what the GO_BINARY go command supports, known from its
+// go version. Features that need a newer go fall back to what it has
+// instead of failing with a flag error.
+type goToolchain struct {
+	// version is the release, e.g. go1.21.5. It is "" when go version
+	// failed or reported a devel build; such a go is taken to support
+	// everything, as wrappers and the latest go do.
+	version string
+	// skip is go test -skip (Go 1.20).
+	skip bool
+	// fullpath is go test -fullpath (Go 1.21).
+	fullpath bool
+	// chdir is go -C (Go 1.20).
+	chdir bool
+	// listJSON is go test -json -list reporting the list as JSON events
+	// (Go 1.10).
+	listJSON bool
+}
+
+func newGoToolchain(version string) goToolchain {
+	since := func(minor int) bool {
+		return version == "" || goVersionAtLeast(version, 1, minor)
+	}
+	return goToolchain{
+		version:  version,
+		skip:     since(20),
+		fullpath: since(21),
+		chdir:    since(20),
+		listJSON: since(10),
+	}
+}
+
+// missing names the features the toolchain lacks and the Go release that
+// added each.
+func (t goToolchain) missing() []string {
+	var missing []string
+	for _, feature := range []struct {
+		name      string
+		release   string
+		supported bool
+	}{
+		{"go test -skip", "go1.20", t.skip},
+		{"go test -fullpath", "go1.21", t.fullpath},
+		{"go -C", "go1.20", t.chdir},
+		{"go test -json -list", "go1.10", t.listJSON},
+	} {
+		if !feature.supported {
+			missing = append(missing, feature.name+" ("+feature.release+")")
+		}
+	}
+	return missing
+}
+
+// goTestArgs drops the flags of args the toolchain does not have, along
+// with their values.
+func (t goToolchain) goTestArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := parseGoFlag(args[i])
+		name = strings.TrimPrefix(name, "test.")
+		if name == "skip" && !t.skip || name == "fullpath" && !t.fullpath {
+			if goFlags[name].takesValue && !hasValue {
+				i++
+			}
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
+
+var goToolchains = struct {
+	sync.Mutex
+	byBinary map[string]goToolchain
+}{byBinary: make(map[string]goToolchain)}
+
+// toolchain probes GO_BINARY, see probeGoToolchain.
+func (c Config) toolchain() goToolchain {
+	return probeGoToolchain(c.GoBinary)
+}
+
+// probeGoToolchain runs `go version` of binary once per process. It sets
+// GOTOOLCHAIN=local so the version is that of binary itself, which is the
+// one that matters: toolchain switching only exists from Go 1.21 on, and
+// those toolchains support every feature goToolchain knows. A go that
+// lacks features gets one note on stderr.
+func probeGoToolchain(binary string) goToolchain {
+	goToolchains.Lock()
+	defer goToolchains.Unlock()
+	if toolchain, ok := goToolchains.byBinary[binary]; ok {
+		return toolchain
+	}
+	cmd := discovery.Runner{Binary: binary, Env: map[string]string{"GOTOOLCHAIN": "local"}}.Command("", "version")
+	output, err := cmd.Output()
+	version := ""
+	if err == nil {
+		version = goVersionFromOutput(string(output))
+	}
+	toolchain := newGoToolchain(version)
+	if missing := toolchain.missing(); len(missing) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "note: %s is %s; doing without %s\n", binary, version, strings.Join(missing, ", "))
+	}
+	goToolchains.byBinary[binary] = toolchain
+	return toolchain
+}
+
+// goVersionFromOutput finds the release in `go version` output, e.g.
+// go1.21.5 in "go version go1.21.5 linux/amd64". A devel toolchain has
+// none and gives "".
+func goVersionFromOutput(output string) string {
+	fields := strings.Fields(output)
+	if len(fields) < 3 || fields[0] != "go" || fields[1] != "version" || !strings.HasPrefix(fields[2], "go1") {
+		return ""
+	}
+	return fields[2]
+}
+
+// goVersionAtLeast reports whether the release version, such as go1.21.5
+// or go1.22rc1, is major.minor or later.
+func goVersionAtLeast(version string, major, minor int) bool {
+	release := strings.TrimPrefix(goRelease(version), "go")
+	majorPart, minorPart, _ := strings.Cut(release, ".")
+	gotMajor, err := strconv.Atoi(majorPart)
+	if err != nil {
+		return false
+	}
+	gotMinor, _ := strconv.Atoi(minorPart)
+	return gotMajor > major || gotMajor == major && gotMinor >= minor
+}
+
+// goRelease trims the patch and prerelease parts of a GOVERSION, e.g.
+// go1.23.4 and go1.23rc1 are both go1.23.
+func goRelease(version string) string {
+	version, _, _ = strings.Cut(version, " ")
+	major, rest, found := strings.Cut(version, ".")
+	if !found {
+		return version
+	}
+	end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		rest = rest[:end]
+	}
+	return major + "." + rest
+}
+
+// recordEnvFingerprint stages the current environment with the files of a
+// generate run and warns when it invalidates entries generated earlier. It
+// never fails the run: without a working go env there is nothing to record.
+func recordEnvFingerprint(cfg Config, absRootPath string, tx *fileTransaction) {
+	current, err := currentEnvFingerprint(cfg, absRootPath)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(absRootPath, envFingerprintPath)
+	if recorded, err := readEnvFingerprint(path); err == nil && recorded != nil {
+		if changes := recorded.invalidatingChanges(current); len(changes) > 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: Go environment changed since the last generate (%s); entries generated for other files may be stale, see go-zed-tasks doctor\n", strings.Join(changes, ", "))
+		}
+	}
+
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return
+	}
+	current.Generated = time.Now().UTC()
+	data, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := tx.stage(path, append(data, '\n'), modes); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: record Go environment: %v\n", err)
+	}
+}
+
+// runPrintPattern prints the -run and -test.run patterns generated entries
+// use for one test name. The words of args are joined with spaces, so a
+// subtest name need not be quoted, and subtest elements are spelled the
+// way the testing package reports them, as in t.Run("sub case") becoming
+// sub_case.
+func runPrintPattern(args []string) error {
+	fs := flag.NewFlagSet("pattern", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	name := strings.Join(fs.Args(), " ")
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("missing test name, e.g. pattern TestFoo/sub case")
+	}
+	elements := strings.Split(name, "/")
+	for i := 1; i < len(elements); i++ {
+		elements[i] = discovery.SubtestName(elements[i])
+	}
+	pattern := discovery.RunPattern(strings.Join(elements, "/"))
+	fmt.Printf("-run %s\n-test.run %s\n", pattern, pattern)
+	return nil
+}
+
+// runWhich maps a go test invocation, given as args after -- or as a task or
+// debug config JSON, back to the tests it runs in the current tree.
+func runWhich(args []string) error {
+	var opts commonOptions
+	var payload string
+	fs := flag.NewFlagSet("which", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.StringVar(&payload, "json", "", "Task or debug config JSON to identify; - reads it from stdin.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	var inv testInvocation
+	switch {
+	case payload != "":
+		data := []byte(payload)
+		if payload == "-" {
+			if data, err = io.ReadAll(os.Stdin); err != nil {
+				return fmt.Errorf("read stdin: %w", err)
+			}
+		}
+		normalized, err := tasks.Normalize(data)
+		if err != nil {
+			return fmt.Errorf("parse -json: %w", err)
+		}
+		var entry map[string]any
+		if err := json.Unmarshal(normalized, &entry); err != nil {
+			return fmt.Errorf("parse -json: %w", err)
+		}
+		inv = invocationFromEntry(entry, cfg.GoBinary)
+	case fs.NArg() > 0:
+		inv = invocationFromArgs(fs.Args(), "", cfg.GoBinary)
+	default:
+		return fmt.Errorf("which needs a command after -- or -json")
+	}
+	if inv.runPattern == "" {
+		return fmt.Errorf("no -run pattern in the command; it runs every test of %s", inv.displayPackage())
+	}
+
+	packageDir := filepath.Join(absRootPath, filepath.FromSlash(strings.TrimPrefix(inv.packagePath(), "./")))
+	matches, err := matchRunPattern(packageDir, inv.runPattern)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Package %s, -run %s\n", inv.displayPackage(), inv.runPattern)
+	for _, match := range matches {
+		rel, relErr := filepath.Rel(absRootPath, match.file)
+		if relErr != nil {
+			rel = match.file
+		}
+		line := fmt.Sprintf("%s:%d: %s", filepath.ToSlash(rel), match.decl.line, match.decl.name)
+		if match.subtests != "" {
+			line += fmt.Sprintf(" (subtests matching %q)", match.subtests)
+		}
+		fmt.Println(line)
+	}
+	if inv.recordedTest != "" {
+		top, _, _ := strings.Cut(inv.recordedTest, "/")
+		if !slices.ContainsFunc(matches, func(m runMatch) bool { return m.decl.name == top }) {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: entry records %s=%s, which the pattern no longer matches\n", testNameEnvKey, inv.recordedTest)
+		}
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no test in %s matches -run %q", inv.displayPackage(), inv.runPattern)
+	}
+	return nil
+}
+
+// testInvocation is what which extracts from a command or entry.
+type testInvocation struct {
+	// pkg is the package argument, with editor root variables removed.
+	pkg          string
+	chdir        string
+	runPattern   string
+	recordedTest string
+}
+
+func (i testInvocation) packagePath() string {
+	pkg := i.pkg
+	if pkg == "" {
+		pkg = "."
+	}
+	if i.chdir != "" {
+		return "./" + path.Join(strings.TrimPrefix(i.chdir, "./"), pkg)
+	}
+	return pkg
+}
+
+func (i testInvocation) displayPackage() string {
+	pkg := i.packagePath()
+	if pkg != "." && !strings.HasPrefix(pkg, "./") {
+		return "./" + pkg
+	}
+	return pkg
+}
+
+// invocationFromArgs reads a go test command line: an optional go binary,
+// -C dir, test, flags and the package. cwd is the root-relative directory
+// the command runs in.
+func invocationFromArgs(args []string, cwd, goBinary string) testInvocation {
+	inv := testInvocation{chdir: cwd}
+	if len(args) > 0 && (args[0] == goBinary || path.Base(filepath.ToSlash(args[0])) == "go") {
+		args = args[1:]
+	}
+	for len(args) > 1 && args[0] == "-C" {
+		inv.chdir = stripEditorRoot(args[1])
+		args = args[2:]
+	}
+	if len(args) > 0 && args[0] == "test" {
+		args = args[1:]
+	}
+	_, testFlags, _ := splitGoTestArgs(args)
+	for i := 0; i < len(testFlags); i++ {
+		name, value, hasValue := parseGoFlag(testFlags[i])
+		switch {
+		case name == "":
+			inv.pkg = stripEditorRoot(testFlags[i])
+		case name == "run" || name == "test.run":
+			if !hasValue && i+1 < len(testFlags) {
+				i++
+				value = testFlags[i]
+			}
+			inv.runPattern = value
+		}
+	}
+	return inv
+}
+
+// invocationFromEntry reads a Zed or VS Code task or debug config.
+func invocationFromEntry(entry map[string]any, goBinary string) testInvocation {
+	var args []string
+	if values, ok := entry["args"].([]any); ok {
+		for _, value := range values {
+			if text, ok := value.(string); ok {
+				args = append(args, text)
+			}
+		}
+	}
+	cwd := ""
+	if value, ok := entry["cwd"].(string); ok {
+		cwd = stripEditorRoot(value)
+	}
+	if options, ok := entry["options"].(map[string]any); ok {
+		if value, ok := options["cwd"].(string); ok {
+			cwd = stripEditorRoot(value)
+		}
+	}
+
+	var inv testInvocation
+	if program, ok := entry["program"].(string); ok {
+		// Debug configs launch the test binary of program with -test.* args.
+		inv = invocationFromArgs(append([]string{"test", program}, args...), cwd, goBinary)
+	} else {
+		command, _ := entry["command"].(string)
+		fields := strings.Fields(command)
+		if inner, ok := tasks.Untee(command); ok {
+			fields = shellFields(inner)
+		}
+		inv = invocationFromArgs(append(fields, args...), cwd, goBinary)
+	}
+	inv.recordedTest, _ = tasks.EnvValue(tasks.EnvOf(entry), testNameEnvKey)
+	return inv
+}
+
+// stripEditorRoot turns $ZED_WORKTREE_ROOT/x or ${workspaceFolder}/x into
+// ./x.
+func stripEditorRoot(value string) string {
+	for _, prefix := range []string{"$ZED_WORKTREE_ROOT", "${ZED_WORKTREE_ROOT}", "${workspaceFolder}"} {
+		if rest, ok := strings.CutPrefix(value, prefix); ok {
+			return "./" + strings.TrimPrefix(rest, "/")
+		}
+	}
+	return value
+}
+
+// runMatch is a top-level test selected by a -run pattern.
+type runMatch struct {
+	file     string
+	decl     testDecl
+	subtests string
+}
+
+// matchRunPattern applies go test -run semantics: the pattern is split on
+// slashes outside brackets and parentheses, and the first element must
+// match the top-level name. Benchmarks only run with -bench and are
+// skipped.
+func matchRunPattern(packageDir, pattern string) ([]runMatch, error) {
+	elements := splitRunPattern(pattern)
+	top, err := regexp.Compile(elements[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid -run pattern %q: %w", pattern, err)
+	}
+	for _, element := range elements[1:] {
+		if _, err := regexp.Compile(element); err != nil {
+			return nil, fmt.Errorf("invalid -run pattern %q: %w", pattern, err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(packageDir, "*_test.go"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no test files in %s", packageDir)
+	}
+	anyTest := regexp.MustCompile(`^(Test|Fuzz|Example)`)
+	var matches []runMatch
+	for _, file := range files {
+		decls, err := findTestDeclsInFile(file, anyTest)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", file, err)
+		}
+		for _, decl := range decls {
+			if top.MatchString(decl.name) {
+				matches = append(matches, runMatch{file: file, decl: decl, subtests: strings.Join(elements[1:], "/")})
+			}
+		}
+	}
+	return matches, nil
+}
+
+// splitRunPattern splits a -run pattern like the testing package does.
+func splitRunPattern(pattern string) []string {
+	var elements []string
+	depth, start := 0, 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '[', '(':
+			depth++
+		case ']', ')':
+			if depth > 0 {
+				depth--
+			}
+		case '\\':
+			i++
+		case '/':
+			if depth == 0 {
+				elements = append(elements, pattern[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(elements, pattern[start:])
+}
+
+// completeCommand is the hidden subcommand shell completion scripts call.
+const completeCommand = "__complete"
+
+var subcommands = []string{"generate", "generate-debug", "generate-package", "watch", "debug", "clear", "prune", "list", "init", "selftest", "query", "validate", "which", "pattern", "compose", "doctor", "stats", "metrics", "logs", "help"}
+
+// runComplete prints completion candidates for the last word of args, one
+// per line with an optional tab-separated description. args are the words
+// after the program name; the last one is the word being completed and may
+// be empty. Values come from the workspace: test files, group names, and
+// the labels and packages of generated entries. Errors print nothing so the
+// shell falls back to its default completion.
+func runComplete(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	partial := args[len(args)-1]
+	words := args[:len(args)-1]
+	if len(words) == 0 {
+		printCandidates(out, partial, subcommands, nil)
+		return nil
+	}
+
+	rootArg, editorArg := "", ""
+	for i := 0; i+1 < len(words); i++ {
+		switch strings.TrimLeft(words[i], "-") {
+		case "root":
+			rootArg = words[i+1]
+		case "editor":
+			editorArg = words[i+1]
+		}
+	}
+	previous := strings.TrimLeft(words[len(words)-1], "-")
+	if !strings.HasPrefix(words[len(words)-1], "-") {
+		return nil
+	}
+
+	switch previous {
+	case "editor":
+		printCandidates(out, partial, []string{string(editorKindZed), string(editorKindVSCode), "zed,vscode"}, nil)
+		return nil
+	case "targets":
+		printCandidates(out, partial, []string{string(generateTargetTasks), string(generateTargetDebug), "tasks,debug"}, nil)
+		return nil
+	case "preset":
+		printCandidates(out, partial, slices.Sorted(maps.Keys(initPresets)), nil)
+		return nil
+	case "output":
+		formats := []string{"json"}
+		if words[0] == "stats" || words[0] == "metrics" {
+			formats = []string{"table", "json"}
+		}
+		printCandidates(out, partial, formats, nil)
+		return nil
+	}
+
+	editor, err := parseEditorKind(strings.Split(editorArg, ",")[0])
+	if err != nil {
+		return nil
+	}
+	absRootPath, err := zed.ResolveWorkspaceRoot(rootArg)
+	if err != nil {
+		return nil
+	}
+	cfg, err := loadConfig(commonOptions{rootPath: absRootPath, editor: editor})
+	if err != nil {
+		return nil
+	}
+
+	switch previous {
+	case "file":
+		var files []string
+		_ = walkTestFiles(absRootPath, func(path string) error {
+			if rel, err := filepath.Rel(absRootPath, path); err == nil {
+				files = append(files, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		printCandidates(out, partial, files, nil)
+	case "package":
+		packages := make(map[string]struct{})
+		_ = walkTestFiles(absRootPath, func(path string) error {
+			if pkg, err := packageArg(absRootPath, filepath.Dir(path)); err == nil {
+				packages[pkg] = struct{}{}
+			}
+			return nil
+		})
+		printCandidates(out, partial, slices.Collect(maps.Keys(packages)), nil)
+	case "group":
+		groups := make(map[string]struct{})
+		nameFilter, err := cfg.testNameFilter()
+		if err != nil {
+			return nil
+		}
+		_ = walkTestFiles(absRootPath, func(path string) error {
+			decls, _ := findTestDeclsInFile(path, nameFilter)
+			for _, decl := range decls {
+				for _, group := range decl.groups {
+					groups[group] = struct{}{}
+				}
+			}
+			return nil
+		})
+		printCandidates(out, partial, slices.Collect(maps.Keys(groups)), nil)
+	case "match", "pkg":
+		labels := make(map[string]string)
+		packages := make(map[string]struct{})
+		for _, target := range []generateTarget{generateTargetTasks, generateTargetDebug} {
+			entries, err := readEditorEntries(editor, target, cfg, absRootPath)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if !isGenerated(entry, cfg) {
+					continue
+				}
+				env := tasks.EnvOf(entry)
+				if label, ok := entryLabel(entry); ok {
+					file, _ := tasks.EnvValue(env, testFileEnvKey)
+					labels[regexp.QuoteMeta(label)] = file
+				}
+				if pkg, ok := tasks.EnvValue(env, packageEnvKey); ok {
+					packages[pkg] = struct{}{}
+				}
+			}
+		}
+		if previous == "pkg" {
+			printCandidates(out, partial, slices.Collect(maps.Keys(packages)), nil)
+			return nil
+		}
+		printCandidates(out, partial, slices.Collect(maps.Keys(labels)), labels)
+	}
+	return nil
+}
+
+// printCandidates prints the sorted candidates that start with partial.
+func printCandidates(out io.Writer, partial string, candidates []string, descriptions map[string]string) {
+	sort.Strings(candidates)
+	for _, candidate := range candidates {
+		if !strings.HasPrefix(candidate, partial) {
+			continue
+		}
+		if description := descriptions[candidate]; description != "" {
+			_, _ = fmt.Fprintf(out, "%s\t%s\n", candidate, description)
+			continue
+		}
+		_, _ = fmt.Fprintln(out, candidate)
+	}
+}
+
+// editorProtocolFlag switches to the stdin/stdout protocol an editor
+// extension uses instead of building command lines.
+const editorProtocolFlag = "--editor-protocol"
+
+// editorRequest is the JSON an editor writes to stdin in --editor-protocol
+// mode.
+type editorRequest struct {
+	// Action is generate or generate-debug.
+	Action string `json:"action"`
+	Root   string `json:"root,omitempty"`
+	File   string `json:"file"`
+	// Files are generated together with File in one merged write.
+	Files  []string `json:"files,omitempty"`
+	Editor string   `json:"editor,omitempty"`
+	// Position is the cursor; the response names the test around it.
+	Position *editorPosition `json:"position,omitempty"`
+	// Buffer is the unsaved editor content of File, if any.
+	Buffer           *string  `json:"buffer,omitempty"`
+	GoTestArgs       []string `json:"goTestArgs,omitempty"`
+	DiscoverSubtests bool     `json:"discoverSubtests,omitempty"`
+	StaticSubtests   bool     `json:"staticSubtests,omitempty"`
+	AutoSubtests     bool     `json:"autoSubtests,omitempty"`
+	// Config overrides config keys for this request, as -config-json.
+	Config map[string]json.RawMessage `json:"config,omitempty"`
+}
+
+// editorPosition is a 1-based line and column.
+type editorPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column,omitempty"`
+}
+
+// editorResponse is written to stdout for every request, including failed
+// ones, which set Error.
+type editorResponse struct {
+	Labels []string `json:"labels"`
+	// Test and Label are the test at the request position and the label of
+	// its generated entry.
+	Test        string             `json:"test,omitempty"`
+	Label       string             `json:"label,omitempty"`
+	Diagnostics []editorDiagnostic `json:"diagnostics"`
+	Error       string             `json:"error,omitempty"`
+}
+
+type editorDiagnostic struct {
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Message  string `json:"message"`
+}
+
+// runEditorProtocol answers one editorRequest read from in. Warnings still go
+// to stderr in their usual form; out only ever receives the response.
+func runEditorProtocol(in io.Reader, out io.Writer) error {
+	response := editorResponse{Labels: []string{}, Diagnostics: []editorDiagnostic{}}
+	var request editorRequest
+	if err := json.NewDecoder(in).Decode(&request); err != nil {
+		response.Error = fmt.Sprintf("parse request: %v", err)
+	} else if err := request.handle(&response); err != nil {
+		response.Error = err.Error()
+	}
+	data, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return fmt.Errorf("serialize response: %w", err)
+	}
+	_, err = out.Write(append(data, '\n'))
+	return err
+}
+
+func (req editorRequest) handle(response *editorResponse) error {
+	var target generateTarget
+	switch req.Action {
+	case "generate":
+		target = generateTargetTasks
+	case "generate-debug":
+		target = generateTargetDebug
+	default:
+		return fmt.Errorf("unsupported action %q (expected generate or generate-debug)", req.Action)
+	}
+	if err := setConfigOverrides(req.Config); err != nil {
+		return err
+	}
+	editor := editorKindZed
+	if req.Editor != "" {
+		var err error
+		if editor, err = parseEditorKind(req.Editor); err != nil {
+			return err
+		}
+	}
+
+	opts := generateOptions{goFilePath: req.File, discoverSubtests: req.DiscoverSubtests, staticSubtests: req.StaticSubtests, autoSubtests: req.AutoSubtests}
+	opts.rootPath = req.Root
+	opts.editor = editor
+	opts.editors = []editorKind{editor}
+	opts.goTestArgs = req.GoTestArgs
+	paths := req.Files
+	if req.File != "" {
+		paths = append([]string{req.File}, paths...)
+	} else if len(paths) == 0 {
+		return fmt.Errorf("missing required field: file")
+	}
+	absFilePaths, absRootPath, err := opts.resolveBatchPaths(paths)
+	if err != nil {
+		return err
+	}
+	results, reports, err := generateFiles(opts, absRootPath, absFilePaths, []generateTarget{target}, nil)
+	if err != nil {
+		return err
+	}
+	for _, report := range reports {
+		response.Labels = append(response.Labels, report.labels(results...)...)
+	}
+
+	for i, result := range results {
+		for _, diagnostic := range result.diagnostics {
+			response.Diagnostics = append(response.Diagnostics, editorDiagnostic{
+				Severity: "error", File: diagnostic.File, Line: diagnostic.Line, Column: diagnostic.Column, Message: diagnostic.Message,
+			})
+		}
+		for _, test := range result.testsInFile {
+			if reason, ok := result.dropReasons[test]; ok {
+				response.Diagnostics = append(response.Diagnostics, editorDiagnostic{
+					Severity: "warning", File: absFilePaths[i], Line: result.testDecls[test].line,
+					Message: fmt.Sprintf("no entry for %s: %s", test, reason),
+				})
+			}
+		}
+	}
+	if req.File == "" {
+		return nil
+	}
+	// Buffer and Position refer to File, which comes first.
+	absFilePath, result := absFilePaths[0], results[0]
+
+	decls := make([]testDecl, 0, len(result.testDecls))
+	for _, decl := range result.testDecls {
+		decls = append(decls, decl)
+	}
+	if req.Buffer != nil {
+		cfg, err := loadConfig(opts.commonOptions)
+		if err != nil {
+			return err
+		}
+		nameFilter, err := cfg.testNameFilter()
+		if err != nil {
+			return err
+		}
+		// The buffer only drives the position lookup and diagnostics:
+		// discovery needs the saved file for go test.
+		if decls, err = findTestDecls(absFilePath, []byte(*req.Buffer), nameFilter); err != nil {
+			response.Diagnostics = append(response.Diagnostics, editorDiagnostic{Severity: "error", File: absFilePath, Message: err.Error()})
+		}
+		for _, decl := range decls {
+			if _, ok := result.testDecls[decl.name]; !ok {
+				response.Diagnostics = append(response.Diagnostics, editorDiagnostic{
+					Severity: "info", File: absFilePath, Line: decl.line,
+					Message: fmt.Sprintf("save the file to generate an entry for %s", decl.name),
+				})
+			}
+		}
+	}
+
+	if req.Position != nil {
+		for _, decl := range decls {
+			if decl.line <= req.Position.Line && req.Position.Line <= decl.endLine {
+				response.Test = decl.name
+			}
+		}
+		if response.Test != "" && slices.Contains(result.selectedTests, response.Test) && len(reports) > 0 {
+			response.Label = newLabelRenderer(reports[0].adapter.labelPrefix, reports[0].adapter.labelTmpl, result).label(response.Test)
+		}
+	}
+	return nil
+}
+
+func runValidate(args []string) error {
+	var opts commonOptions
+	var syncTargets bool
+	editorArg := string(editorKindZed)
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.StringVar(&opts.tasksPathArg, "tasks", "", "Override tasks JSON path.")
+	fs.StringVar(&opts.debugPathArg, "debug", "", "Override debug JSON path.")
+	fs.StringVar(&editorArg, "editor", editorArg, "Editor target. Supported: zed, vscode.")
+	fs.BoolVar(&syncTargets, "sync-targets", false, "Generate the missing task or debug config for each inconsistency.")
+	fs.BoolVar(&opts.offline, "offline", false, "Disable all network access while syncing (same as OFFLINE=true).")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	editor, err := parseEditorKind(editorArg)
+	if err != nil {
+		return err
+	}
+	opts.editor = editor
+
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	mismatches, err := findTargetMismatches(editor, cfg, absRootPath)
+	if err != nil {
+		return err
+	}
+	for _, mismatch := range mismatches {
+		fmt.Printf("%s: %s\n", mismatch.file, mismatch)
+	}
+	if len(mismatches) == 0 {
+		fmt.Println("Tasks and debug configs are consistent")
+		return nil
+	}
+	if !syncTargets {
+		return fmt.Errorf("found %d inconsistencies; rerun with -sync-targets to generate the missing entries", len(mismatches))
+	}
+	return syncMissingTargets(opts, mismatches)
+}
+
+// targetMismatch is a generated test that has an entry in only one of the
+// tasks and debug files.
+type targetMismatch struct {
+	file    string
+	test    string
+	missing generateTarget
+}
+
+func (m targetMismatch) String() string {
+	if m.missing == generateTargetDebug {
+		return m.test + " has a task but no debug config"
+	}
+	return m.test + " has a debug config but no task"
+}
+
+// findTargetMismatches compares the tests of generated tasks and debug
+// configs. Variant tasks have no debug counterpart and are skipped.
+func findTargetMismatches(editor editorKind, cfg Config, absRootPath string) ([]targetMismatch, error) {
+	type testKey struct{ file, test string }
+	seen := make(map[generateTarget]map[testKey]struct{}, 2)
+	targets := []generateTarget{generateTargetTasks, generateTargetDebug}
+	for _, target := range targets {
+		entries, err := readEditorEntries(editor, target, cfg, absRootPath)
+		if err != nil {
+			return nil, err
+		}
+		seen[target] = make(map[testKey]struct{}, len(entries))
+		for _, entry := range entries {
+			if !isGenerated(entry, cfg) {
+				continue
+			}
+			env := tasks.EnvOf(entry)
+			if _, isVariant := tasks.EnvValue(env, variantEnvKey); isVariant {
+				continue
+			}
+			test, ok := tasks.EnvValue(env, testNameEnvKey)
+			if !ok {
+				continue
+			}
+			file, _ := tasks.EnvValue(env, testFileEnvKey)
+			seen[target][testKey{file: file, test: test}] = struct{}{}
+		}
+	}
+
+	var mismatches []targetMismatch
+	for i, target := range targets {
+		other := targets[1-i]
+		for key := range seen[target] {
+			if _, ok := seen[other][key]; !ok {
+				mismatches = append(mismatches, targetMismatch{file: key.file, test: key.test, missing: other})
+			}
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].file != mismatches[j].file {
+			return mismatches[i].file < mismatches[j].file
+		}
+		return mismatches[i].test < mismatches[j].test
+	})
+	return mismatches, nil
+}
+
+// syncMissingTargets regenerates the missing target for each source file
+// with mismatches, discovering subtests when a missing entry is one.
+func syncMissingTargets(opts commonOptions, mismatches []targetMismatch) error {
+	type fileTarget struct {
+		file   string
+		target generateTarget
+	}
+	subtests := make(map[fileTarget]bool)
+	var order []fileTarget
+	for _, mismatch := range mismatches {
+		key := fileTarget{file: mismatch.file, target: mismatch.missing}
+		if _, ok := subtests[key]; !ok {
+			order = append(order, key)
+		}
+		subtests[key] = subtests[key] || strings.Contains(mismatch.test, "/")
+	}
+
+	for _, key := range order {
+		absFilePath := resolvePath(opts.rootPath, filepath.FromSlash(key.file))
+		if key.file == "" || !fileExists(absFilePath) {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: cannot sync %s entries for missing file %q\n", key.target, key.file)
+			continue
+		}
+		args := []string{"-file", absFilePath, "-root", opts.rootPath, "-editor", string(opts.editor), "-targets", string(key.target)}
+		if opts.tasksPathArg != "" {
+			args = append(args, "-tasks", opts.tasksPathArg)
+		}
+		if opts.debugPathArg != "" {
+			args = append(args, "-debug", opts.debugPathArg)
+		}
+		if subtests[key] {
+			args = append(args, "-discover-subtests")
+		}
+		if opts.offline {
+			args = append(args, "-offline")
+		}
+		if err := runGenerate(args, key.target); err != nil {
+			return fmt.Errorf("sync %s for %s: %w", key.target, key.file, err)
+		}
+	}
+	return nil
+}
+
+func runInit(args []string) error {
+	var opts commonOptions
+	var gitignore bool
+	var presetArg string
+	editorArg := string(editorKindZed)
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.StringVar(&editorArg, "editor", editorArg, "Editor target. Supported: zed, vscode.")
+	fs.BoolVar(&gitignore, "gitignore", false, "Add the go-zed-tasks state directory to .gitignore.")
+	fs.StringVar(&presetArg, "preset", "", "Set up the config and wrapper scripts for a test setup. Supported: "+strings.Join(slices.Sorted(maps.Keys(initPresets)), ", ")+".")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	editor, err := parseEditorKind(editorArg)
+	if err != nil {
+		return err
+	}
+	opts.editor = editor
+	preset, ok := initPresets[presetArg]
+	if presetArg != "" && !ok {
+		return fmt.Errorf("unsupported -preset %q (expected %s)", presetArg, strings.Join(slices.Sorted(maps.Keys(initPresets)), ", "))
+	}
+
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return err
+	}
+	opts.rootPath = absRootPath
+
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+	modes, err := cfg.fileModes()
+	if err != nil {
+		return err
+	}
+
+	configPath := resolvePath(absRootPath, defaultConfigPath)
+	if value, ok := configOverrides[configPathEnvKey]; ok {
+		configPath = resolvePath(absRootPath, value)
+	} else if value, ok := os.LookupEnv(configPathEnvKey); ok {
+		configPath = resolvePath(absRootPath, value)
+	}
+	// Scripts sit next to the tasks file and are referenced root-relative,
+	// as tasks run from the workspace root.
+	scriptDir := path.Join(path.Dir(filepath.ToSlash(cfg.TasksPath)), "scripts")
+	type initFile struct {
+		path       string
+		content    func() ([]byte, error)
+		executable bool
+	}
+	files := []initFile{
+		{path: resolvePath(absRootPath, cfg.TasksPath), content: func() ([]byte, error) { return launcherTasksFile(editor) }},
+		{path: resolvePath(absRootPath, cfg.DebugPath), content: func() ([]byte, error) { return emptyDebugFile(editor) }},
+		{path: configPath, content: func() ([]byte, error) { return []byte(starterConfig + preset.configFor(presetArg, scriptDir)), nil }},
+	}
+	for _, name := range slices.Sorted(maps.Keys(preset.scripts)) {
+		files = append(files, initFile{
+			path:       resolvePath(absRootPath, filepath.FromSlash(path.Join(scriptDir, name))),
+			content:    func() ([]byte, error) { return []byte(preset.scripts[name]), nil },
+			executable: true,
+		})
+	}
+	for _, file := range files {
+		if pathExists(file.path) {
+			fmt.Printf("Kept existing %s\n", file.path)
+			if file.path == configPath && presetArg != "" {
+				fmt.Printf("note: the %s preset settings were not added to it; see the README\n", presetArg)
+			}
+			continue
+		}
+		data, err := file.content()
+		if err != nil {
+			return err
+		}
+		fileModes := modes
+		if file.executable {
+			fileModes.file |= 0o111
+		}
+		if err := writeTasks(file.path, data, fileModes); err != nil {
+			return fmt.Errorf("write %q: %w", file.path, err)
+		}
+		fmt.Printf("Created %s\n", file.path)
+	}
+
+	if gitignore {
+		path := filepath.Join(absRootPath, ".gitignore")
+		added, err := appendGitignoreEntry(path, stateDirPath, modes.file)
+		if err != nil {
+			return fmt.Errorf("update %q: %w", path, err)
+		}
+		if added {
+			fmt.Printf("Added %s to %s\n", stateDirPath, path)
+		}
+	}
+	return nil
+}
+
+// launcherTasksFile is a tasks file holding the tasks that run
+// go-zed-tasks for the file open in the editor.
+func launcherTasksFile(editor editorKind) ([]byte, error) {
+	const module = "github.com/VashingMachine/go-zed-test/cmd/go-zed-tasks@latest"
+	if editor == editorKindVSCode {
+		return marshalDocument(map[string]any{
+			"version": defaultVSCodeVersion,
+			"tasks": []map[string]any{
+				{"label": "go-discover", "type": "shell", "command": "go run " + module + " generate -editor vscode -file ${file} -discover-subtests"},
+				{"label": "go-discover-debug", "type": "shell", "command": "go run " + module + " debug -editor vscode -file ${file} -discover-subtests"},
+			},
+		})
+	}
+	launcher := func(label, command string) map[string]any {
+		return map[string]any{
+			"label":         label,
+			"command":       "go run " + module + " " + command + " -file ${ZED_FILE} -discover-subtests",
+			"reveal":        "always",
+			"reveal_target": "dock",
+			"hide":          "never",
+			"shell":         "system",
+		}
+	}
+	return marshalTasks([]map[string]any{
+		launcher("go-discover", "generate"),
+		launcher("go-discover-debug", "debug"),
+	})
+}
+
+func emptyDebugFile(editor editorKind) ([]byte, error) {
+	if editor == editorKindVSCode {
+		return marshalDocument(map[string]any{"version": defaultVSLaunchVer, "configurations": []any{}})
+	}
+	return marshalTasks([]map[string]any{})
+}
+
+// starterConfig is the workspace config file written by init. Process env
+// overrides any value set here.
+const starterConfig = `# go-zed-tasks configuration. Process environment variables override
+# these values. See the README for every ZED_GO_TASKS_* key.
+
+# ZED_GO_TASKS_LABEL_PREFIX=go:
+# ZED_GO_TASKS_DEBUG_LABEL_PREFIX=go:debug:
+# ZED_GO_TASKS_ADDITIONAL_GO_TEST_ARGS=-count=1
+# ZED_GO_TASKS_BUILD_FLAGS=
+# ZED_GO_TASKS_TEST_BINARY_ARGS=
+# ZED_GO_TASKS_TASK_ENV=
+# ZED_GO_TASKS_TASK_CWD=
+# ZED_GO_TASKS_TASK_EXTRA_FIELDS={"reveal_target": "center"}
+# ZED_GO_TASKS_PRUNE_GENERATED=true
+
+# Keys under an OS section apply only on that OS and override the ones
+# above, e.g. for a teammate on Windows:
+# [windows]
+# ZED_GO_TASKS_GO_BINARY=C:\Program Files\Go\bin\go.exe
+# ZED_GO_TASKS_TASK_FIELD_SHELL={"program": "pwsh"}
+`
+
+// initPreset is what init -preset adds for one test setup: config lines,
+// appended to starterConfig, and wrapper scripts by file name.
+type initPreset struct {
+	// config may refer to the scripts directory as <scripts>.
+	config  string
+	scripts map[string]string
+}
+
+// configFor renders the config lines of the preset named name, with the
+// scripts in the root-relative scriptDir.
+func (p initPreset) configFor(name, scriptDir string) string {
+	if p.config == "" {
+		return ""
+	}
+	return "\n# Preset " + name + ".\n" + strings.ReplaceAll(p.config, "<scripts>", scriptDir)
+}
+
+var initPresets = map[string]initPreset{
+	"testify": {
+		config: `# testify suites run their methods as subtests of the suite's TestXxx,
+# so runtime discovery gives every method a task running
+# -run '^TestSuite$/^TestMethod$'.
+ZED_GO_TASKS_DISCOVERY_STRATEGIES=ast,go-list,runtime
+ZED_GO_TASKS_ADDITIONAL_GO_TEST_ARGS=-count=1
+`,
+	},
+	"ginkgo": {
+		config: `# A Ginkgo suite is one TestXxx that calls RunSpecs; its task runs every
+# spec. GINKGO_SPECS adds a task per Describe, Context, It and Entry that
+# focuses on it; set GINKGO_BINARY=ginkgo to run them with the ginkgo CLI.
+ZED_GO_TASKS_GINKGO_SPECS=true
+ZED_GO_TASKS_ADDITIONAL_GO_TEST_ARGS=-count=1
+ZED_GO_TASKS_TEST_BINARY_ARGS=-ginkgo.v
+`,
+	},
+	"bazel": {
+		config: `# Tasks run the go_test target through Bazel; debug configs still build
+# with go, so they need a go.mod that covers the package.
+ZED_GO_TASKS_RUNNER_SCRIPTS=./...=sh <scripts>/go-test-bazel.sh {{.Package}} {{.Run}}
+`,
+		scripts: map[string]string{"go-test-bazel.sh": bazelRunnerScript},
+	},
+	"docker": {
+		config: `# Tasks run go test in a container, see GO_ZED_TASKS_DOCKER_IMAGE in the
+# script; debug configs still run on the host.
+ZED_GO_TASKS_RUNNER_SCRIPTS=./...=sh <scripts>/go-test-docker.sh {{.Package}} {{.Run}} {{.Args}}
+`,
+		scripts: map[string]string{"go-test-docker.sh": dockerRunnerScript},
+	},
+}
+
+const bazelRunnerScript = `#!/bin/sh
+# Written by go-zed-tasks init -preset bazel. RUNNER_SCRIPTS calls it as
+#   go-test-bazel.sh <package> <run pattern>
+# from the workspace root. Targets are assumed to follow the Gazelle naming,
+# //<dir>:<dir base name>_test; change target= below if yours differ.
+set -eu
+pkg=${1#./}
+if [ "$pkg" = "." ]; then
+	pkg=
+	name=$(basename "$PWD")
+else
+	name=$(basename "$pkg")
+fi
+target="//$pkg:${name}_test"
+exec bazel test "$target" --test_output=streamed --test_filter="$2"
+`
+
+const dockerRunnerScript = `#!/bin/sh
+# Written by go-zed-tasks init -preset docker. RUNNER_SCRIPTS calls it as
+#   go-test-docker.sh <package> <run pattern> [go test flags...]
+# from the workspace root, which is mounted at /src. GO_ZED_TASKS_DOCKER_IMAGE
+# picks the image; the module and build caches persist in named volumes.
+set -eu
+pkg=$1
+run=$2
+shift 2
+exec docker run --rm \
+	-v "$PWD":/src -w /src \
+	-v go-zed-tasks-gomod:/go/pkg/mod \
+	-v go-zed-tasks-gocache:/root/.cache/go-build \
+	"${GO_ZED_TASKS_DOCKER_IMAGE:-golang:latest}" \
+	go test "$@" "$pkg" -run "$run"
+`
+
+// appendGitignoreEntry adds entry to the gitignore file at path unless an
+// identical line is already present.
+func appendGitignoreEntry(path, entry string, mode os.FileMode) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == entry {
+			return false, nil
+		}
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	data = append(data, entry+"\n"...)
+	return true, os.WriteFile(path, data, mode)
+}
+
+func runQuery(args []string) error {
+	var opts generateOptions
+	output := "json"
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&opts.goFilePath, "file", "", "Path to the Go file to query (required).")
+	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
+	fs.Var(&opts.goTestArgs, "go-test-arg", "Extra go test argument (repeatable).")
+	fs.Var(&opts.buildFlags, "build-flag", "Go build flag (repeatable). Example: -build-flag=-tags=integration")
+	fs.StringVar(&opts.subtestTimeout, "subtest-timeout", "", "Timeout for discover-subtests test execution (e.g. 30s, 2m).")
+	fs.BoolVar(&opts.discoverSubtests, "discover-subtests", false, "Run tests with go test -json and include discovered subtests.")
+	fs.BoolVar(&opts.staticSubtests, "static-subtests", false, "Include subtests run with a literal name, t.Run(\"name\", ...), found without running anything.")
+	fs.BoolVar(&opts.autoSubtests, "auto-subtests", false, "Find subtests statically, and by running the tests that call t.Run when the package's tests last ran under AUTO_SUBTESTS_MAX_DURATION.")
+	fs.StringVar(&output, "output", output, "Output format. Supported: json.")
+	fs.BoolVar(&opts.offline, "offline", false, "Disable all network access, e.g. an HTTP DISCOVERY_CACHE (same as OFFLINE=true).")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if output != "json" {
+		return fmt.Errorf("unsupported -output %q (expected json)", output)
+	}
+	opts.readOnly = true
+
+	absFilePath, absRootPath, err := opts.resolvePaths()
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	buildFlags, goTestFlags := opts.resolveGoArgs(cfg, fs.Args())
+
+	result, err := discoverTests(opts, cfg, absRootPath, absFilePath, buildFlags, goTestFlags, opts.allTestBinaryArgs(cfg))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(result.queryTree(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("serialize query JSON: %w", err)
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
+
+// queryOutput is the JSON document printed by query.
+type queryOutput struct {
+	File       string       `json:"file"`
+	Package    string       `json:"package"`
+	Unverified bool         `json:"unverified,omitempty"`
+	Tests      []*queryTest `json:"tests"`
+}
+
+type queryTest struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+	// Attributes and Artifacts come from runtime discovery (t.Attr and
+	// t.ArtifactDir).
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Artifacts  string            `json:"artifacts,omitempty"`
+	Subtests   []*queryTest      `json:"subtests,omitempty"`
+}
+
+// queryTree nests the selected tests by their subtest path.
+func (r discoveryResult) queryTree() queryOutput {
+	out := queryOutput{File: r.relFilePath, Package: r.pkgArg, Unverified: r.unverified, Tests: []*queryTest{}}
+	nodes := make(map[string]*queryTest, len(r.selectedTests))
+	// nodeFor also creates the ancestors name has no entry for, such as
+	// TestA/x for the subtest t.Run("x/y", ...) of TestA.
+	var nodeFor func(name string) *queryTest
+	nodeFor = func(name string) *queryTest {
+		if node, ok := nodes[name]; ok {
+			return node
+		}
+		node := &queryTest{Name: name, Kind: discovery.Kind(name), Attributes: r.testAttributes[name], Artifacts: r.testArtifacts[name]}
+		if parent, _, isSubtest := cutLast(name, "/"); isSubtest {
+			node.Kind = "subtest"
+			parentNode := nodeFor(parent)
+			parentNode.Subtests = append(parentNode.Subtests, node)
+		} else {
+			node.File, node.Line = r.relFilePath, r.testDecls[name].line
+			out.Tests = append(out.Tests, node)
+		}
+		nodes[name] = node
+		return node
+	}
+	names := append([]string(nil), r.selectedTests...)
+	sort.Strings(names)
+	for _, name := range names {
+		nodeFor(name)
+	}
+	return out
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// selftestFiles is the module selftest generates entries for. It covers
+// subtests, benchmarks (which must not get tasks) and a build-tagged file.
+var selftestFiles = map[string]string{
+	"go.mod": "module example.com/selftest\n\ngo 1.20\n",
+	"alpha_test.go": `package selftest
+
+import "testing"
+
+func TestAlpha(t *testing.T) {
+	t.Run("child case", func(t *testing.T) {})
+}
+
+func TestBeta(t *testing.T) {}
+
+func BenchmarkAlpha(b *testing.B) {}
+`,
+	"tagged_test.go": `//go:build selftest
+
+package selftest
+
+import "testing"
+
+func TestTagged(t *testing.T) {}
+`,
+}
+
+// selftestCase is one generate run of the selftest and the test names
+// expected in its tasks and debug configs.
+type selftestCase struct {
+	name string
+	file string
+	args []string
+	want []string
+}
+
+func runSelftest(args []string) error {
+	var keep bool
+	editorArg := string(editorKindZed)
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&editorArg, "editor", editorArg, "Editor target. Supported: zed, vscode.")
+	fs.BoolVar(&keep, "keep", false, "Keep the temporary module for inspection.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	editor, err := parseEditorKind(editorArg)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "go-zed-tasks-selftest-")
+	if err != nil {
+		return fmt.Errorf("create temp module: %w", err)
+	}
+	if keep {
+		fmt.Printf("Selftest module: %s\n", dir)
+	} else {
+		defer func() { _ = os.RemoveAll(dir) }()
+	}
+	for name, content := range selftestFiles {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			return fmt.Errorf("write selftest module: %w", err)
+		}
+	}
+
+	cfg, err := loadConfig(commonOptions{rootPath: dir, editor: editor})
+	if err != nil {
+		return err
+	}
+	if version, err := exec.Command(cfg.GoBinary, "env", "GOVERSION").Output(); err == nil {
+		fmt.Printf("Go: %s (%s/%s)\n", strings.TrimSpace(string(version)), runtime.GOOS, runtime.GOARCH)
+	}
+
+	cases := []selftestCase{
+		{name: "subtests", file: "alpha_test.go", args: []string{"-discover-subtests"}, want: []string{"TestAlpha", "TestAlpha/child_case", "TestBeta"}},
+		{name: "build tags", file: "tagged_test.go", args: []string{"-build-flag=-tags=selftest"}, want: []string{"TestTagged"}},
+	}
+	failed := 0
+	for _, tc := range cases {
+		generateArgs := append([]string{"-file", filepath.Join(dir, tc.file), "-root", dir, "-editor", string(editor), "-targets", "tasks,debug"}, tc.args...)
+		if err := runGenerate(generateArgs, generateTargetTasks); err != nil {
+			fmt.Printf("FAIL %s: %v\n", tc.name, err)
+			failed++
+			continue
+		}
+		for _, target := range []generateTarget{generateTargetTasks, generateTargetDebug} {
+			got, err := selftestTestNames(editor, target, cfg, dir, tc.file)
+			if err == nil && !slices.Equal(got, tc.want) {
+				err = fmt.Errorf("got %v, want %v", got, tc.want)
+			}
+			if err != nil {
+				fmt.Printf("FAIL %s (%s): %v\n", tc.name, target, err)
+				failed++
+				continue
+			}
+			fmt.Printf("ok   %s (%s)\n", tc.name, target)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("selftest failed: %d check(s)", failed)
+	}
+	fmt.Println("Selftest passed")
+	return nil
+}
+
+// selftestTestNames returns the sorted test names of the entries generated
+// from relFile in one editor file, ignoring variants.
+func selftestTestNames(editor editorKind, target generateTarget, cfg Config, root, relFile string) ([]string, error) {
+	entries, err := readEditorEntries(editor, target, cfg, root)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if file, _ := tasks.EnvValue(tasks.EnvOf(entry), testFileEnvKey); !isGenerated(entry, cfg) || file != relFile {
+			continue
+		}
+		if _, isVariant := tasks.EnvValue(tasks.EnvOf(entry), variantEnvKey); isVariant {
+			continue
+		}
+		if name, ok := tasks.EnvValue(tasks.EnvOf(entry), testNameEnvKey); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// provenanceGroup collects generated entries produced from one source file.
+type provenanceGroup struct {
+	file         string
+	missing      bool
+	tasks        []string
+	debugConfigs []string
+}
+
+// collectProvenance groups generated tasks and debug configs by the file
+// recorded in their env, flagging files that no longer exist.
+func collectProvenance(editor editorKind, cfg Config, absRootPath string) ([]provenanceGroup, error) {
+	byFile := make(map[string]*provenanceGroup)
+	for _, target := range []generateTarget{generateTargetTasks, generateTargetDebug} {
+		entries, err := readEditorEntries(editor, target, cfg, absRootPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !isGenerated(entry, cfg) {
+				continue
+			}
+			file, _ := tasks.EnvValue(tasks.EnvOf(entry), testFileEnvKey)
+			group, ok := byFile[file]
+			if !ok {
+				group = &provenanceGroup{file: file}
+				if file == "" {
+					group.file = "(unknown)"
+				} else {
+					group.missing = !fileExists(resolvePath(absRootPath, filepath.FromSlash(file)))
+				}
+				byFile[file] = group
+			}
+			label, _ := entryLabel(entry)
+			if target == generateTargetTasks {
+				group.tasks = append(group.tasks, label)
+			} else {
+				group.debugConfigs = append(group.debugConfigs, label)
+			}
+		}
+	}
+
+	groups := make([]provenanceGroup, 0, len(byFile))
+	for _, group := range byFile {
+		sort.Strings(group.tasks)
+		sort.Strings(group.debugConfigs)
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].file < groups[j].file })
+	return groups, nil
+}
+
+// readEditorEntries reads the task or debug entries of the editor file
+// selected by cfg.
+func readEditorEntries(editor editorKind, target generateTarget, cfg Config, absRootPath string) ([]map[string]any, error) {
+	path := resolvePath(absRootPath, cfg.TasksPath)
+	if target == generateTargetDebug {
+		path = resolvePath(absRootPath, cfg.DebugPath)
+	}
+
+	var entries []map[string]any
+	var err error
+	switch {
+	case editor == editorKindVSCode && target == generateTargetDebug:
+		_, entries, err = readVSCodeLaunchDocument(path)
+	case editor == editorKindVSCode:
+		_, entries, err = readVSCodeTasksDocument(path)
+	default:
+		entries, err = tasks.ReadArray(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s %q: %w", target, path, err)
+	}
+	return entries, nil
+}
+
+// loadConfig reads the configuration of the workspace at opts.rootPath,
+// which is detected from the working directory when empty. Paths in the
+// config file are relative to that root, not to the working directory.
+func loadConfig(opts commonOptions) (Config, error) {
+	absRootPath, err := zed.ResolveWorkspaceRoot(opts.rootPath)
+	if err != nil {
+		return Config{}, err
+	}
+	environment, err := configEnvironment(absRootPath)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg, err := env.ParseAsWithOptions[Config](env.Options{
+		Prefix:      envPrefix,
+		Environment: environment,
+	})
+	if err != nil {
+		return Config{}, fmt.Errorf("load config from env: %w", err)
+	}
+	cfg.Offline = cfg.Offline || opts.offline
+	cfg.Force = opts.force
+	cfg.KeptForeign = opts.keptForeign
+	if cfg.KeptForeign == nil {
+		cfg.KeptForeign = &foreignLabels{}
+	}
+	cfg.SkipGeneratedFiles = cfg.SkipGeneratedFiles && !opts.includeGenerated
+	for _, glob := range cfg.GeneratedFileGlobs {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return Config{}, fmt.Errorf("invalid generated_file_globs entry %q: %w", glob, err)
+		}
+	}
+	if opts.mergeStrategy != "" {
+		cfg.MergeStrategy = opts.mergeStrategy
+	}
+	if opts.maxTasks < 0 {
+		return Config{}, fmt.Errorf("invalid -max-tasks %d (expected a task count)", opts.maxTasks)
+	}
+	if opts.maxTasks > 0 {
+		cfg.MaxTasks = opts.maxTasks
+	}
+	switch cfg.ConcurrentRunsPolicy {
+	case concurrentRunsGlobal, concurrentRunsAuto:
+	default:
+		return Config{}, fmt.Errorf("invalid concurrent_runs_policy %q (expected global or auto)", cfg.ConcurrentRunsPolicy)
+	}
+	switch cfg.FileOwnership {
+	case ownershipShared, ownershipExclusive:
+	default:
+		return Config{}, fmt.Errorf("invalid file_ownership %q (expected shared or exclusive)", cfg.FileOwnership)
+	}
+	switch cfg.SkippedTests {
+	case skippedKeep, skippedAnnotate, skippedExclude:
+	default:
+		return Config{}, fmt.Errorf("invalid skipped_tests %q (expected keep, annotate or exclude)", cfg.SkippedTests)
+	}
+	switch cfg.MergeStrategy {
+	case mergeReplace, mergeAppendOnly:
+	case mergeInteractive:
+		cfg.ConfirmReplace = newReplacePrompt(os.Stdin, os.Stderr)
+	default:
+		return Config{}, fmt.Errorf("invalid merge_strategy %q (expected replace, append-only or interactive)", cfg.MergeStrategy)
+	}
+	if _, err := cfg.fileModes(); err != nil {
+		return Config{}, err
+	}
+	if _, err := regexp.Compile(cfg.SecretEnvPattern); err != nil {
+		return Config{}, fmt.Errorf("invalid secret_env_pattern %q: %w", cfg.SecretEnvPattern, err)
+	}
+	switch cfg.SecretEnvMode {
+	case secretEnvModeReference, secretEnvModeOmit, secretEnvModeInline:
+	default:
+		return Config{}, fmt.Errorf("invalid secret_env_mode %q (expected reference, omit or inline)", cfg.SecretEnvMode)
+	}
+	if _, err := parseLabelTemplate(cfg.LabelTemplate); err != nil {
+		return Config{}, fmt.Errorf("invalid label_template: %w", err)
+	}
+	if _, err := parseTaskCwdTemplate(cfg.TaskCwd); err != nil {
+		return Config{}, fmt.Errorf("invalid task_cwd: %w", err)
+	}
+	cfg.TaskFields, err = taskFieldsFromEnv(environment, cfg.TaskExtraFields)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := cfg.taskSettings().Apply(&Task{}); err != nil {
+		return Config{}, fmt.Errorf("invalid task field: %w", err)
+	}
+	if tmpl, err := parseWatchTemplate(cfg.WatchCommand); err != nil {
+		return Config{}, fmt.Errorf("invalid watch_command: %w", err)
+	} else if tmpl != nil {
+		sample := watchTemplateData{Command: "go test ./example", Args: "test ./example", Go: "go", Test: "TestExample", Package: "./example", File: "example/example_test.go"}
+		if err := tmpl.Execute(io.Discard, sample); err != nil {
+			return Config{}, fmt.Errorf("invalid watch_command: %w", err)
+		}
+	}
+	for pattern, text := range cfg.RunnerScripts {
+		tmpl, err := parseRunnerTemplate(text)
+		if err == nil {
+			err = tmpl.Execute(io.Discard, runnerTemplateSample)
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid runner_scripts entry for %s: %w", pattern, err)
+		}
+	}
+	if err := validateRuntimeEnv(cfg); err != nil {
+		return Config{}, err
+	}
+	if cfg.DiscoveryGomaxprocs < 0 || cfg.DiscoveryProcs < 0 {
+		return Config{}, fmt.Errorf("discovery_gomaxprocs and discovery_procs must not be negative")
+	}
+	if cfg.TaskLogKeep < 0 {
+		return Config{}, fmt.Errorf("invalid task_log_keep %d (expected the number of earlier logs to keep)", cfg.TaskLogKeep)
+	}
+	if cfg.ExtraTestNameRegex != "" {
+		if _, err := regexp.Compile(cfg.ExtraTestNameRegex); err != nil {
+			return Config{}, fmt.Errorf("invalid extra_test_name_regex %q: %w", cfg.ExtraTestNameRegex, err)
+		}
+	}
+	if _, err := discovery.CompileSkip(cfg.ExcludeTestRegex); err != nil {
+		return Config{}, fmt.Errorf("invalid exclude_test_regex %q: %w", cfg.ExcludeTestRegex, err)
+	}
+	for key, label := range cfg.KeymapBindings {
+		if strings.TrimSpace(key) == "" || strings.TrimSpace(label) == "" {
+			return Config{}, fmt.Errorf("invalid keymap_bindings entry %q=%q (expected <keystroke>=<task label>)", key, label)
+		}
+	}
+	if cfg.Reproducible {
+		for key, value := range map[string]string{"go_binary": cfg.GoBinary, "coverage_dir": cfg.CoverageDir} {
+			if filepath.IsAbs(value) || strings.HasPrefix(value, "/") {
+				return Config{}, fmt.Errorf("invalid %s %q with reproducible=true (expected a command on PATH or a root-relative path, which is the same on every machine)", key, value)
+			}
+		}
+	}
+	if limit, err := time.ParseDuration(cfg.AutoSubtestsMaxTime); err != nil || limit <= 0 {
+		return Config{}, fmt.Errorf("invalid auto_subtests_max_duration %q (expected a positive duration such as 10s)", cfg.AutoSubtestsMaxTime)
+	}
+	if cfg.MaxLabelLength != 0 && cfg.MaxLabelLength < minMaxLabelLength {
+		return Config{}, fmt.Errorf("invalid max_label_length %d (expected 0 for no limit, or at least %d)", cfg.MaxLabelLength, minMaxLabelLength)
+	}
+	switch cfg.LabelLengthPolicy {
+	case labelLengthTruncate, labelLengthFail:
+	default:
+		return Config{}, fmt.Errorf("invalid label_length_policy %q (expected truncate or fail)", cfg.LabelLengthPolicy)
+	}
+	if cfg.KeymapRecent < 0 || cfg.KeymapRecent > 9 {
+		return Config{}, fmt.Errorf("invalid keymap_recent %d (expected 0 to 9)", cfg.KeymapRecent)
+	}
+	if cfg.MaxTasks < 0 {
+		return Config{}, fmt.Errorf("invalid max_tasks %d (expected a task count, or 0 for no limit)", cfg.MaxTasks)
+	}
+	switch cfg.MaxTasksEviction {
+	case evictionGenerated, evictionRun:
+	default:
+		return Config{}, fmt.Errorf("invalid max_tasks_eviction %q (expected generated or run)", cfg.MaxTasksEviction)
+	}
+	if cfg.MaxRunPattern < 0 {
+		return Config{}, fmt.Errorf("invalid max_run_pattern %d (expected a byte count, or 0 for the platform limit)", cfg.MaxRunPattern)
+	}
+	if cfg.DiscoveryNice < 0 || cfg.DiscoveryNice > 19 {
+		return Config{}, fmt.Errorf("invalid discovery_nice %d (expected 0 to 19)", cfg.DiscoveryNice)
+	}
+	switch cfg.DiscoveryCacheMode {
+	case cacheModeRead, cacheModeWrite, cacheModeReadWrite:
+	default:
+		return Config{}, fmt.Errorf("invalid discovery_cache_mode %q (expected read, write or readwrite)", cfg.DiscoveryCacheMode)
+	}
+	for _, name := range cfg.SanitizerVariants {
+		if _, ok := sanitizerPlatforms[name]; !ok {
+			return Config{}, fmt.Errorf("unknown sanitizer %q in sanitizer_variants (expected asan or msan)", name)
+		}
+	}
+	if cfg.TestTimeout != "" {
+		if _, err := time.ParseDuration(cfg.TestTimeout); err != nil {
+			return Config{}, fmt.Errorf("invalid test_timeout %q: %w", cfg.TestTimeout, err)
+		}
+	}
+	for pattern, timeout := range cfg.TestTimeouts {
+		if _, err := time.ParseDuration(timeout); err != nil {
+			return Config{}, fmt.Errorf("invalid test_timeouts entry %q: %w", pattern, err)
+		}
+	}
+	if cfg.DotenvPath != "" {
+		dotenv, err := readDotenv(resolvePath(absRootPath, cfg.DotenvPath))
+		if err != nil {
+			return Config{}, fmt.Errorf("read dotenv %q: %w", cfg.DotenvPath, err)
+		}
+		if cfg.TaskEnv == nil {
+			cfg.TaskEnv = make(map[string]string, len(dotenv))
+		}
+		for key, value := range dotenv {
+			if _, ok := cfg.TaskEnv[key]; !ok {
+				cfg.TaskEnv[key] = value
+			}
+		}
+	}
+	for key, value := range cfg.TaskEnv {
+		sample := envTemplateData{Test: "TestExample", Package: "./example", File: "example/example_test.go"}
+		if _, err := expandEnvTemplate(value, sample); err != nil {
+			return Config{}, fmt.Errorf("invalid task_env template for %s: %w", key, err)
+		}
+	}
+
+	if opts.tasksPathArg != "" {
+		cfg.TasksPath = opts.tasksPathArg
+	}
+	if opts.debugPathArg != "" {
+		cfg.DebugPath = opts.debugPathArg
+	}
+	if opts.editor == editorKindVSCode {
+		if opts.tasksPathArg == "" {
+			if _, set := environment[tasksPathEnvKey]; !set {
+				cfg.TasksPath = defaultVSTasksPath
+			}
+		}
+		if opts.debugPathArg == "" {
+			if _, set := environment[debugPathEnvKey]; !set {
+				cfg.DebugPath = defaultVSDebugPath
+			}
+		}
+	}
+	if err := cfg.checkExclusivePaths(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// configEnvironment is the process environment plus the ZED_GO_TASKS_*
+// keys of the workspace config file (CONFIG_PATH, default
+// .zed/go-zed-tasks.env), with the section for this OS applied. Process
+// env wins over the file.
+func configEnvironment(rootPath string) (map[string]string, error) {
+	environment := env.ToMap(os.Environ())
+	maps.Copy(environment, configOverrides)
+	configPath, explicit := environment[configPathEnvKey]
+	if !explicit {
+		configPath = defaultConfigPath
+	}
+	path := resolvePath(rootPath, configPath)
+	values, err := readConfigFile(path, runtime.GOOS)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return environment, nil
+		}
+		return nil, fmt.Errorf("read config file %q: %w", path, err)
+	}
+	for key, value := range values {
+		if !strings.HasPrefix(key, envPrefix) {
+			continue
+		}
+		if _, set := environment[key]; !set {
+			environment[key] = value
+		}
+	}
+	return environment, nil
+}
+
+const (
+	configJSONFlag  = "-config-json"
+	stdinConfigFlag = "--stdin-config"
+)
+
+// configOverrides are the config keys set for one invocation by
+// -config-json, --stdin-config or the config of an editor protocol
+// request. They take precedence over the environment and the config file.
+var configOverrides map[string]string
+
+// parseConfigOverrideFlags sets configOverrides from the -config-json and
+// --stdin-config flags in front of the command, and returns the rest of
+// args.
+func parseConfigOverrideFlags(args []string, stdin io.Reader) ([]string, error) {
+	for len(args) > 0 {
+		var data []byte
+		name, value, hasValue := strings.Cut(args[0], "=")
+		switch strings.TrimLeft(name, "-") {
+		case configJSONFlag[1:]:
+			if !hasValue {
+				if len(args) < 2 {
+					return nil, fmt.Errorf("flag needs an argument: %s", configJSONFlag)
+				}
+				value, args = args[1], args[1:]
+			}
+			data = []byte(value)
+		case stdinConfigFlag[2:]:
+			if len(args) > 1 && (args[1] == editorProtocolFlag || args[1] == editorProtocolFlag[1:]) {
+				return nil, fmt.Errorf("%s cannot be combined with %s; pass the overrides as the request's config", stdinConfigFlag, editorProtocolFlag)
+			}
+			var err error
+			if data, err = io.ReadAll(stdin); err != nil {
+				return nil, fmt.Errorf("read %s: %w", stdinConfigFlag, err)
+			}
+		default:
+			return args, nil
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("invalid config JSON: expected an object of config keys: %w", err)
+		}
+		if err := setConfigOverrides(values); err != nil {
+			return nil, err
+		}
+		args = args[1:]
+	}
+	return args, nil
+}
+
+// setConfigOverrides adds values to configOverrides. Keys are config
+// names with or without the ZED_GO_TASKS_ prefix, in any case. Values are
+// JSON strings, numbers or booleans; list keys also take arrays and map
+// keys objects, and other keys take objects as their JSON text, as
+// TASK_EXTRA_FIELDS expects.
+func setConfigOverrides(values map[string]json.RawMessage) error {
+	fields := configFields()
+	for key, raw := range values {
+		name := envPrefix + strings.TrimPrefix(strings.ToUpper(key), envPrefix)
+		field, known := fields[name]
+		if !known && !strings.HasPrefix(name, taskFieldEnvPrefix) && name != configPathEnvKey {
+			return fmt.Errorf("unknown config key %q", key)
+		}
+		value, err := configOverrideValue(field, raw)
+		if err != nil {
+			return fmt.Errorf("invalid config key %q: %w", key, err)
+		}
+		if configOverrides == nil {
+			configOverrides = make(map[string]string)
+		}
+		configOverrides[name] = value
+	}
+	return nil
+}
+
+// configFields maps the prefixed environment name of every Config field
+// to the field.
+func configFields() map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	typ := reflect.TypeFor[Config]()
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		if name := field.Tag.Get("env"); name != "" {
+			fields[envPrefix+name] = field
+		}
+	}
+	return fields
+}
+
+func configOverrideValue(field reflect.StructField, raw json.RawMessage) (string, error) {
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+	separator := cmp.Or(field.Tag.Get("envSeparator"), ",")
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case json.Number, bool:
+		return fmt.Sprint(value), nil
+	case []any:
+		if field.Type == nil || field.Type.Kind() != reflect.Slice {
+			return "", fmt.Errorf("does not take a list")
+		}
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			switch item.(type) {
+			case string, json.Number, bool:
+				items = append(items, fmt.Sprint(item))
+			default:
+				return "", fmt.Errorf("list items must be strings, numbers or booleans")
+			}
+		}
+		return strings.Join(items, separator), nil
+	case map[string]any:
+		if field.Type == nil || field.Type.Kind() != reflect.Map {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, raw); err != nil {
+				return "", err
+			}
+			return compact.String(), nil
+		}
+		keyValSeparator := cmp.Or(field.Tag.Get("envKeyValSeparator"), ":")
+		pairs := make([]string, 0, len(value))
+		for _, key := range slices.Sorted(maps.Keys(value)) {
+			item, ok := value[key].(string)
+			if !ok {
+				return "", fmt.Errorf("value of %q must be a string", key)
+			}
+			pairs = append(pairs, key+keyValSeparator+item)
+		}
+		return strings.Join(pairs, separator), nil
+	}
+	return "", fmt.Errorf("unsupported value %s", raw)
+}
+
+// taskFieldsFromEnv collects extra Zed task fields: the TASK_EXTRA_FIELDS
+// JSON object, then TASK_FIELD_<NAME>=<json> keys, whose lower-cased name
+// is the field name (TASK_FIELD_REVEAL_TARGET sets reveal_target).
+func taskFieldsFromEnv(environment map[string]string, extraFields string) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if strings.TrimSpace(extraFields) != "" {
+		if err := json.Unmarshal([]byte(extraFields), &fields); err != nil {
+			return nil, fmt.Errorf("invalid task_extra_fields: must be a JSON object: %w", err)
+		}
+	}
+	for key, value := range environment {
+		name, ok := strings.CutPrefix(key, taskFieldEnvPrefix)
+		if !ok || name == "" {
+			continue
+		}
+		if !json.Valid([]byte(value)) {
+			return nil, fmt.Errorf("invalid %s: value must be JSON, e.g. %s='\"center\"'", key, key)
+		}
+		fields[strings.ToLower(name)] = json.RawMessage(value)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// readDotenv parses KEY=VALUE lines, ignoring blanks, comments, and an
+// optional "export " prefix. Surrounding quotes are stripped from values.
+func readDotenv(path string) (map[string]string, error) {
+	values, _, err := readDotenvSections(path, false)
+	return values, err
+}
+
+// configSectionOS lists the GOOS values a config file section may name.
+var configSectionOS = []string{
+	"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js",
+	"linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows",
+}
+
+// readConfigFile reads a config file like readDotenv, except that it may
+// also have [windows], [darwin], [linux] or other GOOS sections. Keys
+// before the first section apply everywhere; the keys in the section for
+// goos override them, and the other sections are ignored.
+func readConfigFile(path, goos string) (map[string]string, error) {
+	values, sections, err := readDotenvSections(path, true)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(values, sections[goos])
+	return values, nil
+}
+
+// readDotenvSections parses a dotenv file. With sections, "[goos]" lines
+// start a section and the keys after them are returned by section name
+// instead of in values.
+func readDotenvSections(path string, sections bool) (map[string]string, map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make(map[string]string)
+	bySection := make(map[string]map[string]string)
+	current := values
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, ok := strings.CutPrefix(line, "["); ok && sections {
+			name, ok = strings.CutSuffix(name, "]")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !ok || !slices.Contains(configSectionOS, name) {
+				return nil, nil, fmt.Errorf("line %d: unknown section %s (expected an OS such as [windows], [darwin] or [linux])", lineNo, line)
+			}
+			if bySection[name] == nil {
+				bySection[name] = make(map[string]string)
+			}
+			current = bySection[name]
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		current[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return values, bySection, nil
+}
+
+func parseEditorKind(value string) (editorKind, error) {
+	normalized := strings.ToLower(strings.TrimSpace(value))
+	switch normalized {
+	case "", string(editorKindZed):
+		return editorKindZed, nil
+	case string(editorKindVSCode):
+		return editorKindVSCode, nil
+	default:
+		return "", fmt.Errorf("unsupported editor %q (expected zed or vscode)", value)
+	}
+}
+
+func parseEditorKinds(value string) ([]editorKind, error) {
+	seen := make(map[editorKind]struct{})
+	var editors []editorKind
+	for _, part := range strings.Split(value, ",") {
+		editor, err := parseEditorKind(part)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[editor]; ok {
+			continue
+		}
+		seen[editor] = struct{}{}
+		editors = append(editors, editor)
+	}
+	return editors, nil
+}
+
+func printUsage() {
+	fmt.Println(`Usage:
+	  go-zed-tasks generate -file <path/to/file_test.go> [flags]
+	  go-zed-tasks generate-debug -file <path/to/file_test.go> [flags]
+	  go-zed-tasks generate -group <name> [flags]
+	  go-zed-tasks generate -files-from <list|-> [flags]
+	  go-zed-tasks generate -file <path> (-test <name> | -line <n>) [-label <label>] [flags]
+	  go-zed-tasks generate-package -package <dir> [flags]
+	  go-zed-tasks watch [-debounce 300ms] [flags]
+	  go-zed-tasks clear [flags]
+	  go-zed-tasks prune -older-than 30d [flags]
+	  go-zed-tasks list [-stale] [flags]
+	  go-zed-tasks init [-editor zed|vscode] [-gitignore]
+	  go-zed-tasks selftest [-editor zed|vscode] [-keep]
+	  go-zed-tasks query -file path/to/foo_test.go [-discover-subtests] [-output json]
+	  go-zed-tasks validate [-sync-targets] [flags]
+	  go-zed-tasks which [-root dir] (-json '<task JSON>' | -json - | -- go test ./pkg -run ^TestX$)
+	  go-zed-tasks pattern <test>[/<subtest>...]
+	  go-zed-tasks compose -name <name> [-append] [flags] <test or label>...
+	  go-zed-tasks doctor [-root dir]
+	  go-zed-tasks stats [-discover-subtests] [-output table|json] [flags]
+	  go-zed-tasks metrics [-output table|json] [-clear]
+	  go-zed-tasks logs [-lines N] [-previous N] [-follow] [label]
+	  go-zed-tasks --editor-protocol < request.json
+	  go-zed-tasks -config-json '{"LABEL_PREFIX": "unit:"}' <command> [flags]
+	  go-zed-tasks --stdin-config <command> [flags] < config.json
+
+Commands:
+	  generate        Scan file tests and write/update one task per test.
+	  generate-debug  Scan file tests and write/update one debug config per test.
+	  generate-package  Scan every test file of a package and write/update their tasks in one merge.
+	  watch           Regenerate the tasks of each test file saved under the workspace root, until interrupted.
+	  debug           Alias for generate-debug.
+	  clear           Remove previously auto-generated tasks (optionally filtered).
+	  prune           Remove generated tasks not regenerated for -older-than whose test is gone.
+	  list            Show generated tasks and debug configs grouped by source file.
+	  init            Create tasks/debug skeletons and a starter config file (-preset testify, ginkgo, bazel or docker).
+	  selftest        Run the full pipeline against a temporary module and verify the output.
+	  query           Print the discovered test tree as JSON without writing anything.
+	  validate        Report tests that have a task but no debug config, or the reverse.
+	  which           Show which tests a go test command, task or debug config runs.
+	  pattern         Print the -run and -test.run regex generated entries use for a test name.
+	  compose         Write one task running several tests or generated labels, e.g. go:focus.
+	  doctor          Show the Go environment and whether it changed since the last generate.
+	  stats           Count tests, subtests, benchmarks and generated entries per package.
+	  metrics         Summarize generate timings recorded with METRICS=true (P50/P95 per phase).
+	  logs            Print the log of a task's last run (TASK_LOGS=true), or list the logged labels.
+	  --editor-protocol  Read one JSON request from stdin and write a JSON response (for editor extensions).
+
+Flags (both commands):
+	  -root      Workspace root (auto-detected if omitted)
+	  -tasks     Override tasks file path
+	  -debug     Override debug file path
+	  -editor    Editor target: zed (default) or vscode; generate accepts zed,vscode
+	  -out       Write resulting JSON to another path instead (- for stdout)
+	  -dry-run   Print resulting JSON instead of writing
+
+Generate-only:
+	  -file      Go file to scan (required)
+	  -targets   Outputs to write from one discovery run: tasks, debug, or tasks,debug
+	  -go-test-arg  Extra go test argument (repeatable), also supports args after --.
+	  -build-flag  Go build flag (repeatable); debug configs get these as buildFlags.
+	  -test-binary-arg  Test binary argument placed after -args (repeatable).
+	  -golden-update Append GOLDEN_UPDATE_FLAG (default -update) to the test binary args.
+	  -discover-subtests Run tests with go test -json and include discovered subtests.
+	  -subtest-timeout Timeout for subtest discovery execution (default from env, 30s).
+	  -verbose   List the tests each discovery strategy dropped, and why.
+	  -include-unverified Keep tests go test -list does not report, marked unverified.
+	  -group     Write one <prefix>group:<name> task for tests tagged // zed:group <name>.
+	  -include-generated Let -group (also compose, stats) scan machine-generated test files.
+	  -no-discovery-cache Ignore cached subtest discovery manifests (DISCOVERY_CACHE).
+	  -offline  Disable all network access (also query, validate; same as OFFLINE=true).
+	  -merge-strategy replace (default), append-only (only add new labels) or interactive (ask per conflicting label).
+	  -format   editor (default; the -editor files), taskfile (TASKFILE_PATH for go-task), makefile (MAKEFILE_PATH) or yaml (EXPORT_PATH).
+	  -max-tasks Keep at most N generated tasks per tasks file, evicting the least recently used (MAX_TASKS).
+	  -output   json prints the summary (files, tests, strategies, written files, stats, durations) as JSON.
+
+	  -force     Prune marked entries that do not run go (also clear).
+
+Clear-only:
+	  -match     Only remove generated tasks whose label matches this regex
+	  -pkg       Only remove generated tasks for this package directory (relative to the current directory, like -file)
+	  -file      Only remove generated tasks generated from this file (relative to the current directory, as for generate)
+
+	Configuration:
+	  Uses environment variables with prefix ZED_GO_TASKS_.
+	  Example: ZED_GO_TASKS_LABEL_PREFIX=unit:
+	  -config-json '{...}' or --stdin-config before the command override them for one run.
+
+	Editor defaults:
+	  zed     tasks=.zed/tasks.json, debug=.zed/debug.json
+	  vscode  tasks=.vscode/tasks.json, debug=.vscode/launch.json
+
+Backward compatibility:
+	  go-zed-tasks -file <path> behaves the same as "generate".`)
+}
+
+// testNameFilter matches TEST_NAME_REGEX, or the regex configured for the
+// kind of the function (BENCHMARK_NAME_REGEX and so on), so one kind can be
+// enabled without loosening the filter for the others. Tests go test -skip
+// EXCLUDE_TEST_REGEX would skip never match.
+type testNameFilter struct {
+	all     *regexp.Regexp
+	kinds   map[string]*regexp.Regexp
+	exclude discovery.SkipPattern
+}
+
+func (f testNameFilter) MatchString(name string) bool {
+	if f.exclude.Skips(name) {
+		return false
+	}
+	if f.all.MatchString(name) {
+		return true
+	}
+	pattern, ok := f.kinds[discovery.Kind(name)]
+	return ok && pattern.MatchString(name)
+}
+
+// kindNameRegexes maps test kinds to their configured name regex.
+func (c Config) kindNameRegexes() map[string]string {
+	return map[string]string{
+		"benchmark": c.BenchmarkNameRegex,
+		"fuzz":      c.FuzzNameRegex,
+		"example":   c.ExampleNameRegex,
+	}
+}
+
+func (c Config) testNameFilter() (testNameFilter, error) {
+	all, err := regexp.Compile(c.TestNameRegex)
+	if err != nil {
+		return testNameFilter{}, fmt.Errorf("invalid test_name_regex %q: %w", c.TestNameRegex, err)
+	}
+	exclude, err := discovery.CompileSkip(c.ExcludeTestRegex)
+	if err != nil {
+		return testNameFilter{}, fmt.Errorf("invalid exclude_test_regex %q: %w", c.ExcludeTestRegex, err)
+	}
+	filter := testNameFilter{all: all, kinds: make(map[string]*regexp.Regexp), exclude: exclude}
+	for kind, expr := range c.kindNameRegexes() {
+		if expr == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return testNameFilter{}, fmt.Errorf("invalid %s_name_regex %q: %w", kind, expr, err)
+		}
+		filter.kinds[kind] = pattern
+	}
+	return filter, nil
+}
+
+// goListRegex is GO_LIST_REGEX widened by the per-kind name regexes, so go
+// test -list reports the benchmarks, fuzz targets and examples they enable.
+func (c Config) goListRegex() string {
+	parts := []string{c.GoListRegex}
+	for _, kind := range []string{"benchmark", "fuzz", "example"} {
+		if expr := c.kindNameRegexes()[kind]; expr != "" {
+			parts = append(parts, expr)
+		}
+	}
+	if len(parts) == 1 {
+		return c.GoListRegex
+	}
+	return "(?:" + strings.Join(parts, ")|(?:") + ")"
+}
+
+func findTestsInFile(path string, namePattern discovery.NameMatcher) ([]string, error) {
+	decls, err := findTestDeclsInFile(path, namePattern)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(decls))
+	for _, decl := range decls {
+		names = append(names, decl.name)
+	}
+	return names, nil
+}
+
+// testDecl is a test function declared in a file. problem explains why go
+// test would not treat it as a test, if it can tell from the declaration.
+type testDecl struct {
+	name    string
+	line    int
+	endLine int
+	// parallelCalls counts .Parallel() calls in the body, subtests included.
+	parallelCalls int
+	problem       string
+	// groups are the names from `// zed:group <name>...` doc comment lines.
+	groups []string
+	// callsShort is set when the body, subtests included, calls
+	// testing.Short().
+	callsShort bool
+	// cwd is the directory of a `// zed:cwd <dir>` doc comment line,
+	// relative to the package directory.
+	cwd string
+	// compileOnly is set for examples without an output comment, which go
+	// test compiles but never runs.
+	compileOnly bool
+}
+
+func findTestDeclsInFile(path string, namePattern discovery.NameMatcher) ([]testDecl, error) {
+	return findTestDecls(path, nil, namePattern)
+}
+
+// findTestDecls parses src, or the file at path when src is nil.
+func findTestDecls(path string, src []byte, namePattern discovery.NameMatcher) ([]testDecl, error) {
+	tests, err := discovery.FindTests(path, src, namePattern)
+	if err != nil {
+		return nil, err
+	}
+	decls := make([]testDecl, 0, len(tests))
+	for _, test := range tests {
+		decls = append(decls, testDecl{
+			name:          test.Name,
+			line:          test.Line,
+			endLine:       test.EndLine,
+			parallelCalls: test.ParallelCalls,
+			problem:       test.Problem,
+			groups:        test.Groups,
+			callsShort:    test.CallsShort,
+			cwd:           test.Cwd,
+			compileOnly:   test.CompileOnly,
+		})
+	}
+	return decls, nil
+}
+
+// testCwd resolves the zed:cwd directory of the top-level test of
+// testName against the package. It returns the root-relative slash path,
+// or false when the test has none or it leaves the workspace.
+func (r discoveryResult) testCwd(testName string) (string, bool) {
+	topLevel, _, _ := strings.Cut(testName, "/")
+	cwd := r.testDecls[topLevel].cwd
+	if cwd == "" {
+		return "", false
+	}
+	dir := path.Join(strings.TrimPrefix(r.pkgArg, "./"), filepath.ToSlash(cwd))
+	if path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", false
+	}
+	return dir, true
+}
+
+// entryDir returns the cwd of the entries of testName and the package
+// argument relative to it: TASK_CWD, unless the test has a zed:cwd
+// comment, which moves both to its directory.
+func (r discoveryResult) entryDir(cfg Config, editor editorKind, testName string) (cwd, pkgArg string) {
+	dir, ok := r.testCwd(testName)
+	if !ok {
+		return taskCwd(cfg, editor, r.pkgArg), packageArgForCwd(cfg, r.pkgArg)
+	}
+	rel, err := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(strings.TrimPrefix(r.pkgArg, "./")))
+	if err != nil {
+		rel = "."
+	}
+	pkgArg = filepath.ToSlash(rel)
+	if !strings.HasPrefix(pkgArg, ".") {
+		pkgArg = "./" + pkgArg
+	}
+	if dir != "." {
+		dir = "./" + dir
+	}
+	if editor == editorKindVSCode {
+		return vscodeProgramForPackageArg(dir), pkgArg
+	}
+	return zedPathForPackageArg(dir), pkgArg
+}
+
+func intersectTests(fileTests []string, listed map[string]struct{}) []string {
+	result := make([]string, 0, len(fileTests))
+	for _, name := range fileTests {
+		if _, ok := listed[name]; ok {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+func packageArg(root, packageDir string) (string, error) {
+	rel, err := rootRelPath(root, packageDir)
+	if err != nil {
+		return "", err
+	}
+
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		return ".", nil
+	}
+
+	if strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("package directory %q is outside root %q", packageDir, root)
+	}
+
+	return "./" + rel, nil
+}
+
+// Task and DebugConfig are the Zed entries generate writes.
+type (
+	Task        = zed.Task
+	DebugConfig = zed.DebugConfig
+)
+
+func makeGeneratedTasks(result discoveryResult, cfg Config) []Task {
+	pkgArg := result.pkgArg
+	labels := newLabelRenderer(cfg.LabelPrefix, cfg.LabelTemplate, result)
+	specs := result.taskSpecs()
+	tasks := make([]Task, 0, len(specs))
+	for _, spec := range specs {
+		testName := spec.testName
+		variant := ""
+		if spec.variant != nil {
+			variant = spec.variant.name
+		}
+		label := spec.label(labels)
+		cwd, testPkgArg := result.entryDir(cfg, editorKindZed, testName)
+		task := zed.NewGoTestTask(label, cfg.GoBinary, zed.GoTest{
+			Name:       testName,
+			Package:    testPkgArg,
+			Chdir:      goChdirFor(cfg, editorKindZed, pkgArg),
+			GoTestArgs: spec.goTestArgs(result),
+			BinaryArgs: spec.binaryArgs(result, editorKindZed),
+		})
+		if runner := spec.runnerCommand(result, cfg, editorKindZed); runner != "" {
+			task.Command, task.Args = runner, nil
+		}
+		if cfg.TaskLogs {
+			task.Command, task.Args = cfg.taskLog(editorKindZed).Tee(label, shellCommand(task.Command, task.Args)), nil
+		}
+		task.Env = spec.env(addRuntimeEnv(cfg, result.generatedEnv(cfg, editorKindZed, testName)))
+		task.Cwd = cwd
+		task.AllowConcurrentRuns = cfg.allowConcurrentRuns(variant, pkgArg)
+		tasks = append(tasks, task)
+	}
+	for _, ginkgo := range makeGinkgoTasks(result, cfg, editorKindZed) {
+		tasks = append(tasks, Task{
+			Label:               ginkgo.label,
+			Command:             ginkgo.command,
+			Args:                ginkgo.args,
+			Env:                 ginkgo.env,
+			Cwd:                 taskCwd(cfg, editorKindZed, pkgArg),
+			AllowConcurrentRuns: cfg.allowConcurrentRuns(ginkgoVariantName, pkgArg),
+		})
+	}
+	for _, watch := range makeWatchTasks(result, cfg, editorKindZed) {
+		tasks = append(tasks, Task{
+			Label:               watch.label,
+			Command:             watch.command,
+			Env:                 watch.env,
+			Cwd:                 taskCwd(cfg, editorKindZed, pkgArg),
+			AllowConcurrentRuns: cfg.allowConcurrentRuns(watchVariantName, pkgArg),
+		})
+	}
+	if cfg.CoverageVariants {
+		tasks = append(tasks, Task{
+			Label:               cfg.LabelPrefix + coverageTaskName,
+			Command:             coverageCommand(cfg, editorKindZed),
+			Env:                 coverageTaskEnv(cfg, editorKindZed),
+			AllowConcurrentRuns: cfg.allowConcurrentRuns(coverVariantName),
+		})
+	}
+	settings := cfg.taskSettings()
+	for i := range tasks {
+		// loadConfig validated the field values.
+		_ = settings.Apply(&tasks[i])
+	}
+	return tasks
+}
+
+func makeGeneratedDebugConfigs(result discoveryResult, cfg Config) []DebugConfig {
+	labels := newLabelRenderer(cfg.DebugLabelPrefix, cfg.LabelTemplate, result)
+	configs := make([]DebugConfig, 0, len(result.selectedTests))
+	for _, testName := range result.selectedTests {
+		cwd, testPkgArg := result.entryDir(cfg, editorKindZed, testName)
+		config := zed.NewDelveTest(labels.label(testName), testPkgArg, delveTestArgs(testName, result.extraGoTestArgs, result.testBinaryArgs))
+		config.Env = result.debugEnv(cfg, editorKindZed, testName)
+		config.Cwd = cwd
+		config.BuildFlags = joinBuildFlags(result.buildFlags)
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+func makeGeneratedVSCodeTasks(result discoveryResult, cfg Config) []map[string]any {
+	pkgArg := result.pkgArg
+	labels := newLabelRenderer(cfg.LabelPrefix, cfg.LabelTemplate, result)
+	specs := result.taskSpecs()
+	tasks := make([]map[string]any, 0, len(specs))
+	for _, spec := range specs {
+		testName := spec.testName
+		cwd, testPkgArg := result.entryDir(cfg, editorKindVSCode, testName)
+		args := goTestTaskArgs(testName, testPkgArg, goChdirFor(cfg, editorKindVSCode, pkgArg), spec.goTestArgs(result), spec.binaryArgs(result, editorKindVSCode))
+
+		options := map[string]any{
+			"env": spec.env(addRuntimeEnv(cfg, result.generatedEnv(cfg, editorKindVSCode, testName))),
+		}
+		if cwd != "" {
+			options["cwd"] = cwd
+		}
+		label := spec.label(labels)
+		task := map[string]any{
+			"label":   label,
+			"type":    "shell",
+			"command": cfg.GoBinary,
+			"args":    args,
+			"group":   "test",
+			"options": options,
+		}
+		if runner := spec.runnerCommand(result, cfg, editorKindVSCode); runner != "" {
+			task["command"] = runner
+			delete(task, "args")
+		}
+		if cfg.TaskLogs {
+			command, _ := task["command"].(string)
+			// VS Code runs shell tasks in PowerShell or cmd.exe on Windows,
+			// which cannot run the POSIX wrapper, so there the task runs
+			// unwrapped and keeps no log.
+			plain := map[string]any{"command": command}
+			if _, ok := task["args"]; ok {
+				plain["args"] = args
+				command = shellCommand(command, args)
+			}
+			task["windows"] = plain
+			task["command"] = cfg.taskLog(editorKindVSCode).Tee(label, command)
+			delete(task, "args")
+		}
+		tasks = append(tasks, task)
+	}
+	for _, ginkgo := range makeGinkgoTasks(result, cfg, editorKindVSCode) {
+		options := map[string]any{"env": ginkgo.env}
+		if cwd := taskCwd(cfg, editorKindVSCode, pkgArg); cwd != "" {
+			options["cwd"] = cwd
+		}
+		tasks = append(tasks, map[string]any{
+			"label":   ginkgo.label,
+			"type":    "shell",
+			"command": ginkgo.command,
+			"args":    ginkgo.args,
+			"group":   "test",
+			"options": options,
+		})
+	}
+	for _, watch := range makeWatchTasks(result, cfg, editorKindVSCode) {
+		options := map[string]any{"env": watch.env}
+		if cwd := taskCwd(cfg, editorKindVSCode, pkgArg); cwd != "" {
+			options["cwd"] = cwd
+		}
+		tasks = append(tasks, map[string]any{
+			"label":        watch.label,
+			"type":         "shell",
+			"command":      watch.command,
+			"isBackground": true,
+			"group":        "test",
+			"options":      options,
+		})
+	}
+	if cfg.CoverageVariants {
+		tasks = append(tasks, map[string]any{
+			"label":   cfg.LabelPrefix + coverageTaskName,
+			"type":    "shell",
+			"command": coverageCommand(cfg, editorKindVSCode),
+			"group":   "test",
+			"options": map[string]any{"env": coverageTaskEnv(cfg, editorKindVSCode)},
+		})
+	}
+	return tasks
+}
+
+const coverageTaskName = "coverage"
+
+// coverageCommand merges the coverage data the [cover] variants wrote into
+// one text profile next to COVERAGE_DIR and prints per-function and total
+// coverage.
+func coverageCommand(cfg Config, editor editorKind) string {
+	dir := editorRootPath(editor, cfg.CoverageDir)
+	profile := editorRootPath(editor, strings.TrimSuffix(filepath.ToSlash(cfg.CoverageDir), "/")+".out")
+	goBinary := shellQuote(cfg.GoBinary)
+	return fmt.Sprintf(`%s tool covdata textfmt -i="%s" -o="%s" && %s tool cover -func="%s"`, goBinary, dir, profile, goBinary, profile)
+}
+
+// coverageTaskEnv marks the coverage aggregate as generated. It names no
+// test, so it is shared by every file that enables coverage variants.
+func coverageTaskEnv(cfg Config, editor editorKind) map[string]string {
+	env := injectedTaskEnv(cfg, editor)
+	env[cfg.GeneratedEnvKey] = cfg.GeneratedEnvValue
+	env[variantEnvKey] = coverVariantName
+	return env
+}
+
+// taskLogDir holds the output of TASK_LOGS tasks, one file per label.
+const taskLogDir = stateDirPath + "logs"
+
+// taskLog is where TASK_LOGS tasks of editor write their output.
+func (c Config) taskLog(editor editorKind) tasks.Log {
+	return tasks.Log{Dir: editorRootPath(editor, taskLogDir), Keep: c.TaskLogKeep}
+}
+
+// taskSettings are the USE_NEW_TERMINAL, REVEAL, HIDE and task field
+// settings every generated Zed task gets.
+func (c Config) taskSettings() zed.TaskSettings {
+	return zed.TaskSettings{UseNewTerminal: c.UseNewTerminal, Reveal: c.Reveal, Hide: c.Hide, Fields: c.TaskFields}
+}
+
+// shellCommand is command and args as one shell string.
+func shellCommand(command string, args []string) string {
+	if len(args) == 0 {
+		return command
+	}
+	return shellQuote(command) + " " + shellJoin(args)
+}
+
+// shellFields splits a command line written by shellJoin back into its
+// words: single quotes group, and a backslash escapes the next character.
+func shellFields(command string) []string {
+	var fields []string
+	var word strings.Builder
+	inWord, quoted, escaped := false, false, false
+	for _, r := range command {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quoted:
+			if r == '\'' {
+				quoted = false
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'':
+			quoted, inWord = true, true
+		case r == '\\':
+			escaped, inWord = true, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				fields = append(fields, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		fields = append(fields, word.String())
+	}
+	return fields
+}
+
+// watchPresets are the WATCH_COMMAND shorthands for common file watchers.
+var watchPresets = map[string]string{
+	"gow":       "gow {{.Args}}",
+	"reflex":    `reflex -r '\.go$' -s -- {{.Command}}`,
+	"watchexec": "watchexec -e go -r -- {{.Command}}",
+}
+
+// watchTemplateData is the value WATCH_COMMAND is executed against. Command
+// and Args are already shell-quoted.
+type watchTemplateData struct {
+	Command string
+	Args    string
+	Go      string
+	Test    string
+	Package string
+	File    string
+}
+
+func parseWatchTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	if preset, ok := watchPresets[text]; ok {
+		text = preset
+	}
+	return template.New("watch").Option("missingkey=error").Funcs(labelTemplateFuncs).Parse(text)
+}
+
+// runnerTemplateData is the value a RUNNER_SCRIPTS template is executed
+// against. Run, Args and BinaryArgs are already shell-quoted.
+type runnerTemplateData struct {
+	Package    string
+	Run        string
+	Args       string
+	BinaryArgs string
+	Test       string
+	File       string
+}
+
+var runnerTemplateSample = runnerTemplateData{Package: "./example", Run: "'^TestExample$'", Args: "-count=1", Test: "TestExample", File: "example/example_test.go"}
+
+func parseRunnerTemplate(text string) (*template.Template, error) {
+	return template.New("runner").Option("missingkey=error").Funcs(labelTemplateFuncs).Parse(strings.TrimSpace(text))
+}
+
+// runnerScriptFor returns the RUNNER_SCRIPTS template of the most specific
+// pattern matching pkgArg, or nil to run go test directly.
+func (c Config) runnerScriptFor(pkgArg string) *template.Template {
+	text, best := "", -1
+	for pattern, value := range c.RunnerScripts {
+		if score := packagePatternScore(pattern, pkgArg); score > best {
+			text, best = value, score
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	// loadConfig already rejected templates that do not parse.
+	tmpl, _ := parseRunnerTemplate(text)
+	return tmpl
+}
+
+// runnerCommand renders the project's test wrapper for one task of spec,
+// or returns "" when the package has no runner script.
+func (s taskSpec) runnerCommand(r discoveryResult, cfg Config, editor editorKind) string {
+	tmpl := cfg.runnerScriptFor(r.pkgArg)
+	if tmpl == nil {
+		return ""
+	}
+	data := runnerTemplateData{
+		Package:    r.pkgArg,
+		Run:        shellQuote(discovery.RunPattern(s.testName)),
+		Args:       shellJoin(s.goTestArgs(r)),
+		BinaryArgs: shellJoin(s.binaryArgs(r, editor)),
+		Test:       s.testName,
+		File:       r.relFilePath,
+	}
+	var command bytes.Buffer
+	if err := tmpl.Execute(&command, data); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: runner script for %s: %v; running go test instead\n", s.testName, err)
+		return ""
+	}
+	return strings.TrimSpace(command.String())
+}
+
+// watchTask is a generated `<prefix>watch:TestX` task: a shell command that
+// reruns the test whenever a file changes.
+type watchTask struct {
+	label   string
+	command string
+	env     map[string]string
+}
+
+// ginkgoTask is a task running one Ginkgo container or spec.
+type ginkgoTask struct {
+	label   string
+	command string
+	args    []string
+	env     map[string]string
+}
+
+// makeGinkgoTasks runs each Ginkgo container and spec of the file on its
+// own: with GINKGO_BINARY through the ginkgo CLI with --focus, otherwise
+// as go test of the suite with -ginkgo.focus.
+func makeGinkgoTasks(result discoveryResult, cfg Config, editor editorKind) []ginkgoTask {
+	if len(result.ginkgoSpecs) == 0 {
+		return nil
+	}
+	if cfg.GinkgoBinary == "" && result.ginkgoSuite == "" {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: skip Ginkgo specs of %s: no test in %s calls RunSpecs\n", result.relFilePath, result.pkgArg)
+		return nil
+	}
+	spec := taskSpec{testName: result.ginkgoSuite}
+	tasks := make([]ginkgoTask, 0, len(result.ginkgoSpecs))
+	for _, ginkgo := range result.ginkgoSpecs {
+		focus := ginkgo.Focus()
+		var command string
+		var args []string
+		if cfg.GinkgoBinary != "" {
+			command = cfg.GinkgoBinary
+			args = append(slices.Clone(result.buildFlags), "--focus="+focus, packageArgForCwd(cfg, result.pkgArg))
+			if binaryArgs := spec.binaryArgs(result, editor); len(binaryArgs) > 0 {
+				args = append(append(args, "--"), binaryArgs...)
+			}
+		} else {
+			command = cfg.GoBinary
+			binaryArgs := append(slices.Clone(spec.binaryArgs(result, editor)), "-ginkgo.focus="+focus)
+			args = goTestTaskArgs(result.ginkgoSuite, packageArgForCwd(cfg, result.pkgArg), goChdirFor(cfg, editor, result.pkgArg), spec.goTestArgs(result), binaryArgs)
+		}
+		env := addRuntimeEnv(cfg, result.generatedEnv(cfg, editor, result.ginkgoSuite))
+		env[variantEnvKey] = ginkgoVariantName
+		env[specEnvKey] = ginkgo.Text
+		tasks = append(tasks, ginkgoTask{
+			label:   truncateLabel(cfg.GinkgoLabelPrefix+ginkgo.Text, result.maxLabelLength),
+			command: command,
+			args:    args,
+			env:     env,
+		})
+	}
+	return tasks
+}
+
+// makeWatchTasks renders WATCH_COMMAND around the plain go test invocation
+// of every selected test. Variants get no watch task.
+func makeWatchTasks(result discoveryResult, cfg Config, editor editorKind) []watchTask {
+	// loadConfig already rejected templates that do not parse.
+	tmpl, _ := parseWatchTemplate(cfg.WatchCommand)
+	if tmpl == nil {
+		return nil
+	}
+	labels := newLabelRenderer(cfg.LabelPrefix+"watch:", cfg.LabelTemplate, result)
+	tasks := make([]watchTask, 0, len(result.selectedTests))
+	for _, testName := range result.selectedTests {
+		spec := taskSpec{testName: testName}
+		args := goTestTaskArgs(testName, packageArgForCwd(cfg, result.pkgArg), goChdirFor(cfg, editor, result.pkgArg), spec.goTestArgs(result), spec.binaryArgs(result, editor))
+		quotedArgs := shellJoin(args)
+		data := watchTemplateData{
+			Command: shellQuote(cfg.GoBinary) + " " + quotedArgs,
+			Args:    quotedArgs,
+			Go:      shellQuote(cfg.GoBinary),
+			Test:    testName,
+			Package: result.pkgArg,
+			File:    result.relFilePath,
+		}
+		var command bytes.Buffer
+		if err := tmpl.Execute(&command, data); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "warning: skip watch task for %s: %v\n", testName, err)
+			continue
+		}
+		env := addRuntimeEnv(cfg, result.generatedEnv(cfg, editor, testName))
+		env[variantEnvKey] = watchVariantName
+		tasks = append(tasks, watchTask{label: labels.label(testName), command: command.String(), env: env})
+	}
+	return tasks
+}
+
+// shellJoin quotes args for a POSIX shell command line.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote single-quotes s unless it only holds characters that are safe
+// unquoted.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func makeGeneratedVSCodeDebugConfigs(result discoveryResult, cfg Config) []map[string]any {
+	pkgArg := result.pkgArg
+	labels := newLabelRenderer(cfg.DebugLabelPrefix, cfg.LabelTemplate, result)
+	configs := make([]map[string]any, 0, len(result.selectedTests))
+	for _, testName := range result.selectedTests {
+		taskArgs := delveTestArgs(testName, result.extraGoTestArgs, result.testBinaryArgs)
+
+		config := map[string]any{
+			"name":    labels.label(testName),
+			"type":    "go",
+			"request": "launch",
+			"mode":    "test",
+			"program": vscodeProgramForPackageArg(pkgArg),
+			"args":    taskArgs,
+			"env":     result.debugEnv(cfg, editorKindVSCode, testName),
+		}
+		if cwd, _ := result.entryDir(cfg, editorKindVSCode, testName); cwd != "" {
+			config["cwd"] = cwd
+		}
+		if len(result.buildFlags) > 0 {
+			config["buildFlags"] = joinBuildFlags(result.buildFlags)
+		}
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+// generatedEnv builds the env block shared by all generated entries: the
+// generated marker, test provenance, and any configured task env.
+func generatedEnv(cfg Config, editor editorKind, testName, relFilePath, pkgArg string) map[string]string {
+	env := make(map[string]string)
+	data := envTemplateData{Test: testName, Package: pkgArg, File: relFilePath}
+	for key, value := range injectedTaskEnv(cfg, editor) {
+		if expanded, err := expandEnvTemplate(value, data); err == nil {
+			// loadConfig already rejected templates that fail.
+			value = expanded
+		}
+		env[key] = value
+	}
+	env[cfg.GeneratedEnvKey] = cfg.GeneratedEnvValue
+	env[testNameEnvKey] = testName
+	env[testFileEnvKey] = relFilePath
+	env[packageEnvKey] = pkgArg
+	return env
+}
+
+// generatedEnv is generatedEnv for one test of this result, flagging entries
+// whose tests could not be verified with go test -list.
+func (r discoveryResult) generatedEnv(cfg Config, editor editorKind, testName string) map[string]string {
+	env := generatedEnv(cfg, editor, testName, r.relFilePath, r.pkgArg)
+	for key, value := range r.cgoEnv {
+		if _, ok := env[key]; !ok {
+			env[key] = value
+		}
+	}
+	if r.isUnverified(testName) {
+		env[unverifiedEnvKey] = "1"
+	}
+	return env
+}
+
+// debugEnv is the env of a debug config. Delve already stops on panics, so
+// the runtime env is only added with RUNTIME_ENV_IN_DEBUG.
+func (r discoveryResult) debugEnv(cfg Config, editor editorKind, testName string) map[string]string {
+	env := r.generatedEnv(cfg, editor, testName)
+	if cfg.RuntimeEnvInDebug {
+		env = addRuntimeEnv(cfg, env)
+	}
+	return env
+}
+
+// addRuntimeEnv sets GOTRACEBACK and GODEBUG from the config so a crashing
+// test dumps every goroutine. Values from TASK_ENV win.
+func addRuntimeEnv(cfg Config, env map[string]string) map[string]string {
+	if _, ok := env["GOTRACEBACK"]; !ok && cfg.Gotraceback != "" {
+		env["GOTRACEBACK"] = cfg.Gotraceback
+	}
+	if _, ok := env["GODEBUG"]; !ok && cfg.Godebug != "" {
+		env["GODEBUG"] = cfg.Godebug
+	}
+	return env
+}
 
-		fmt.Printf("Updated %s\n", debugAbsPath)
-		fmt.Printf("Discovered in file: %d, runnable with go test -list: %d\n", len(testsInFile), len(runnableTests))
-		if opts.discoverSubtests {
-			fmt.Printf("Discovered by runtime execution: %d (new: %d, timeout %s)\n", len(discoveredTests), discoveredNewCount, subtestDiscoveryTimeout)
-		}
-		fmt.Printf("Debug configs added: %d, updated: %d, removed: %d\n", stats.Added, stats.Updated, stats.Removed)
-		for _, testName := range selectedTests {
-			fmt.Printf("Generated debug config: %s%s\n", cfg.DebugLabelPrefix, testName)
+func validateRuntimeEnv(cfg Config) error {
+	switch cfg.Gotraceback {
+	case "", "none", "single", "all", "system", "crash", "wer":
+	default:
+		if _, err := strconv.Atoi(cfg.Gotraceback); err != nil {
+			return fmt.Errorf("invalid gotraceback %q (expected none, single, all, system, crash, wer or a number)", cfg.Gotraceback)
 		}
+	}
+	if cfg.Godebug == "" {
 		return nil
 	}
+	for _, setting := range strings.Split(cfg.Godebug, ",") {
+		if key, _, ok := strings.Cut(setting, "="); !ok || strings.TrimSpace(key) == "" {
+			return fmt.Errorf("invalid godebug %q: %q is not a key=value setting", cfg.Godebug, setting)
+		}
+	}
+	return nil
+}
 
-	return fmt.Errorf("unsupported generate target %q", target)
+// envTemplateData is what templates in TASK_ENV values are executed
+// against, once per generated entry.
+type envTemplateData struct {
+	Test    string
+	Package string
+	File    string
 }
 
-func runClear(args []string) error {
-	var opts commonOptions
-	editorArg := string(editorKindZed)
-	fs := flag.NewFlagSet("clear", flag.ContinueOnError)
-	fs.SetOutput(os.Stderr)
-	fs.StringVar(&opts.rootPath, "root", "", "Workspace root. If empty, auto-detected from go.mod/.git.")
-	fs.StringVar(&opts.tasksPathArg, "tasks", "", "Override tasks JSON path.")
-	fs.StringVar(&opts.debugPathArg, "debug", "", "Override debug JSON path.")
-	fs.StringVar(&editorArg, "editor", editorArg, "Editor target. Supported: zed, vscode.")
-	fs.BoolVar(&opts.dryRun, "dry-run", false, "Print resulting tasks JSON instead of writing it.")
-	if err := fs.Parse(args); err != nil {
-		return err
+// expandEnvTemplate executes a TASK_ENV value that contains {{ }}. Editor
+// variables such as $ZED_WORKTREE_ROOT are plain text to the template, so
+// they pass through for the editor to expand at run time.
+func expandEnvTemplate(value string, data envTemplateData) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
 	}
-	editor, err := parseEditorKind(editorArg)
+	tmpl, err := template.New("env").Option("missingkey=error").Funcs(labelTemplateFuncs).Parse(value)
 	if err != nil {
-		return err
+		return "", err
 	}
-	opts.editor = editor
-
-	if opts.rootPath == "" {
-		cwd, err := os.Getwd()
-		if err != nil {
-			return fmt.Errorf("get cwd: %w", err)
-		}
-		opts.rootPath = detectWorkspaceRoot(cwd)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
 	}
+	return buf.String(), nil
+}
 
-	absRootPath, err := filepath.Abs(opts.rootPath)
-	if err != nil {
-		return fmt.Errorf("resolve root path: %w", err)
+// injectedTaskEnv returns the user-configured task env with secret-looking
+// keys replaced by editor env references, or dropped in omit mode.
+func injectedTaskEnv(cfg Config, editor editorKind) map[string]string {
+	out := make(map[string]string, len(cfg.TaskEnv))
+	secretPattern := compileSecretEnvPattern(cfg.SecretEnvPattern)
+	for key, value := range cfg.TaskEnv {
+		if secretPattern == nil || !secretPattern.MatchString(key) {
+			out[key] = value
+			continue
+		}
+		switch cfg.SecretEnvMode {
+		case secretEnvModeInline:
+			out[key] = value
+		case secretEnvModeOmit:
+			continue
+		default:
+			out[key] = envReference(editor, key)
+		}
 	}
+	return out
+}
 
-	cfg, err := loadConfig(opts)
-	if err != nil {
-		return err
+// secretEnvKeys lists configured task env keys that match the secret pattern.
+func secretEnvKeys(cfg Config) []string {
+	secretPattern := compileSecretEnvPattern(cfg.SecretEnvPattern)
+	if secretPattern == nil {
+		return nil
 	}
-
-	tasksAbsPath := resolvePath(absRootPath, cfg.TasksPath)
-	removed := 0
-	var output []byte
-	if opts.editor == editorKindVSCode {
-		doc, existing, err := readVSCodeTasksDocument(tasksAbsPath)
-		if err != nil {
-			return fmt.Errorf("read tasks %q: %w", tasksAbsPath, err)
-		}
-		filtered := make([]map[string]any, 0, len(existing))
-		for _, task := range existing {
-			if isGenerated(task, cfg) {
-				removed++
-				continue
-			}
-			filtered = append(filtered, task)
-		}
-		doc["tasks"] = filtered
-		output, err = marshalDocument(doc)
-		if err != nil {
-			return err
-		}
-	} else {
-		existing, err := readTasks(tasksAbsPath)
-		if err != nil {
-			return fmt.Errorf("read tasks %q: %w", tasksAbsPath, err)
-		}
-		filtered := make([]map[string]any, 0, len(existing))
-		for _, task := range existing {
-			if isGenerated(task, cfg) {
-				removed++
-				continue
-			}
-			filtered = append(filtered, task)
-		}
-		output, err = marshalTasks(filtered)
-		if err != nil {
-			return err
+	var keys []string
+	for key := range cfg.TaskEnv {
+		if secretPattern.MatchString(key) {
+			keys = append(keys, key)
 		}
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	if opts.dryRun {
-		_, _ = os.Stdout.Write(output)
+func compileSecretEnvPattern(pattern string) *regexp.Regexp {
+	if pattern == "" {
 		return nil
 	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		// loadConfig validates the pattern; treat a bad one as "everything is secret".
+		return regexp.MustCompile(".*")
+	}
+	return compiled
+}
 
-	if err := writeTasks(tasksAbsPath, output); err != nil {
-		return fmt.Errorf("write tasks file: %w", err)
+func envReference(editor editorKind, key string) string {
+	if editor == editorKindVSCode {
+		return "${env:" + key + "}"
 	}
+	return "${" + key + "}"
+}
 
-	fmt.Printf("Updated %s\n", tasksAbsPath)
-	fmt.Printf("Removed generated tasks: %d\n", removed)
-	return nil
+// taskVariant is an extra flavor of a generated task, such as a golden-file
+// update run. Variant tasks are labeled "<prefix><test> [<name>]".
+type taskVariant struct {
+	name       string
+	goTestArgs []string
+	binaryArgs []string
+	env        map[string]string
+	// coverDir is the root-relative -test.gocoverdir of coverage variants.
+	coverDir string
+	// tests limits the variant to these test names; nil means every test.
+	tests map[string]struct{}
 }
 
-func loadConfig(opts commonOptions) (Config, error) {
-	cfg, err := env.ParseAsWithOptions[Config](env.Options{
-		Prefix: envPrefix,
-	})
-	if err != nil {
-		return Config{}, fmt.Errorf("load config from env: %w", err)
-	}
+// taskSpec is one generated task: a test, optionally in a variant flavor.
+type taskSpec struct {
+	testName string
+	variant  *taskVariant
+}
 
-	if opts.tasksPathArg != "" {
-		cfg.TasksPath = opts.tasksPathArg
-	}
-	if opts.debugPathArg != "" {
-		cfg.DebugPath = opts.debugPathArg
-	}
-	if opts.editor == editorKindVSCode {
-		if opts.tasksPathArg == "" {
-			if _, set := os.LookupEnv(tasksPathEnvKey); !set {
-				cfg.TasksPath = defaultVSTasksPath
-			}
-		}
-		if opts.debugPathArg == "" {
-			if _, set := os.LookupEnv(debugPathEnvKey); !set {
-				cfg.DebugPath = defaultVSDebugPath
+func (r discoveryResult) taskSpecs() []taskSpec {
+	specs := make([]taskSpec, 0, len(r.selectedTests)*(1+len(r.variants)))
+	for _, testName := range r.selectedTests {
+		specs = append(specs, taskSpec{testName: testName})
+		for i := range r.variants {
+			variant := &r.variants[i]
+			if variant.tests != nil {
+				topLevel, _, _ := strings.Cut(testName, "/")
+				if _, ok := variant.tests[topLevel]; !ok {
+					continue
+				}
 			}
+			specs = append(specs, taskSpec{testName: testName, variant: variant})
 		}
 	}
-	return cfg, nil
+	return specs
 }
 
-func parseEditorKind(value string) (editorKind, error) {
-	normalized := strings.ToLower(strings.TrimSpace(value))
-	switch normalized {
-	case "", string(editorKindZed):
-		return editorKindZed, nil
-	case string(editorKindVSCode):
-		return editorKindVSCode, nil
-	default:
-		return "", fmt.Errorf("unsupported editor %q (expected zed or vscode)", value)
+func (s taskSpec) label(labels labelRenderer) string {
+	if s.variant == nil {
+		return labels.label(s.testName)
 	}
+	return labels.label(s.testName) + " [" + s.variant.name + "]"
 }
 
-func printUsage() {
-	fmt.Println(`Usage:
-	  go-zed-tasks generate -file <path/to/file_test.go> [flags]
-	  go-zed-tasks generate-debug -file <path/to/file_test.go> [flags]
-	  go-zed-tasks clear [flags]
-
-Commands:
-	  generate        Scan file tests and write/update one task per test.
-	  generate-debug  Scan file tests and write/update one debug config per test.
-	  debug           Alias for generate-debug.
-	  clear           Remove all previously auto-generated tasks.
+// labelData is the value LABEL_TEMPLATE is executed against.
+type labelData struct {
+	Prefix  string
+	Test    string
+	Package string
+	File    string
+}
 
-Flags (both commands):
-	  -root      Workspace root (auto-detected if omitted)
-	  -tasks     Override tasks file path
-	  -debug     Override debug file path
-	  -editor    Editor target: zed (default) or vscode
-	  -dry-run   Print resulting JSON instead of writing
+// labelRenderer builds entry labels from the label prefix and, when
+// configured, LABEL_TEMPLATE.
+type labelRenderer struct {
+	prefix      string
+	tmpl        *template.Template
+	pkgArg      string
+	relFilePath string
+	// skipped holds the skip messages to annotate labels with, see
+	// SKIPPED_TESTS=annotate.
+	skipped map[string]string
+	// maxLength truncates longer base labels, see MAX_LABEL_LENGTH.
+	maxLength int
+	// custom are the -label overrides by test name.
+	custom map[string]string
+}
 
-Generate-only:
-	  -file      Go file to scan (required)
-	  -go-test-arg  Extra go test argument (repeatable), also supports args after --.
-	  -discover-subtests Run tests with go test -json and include discovered subtests.
-	  -subtest-timeout Timeout for subtest discovery execution (default from env, 30s).
+func newLabelRenderer(prefix, labelTemplate string, result discoveryResult) labelRenderer {
+	// loadConfig already rejected templates that do not parse.
+	tmpl, _ := parseLabelTemplate(labelTemplate)
+	labels := labelRenderer{prefix: prefix, tmpl: tmpl, pkgArg: result.pkgArg, relFilePath: result.relFilePath, maxLength: result.maxLabelLength, custom: result.labels}
+	if result.annotateSkipped {
+		labels.skipped = result.skippedTests
+	}
+	return labels
+}
 
-	Configuration:
-	  Uses environment variables with prefix ZED_GO_TASKS_.
-	  Example: ZED_GO_TASKS_LABEL_PREFIX=unit:
+func (l labelRenderer) label(testName string) string {
+	return truncateLabel(l.baseLabel(testName), l.maxLength) + l.skipAnnotation(testName)
+}
 
-	Editor defaults:
-	  zed     tasks=.zed/tasks.json, debug=.zed/debug.json
-	  vscode  tasks=.vscode/tasks.json, debug=.vscode/launch.json
+// truncateLabel shortens a label longer than maxLength runes to its head
+// and tail around an ellipsis, followed by "~" and a hash of the whole
+// label so that truncated labels stay unique. maxLength 0 keeps it.
+func truncateLabel(label string, maxLength int) string {
+	runes := []rune(label)
+	if maxLength <= 0 || len(runes) <= maxLength {
+		return label
+	}
+	suffix := "~" + shortHash(label)
+	keep := maxLength - len(suffix) - 1
+	head := (keep + 1) / 2
+	return string(runes[:head]) + "…" + string(runes[len(runes)-(keep-head):]) + suffix
+}
 
-Backward compatibility:
-	  go-zed-tasks -file <path> behaves the same as "generate".`)
+// longLabel is a test whose label exceeds MAX_LABEL_LENGTH.
+type longLabel struct {
+	pkgArg string
+	test   string
+	length int
 }
 
-func findTestsInFile(path string, namePattern *regexp.Regexp) ([]string, error) {
-	fset := token.NewFileSet()
-	parsed, err := parser.ParseFile(fset, path, nil, 0)
-	if err != nil {
-		return nil, err
+// longLabels lists the tests of results whose untruncated task labels
+// exceed MAX_LABEL_LENGTH.
+func longLabels(results []discoveryResult, cfg Config) []longLabel {
+	if cfg.MaxLabelLength <= 0 {
+		return nil
 	}
-
-	seen := make(map[string]struct{})
-	var names []string
-	for _, decl := range parsed.Decls {
-		fn, ok := decl.(*ast.FuncDecl)
-		if !ok || fn.Recv != nil {
-			continue
-		}
-		name := fn.Name.Name
-		if !namePattern.MatchString(name) {
-			continue
-		}
-		if _, ok := seen[name]; ok {
-			continue
+	var long []longLabel
+	for _, result := range results {
+		labels := newLabelRenderer(cfg.LabelPrefix, cfg.LabelTemplate, result)
+		for _, test := range result.selectedTests {
+			if length := utf8.RuneCountInString(labels.baseLabel(test)); length > cfg.MaxLabelLength {
+				long = append(long, longLabel{pkgArg: result.pkgArg, test: test, length: length})
+			}
 		}
-		seen[name] = struct{}{}
-		names = append(names, name)
 	}
-	return names, nil
+	return long
 }
 
-func listTestsWithGo(goBinary, packageDir, listRegex string) (map[string]struct{}, error) {
-	cmd := exec.Command(goBinary, "test", "-list", listRegex, ".")
-	cmd.Dir = packageDir
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("go test -list failed in %s: %w\n%s", packageDir, err, strings.TrimSpace(string(out)))
+// checkLabelLengths reports the tests whose labels exceed MAX_LABEL_LENGTH
+// so their authors can shorten them: a warning when the labels are
+// truncated, an error with LABEL_LENGTH_POLICY=fail.
+func checkLabelLengths(results []discoveryResult, cfg Config) error {
+	long := longLabels(results, cfg)
+	if len(long) == 0 {
+		return nil
+	}
+	var buf strings.Builder
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	for _, label := range long {
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%d chars\n", label.pkgArg, label.test, label.length)
 	}
+	_ = w.Flush()
+	if cfg.LabelLengthPolicy == labelLengthFail {
+		return fmt.Errorf("%d labels exceed max_label_length %d; shorten these tests:\n%s", len(long), cfg.MaxLabelLength, strings.TrimRight(buf.String(), "\n"))
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "warning: truncated %d labels longer than MAX_LABEL_LENGTH=%d; shorten these tests:\n%s", len(long), cfg.MaxLabelLength, buf.String())
+	return nil
+}
 
-	names := make(map[string]struct{})
-	identPattern := regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
-	scanner := bufio.NewScanner(bytes.NewReader(out))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" ||
-			strings.HasPrefix(line, "ok ") ||
-			strings.HasPrefix(line, "? ") ||
-			strings.HasPrefix(line, "PASS") ||
-			strings.HasPrefix(line, "FAIL") {
-			continue
-		}
+func (l labelRenderer) baseLabel(testName string) string {
+	if label, ok := l.custom[testName]; ok {
+		return label
+	}
+	if l.tmpl == nil {
+		return l.prefix + testName
+	}
+	var buf bytes.Buffer
+	data := labelData{Prefix: l.prefix, Test: testName, Package: l.pkgArg, File: l.relFilePath}
+	if err := l.tmpl.Execute(&buf, data); err != nil || strings.TrimSpace(buf.String()) == "" {
+		return l.prefix + testName
+	}
+	return buf.String()
+}
 
-		fields := strings.Fields(line)
-		if len(fields) == 0 {
-			continue
-		}
+// maxSkipAnnotation caps the skip message shown in a label.
+const maxSkipAnnotation = 40
 
-		name := fields[0]
-		if !identPattern.MatchString(name) {
-			continue
-		}
-		names[name] = struct{}{}
+// skipAnnotation is the " [skipped: message]" suffix of a test that skipped
+// during discovery, or "".
+func (l labelRenderer) skipAnnotation(testName string) string {
+	message, ok := l.skipped[testName]
+	if !ok {
+		return ""
+	}
+	if message == "" {
+		return " [skipped]"
 	}
+	if runes := []rune(message); len(runes) > maxSkipAnnotation {
+		message = strings.TrimSpace(string(runes[:maxSkipAnnotation-1])) + "…"
+	}
+	return " [skipped: " + message + "]"
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+// parseLabelTemplate parses LABEL_TEMPLATE. An empty template yields nil,
+// which keeps the plain prefix+name labels.
+func parseLabelTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
 	}
+	return template.New("label").Option("missingkey=error").Funcs(labelTemplateFuncs).Parse(text)
+}
 
-	return names, nil
+var labelTemplateFuncs = template.FuncMap{
+	"trimPrefix": trimTestPrefix,
+	"words":      camelWords,
+	"shortPath":  shortPath,
+	"base":       func(p string) string { return path.Base(strings.TrimPrefix(p, "./")) },
+	"hash":       shortHash,
 }
 
-func intersectTests(fileTests []string, listed map[string]struct{}) []string {
-	result := make([]string, 0, len(fileTests))
-	for _, name := range fileTests {
-		if _, ok := listed[name]; ok {
-			result = append(result, name)
+// trimTestPrefix strips the Test/Benchmark/Fuzz/Example prefix and any
+// separator that follows it.
+func trimTestPrefix(name string) string {
+	for _, prefix := range []string{"Test", "Benchmark", "Fuzz", "Example"} {
+		if rest, ok := strings.CutPrefix(name, prefix); ok {
+			return strings.TrimLeft(rest, "_")
 		}
 	}
-	return result
+	return name
 }
 
-func packageArg(root, packageDir string) (string, error) {
-	rel, err := filepath.Rel(root, packageDir)
-	if err != nil {
-		return "", err
+// camelWords splits CamelCase and underscore-separated names into lower-case
+// words, so Refund_SucceedsHTTP becomes "refund succeeds http". Subtest
+// separators are kept as " / ".
+func camelWords(name string) string {
+	var parts []string
+	for _, segment := range strings.Split(name, "/") {
+		var words []string
+		var current []rune
+		runes := []rune(segment)
+		flush := func() {
+			if len(current) > 0 {
+				words = append(words, strings.ToLower(string(current)))
+				current = current[:0]
+			}
+		}
+		for i, r := range runes {
+			switch {
+			case r == '_' || r == '-' || unicode.IsSpace(r):
+				flush()
+				continue
+			case unicode.IsUpper(r) && len(current) > 0:
+				prev := current[len(current)-1]
+				nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+				if !unicode.IsUpper(prev) || nextLower {
+					flush()
+				}
+			}
+			current = append(current, r)
+		}
+		flush()
+		parts = append(parts, strings.Join(words, " "))
 	}
+	return strings.Join(parts, " / ")
+}
 
-	rel = filepath.ToSlash(rel)
-	if rel == "." {
-		return ".", nil
+// shortPath abbreviates every directory of a slash path to its first
+// letter: internal/payments/refund_test.go becomes i/p/refund_test.go.
+func shortPath(p string) string {
+	elems := strings.Split(strings.TrimPrefix(p, "./"), "/")
+	for i := 0; i < len(elems)-1; i++ {
+		if r := []rune(elems[i]); len(r) > 0 {
+			elems[i] = string(r[0])
+		}
 	}
+	return strings.Join(elems, "/")
+}
 
-	if strings.HasPrefix(rel, "..") {
-		return "", fmt.Errorf("package directory %q is outside root %q", packageDir, root)
+// shortHash returns the first 7 hex digits of the SHA-256 of s.
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:7]
+}
+
+// goTestArgs are the build flags followed by the go test flags of the task.
+// The configured test timeout is added unless the flags already set one.
+func (s taskSpec) goTestArgs(r discoveryResult) []string {
+	args := append(append([]string(nil), r.buildFlags...), r.extraGoTestArgs...)
+	if r.testTimeout != "" && !hasGoFlag(args, "timeout") {
+		args = append(args, "-timeout="+r.testTimeout)
 	}
+	if s.variant == nil {
+		return args
+	}
+	return append(args, s.variant.goTestArgs...)
+}
 
-	return "./" + rel, nil
+func (s taskSpec) binaryArgs(r discoveryResult, editor editorKind) []string {
+	if s.variant == nil {
+		return r.testBinaryArgs
+	}
+	args := append(append([]string(nil), r.testBinaryArgs...), s.variant.binaryArgs...)
+	if s.variant.coverDir != "" {
+		args = append(args, "-test.gocoverdir="+editorRootPath(editor, s.variant.coverDir))
+	}
+	return args
 }
 
-func makeGeneratedTasks(testNames []string, pkgArg, relFilePath string, cfg Config, extraGoTestArgs []string) []map[string]any {
-	tasks := make([]map[string]any, 0, len(testNames))
-	for _, testName := range testNames {
-		args := make([]string, 0, 5+len(extraGoTestArgs))
-		args = append(args, "test")
-		args = append(args, extraGoTestArgs...)
-		args = append(args, pkgArg, "-run", runPatternForTestName(testName))
+// editorRootPath anchors a root-relative path at the editor's worktree
+// variable.
+func editorRootPath(editor editorKind, relPath string) string {
+	relPath = "./" + strings.TrimPrefix(filepath.ToSlash(filepath.Clean(relPath)), "./")
+	if editor == editorKindVSCode {
+		return vscodeProgramForPackageArg(relPath)
+	}
+	return zedPathForPackageArg(relPath)
+}
 
-		task := map[string]any{
-			"label":                 cfg.LabelPrefix + testName,
-			"command":               cfg.GoBinary,
-			"args":                  args,
-			"use_new_terminal":      cfg.UseNewTerminal,
-			"allow_concurrent_runs": cfg.AllowConcurrentRuns,
-			"reveal":                cfg.Reveal,
-			"hide":                  cfg.Hide,
-			"env": map[string]any{
-				cfg.GeneratedEnvKey: cfg.GeneratedEnvValue,
-				"ZED_GO_TEST_NAME":  testName,
-				"ZED_GO_TEST_FILE":  relFilePath,
-			},
+func (s taskSpec) env(env map[string]string) map[string]string {
+	if s.variant != nil {
+		for key, value := range s.variant.env {
+			env[key] = value
 		}
-		tasks = append(tasks, task)
+		env[variantEnvKey] = s.variant.name
 	}
-	return tasks
+	return env
 }
 
-func makeGeneratedDebugConfigs(testNames []string, pkgArg, relFilePath string, cfg Config, extraGoTestArgs []string) []map[string]any {
-	configs := make([]map[string]any, 0, len(testNames))
-	for _, testName := range testNames {
-		taskArgs := make([]string, 0, len(extraGoTestArgs)+2)
-		taskArgs = append(taskArgs, normalizeGoTestArgsForDelve(extraGoTestArgs)...)
-		taskArgs = append(taskArgs, "-test.run", runPatternForTestName(testName))
+// goTestTaskArgs builds `go test` args for one test. A non-empty chdir
+// runs `go -C <chdir> test .` instead of naming the package.
+func goTestTaskArgs(testName, pkgArg, chdir string, extraGoTestArgs, testBinaryArgs []string) []string {
+	return zed.GoTest{Name: testName, Package: pkgArg, Chdir: chdir, GoTestArgs: extraGoTestArgs, BinaryArgs: testBinaryArgs}.Args()
+}
 
-		config := map[string]any{
-			"label":   cfg.DebugLabelPrefix + testName,
-			"adapter": "Delve",
-			"request": "launch",
-			"mode":    "test",
-			"program": pkgArg,
-			"args":    taskArgs,
-			"env": map[string]any{
-				cfg.GeneratedEnvKey: cfg.GeneratedEnvValue,
-				"ZED_GO_TEST_NAME":  testName,
-				"ZED_GO_TEST_FILE":  relFilePath,
-			},
-		}
-		configs = append(configs, config)
+// delveTestArgs builds test binary args for a debug config, with the go
+// test flags rewritten into their -test. form.
+func delveTestArgs(testName string, extraGoTestArgs, testBinaryArgs []string) []string {
+	return zed.GoTest{Name: testName, GoTestArgs: normalizeGoTestArgsForDelve(extraGoTestArgs), BinaryArgs: testBinaryArgs}.DelveArgs()
+}
+
+// goChdirFor returns the package directory for `go -C` when GO_TEST_CHDIR
+// is enabled, anchored at the editor's worktree variable so the task does
+// not depend on the directory it is spawned in.
+func goChdirFor(cfg Config, editor editorKind, pkgArg string) string {
+	if !cfg.GoTestChdir || !cfg.toolchain().chdir {
+		return ""
 	}
-	return configs
+	if editor == editorKindVSCode {
+		return vscodeProgramForPackageArg(pkgArg)
+	}
+	return zedPathForPackageArg(pkgArg)
 }
 
-func makeGeneratedVSCodeTasks(testNames []string, pkgArg, relFilePath string, cfg Config, extraGoTestArgs []string) []map[string]any {
-	tasks := make([]map[string]any, 0, len(testNames))
-	for _, testName := range testNames {
-		args := make([]string, 0, 5+len(extraGoTestArgs))
-		args = append(args, "test")
-		args = append(args, extraGoTestArgs...)
-		args = append(args, pkgArg, "-run", runPatternForTestName(testName))
+// taskCwd resolves TASK_CWD for one entry: root, package, or a template
+// over .Root, .PackageDir and .Package. Empty leaves cwd unset.
+func taskCwd(cfg Config, editor editorKind, pkgArg string) string {
+	root, pkgDir := zedPathForPackageArg("."), zedPathForPackageArg(pkgArg)
+	if editor == editorKindVSCode {
+		root, pkgDir = vscodeProgramForPackageArg("."), vscodeProgramForPackageArg(pkgArg)
+	}
+	switch cfg.TaskCwd {
+	case "":
+		return ""
+	case taskCwdRoot:
+		return root
+	case taskCwdPackage:
+		return pkgDir
+	}
 
-		task := map[string]any{
-			"label":   cfg.LabelPrefix + testName,
-			"type":    "shell",
-			"command": cfg.GoBinary,
-			"args":    args,
-			"group":   "test",
-			"options": map[string]any{
-				"env": map[string]any{
-					cfg.GeneratedEnvKey: cfg.GeneratedEnvValue,
-					"ZED_GO_TEST_NAME":  testName,
-					"ZED_GO_TEST_FILE":  relFilePath,
-				},
-			},
-		}
-		tasks = append(tasks, task)
+	// loadConfig already rejected templates that do not parse.
+	tmpl, _ := parseTaskCwdTemplate(cfg.TaskCwd)
+	var buf bytes.Buffer
+	data := struct{ Root, PackageDir, Package string }{root, pkgDir, pkgArg}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return ""
 	}
-	return tasks
+	return buf.String()
+}
+
+// parseTaskCwdTemplate parses a custom TASK_CWD. The root and package
+// keywords and an empty value yield nil.
+func parseTaskCwdTemplate(text string) (*template.Template, error) {
+	switch text {
+	case "", taskCwdRoot, taskCwdPackage:
+		return nil, nil
+	}
+	return template.New("cwd").Option("missingkey=error").Parse(text)
 }
 
-func makeGeneratedVSCodeDebugConfigs(testNames []string, pkgArg, relFilePath string, cfg Config, extraGoTestArgs []string) []map[string]any {
-	configs := make([]map[string]any, 0, len(testNames))
-	for _, testName := range testNames {
-		taskArgs := make([]string, 0, len(extraGoTestArgs)+2)
-		taskArgs = append(taskArgs, normalizeGoTestArgsForDelve(extraGoTestArgs)...)
-		taskArgs = append(taskArgs, "-test.run", runPatternForTestName(testName))
+// packageArgForCwd is the package argument relative to the task cwd: a
+// package cwd runs the package in place.
+func packageArgForCwd(cfg Config, pkgArg string) string {
+	if cfg.TaskCwd == taskCwdPackage {
+		return "."
+	}
+	return pkgArg
+}
 
-		config := map[string]any{
-			"name":    cfg.DebugLabelPrefix + testName,
-			"type":    "go",
-			"request": "launch",
-			"mode":    "test",
-			"program": vscodeProgramForPackageArg(pkgArg),
-			"args":    taskArgs,
-			"env": map[string]any{
-				cfg.GeneratedEnvKey: cfg.GeneratedEnvValue,
-				"ZED_GO_TEST_NAME":  testName,
-				"ZED_GO_TEST_FILE":  relFilePath,
-			},
-		}
-		configs = append(configs, config)
+func zedPathForPackageArg(pkgArg string) string {
+	if pkgArg == "." {
+		return "$ZED_WORKTREE_ROOT"
+	}
+	if strings.HasPrefix(pkgArg, "./") {
+		return "$ZED_WORKTREE_ROOT/" + strings.TrimPrefix(pkgArg, "./")
 	}
-	return configs
+	return pkgArg
 }
 
 func vscodeProgramForPackageArg(pkgArg string) string {
@@ -731,24 +9181,183 @@ func vscodeProgramForPackageArg(pkgArg string) string {
 	return pkgArg
 }
 
+// normalizeGoTestArgsForDelve rewrites go test flags into the -test.*
+// flags of the test binary Delve launches. Flags only the go command
+// understands are dropped; unknown args are passed through unchanged.
 func normalizeGoTestArgsForDelve(args []string) []string {
 	out := make([]string, 0, len(args))
-	for _, arg := range args {
-		switch {
-		case arg == "-v":
-			out = append(out, "-test.v")
-		case arg == "-count":
-			// Bare -count is not useful without a value for debug configs.
-			continue
-		case strings.HasPrefix(arg, "-count="):
-			out = append(out, "-test."+strings.TrimPrefix(arg, "-"))
-		default:
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := parseGoFlag(arg)
+		info, known := goFlags[name]
+		if !known {
 			out = append(out, arg)
+			continue
+		}
+		if info.takesValue && !hasValue {
+			if i+1 >= len(args) {
+				// A trailing value flag without its value is not useful.
+				continue
+			}
+			i++
+			value, hasValue = args[i], true
+		}
+		if info.kind != goFlagTest {
+			continue
 		}
+		if hasValue {
+			out = append(out, "-test."+name+"="+value)
+			continue
+		}
+		out = append(out, "-test."+name)
 	}
 	return out
 }
 
+type goFlagKind int
+
+const (
+	// goFlagBuild flags configure the build, e.g. -tags or -race.
+	goFlagBuild goFlagKind = iota + 1
+	// goFlagTest flags are forwarded to the test binary as -test.<name>.
+	goFlagTest
+	// goFlagCommand flags only affect the go command itself, e.g. -json.
+	goFlagCommand
+)
+
+type goFlagInfo struct {
+	kind       goFlagKind
+	takesValue bool
+}
+
+// goFlags classifies the flags `go test` accepts before the package list.
+var goFlags = map[string]goFlagInfo{
+	"a":             {goFlagBuild, false},
+	"asan":          {goFlagBuild, false},
+	"asmflags":      {goFlagBuild, true},
+	"buildmode":     {goFlagBuild, true},
+	"buildvcs":      {goFlagBuild, false},
+	"compiler":      {goFlagBuild, true},
+	"cover":         {goFlagBuild, false},
+	"covermode":     {goFlagBuild, true},
+	"coverpkg":      {goFlagBuild, true},
+	"gccgoflags":    {goFlagBuild, true},
+	"gcflags":       {goFlagBuild, true},
+	"installsuffix": {goFlagBuild, true},
+	"ldflags":       {goFlagBuild, true},
+	"linkshared":    {goFlagBuild, false},
+	"mod":           {goFlagBuild, true},
+	"modcacherw":    {goFlagBuild, false},
+	"modfile":       {goFlagBuild, true},
+	"msan":          {goFlagBuild, false},
+	"n":             {goFlagBuild, false},
+	"overlay":       {goFlagBuild, true},
+	"p":             {goFlagBuild, true},
+	"pgo":           {goFlagBuild, true},
+	"pkgdir":        {goFlagBuild, true},
+	"race":          {goFlagBuild, false},
+	"tags":          {goFlagBuild, true},
+	"toolexec":      {goFlagBuild, true},
+	"trimpath":      {goFlagBuild, false},
+	"work":          {goFlagBuild, false},
+	"x":             {goFlagBuild, false},
+
+	"bench":                {goFlagTest, true},
+	"benchmem":             {goFlagTest, false},
+	"benchtime":            {goFlagTest, true},
+	"blockprofile":         {goFlagTest, true},
+	"blockprofilerate":     {goFlagTest, true},
+	"count":                {goFlagTest, true},
+	"coverprofile":         {goFlagTest, true},
+	"cpu":                  {goFlagTest, true},
+	"cpuprofile":           {goFlagTest, true},
+	"failfast":             {goFlagTest, false},
+	"fullpath":             {goFlagTest, false},
+	"fuzz":                 {goFlagTest, true},
+	"fuzzminimizetime":     {goFlagTest, true},
+	"fuzztime":             {goFlagTest, true},
+	"list":                 {goFlagTest, true},
+	"memprofile":           {goFlagTest, true},
+	"memprofilerate":       {goFlagTest, true},
+	"mutexprofile":         {goFlagTest, true},
+	"mutexprofilefraction": {goFlagTest, true},
+	"outputdir":            {goFlagTest, true},
+	"parallel":             {goFlagTest, true},
+	"run":                  {goFlagTest, true},
+	"short":                {goFlagTest, false},
+	"shuffle":              {goFlagTest, true},
+	"skip":                 {goFlagTest, true},
+	"timeout":              {goFlagTest, true},
+	"trace":                {goFlagTest, true},
+	"v":                    {goFlagTest, false},
+
+	"c":    {goFlagCommand, false},
+	"exec": {goFlagCommand, true},
+	"json": {goFlagCommand, false},
+	"o":    {goFlagCommand, true},
+	"vet":  {goFlagCommand, true},
+}
+
+// parseGoFlag splits -name=value (or --name=value) into its parts. name is
+// empty for args that are not flags.
+func parseGoFlag(arg string) (name, value string, hasValue bool) {
+	if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+		return "", "", false
+	}
+	name = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	name, value, hasValue = strings.Cut(name, "=")
+	return name, value, hasValue
+}
+
+// hasGoFlag reports whether args set the named flag, in either its go test
+// or its -test. form.
+func hasGoFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if flagName, _, _ := parseGoFlag(arg); flagName == name || flagName == "test."+name {
+			return true
+		}
+	}
+	return false
+}
+
+// splitGoTestArgs separates go build flags, go test flags and the test
+// binary args that follow -args. Build flags keep their separate value
+// arg, e.g. -tags integration.
+func splitGoTestArgs(args []string) (buildFlags, testFlags, binaryArgs []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-args" || arg == "--args" {
+			binaryArgs = append(binaryArgs, args[i+1:]...)
+			break
+		}
+		name, _, hasValue := parseGoFlag(arg)
+		info := goFlags[name]
+		group := &testFlags
+		if info.kind == goFlagBuild {
+			group = &buildFlags
+		}
+		*group = append(*group, arg)
+		if info.takesValue && !hasValue && i+1 < len(args) {
+			i++
+			*group = append(*group, args[i])
+		}
+	}
+	return buildFlags, testFlags, binaryArgs
+}
+
+// joinBuildFlags renders build flags as the single string Delve's
+// buildFlags option expects, quoting values that contain spaces.
+func joinBuildFlags(flags []string) string {
+	quoted := make([]string, 0, len(flags))
+	for _, arg := range flags {
+		if strings.ContainsAny(arg, " \t\"'") {
+			arg = strconv.Quote(arg)
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
 func resolveSubtestTimeout(fromEnv, fromFlag string) (time.Duration, error) {
 	value := strings.TrimSpace(fromEnv)
 	if strings.TrimSpace(fromFlag) != "" {
@@ -768,85 +9377,46 @@ func resolveSubtestTimeout(fromEnv, fromFlag string) (time.Duration, error) {
 	return timeout, nil
 }
 
-func discoverSubtestsWithGo(
-	goBinary string,
-	packageDir string,
-	topLevelTests []string,
-	timeout time.Duration,
-	extraGoTestArgs []string,
-) ([]string, error) {
-	if len(topLevelTests) == 0 {
-		return []string{}, nil
-	}
-
-	args := []string{"test", "-json", "-count=1", "-timeout", timeout.String()}
-	args = append(args, sanitizeDiscoveryGoTestArgs(extraGoTestArgs)...)
-	args = append(args, "-run", buildTopLevelRunPattern(topLevelTests), ".")
-
-	cmd := exec.Command(goBinary, args...)
-	cmd.Dir = packageDir
-	out, err := cmd.CombinedOutput()
-
-	discovered, parseErr := parseRunEventsFromGoTestJSON(out)
-	if parseErr != nil {
-		return nil, parseErr
+// runProcessTree runs cmd like cmd.Run, but when the tool gets one of the
+// terminationSignals it kills cmd together with the processes cmd started,
+// such as the test binary of go test, instead of leaving them running.
+func runProcessTree(cmd *exec.Cmd) error {
+	startProcessTree(cmd)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, terminationSignals...)
+	defer signal.Stop(stop)
+	if err := cmd.Start(); err != nil {
+		return err
 	}
-
-	// Discovery can still be useful even if tests failed; only fail hard when nothing was discovered.
-	if err != nil && len(discovered) == 0 {
-		return nil, fmt.Errorf("go test discovery failed in %s: %w\n%s", packageDir, err, strings.TrimSpace(string(out)))
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case sig := <-stop:
+		_ = killProcessTree(cmd.Process)
+		<-done
+		return fmt.Errorf("%w by %s", discovery.ErrInterrupted, sig)
 	}
-
-	return discovered, nil
 }
 
 func sanitizeDiscoveryGoTestArgs(args []string) []string {
 	out := make([]string, 0, len(args))
-	for _, arg := range args {
-		switch {
-		case arg == "-json", arg == "-run", strings.HasPrefix(arg, "-run="),
-			arg == "-list", strings.HasPrefix(arg, "-list="),
-			arg == "-timeout", strings.HasPrefix(arg, "-timeout="),
-			arg == "-count", strings.HasPrefix(arg, "-count="):
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := parseGoFlag(args[i])
+		switch name {
+		case "json", "run", "list", "timeout", "count":
+			// Discovery sets these itself; drop a separate value too.
+			if goFlags[name].takesValue && !hasValue {
+				i++
+			}
 			continue
-		default:
-			out = append(out, arg)
 		}
+		out = append(out, args[i])
 	}
 	return out
 }
 
-func parseRunEventsFromGoTestJSON(output []byte) ([]string, error) {
-	seen := make(map[string]struct{})
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-
-		var ev goTestJSONEvent
-		if err := json.Unmarshal([]byte(line), &ev); err != nil {
-			// Ignore non-JSON lines and keep scanning.
-			continue
-		}
-		if ev.Action == "run" && ev.Test != "" {
-			seen[ev.Test] = struct{}{}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	tests := make([]string, 0, len(seen))
-	for name := range seen {
-		tests = append(tests, name)
-	}
-	sort.Strings(tests)
-	return tests, nil
-}
-
 func mergeUniqueTests(base []string, extra []string) []string {
 	seen := make(map[string]struct{}, len(base)+len(extra))
 	merged := make([]string, 0, len(base)+len(extra))
@@ -889,38 +9459,41 @@ func countUniqueNotInBase(base []string, candidates []string) int {
 	return count
 }
 
-func buildTopLevelRunPattern(testNames []string) string {
-	if len(testNames) == 1 {
-		return "^" + regexp.QuoteMeta(testNames[0]) + "$"
-	}
-
-	parts := make([]string, 0, len(testNames))
-	for _, name := range testNames {
-		parts = append(parts, regexp.QuoteMeta(name))
+// mergePolicy is how merges into Zed files apply the merge strategy, file
+// ownership and the generated marker of c.
+func (c Config) mergePolicy() tasks.Policy {
+	return tasks.Policy{
+		Generated:     func(entry map[string]any) bool { return isGenerated(entry, c) },
+		Owned:         c.entryOwner(),
+		ID:            stableEntryID,
+		Prunes:        c.prunes,
+		Collapses:     c.collapses,
+		Replaces:      c.replaces,
+		SortGenerated: c.Reproducible,
 	}
-	sort.Strings(parts)
-	return "^(" + strings.Join(parts, "|") + ")$"
 }
 
-func runPatternForTestName(testName string) string {
-	if testName == "" {
-		return "^$"
-	}
-
-	segments := strings.Split(testName, "/")
-	for i, segment := range segments {
-		segments[i] = "^" + regexp.QuoteMeta(segment) + "$"
-	}
-	return strings.Join(segments, "/")
+// stableEntryIDKeys are the marker env keys that identify what a generated
+// entry runs, whatever its label. The file is left out: a test name is
+// unique within its package, and older versions did not record it.
+var stableEntryIDKeys = []string{testNameEnvKey, packageEnvKey, variantEnvKey, groupEnvKey, partEnvKey, specEnvKey}
+
+// stableEntryID identifies the test, package, variant and group a
+// generated entry runs. Two entries with the same ID are duplicates, e.g.
+// left behind by a LABEL_PREFIX change. It is "" when env has none of the
+// keys.
+func stableEntryID(env any) string {
+	return tasks.StableID(env, stableEntryIDKeys)
 }
 
-func mergeTasks(tasksPath string, generated []map[string]any, cfg Config) ([]map[string]any, mergeStats, error) {
-	existing, err := readTasks(tasksPath)
-	if err != nil {
-		return nil, mergeStats{}, err
+// collapses reports whether a merge may drop duplicate generated entries.
+// append-only never drops entries, and entries that do not run go are left
+// to keepsForeign.
+func (c Config) collapses(owned bool) bool {
+	if c.FileOwnership == ownershipExclusive {
+		return true
 	}
-	merged, stats := mergeGeneratedEntries(existing, generated, cfg, "label")
-	return merged, stats, nil
+	return c.MergeStrategy != mergeAppendOnly && (owned || c.Force)
 }
 
 func mergeVSCodeTasks(tasksPath string, generated []map[string]any, cfg Config) (map[string]any, mergeStats, error) {
@@ -928,8 +9501,8 @@ func mergeVSCodeTasks(tasksPath string, generated []map[string]any, cfg Config)
 	if err != nil {
 		return nil, mergeStats{}, err
 	}
-	merged, stats := mergeGeneratedEntries(existing, generated, cfg, "label")
-	doc["tasks"] = merged
+	merged, stats := tasks.MergeEntries(existing, generated, "label", cfg.mergePolicy())
+	doc["tasks"] = syncAllGeneratedVSCodeTask(merged, cfg)
 	return doc, stats, nil
 }
 
@@ -938,46 +9511,11 @@ func mergeVSCodeDebugConfigs(path string, generated []map[string]any, cfg Config
 	if err != nil {
 		return nil, mergeStats{}, err
 	}
-	merged, stats := mergeGeneratedEntries(existing, generated, cfg, "name")
+	merged, stats := tasks.MergeEntries(existing, generated, "name", cfg.mergePolicy())
 	doc["configurations"] = merged
 	return doc, stats, nil
 }
 
-func mergeGeneratedEntries(existing []map[string]any, generated []map[string]any, cfg Config, key string) ([]map[string]any, mergeStats) {
-	filtered := make([]map[string]any, 0, len(existing))
-	removed := 0
-	for _, entry := range existing {
-		if cfg.PruneGenerated && isGenerated(entry, cfg) {
-			removed++
-			continue
-		}
-		filtered = append(filtered, entry)
-	}
-
-	entryIndex := make(map[string]int, len(filtered))
-	for i, entry := range filtered {
-		if name, ok := entry[key].(string); ok {
-			entryIndex[name] = i
-		}
-	}
-
-	added := 0
-	updated := 0
-	for _, entry := range generated {
-		name, _ := entry[key].(string)
-		if idx, ok := entryIndex[name]; ok {
-			filtered[idx] = entry
-			updated++
-			continue
-		}
-		filtered = append(filtered, entry)
-		entryIndex[name] = len(filtered) - 1
-		added++
-	}
-
-	return filtered, mergeStats{Added: added, Updated: updated, Removed: removed}
-}
-
 func marshalTasks(tasks []map[string]any) ([]byte, error) {
 	output, err := json.MarshalIndent(tasks, "", "  ")
 	if err != nil {
@@ -994,258 +9532,246 @@ func marshalDocument(doc map[string]any) ([]byte, error) {
 	return append(output, '\n'), nil
 }
 
-func writeTasks(path string, data []byte) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+func writeTasks(path string, data []byte, modes fileModes) error {
+	if err := os.MkdirAll(filepath.Dir(path), modes.dir); err != nil {
 		return fmt.Errorf("create tasks directory: %w", err)
 	}
-	if err := os.WriteFile(path, data, 0o644); err != nil {
+	// os.WriteFile only applies the mode when creating the file, so existing
+	// files keep their permissions and owner.
+	if err := os.WriteFile(path, data, modes.file); err != nil {
 		return err
 	}
 	return nil
 }
 
-func readTasks(path string) ([]map[string]any, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []map[string]any{}, nil
-		}
-		return nil, err
-	}
+// fileTransaction stages the files one run writes and replaces them
+// together. Each file is written to a temporary sibling, and commit renames
+// them into place; when a rename fails, the files replaced so far are
+// restored, so tasks, debug configs and state never disagree.
+type fileTransaction struct {
+	staged []stagedFile
+}
 
-	data = bytes.TrimSpace(data)
-	if len(data) == 0 {
-		return []map[string]any{}, nil
-	}
+type stagedFile struct {
+	path string
+	temp string
+	// backup is where commit moved the replaced file until it succeeds.
+	backup   string
+	replaced bool
+}
 
-	normalized, err := normalizeRelaxedJSON(data)
-	if err != nil {
-		return nil, err
+// stage writes data next to path without touching path. Symlinks are
+// followed, and an existing file's mode carries over to its replacement.
+func (tx *fileTransaction) stage(path string, data []byte, modes fileModes) error {
+	mode := modes.file
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.IsDir():
+		return fmt.Errorf("%s is a directory", path)
+	case err == nil:
+		if path, err = filepath.EvalSymlinks(path); err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	case !errors.Is(err, os.ErrNotExist):
+		return err
 	}
-
-	var tasks []map[string]any
-	if err := json.Unmarshal(normalized, &tasks); err != nil {
-		return nil, err
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, modes.dir); err != nil {
+		return fmt.Errorf("create directory %s: %w", dir, err)
 	}
 
-	return tasks, nil
-}
-
-func readVSCodeTasksDocument(path string) (map[string]any, []map[string]any, error) {
-	doc, err := readObject(path)
+	temp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	if version, ok := doc["version"].(string); !ok || strings.TrimSpace(version) == "" {
-		doc["version"] = defaultVSCodeVersion
+	staged := stagedFile{path: path, temp: temp.Name()}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(staged.temp, mode)
 	}
-	tasks, err := readObjectSlice(doc, "tasks")
 	if err != nil {
-		return nil, nil, err
+		_ = os.Remove(staged.temp)
+		return err
 	}
-	return doc, tasks, nil
+	if info != nil {
+		keepOwner(staged.temp, info)
+	}
+	tx.staged = append(tx.staged, staged)
+	return nil
 }
 
-func readVSCodeLaunchDocument(path string) (map[string]any, []map[string]any, error) {
-	doc, err := readObject(path)
-	if err != nil {
-		return nil, nil, err
+// stageWithFallback stages data for path. When the directory of path is
+// not writable, e.g. a read-only checkout, it stages the file at the same
+// root-relative path under FALLBACK_DIR instead and returns that path, or
+// explains how to get around the error when no fallback is configured.
+func (tx *fileTransaction) stageWithFallback(cfg Config, absRootPath, path string, data []byte, modes fileModes) (string, error) {
+	err := tx.stage(path, data, modes)
+	if err == nil || !errors.Is(err, fs.ErrPermission) {
+		return path, err
 	}
-	if version, ok := doc["version"].(string); !ok || strings.TrimSpace(version) == "" {
-		doc["version"] = defaultVSLaunchVer
+	dir, dirErr := cfg.fallbackDir(absRootPath)
+	if dirErr != nil {
+		return path, dirErr
 	}
-	configs, err := readObjectSlice(doc, "configurations")
-	if err != nil {
-		return nil, nil, err
+	if dir == "" {
+		return path, fmt.Errorf("cannot write %s (%w); make %s writable, point TASKS_PATH/DEBUG_PATH at a writable file, or set FALLBACK_DIR (e.g. state) to write it elsewhere", path, fs.ErrPermission, filepath.Dir(path))
 	}
-	return doc, configs, nil
+	rel, relErr := filepath.Rel(absRootPath, path)
+	if relErr != nil || !filepath.IsLocal(rel) {
+		rel = filepath.Base(path)
+	}
+	fallback := filepath.Join(dir, rel)
+	if err := tx.stage(fallback, data, modes); err != nil {
+		return path, fmt.Errorf("write fallback %s: %w", fallback, err)
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "note: %s is not writable; wrote %s instead. Copy it into place, or make the directory writable and generate again\n", filepath.Dir(path), fallback)
+	return fallback, nil
 }
 
-func readObject(path string) (map[string]any, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return map[string]any{}, nil
+// fallbackDir resolves FALLBACK_DIR for the workspace at absRootPath: ""
+// when unset, a per-workspace directory under the user's state directory
+// for "state", or the given directory, relative to the workspace root.
+func (c Config) fallbackDir(absRootPath string) (string, error) {
+	switch c.FallbackDir {
+	case "":
+		return "", nil
+	case "state":
+		base, err := userStateDir()
+		if err != nil {
+			return "", fmt.Errorf("resolve FALLBACK_DIR=state: %w", err)
 		}
-		return nil, err
-	}
-
-	data = bytes.TrimSpace(data)
-	if len(data) == 0 {
-		return map[string]any{}, nil
+		return filepath.Join(base, "go-zed-tasks", filepath.Base(absRootPath)+"-"+shortHash(absRootPath)), nil
 	}
+	return resolvePath(absRootPath, c.FallbackDir), nil
+}
 
-	normalized, err := normalizeRelaxedJSON(data)
-	if err != nil {
-		return nil, err
-	}
+const (
+	// lockWait bounds how long lockFile waits where it has to poll.
+	lockWait = 30 * time.Second
+	lockPoll = 50 * time.Millisecond
+	// staleLockAge is when a polled lock file counts as left behind.
+	staleLockAge = 2 * time.Minute
+)
 
-	var doc map[string]any
-	if err := json.Unmarshal(normalized, &doc); err != nil {
-		return nil, err
+// lockState serializes the read-merge-write cycles of runs in the same
+// workspace with a lock file in the state directory and returns its
+// unlock. Locking is best effort: where the lock cannot be taken, such as
+// a read-only .zed/, the run goes ahead with a warning.
+func lockState(absRootPath string, modes fileModes) (unlock func()) {
+	dir := filepath.Join(absRootPath, filepath.FromSlash(stateDirPath))
+	if err := os.MkdirAll(dir, modes.dir); err != nil {
+		return func() {}
 	}
-	if doc == nil {
-		doc = map[string]any{}
+	unlock, err := lockFile(filepath.Join(dir, "lock"))
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: running without the workspace lock: %v\n", err)
+		return func() {}
 	}
-	return doc, nil
+	return unlock
 }
 
-func readObjectSlice(doc map[string]any, key string) ([]map[string]any, error) {
-	value, ok := doc[key]
-	if !ok || value == nil {
-		return []map[string]any{}, nil
-	}
-	raw, ok := value.([]any)
-	if !ok {
-		return nil, fmt.Errorf("%q must be an array", key)
+// userStateDir is $XDG_STATE_HOME, or ~/.local/state where XDG applies
+// and the user cache directory elsewhere.
+func userStateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return dir, nil
 	}
-	entries := make([]map[string]any, 0, len(raw))
-	for i, item := range raw {
-		m, ok := item.(map[string]any)
-		if !ok {
-			return nil, fmt.Errorf("%q[%d] must be an object", key, i)
-		}
-		entries = append(entries, m)
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" || runtime.GOOS == "ios" || runtime.GOOS == "plan9" {
+		return os.UserCacheDir()
 	}
-	return entries, nil
-}
-
-func normalizeRelaxedJSON(data []byte) ([]byte, error) {
-	withoutComments, err := stripJSONComments(data)
+	home, err := os.UserHomeDir()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	return stripTrailingCommas(withoutComments), nil
+	return filepath.Join(home, ".local", "state"), nil
 }
 
-func stripJSONComments(data []byte) ([]byte, error) {
-	var out []byte
-	out = make([]byte, 0, len(data))
-
-	inString := false
-	inLineComment := false
-	inBlockComment := false
-	escape := false
-
-	for i := 0; i < len(data); i++ {
-		ch := data[i]
-
-		if inLineComment {
-			if ch == '\n' {
-				inLineComment = false
-				out = append(out, ch)
-			}
-			continue
-		}
-
-		if inBlockComment {
-			if ch == '*' && i+1 < len(data) && data[i+1] == '/' {
-				inBlockComment = false
-				i++
-			}
-			continue
-		}
-
-		if inString {
-			out = append(out, ch)
-			if escape {
-				escape = false
-				continue
-			}
-			if ch == '\\' {
-				escape = true
-				continue
-			}
-			if ch == '"' {
-				inString = false
-			}
-			continue
-		}
-
-		if ch == '"' {
-			inString = true
-			out = append(out, ch)
-			continue
+// commit moves every staged file into place, or none of them.
+func (tx *fileTransaction) commit() error {
+	for i := range tx.staged {
+		if err := tx.staged[i].replace(); err != nil {
+			err = fmt.Errorf("replace %s: %w", tx.staged[i].path, err)
+			tx.rollback()
+			return err
 		}
-
-		if ch == '/' && i+1 < len(data) {
-			next := data[i+1]
-			if next == '/' {
-				inLineComment = true
-				i++
-				continue
-			}
-			if next == '*' {
-				inBlockComment = true
-				i++
-				continue
-			}
+	}
+	for _, file := range tx.staged {
+		if file.backup != "" {
+			_ = os.Remove(file.backup)
 		}
-
-		out = append(out, ch)
 	}
+	tx.staged = nil
+	return nil
+}
 
-	if inBlockComment {
-		return nil, fmt.Errorf("unterminated block comment in tasks file")
+func (f *stagedFile) replace() error {
+	if _, err := os.Lstat(f.path); err == nil {
+		backup := strings.TrimSuffix(f.temp, ".tmp") + ".bak"
+		if err := os.Rename(f.path, backup); err != nil {
+			return err
+		}
+		f.backup = backup
 	}
-	if inString {
-		return nil, fmt.Errorf("unterminated string in tasks file")
+	if err := os.Rename(f.temp, f.path); err != nil {
+		return err
 	}
-	return out, nil
+	f.replaced = true
+	return nil
 }
 
-func stripTrailingCommas(data []byte) []byte {
-	out := make([]byte, 0, len(data))
-	inString := false
-	escape := false
-
-	for i := 0; i < len(data); i++ {
-		ch := data[i]
-
-		if inString {
-			out = append(out, ch)
-			if escape {
-				escape = false
-				continue
-			}
-			if ch == '\\' {
-				escape = true
-				continue
-			}
-			if ch == '"' {
-				inString = false
-			}
-			continue
-		}
-
-		if ch == '"' {
-			inString = true
-			out = append(out, ch)
-			continue
+// rollback restores the files commit replaced and removes staged ones. It
+// does nothing after a successful commit.
+func (tx *fileTransaction) rollback() {
+	for i := len(tx.staged) - 1; i >= 0; i-- {
+		file := tx.staged[i]
+		if file.backup != "" {
+			_ = os.Rename(file.backup, file.path)
+		} else if file.replaced {
+			_ = os.Remove(file.path)
 		}
-
-		if ch == ',' {
-			j := i + 1
-			for j < len(data) && isJSONWhitespace(data[j]) {
-				j++
-			}
-			if j < len(data) && (data[j] == '}' || data[j] == ']') {
-				continue
-			}
+		if !file.replaced {
+			_ = os.Remove(file.temp)
 		}
-
-		out = append(out, ch)
 	}
+	tx.staged = nil
+}
 
-	return out
+func readVSCodeTasksDocument(path string) (map[string]any, []map[string]any, error) {
+	doc, err := tasks.ReadObject(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version, ok := doc["version"].(string); !ok || strings.TrimSpace(version) == "" {
+		doc["version"] = defaultVSCodeVersion
+	}
+	tasks, err := tasks.ObjectSlice(doc, "tasks")
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, tasks, nil
 }
 
-func isJSONWhitespace(ch byte) bool {
-	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+func readVSCodeLaunchDocument(path string) (map[string]any, []map[string]any, error) {
+	doc, err := tasks.ReadObject(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version, ok := doc["version"].(string); !ok || strings.TrimSpace(version) == "" {
+		doc["version"] = defaultVSLaunchVer
+	}
+	configs, err := tasks.ObjectSlice(doc, "configurations")
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, configs, nil
 }
 
 func isGenerated(task map[string]any, cfg Config) bool {
-	if val, ok := generatedValueFromEnvMap(task["env"], cfg.GeneratedEnvKey); ok {
+	if val, ok := tasks.EnvValue(task["env"], cfg.GeneratedEnvKey); ok {
 		return val == cfg.GeneratedEnvValue
 	}
 
@@ -1257,47 +9783,23 @@ func isGenerated(task map[string]any, cfg Config) bool {
 	if !ok {
 		return false
 	}
-	val, ok := generatedValueFromEnvMap(options["env"], cfg.GeneratedEnvKey)
+	val, ok := tasks.EnvValue(options["env"], cfg.GeneratedEnvKey)
 	if !ok {
 		return false
 	}
 	return val == cfg.GeneratedEnvValue
 }
 
-func generatedValueFromEnvMap(value any, key string) (string, bool) {
-	env, ok := value.(map[string]any)
-	if !ok {
-		return "", false
-	}
-	valAny, ok := env[key]
-	if !ok {
-		return "", false
-	}
-	val, ok := valAny.(string)
-	if !ok {
-		return "", false
-	}
-	return val, true
-}
-
-func detectWorkspaceRoot(start string) string {
-	for current := start; ; {
-		if fileExists(filepath.Join(current, "go.mod")) || pathExists(filepath.Join(current, ".git")) {
-			return current
-		}
-
-		parent := filepath.Dir(current)
-		if parent == current {
-			break
+// rootRelPath is filepath.Rel for a path under root. Where paths fold case,
+// a path that spells root differently, e.g. from an editor that
+// lower-cases drive letters, is still taken to be under root.
+func rootRelPath(root, target string) (string, error) {
+	if pathsFoldCase && len(target) >= len(root) && strings.EqualFold(target[:len(root)], root) {
+		if len(target) == len(root) || os.IsPathSeparator(target[len(root)]) || os.IsPathSeparator(root[len(root)-1]) {
+			target = root + target[len(root):]
 		}
-		current = parent
 	}
-
-	cwd, err := os.Getwd()
-	if err != nil {
-		return start
-	}
-	return cwd
+	return filepath.Rel(root, target)
 }
 
 func resolvePath(root, path string) string {
@@ -1307,6 +9809,18 @@ func resolvePath(root, path string) string {
 	return filepath.Join(root, path)
 }
 
+// resolveOutPath resolves -out relative to the current directory, keeping "-"
+// as the stdout marker.
+func resolveOutPath(path string) string {
+	if path == "-" {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
 func fileExists(path string) bool {
 	info, err := os.Stat(path)
 	if err != nil {
@@ -3,27 +3,45 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/VashingMachine/go-zed-test/pkg/discovery"
+	"github.com/VashingMachine/go-zed-test/pkg/tasks"
 )
 
 var configEnvKeys = []string{
+	"ZED_GO_TASKS_CONFIG_PATH",
 	"ZED_GO_TASKS_TASKS_PATH",
 	"ZED_GO_TASKS_DEBUG_PATH",
 	"ZED_GO_TASKS_LABEL_PREFIX",
 	"ZED_GO_TASKS_DEBUG_LABEL_PREFIX",
+	"ZED_GO_TASKS_LABEL_TEMPLATE",
 	"ZED_GO_TASKS_GO_BINARY",
 	"ZED_GO_TASKS_TEST_NAME_REGEX",
 	"ZED_GO_TASKS_GO_LIST_REGEX",
+	"ZED_GO_TASKS_BENCHMARK_NAME_REGEX",
+	"ZED_GO_TASKS_FUZZ_NAME_REGEX",
+	"ZED_GO_TASKS_EXAMPLE_NAME_REGEX",
 	"ZED_GO_TASKS_ADDITIONAL_GO_TEST_ARGS",
 	"ZED_GO_TASKS_USE_NEW_TERMINAL",
 	"ZED_GO_TASKS_ALLOW_CONCURRENT_RUNS",
@@ -33,6 +51,82 @@ var configEnvKeys = []string{
 	"ZED_GO_TASKS_GENERATED_ENV_KEY",
 	"ZED_GO_TASKS_GENERATED_ENV_VALUE",
 	"ZED_GO_TASKS_SUBTEST_DISCOVERY_TIMEOUT",
+	"ZED_GO_TASKS_TEST_TIMEOUT",
+	"ZED_GO_TASKS_TEST_TIMEOUTS",
+	"ZED_GO_TASKS_DISCOVERY_STRATEGIES",
+	"ZED_GO_TASKS_TASK_EXTRA_FIELDS",
+	"ZED_GO_TASKS_TEST_BINARY_ARGS",
+	"ZED_GO_TASKS_BUILD_FLAGS",
+	"ZED_GO_TASKS_GO_TEST_CHDIR",
+	"ZED_GO_TASKS_TASK_CWD",
+	"ZED_GO_TASKS_GOLDEN_UPDATE_FLAG",
+	"ZED_GO_TASKS_CROSS_COMPILE_VARIANTS",
+	"ZED_GO_TASKS_GOLDEN_VARIANTS",
+	"ZED_GO_TASKS_GOLDEN_FLAG_REGEX",
+	"ZED_GO_TASKS_TASK_ENV",
+	"ZED_GO_TASKS_DOTENV_PATH",
+	"ZED_GO_TASKS_SECRET_ENV_PATTERN",
+	"ZED_GO_TASKS_SECRET_ENV_MODE",
+	"ZED_GO_TASKS_FILE_MODE",
+	"ZED_GO_TASKS_DIR_MODE",
+	"ZED_GO_TASKS_WATCH_COMMAND",
+	"ZED_GO_TASKS_COVERAGE_VARIANTS",
+	"ZED_GO_TASKS_COVERAGE_DIR",
+	"ZED_GO_TASKS_GOTRACEBACK",
+	"ZED_GO_TASKS_GODEBUG",
+	"ZED_GO_TASKS_RUNTIME_ENV_IN_DEBUG",
+	"ZED_GO_TASKS_SANITIZER_VARIANTS",
+	"ZED_GO_TASKS_SANITIZER_CC",
+	"ZED_GO_TASKS_SANITIZER_CXX",
+	"ZED_GO_TASKS_CGO_ENABLED",
+	"ZED_GO_TASKS_CGO_CFLAGS",
+	"ZED_GO_TASKS_PKG_CONFIG_PATH",
+	"ZED_GO_TASKS_DISCOVERY_CACHE",
+	"ZED_GO_TASKS_DISCOVERY_CACHE_MODE",
+	"ZED_GO_TASKS_DISCOVERY_CACHE_TOKEN",
+	"ZED_GO_TASKS_CA_BUNDLE",
+	"ZED_GO_TASKS_OFFLINE",
+	"ZED_GO_TASKS_DISCOVERY_GOMAXPROCS",
+	"ZED_GO_TASKS_DISCOVERY_PROCS",
+	"ZED_GO_TASKS_DISCOVERY_NICE",
+	"ZED_GO_TASKS_MERGE_STRATEGY",
+	"ZED_GO_TASKS_CONCURRENT_RUNS_POLICY",
+	"ZED_GO_TASKS_SERIAL_PACKAGES",
+	"ZED_GO_TASKS_AGGREGATE_PARALLEL",
+	"ZED_GO_TASKS_SKIPPED_TESTS",
+	"ZED_GO_TASKS_FAILFAST_VARIANTS",
+	"ZED_GO_TASKS_FILE_OWNERSHIP",
+	"ZED_GO_TASKS_FALLBACK_DIR",
+	"ZED_GO_TASKS_RUNNER_SCRIPTS",
+	"ZED_GO_TASKS_MAX_RUN_PATTERN",
+	"ZED_GO_TASKS_METRICS",
+	"ZED_GO_TASKS_METRICS_PATH",
+	"ZED_GO_TASKS_TASK_LOGS",
+	"ZED_GO_TASKS_TASK_LOG_KEEP",
+	"ZED_GO_TASKS_SHORT_VARIANTS",
+	"ZED_GO_TASKS_EXTRA_TEST_NAME_REGEX",
+	"ZED_GO_TASKS_KEYMAP_PATH",
+	"ZED_GO_TASKS_REPRODUCIBLE",
+	"ZED_GO_TASKS_SKIP_GENERATED_FILES",
+	"ZED_GO_TASKS_GENERATED_FILE_GLOBS",
+	"ZED_GO_TASKS_KEYMAP_BINDINGS",
+	"ZED_GO_TASKS_KEYMAP_RECENT",
+	"ZED_GO_TASKS_KEYMAP_RECENT_PREFIX",
+	"ZED_GO_TASKS_ALL_GENERATED_TASK",
+	"ZED_GO_TASKS_EXCLUDE_TEST_REGEX",
+	"ZED_GO_TASKS_MAX_LABEL_LENGTH",
+	"ZED_GO_TASKS_LABEL_LENGTH_POLICY",
+	"ZED_GO_TASKS_GINKGO_SPECS",
+	"ZED_GO_TASKS_GINKGO_LABEL_PREFIX",
+	"ZED_GO_TASKS_GINKGO_BINARY",
+	"ZED_GO_TASKS_AUTO_SUBTESTS_MAX_DURATION",
+	"ZED_GO_TASKS_MAX_TASKS",
+	"ZED_GO_TASKS_MAX_TASKS_EVICTION",
+	"ZED_GO_TASKS_TASKFILE_PATH",
+	"ZED_GO_TASKS_TASKFILE_PREFIX",
+	"ZED_GO_TASKS_MAKEFILE_PATH",
+	"ZED_GO_TASKS_MAKEFILE_PREFIX",
+	"ZED_GO_TASKS_EXPORT_PATH",
 }
 
 func TestRun_HelpAndUnknownCommand(t *testing.T) {
@@ -89,7 +183,7 @@ func TestReadTasks_SupportsCommentsAndTrailingCommas(t *testing.T) {
   },
 ]`)
 
-	tasks, err := readTasks(tasksPath)
+	tasks, err := tasks.ReadArray(tasksPath)
 	require.NoError(t, err)
 	require.Len(t, tasks, 2)
 
@@ -127,25 +221,14 @@ func TestMergeTasks_PrunesGeneratedAndUpsertsByLabel(t *testing.T) {
   }
 ]`)
 
-	generated := []map[string]any{
-		{
-			"label":   "go:TestNew",
-			"command": "go",
-			"env": map[string]any{
-				cfg.GeneratedEnvKey: cfg.GeneratedEnvValue,
-			},
-		},
-		{
-			"label":   "go:TestAdded",
-			"command": "go",
-			"env": map[string]any{
-				cfg.GeneratedEnvKey: cfg.GeneratedEnvValue,
-			},
-		},
+	generated := []Task{
+		{Label: "go:TestNew", Command: "go", Env: map[string]string{cfg.GeneratedEnvKey: cfg.GeneratedEnvValue}},
+		{Label: "go:TestAdded", Command: "go", Env: map[string]string{cfg.GeneratedEnvKey: cfg.GeneratedEnvValue}},
 	}
 
-	merged, stats, err := mergeTasks(tasksPath, generated, cfg)
+	file, stats, err := tasks.MergeFile(tasksPath, generated, cfg.mergePolicy())
 	require.NoError(t, err)
+	merged := file.Values()
 
 	assert.Equal(t, 1, stats.Removed)
 	assert.Equal(t, 1, stats.Updated)
@@ -157,6 +240,101 @@ func TestMergeTasks_PrunesGeneratedAndUpsertsByLabel(t *testing.T) {
 	assert.Nil(t, findTaskByLabel(merged, "go:TestOld"))
 }
 
+func TestMergeTasks_CollapsesDuplicateGeneratedEntries(t *testing.T) {
+	root := t.TempDir()
+	tasksPath := filepath.Join(root, "tasks.json")
+	cfg := Config{GeneratedEnvKey: "ZED_GO_TEST_TASK_GENERATED", GeneratedEnvValue: "1", MergeStrategy: mergeReplace}
+
+	writeFile(t, tasksPath, `[
+  {"label": "test:TestA", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestA", "ZED_GO_TEST_PACKAGE": "./a"}},
+  {"label": "go:TestA", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestA", "ZED_GO_TEST_PACKAGE": "./a"}},
+  {"label": "old:TestB", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestB", "ZED_GO_TEST_PACKAGE": "./b"}},
+  {"label": "new:TestB", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestB", "ZED_GO_TEST_PACKAGE": "./b"}},
+  {"label": "go:TestB [race]", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestB", "ZED_GO_TEST_PACKAGE": "./b", "ZED_GO_TEST_VARIANT": "race"}},
+  {"label": "script:TestB", "command": "./test.sh", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestB", "ZED_GO_TEST_PACKAGE": "./b"}},
+  {"label": "manual:TestA", "command": "go", "env": {"ZED_GO_TEST_NAME": "TestA", "ZED_GO_TEST_PACKAGE": "./a"}}
+]`)
+
+	generated := []Task{{Label: "go:TestA", Command: "go", Env: map[string]string{
+		cfg.GeneratedEnvKey: cfg.GeneratedEnvValue, testNameEnvKey: "TestA", packageEnvKey: "./a",
+	}}}
+	file, stats, err := tasks.MergeFile(tasksPath, generated, cfg.mergePolicy())
+	require.NoError(t, err)
+
+	assert.Equal(t, mergeStats{Updated: 1, Collapsed: 2}, stats)
+	assert.Equal(t, []string{"go:TestA", "new:TestB", "go:TestB [race]", "script:TestB", "manual:TestA"}, labelsFromTasks(file.Values()))
+
+	cfg.MergeStrategy = mergeAppendOnly
+	file, stats, err = tasks.MergeFile(tasksPath, generated, cfg.mergePolicy())
+	require.NoError(t, err)
+	assert.Zero(t, stats.Collapsed)
+	assert.Len(t, file.Values(), 7)
+}
+
+func TestMergeTasks_KeepsUntouchedEntriesVerbatim(t *testing.T) {
+	root := t.TempDir()
+	tasksPath := filepath.Join(root, "tasks.json")
+	cfg := Config{GeneratedEnvKey: "ZED_GO_TEST_TASK_GENERATED", GeneratedEnvValue: "1", PruneGenerated: true}
+
+	writeFile(t, tasksPath, `[
+  // manual entries keep their key order and escaping
+  {"label": "manual", "command": "make lint && make test"},
+  {"label": 42, "command": "odd"},
+]`)
+
+	file, stats, err := tasks.MergeFile(tasksPath, []Task{
+		{Label: "go:TestA", Command: "go", Env: map[string]string{cfg.GeneratedEnvKey: cfg.GeneratedEnvValue}},
+	}, cfg.mergePolicy())
+	require.NoError(t, err)
+	assert.Equal(t, mergeStats{Added: 1}, stats)
+
+	data, err := file.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, `[
+  {
+    "label": "manual",
+    "command": "make lint && make test"
+  },
+  {
+    "command": "odd",
+    "label": 42
+  },
+  {
+    "allow_concurrent_runs": false,
+    "command": "go",
+    "env": {
+      "ZED_GO_TEST_TASK_GENERATED": "1"
+    },
+    "label": "go:TestA",
+    "use_new_terminal": false
+  }
+]
+`, string(data))
+}
+
+func TestTask_RoundTripKeepsUnknownFields(t *testing.T) {
+	input := `{"label":"go:TestA","command":"go","tags":["go-test"],"reveal_target":"center","shell":{"program":"bash"},"use_new_terminal":true,"allow_concurrent_runs":false}`
+
+	var task Task
+	require.NoError(t, json.Unmarshal([]byte(input), &task))
+	assert.Equal(t, "go:TestA", task.Label)
+	assert.True(t, task.UseNewTerminal)
+	assert.Equal(t, map[string]json.RawMessage{
+		"tags":          json.RawMessage(`["go-test"]`),
+		"reveal_target": json.RawMessage(`"center"`),
+		"shell":         json.RawMessage(`{"program":"bash"}`),
+	}, task.Extra)
+
+	task.Extra["label"] = json.RawMessage(`"ignored"`)
+	data, err := json.Marshal(task)
+	require.NoError(t, err)
+	assert.JSONEq(t, input, string(data))
+
+	var config DebugConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"label":"d","adapter":"Delve","request":"launch","stopOnEntry":true}`), &config))
+	assert.Equal(t, map[string]json.RawMessage{"stopOnEntry": json.RawMessage(`true`)}, config.Extra)
+}
+
 func TestRunGenerate_CreatesTasksForCurrentFileAndPreservesManual(t *testing.T) {
 	clearConfigEnv(t)
 
@@ -257,6 +435,48 @@ func TestOne(t *testing.T) {}
 	assert.Equal(t, "yes", env["AUTO_TASK"])
 }
 
+func TestRunGenerate_RendersLabelTemplate(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "internal", "payments", "refund_test.go")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package payments
+import "testing"
+
+func TestRefund_Succeeds(t *testing.T) {}
+`)
+
+	setEnv(t, "ZED_GO_TASKS_LABEL_TEMPLATE", "{{base .Package}} ▸ {{words (trimPrefix .Test)}}")
+
+	err := runGenerate([]string{"-file", targetFile, "-root", root, "-targets", "tasks,debug"}, generateTargetTasks)
+	require.NoError(t, err)
+
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	task := taskByLabel(t, tasks, "payments ▸ refund succeeds")
+	assert.Equal(t, []string{"test", "./internal/payments", "-run", "^TestRefund_Succeeds$"}, toStringSlice(t, task["args"]))
+
+	configs := readTasksForTest(t, filepath.Join(root, ".zed", "debug.json"))
+	assert.Equal(t, []string{"payments ▸ refund succeeds"}, labelsFromTasks(configs))
+
+	setEnv(t, "ZED_GO_TASKS_LABEL_TEMPLATE", "{{.Nope")
+	err = runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid label_template")
+}
+
+func TestLabelTemplateFuncs(t *testing.T) {
+	assert.Equal(t, "Refund_Succeeds", trimTestPrefix("TestRefund_Succeeds"))
+	assert.Equal(t, "Parse", trimTestPrefix("BenchmarkParse"))
+	assert.Equal(t, "refund succeeds http server", camelWords("Refund_SucceedsHTTPServer"))
+	assert.Equal(t, "refund / with fee", camelWords("Refund/with_fee"))
+	assert.Equal(t, "i/p/refund_test.go", shortPath("internal/payments/refund_test.go"))
+	assert.Equal(t, "i/payments", shortPath("./internal/payments"))
+	assert.Len(t, shortHash("TestRefund"), 7)
+	assert.Equal(t, shortHash("TestRefund"), shortHash("TestRefund"))
+}
+
 func TestRunGenerate_UsesCommandLineGoTestArgs(t *testing.T) {
 	clearConfigEnv(t)
 
@@ -290,378 +510,4134 @@ func TestOne(t *testing.T) {}
 	assert.Equal(t, []string{"test", "-v", "-count=1", "-timeout=30s", ".", "-run", "^TestOne$"}, args)
 }
 
-func TestRunGenerate_PrintsEachGeneratedTask(t *testing.T) {
+func TestRunGenerate_PassesTestBinaryArgsAfterArgs(t *testing.T) {
 	clearConfigEnv(t)
 
 	root := t.TempDir()
 	targetFile := filepath.Join(root, "target_test.go")
 	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	debugPath := filepath.Join(root, ".zed", "debug.json")
 
 	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
 	writeFile(t, targetFile, `package sample
 import "testing"
 
-func TestAlpha(t *testing.T) {}
-func TestBeta(t *testing.T) {}
+func TestOne(t *testing.T) {}
 `)
 
-	out := captureStdout(t, func() {
-		err := runGenerate([]string{
-			"-file", targetFile,
-			"-root", root,
-			"-tasks", tasksPath,
-		}, generateTargetTasks)
-		require.NoError(t, err)
-	})
+	setEnv(t, "ZED_GO_TASKS_TEST_BINARY_ARGS", "-fixtures=testdata")
+	setEnv(t, "ZED_GO_TASKS_GOLDEN_UPDATE_FLAG", "-update-golden")
 
-	assert.Contains(t, out, "Generated task: go:TestAlpha")
-	assert.Contains(t, out, "Generated task: go:TestBeta")
+	err := runGenerate([]string{
+		"-file", targetFile,
+		"-root", root,
+		"-targets", "tasks,debug",
+		"-go-test-arg=-v",
+		"-test-binary-arg=-verbose-fixtures",
+		"-golden-update",
+	}, generateTargetTasks)
+	require.NoError(t, err)
+
+	task := taskByLabel(t, readTasksForTest(t, tasksPath), "go:TestOne")
+	assert.Equal(t, []string{
+		"test", "-v", ".", "-run", "^TestOne$",
+		"-args", "-fixtures=testdata", "-verbose-fixtures", "-update-golden",
+	}, toStringSlice(t, task["args"]))
+
+	config := taskByLabel(t, readTasksForTest(t, debugPath), "go:debug:TestOne")
+	assert.Equal(t, []string{
+		"-test.v", "-test.run", "^TestOne$",
+		"-fixtures=testdata", "-verbose-fixtures", "-update-golden",
+	}, toStringSlice(t, config["args"]))
 }
 
-func TestRunGenerateDebug_WritesDebugConfigs(t *testing.T) {
+func TestRunGenerate_SeparatesBuildFlagsTestFlagsAndBinaryArgs(t *testing.T) {
 	clearConfigEnv(t)
 
 	root := t.TempDir()
 	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
 	debugPath := filepath.Join(root, ".zed", "debug.json")
 
 	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
-	writeFile(t, targetFile, `package sample
+	writeFile(t, targetFile, `//go:build integration
+
+package sample
 import "testing"
 
 func TestOne(t *testing.T) {}
 `)
 
+	setEnv(t, "ZED_GO_TASKS_BUILD_FLAGS", "-trimpath")
+
 	err := runGenerate([]string{
 		"-file", targetFile,
 		"-root", root,
-		"-debug", debugPath,
-		"-go-test-arg=-v",
-		"-go-test-arg=-count=1",
-	}, generateTargetDebug)
+		"-targets", "tasks,debug",
+		"-build-flag=-ldflags=-X main.version=dev",
+		"--", "-v", "-tags", "integration", "-count", "1", "-json", "-args", "-update",
+	}, generateTargetTasks)
 	require.NoError(t, err)
 
-	configs := readTasksForTest(t, debugPath)
-	require.Len(t, configs, 1)
+	task := taskByLabel(t, readTasksForTest(t, tasksPath), "go:TestOne")
+	assert.Equal(t, []string{
+		"test", "-trimpath", "-ldflags=-X main.version=dev", "-tags", "integration",
+		"-v", "-count", "1", "-json", ".", "-run", "^TestOne$", "-args", "-update",
+	}, toStringSlice(t, task["args"]))
 
-	config := taskByLabel(t, configs, "go:debug:TestOne")
-	assert.Equal(t, "Delve", config["adapter"])
-	assert.Equal(t, "launch", config["request"])
-	assert.Equal(t, "test", config["mode"])
+	config := taskByLabel(t, readTasksForTest(t, debugPath), "go:debug:TestOne")
+	assert.Equal(t, []string{"-test.v", "-test.count=1", "-test.run", "^TestOne$", "-update"}, toStringSlice(t, config["args"]))
+	assert.Equal(t, `-trimpath "-ldflags=-X main.version=dev" -tags integration`, config["buildFlags"])
+}
+
+func TestRunGenerate_GoTestChdirUsesDashC(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "internal", "payments", "refund_test.go")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package payments
+import "testing"
+
+func TestRefund(t *testing.T) {}
+`)
+
+	setEnv(t, "ZED_GO_TASKS_GO_TEST_CHDIR", "true")
+
+	err := runGenerate([]string{"-file", targetFile, "-root", root, "-editor", "zed,vscode", "-go-test-arg=-v"}, generateTargetTasks)
+	require.NoError(t, err)
+
+	task := taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:TestRefund")
+	assert.Equal(t, []string{"-C", "$ZED_WORKTREE_ROOT/internal/payments", "test", "-v", ".", "-run", "^TestRefund$"}, toStringSlice(t, task["args"]))
+	assert.Equal(t, "./internal/payments", toStringMap(t, task["env"])["ZED_GO_TEST_PACKAGE"])
+
+	_, vscodeTasks, err := readVSCodeTasksDocument(filepath.Join(root, ".vscode", "tasks.json"))
+	require.NoError(t, err)
+	vscodeTask := taskByLabel(t, vscodeTasks, "go:TestRefund")
+	assert.Equal(t, []string{"-C", "${workspaceFolder}/internal/payments", "test", "-v", ".", "-run", "^TestRefund$"}, toStringSlice(t, vscodeTask["args"]))
+}
+
+func TestRunGenerate_TaskCwdAddsExplicitCwd(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "internal", "payments", "refund_test.go")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package payments
+import "testing"
+
+func TestRefund(t *testing.T) {}
+`)
+
+	setEnv(t, "ZED_GO_TASKS_TASK_CWD", "package")
+	err := runGenerate([]string{"-file", targetFile, "-root", root, "-targets", "tasks,debug"}, generateTargetTasks)
+	require.NoError(t, err)
+
+	task := taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:TestRefund")
+	assert.Equal(t, "$ZED_WORKTREE_ROOT/internal/payments", task["cwd"])
+	assert.Equal(t, []string{"test", ".", "-run", "^TestRefund$"}, toStringSlice(t, task["args"]))
+
+	config := taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "debug.json")), "go:debug:TestRefund")
+	assert.Equal(t, "$ZED_WORKTREE_ROOT/internal/payments", config["cwd"])
 	assert.Equal(t, ".", config["program"])
 
-	args := toStringSlice(t, config["args"])
-	assert.Equal(t, []string{"-test.v", "-test.count=1", "-test.run", "^TestOne$"}, args)
+	setEnv(t, "ZED_GO_TASKS_TASK_CWD", "{{.Root}}/testdata")
+	err = runGenerate([]string{"-file", targetFile, "-root", root, "-editor", "vscode"}, generateTargetTasks)
+	require.NoError(t, err)
 
-	env := toStringMap(t, config["env"])
-	assert.Equal(t, "1", env["ZED_GO_TEST_TASK_GENERATED"])
-	assert.Equal(t, "TestOne", env["ZED_GO_TEST_NAME"])
-	assert.Equal(t, "target_test.go", env["ZED_GO_TEST_FILE"])
+	_, vscodeTasks, err := readVSCodeTasksDocument(filepath.Join(root, ".vscode", "tasks.json"))
+	require.NoError(t, err)
+	options, ok := taskByLabel(t, vscodeTasks, "go:TestRefund")["options"].(map[string]any)
+	require.True(t, ok)
+	assert.Equal(t, "${workspaceFolder}/testdata", options["cwd"])
+
+	setEnv(t, "ZED_GO_TASKS_TASK_CWD", "{{.Root")
+	err = runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid task_cwd")
 }
 
-func TestRunGenerate_VSCode_WritesTasksJSON(t *testing.T) {
+func TestNormalizeGoTestArgsForDelve_MapsTestFlagsAndDropsCommandFlags(t *testing.T) {
+	assert.Equal(t,
+		[]string{"-test.v", "-test.timeout=2m", "-test.short", "-test.parallel=4", "-custom"},
+		normalizeGoTestArgsForDelve([]string{"-v", "-timeout", "2m", "--short", "-parallel=4", "-json", "-vet=off", "-custom", "-count"}),
+	)
+}
+
+func TestRunGenerate_AddsGoldenUpdateVariantWhenFlagDetected(t *testing.T) {
 	clearConfigEnv(t)
 
 	root := t.TempDir()
 	targetFile := filepath.Join(root, "target_test.go")
-	tasksPath := filepath.Join(root, ".vscode", "tasks.json")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
 
 	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "golden_test.go"), `package sample
+import "flag"
+
+var update = flag.Bool("update", false, "update golden files")
+`)
 	writeFile(t, targetFile, `package sample
 import "testing"
 
-func TestOne(t *testing.T) {}
+func TestRender(t *testing.T) {}
 `)
-	writeFile(t, tasksPath, `{
-  "version": "2.0.0",
-  "tasks": [
-    {
-      "label": "manual",
-      "type": "shell",
-      "command": "echo"
-    },
-    {
-      "label": "go:Old",
-      "type": "shell",
-      "command": "go",
-      "options": {
-        "env": {
-          "ZED_GO_TEST_TASK_GENERATED": "1"
-        }
-      }
-    }
-  ]
-}`)
 
+	out := captureStdout(t, func() {
+		err := runGenerate([]string{
+			"-file", targetFile,
+			"-root", root,
+		}, generateTargetTasks)
+		require.NoError(t, err)
+	})
+	assert.Contains(t, out, "Generated task: go:TestRender [update-golden]")
+
+	tasks := readTasksForTest(t, tasksPath)
+	labels := labelsFromTasks(tasks)
+	sort.Strings(labels)
+	assert.Equal(t, []string{"go:TestRender", "go:TestRender [update-golden]"}, labels)
+
+	variant := taskByLabel(t, tasks, "go:TestRender [update-golden]")
+	assert.Equal(t, []string{"test", ".", "-run", "^TestRender$", "-args", "-update"}, toStringSlice(t, variant["args"]))
+	assert.Equal(t, "update-golden", toStringMap(t, variant["env"])["ZED_GO_TEST_VARIANT"])
+
+	setEnv(t, "ZED_GO_TASKS_GOLDEN_VARIANTS", "false")
 	err := runGenerate([]string{
 		"-file", targetFile,
 		"-root", root,
-		"-editor", "vscode",
 	}, generateTargetTasks)
 	require.NoError(t, err)
+	assert.Equal(t, []string{"go:TestRender"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+}
 
-	doc, tasks, err := readVSCodeTasksDocument(tasksPath)
-	require.NoError(t, err)
-	assert.Equal(t, "2.0.0", doc["version"])
-
-	labels := labelsFromTasks(tasks)
-	sort.Strings(labels)
-	assert.Equal(t, []string{"go:TestOne", "manual"}, labels)
+func TestFindGoldenFlag_DetectsBoolVar(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "flags_test.go"), `package sample
+import "flag"
 
-	task := taskByLabel(t, tasks, "go:TestOne")
-	assert.Equal(t, "shell", task["type"])
-	assert.Equal(t, "go", task["command"])
-	assert.Equal(t, "test", task["group"])
+var other = flag.String("update", "", "not a bool")
+var golden bool
 
-	args := toStringSlice(t, task["args"])
-	assert.Equal(t, []string{"test", ".", "-run", "^TestOne$"}, args)
+func init() {
+	flag.BoolVar(&golden, "update-golden", false, "refresh")
+}
+`)
 
-	options, ok := task["options"].(map[string]any)
-	require.True(t, ok, "expected task.options to be an object")
-	env := toStringMap(t, options["env"])
-	assert.Equal(t, "1", env["ZED_GO_TEST_TASK_GENERATED"])
-	assert.Equal(t, "TestOne", env["ZED_GO_TEST_NAME"])
-	assert.Equal(t, "target_test.go", env["ZED_GO_TEST_FILE"])
+	name, err := findGoldenFlag(root, regexp.MustCompile(`^(update|golden|update[-_]goldens?)$`))
+	require.NoError(t, err)
+	assert.Equal(t, "update-golden", name)
 }
 
-func TestRunGenerateDebug_VSCode_WritesLaunchJSON(t *testing.T) {
+func TestRunGenerate_FileForOtherOSSkipsVerification(t *testing.T) {
 	clearConfigEnv(t)
 
+	otherOS := "windows"
+	if runtime.GOOS == otherOS {
+		otherOS = "linux"
+	}
+
 	root := t.TempDir()
-	targetFile := filepath.Join(root, "target_test.go")
-	launchPath := filepath.Join(root, ".vscode", "launch.json")
+	targetFile := filepath.Join(root, "target_"+otherOS+"_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
 
 	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "host_test.go"), `package sample
+import "testing"
+
+func TestHost(t *testing.T) {}
+`)
 	writeFile(t, targetFile, `package sample
 import "testing"
 
-func TestOne(t *testing.T) {}
+func TestPlatform(t *testing.T) {}
 `)
+	setEnv(t, "ZED_GO_TASKS_CROSS_COMPILE_VARIANTS", "true")
 
 	err := runGenerate([]string{
 		"-file", targetFile,
 		"-root", root,
-		"-editor", "vscode",
-		"-go-test-arg=-v",
-	}, generateTargetDebug)
+	}, generateTargetTasks)
 	require.NoError(t, err)
 
-	doc, configs, err := readVSCodeLaunchDocument(launchPath)
-	require.NoError(t, err)
-	assert.Equal(t, "0.2.0", doc["version"])
-	require.Len(t, configs, 1)
+	tasks := readTasksForTest(t, tasksPath)
+	variantLabel := "go:TestPlatform [" + otherOS + "/" + runtime.GOARCH + "]"
+	labels := labelsFromTasks(tasks)
+	sort.Strings(labels)
+	assert.Equal(t, []string{"go:TestPlatform", variantLabel}, labels)
 
-	var config map[string]any
-	for _, candidate := range configs {
-		if name, ok := candidate["name"].(string); ok && name == "go:debug:TestOne" {
-			config = candidate
-			break
-		}
-	}
-	require.NotNil(t, config, "expected config with name %q", "go:debug:TestOne")
-	assert.Equal(t, "go", config["type"])
-	assert.Equal(t, "launch", config["request"])
-	assert.Equal(t, "test", config["mode"])
-	assert.Equal(t, "${workspaceFolder}", config["program"])
+	env := toStringMap(t, taskByLabel(t, tasks, variantLabel)["env"])
+	assert.Equal(t, otherOS, env["GOOS"])
+	assert.Equal(t, runtime.GOARCH, env["GOARCH"])
+}
 
-	args := toStringSlice(t, config["args"])
-	assert.Equal(t, []string{"-test.v", "-test.run", "^TestOne$"}, args)
+func TestCheckBuildConstraints_UsesBuildTagsAndGoBuildLines(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "integration_test.go")
+	writeFile(t, path, `//go:build integration
 
-	env := toStringMap(t, config["env"])
-	assert.Equal(t, "1", env["ZED_GO_TEST_TASK_GENERATED"])
-	assert.Equal(t, "TestOne", env["ZED_GO_TEST_NAME"])
-	assert.Equal(t, "target_test.go", env["ZED_GO_TEST_FILE"])
+package sample
+`)
+
+	constraint, err := checkBuildConstraints(path, nil)
+	require.NoError(t, err)
+	assert.False(t, constraint.matchesHost)
+	assert.Empty(t, constraint.target.goos)
+
+	constraint, err = checkBuildConstraints(path, buildTagsFromArgs([]string{"-v", "-tags=integration,slow"}))
+	require.NoError(t, err)
+	assert.True(t, constraint.matchesHost)
 }
 
-func TestRunClear_VSCode_RemovesOnlyGeneratedTasks(t *testing.T) {
+func TestRunGenerate_CompileErrorKeepsUnverifiedTasks(t *testing.T) {
 	clearConfigEnv(t)
 
 	root := t.TempDir()
-	tasksPath := filepath.Join(root, ".vscode", "tasks.json")
-	writeFile(t, tasksPath, `{
-  "version": "2.0.0",
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOne(t *testing.T) {}
+`)
+	writeFile(t, filepath.Join(root, "broken_test.go"), `package sample
+
+func helper() int { return missing }
+`)
+
+	var out string
+	captureStderr(t, func() {
+		out = captureStdout(t, func() {
+			require.NoError(t, runGenerate([]string{
+				"-file", targetFile,
+				"-root", root,
+				"-discover-subtests",
+			}, generateTargetTasks))
+		})
+	})
+
+	task := taskByLabel(t, readTasksForTest(t, tasksPath), "go:TestOne")
+	assert.Equal(t, "1", toStringMap(t, task["env"])["ZED_GO_TEST_UNVERIFIED"])
+	// The summary must not claim that go test ran.
+	assert.Contains(t, out, "Discovered in file: 1, unverified (package does not compile): 1\n")
+	assert.Contains(t, out, "Discovered by runtime execution: skipped (package does not compile)\n")
+	assert.NotContains(t, out, "runnable with go test -list")
+}
+
+func TestRunGenerate_SiblingSyntaxErrorKeepsGoldenDetectionAndUnverifiedTasks(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "b.go"), `package sample
+
+func broken( {
+`)
+	writeFile(t, filepath.Join(root, "golden_test.go"), `package sample
+import "flag"
+
+var update = flag.Bool("update", false, "update golden files")
+`)
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestRender(t *testing.T) {}
+`)
+
+	stderr := captureStderr(t, func() {
+		require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	})
+	assert.Contains(t, stderr, "warning: golden flag detection skipped b.go")
+
+	tasks := readTasksForTest(t, tasksPath)
+	labels := labelsFromTasks(tasks)
+	sort.Strings(labels)
+	assert.Equal(t, []string{"go:TestRender", "go:TestRender [update-golden]"}, labels)
+	assert.Equal(t, "1", toStringMap(t, taskByLabel(t, tasks, "go:TestRender")["env"])["ZED_GO_TEST_UNVERIFIED"])
+}
+
+func TestRunGenerate_PrintsEachGeneratedTask(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestAlpha(t *testing.T) {}
+func TestBeta(t *testing.T) {}
+`)
+
+	out := captureStdout(t, func() {
+		err := runGenerate([]string{
+			"-file", targetFile,
+			"-root", root,
+			"-tasks", tasksPath,
+		}, generateTargetTasks)
+		require.NoError(t, err)
+	})
+
+	assert.Contains(t, out, "Generated task: go:TestAlpha")
+	assert.Contains(t, out, "Generated task: go:TestBeta")
+}
+
+func TestRunGenerateDebug_WritesDebugConfigs(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	debugPath := filepath.Join(root, ".zed", "debug.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOne(t *testing.T) {}
+`)
+
+	err := runGenerate([]string{
+		"-file", targetFile,
+		"-root", root,
+		"-debug", debugPath,
+		"-go-test-arg=-v",
+		"-go-test-arg=-count=1",
+	}, generateTargetDebug)
+	require.NoError(t, err)
+
+	configs := readTasksForTest(t, debugPath)
+	require.Len(t, configs, 1)
+
+	config := taskByLabel(t, configs, "go:debug:TestOne")
+	assert.Equal(t, "Delve", config["adapter"])
+	assert.Equal(t, "launch", config["request"])
+	assert.Equal(t, "test", config["mode"])
+	assert.Equal(t, ".", config["program"])
+
+	args := toStringSlice(t, config["args"])
+	assert.Equal(t, []string{"-test.v", "-test.count=1", "-test.run", "^TestOne$"}, args)
+
+	env := toStringMap(t, config["env"])
+	assert.Equal(t, "1", env["ZED_GO_TEST_TASK_GENERATED"])
+	assert.Equal(t, "TestOne", env["ZED_GO_TEST_NAME"])
+	assert.Equal(t, "target_test.go", env["ZED_GO_TEST_FILE"])
+}
+
+func TestRunGenerate_TargetsWritesTasksAndDebugConfigs(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	debugPath := filepath.Join(root, ".zed", "debug.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOne(t *testing.T) {}
+`)
+
+	out := captureStdout(t, func() {
+		err := runGenerate([]string{
+			"-file", targetFile,
+			"-root", root,
+			"-targets", "tasks,debug",
+		}, generateTargetTasks)
+		require.NoError(t, err)
+	})
+	assert.Equal(t, 1, strings.Count(out, "Discovered in file: 1, runnable with go test -list: 1"))
+	assert.Contains(t, out, "Generated task: go:TestOne")
+	assert.Contains(t, out, "Generated debug config: go:debug:TestOne")
+
+	tasks := readTasksForTest(t, tasksPath)
+	assert.NotNil(t, taskByLabel(t, tasks, "go:TestOne"))
+
+	configs := readTasksForTest(t, debugPath)
+	assert.NotNil(t, taskByLabel(t, configs, "go:debug:TestOne"))
+}
+
+func TestRunGenerate_MultipleEditorsShareDiscovery(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOne(t *testing.T) {}
+`)
+
+	out := captureStdout(t, func() {
+		err := runGenerate([]string{
+			"-file", targetFile,
+			"-root", root,
+			"-editor", "zed,vscode",
+			"-targets", "tasks,debug",
+		}, generateTargetTasks)
+		require.NoError(t, err)
+	})
+	assert.Equal(t, 1, strings.Count(out, "Discovered in file:"))
+	assert.Contains(t, out, "Tasks added: 1, updated: 0, removed: 0 (zed)")
+	assert.Contains(t, out, "Debug configs added: 1, updated: 0, removed: 0 (vscode)")
+
+	assert.NotNil(t, taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:TestOne"))
+	assert.NotNil(t, taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "debug.json")), "go:debug:TestOne"))
+
+	_, vscodeTasks, err := readVSCodeTasksDocument(filepath.Join(root, ".vscode", "tasks.json"))
+	require.NoError(t, err)
+	assert.NotNil(t, taskByLabel(t, vscodeTasks, "go:TestOne"))
+
+	_, launchConfigs, err := readVSCodeLaunchDocument(filepath.Join(root, ".vscode", "launch.json"))
+	require.NoError(t, err)
+	assert.Len(t, launchConfigs, 1)
+
+	err = runGenerate([]string{
+		"-file", targetFile,
+		"-root", root,
+		"-editor", "zed,vscode",
+		"-tasks", filepath.Join(root, "custom.json"),
+	}, generateTargetTasks)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "require a single -editor")
+}
+
+func TestRunGenerate_OutWritesToAlternatePath(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	outPath := filepath.Join(root, "artifacts", "tasks.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOne(t *testing.T) {}
+`)
+	writeFile(t, tasksPath, `[{"label": "manual", "command": "echo"}]`)
+
+	out := captureStdout(t, func() {
+		err := runGenerate([]string{
+			"-file", targetFile,
+			"-root", root,
+			"-out", outPath,
+		}, generateTargetTasks)
+		require.NoError(t, err)
+	})
+	assert.Contains(t, out, "Updated "+outPath)
+
+	labels := labelsFromTasks(readTasksForTest(t, outPath))
+	sort.Strings(labels)
+	assert.Equal(t, []string{"go:TestOne", "manual"}, labels)
+	assert.Equal(t, []string{"manual"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	out = captureStdout(t, func() {
+		err := runGenerate([]string{
+			"-file", targetFile,
+			"-root", root,
+			"-out", "-",
+		}, generateTargetTasks)
+		require.NoError(t, err)
+	})
+	var printed []map[string]any
+	require.NoError(t, json.Unmarshal([]byte(out), &printed))
+	assert.NotNil(t, taskByLabel(t, printed, "go:TestOne"))
+}
+
+func TestParseGenerateTargets_RejectsUnknownAndEmpty(t *testing.T) {
+	targets, err := parseGenerateTargets("debug, tasks,debug")
+	require.NoError(t, err)
+	assert.Equal(t, []generateTarget{generateTargetDebug, generateTargetTasks}, targets)
+
+	_, err = parseGenerateTargets("tasks,launch")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unsupported target "launch"`)
+
+	_, err = parseGenerateTargets(" , ")
+	require.Error(t, err)
+}
+
+func TestRunGenerate_UsesConfiguredModesAndPreservesExisting(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	debugPath := filepath.Join(root, ".zed", "debug.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOne(t *testing.T) {}
+`)
+	writeFile(t, debugPath, "[]")
+	require.NoError(t, os.Chmod(debugPath, 0o640))
+
+	setEnv(t, "ZED_GO_TASKS_FILE_MODE", "0600")
+	setEnv(t, "ZED_GO_TASKS_DIR_MODE", "0700")
+
+	err := runGenerate([]string{
+		"-file", targetFile,
+		"-root", root,
+		"-targets", "tasks,debug",
+	}, generateTargetTasks)
+	require.NoError(t, err)
+
+	info, err := os.Stat(tasksPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	info, err = os.Stat(debugPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+
+	setEnv(t, "ZED_GO_TASKS_FILE_MODE", "rw")
+	_, err = loadConfig(commonOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid file_mode")
+}
+
+func TestRunGenerate_RedactsSecretTaskEnv(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOne(t *testing.T) {}
+`)
+	writeFile(t, filepath.Join(root, ".env"), "# local settings\nexport DB_PASSWORD='hunter2'\nLOG_LEVEL=info\n")
+
+	setEnv(t, "ZED_GO_TASKS_TASK_ENV", "API_TOKEN:abc,LOG_LEVEL:debug")
+	setEnv(t, "ZED_GO_TASKS_DOTENV_PATH", ".env")
+
+	err := runGenerate([]string{
+		"-file", targetFile,
+		"-root", root,
+	}, generateTargetTasks)
+	require.NoError(t, err)
+
+	env := toStringMap(t, taskByLabel(t, readTasksForTest(t, tasksPath), "go:TestOne")["env"])
+	assert.Equal(t, "${API_TOKEN}", env["API_TOKEN"])
+	assert.Equal(t, "${DB_PASSWORD}", env["DB_PASSWORD"])
+	assert.Equal(t, "debug", env["LOG_LEVEL"])
+
+	setEnv(t, "ZED_GO_TASKS_SECRET_ENV_MODE", "omit")
+	err = runGenerate([]string{
+		"-file", targetFile,
+		"-root", root,
+	}, generateTargetTasks)
+	require.NoError(t, err)
+
+	env = toStringMap(t, taskByLabel(t, readTasksForTest(t, tasksPath), "go:TestOne")["env"])
+	assert.NotContains(t, env, "API_TOKEN")
+	assert.NotContains(t, env, "DB_PASSWORD")
+	assert.Equal(t, "debug", env["LOG_LEVEL"])
+
+	assert.Equal(t, map[string]string{"API_TOKEN": "${env:API_TOKEN}"}, injectedTaskEnv(Config{
+		TaskEnv:          map[string]string{"API_TOKEN": "abc"},
+		SecretEnvPattern: "TOKEN",
+		SecretEnvMode:    secretEnvModeReference,
+	}, editorKindVSCode))
+}
+
+func TestRunGenerate_VSCode_WritesTasksJSON(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".vscode", "tasks.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOne(t *testing.T) {}
+`)
+	writeFile(t, tasksPath, `{
+  "version": "2.0.0",
+  "tasks": [
+    {
+      "label": "manual",
+      "type": "shell",
+      "command": "echo"
+    },
+    {
+      "label": "go:Old",
+      "type": "shell",
+      "command": "go",
+      "options": {
+        "env": {
+          "ZED_GO_TEST_TASK_GENERATED": "1"
+        }
+      }
+    }
+  ]
+}`)
+
+	err := runGenerate([]string{
+		"-file", targetFile,
+		"-root", root,
+		"-editor", "vscode",
+	}, generateTargetTasks)
+	require.NoError(t, err)
+
+	doc, tasks, err := readVSCodeTasksDocument(tasksPath)
+	require.NoError(t, err)
+	assert.Equal(t, "2.0.0", doc["version"])
+
+	labels := labelsFromTasks(tasks)
+	sort.Strings(labels)
+	assert.Equal(t, []string{"go:TestOne", "manual"}, labels)
+
+	task := taskByLabel(t, tasks, "go:TestOne")
+	assert.Equal(t, "shell", task["type"])
+	assert.Equal(t, "go", task["command"])
+	assert.Equal(t, "test", task["group"])
+
+	args := toStringSlice(t, task["args"])
+	assert.Equal(t, []string{"test", ".", "-run", "^TestOne$"}, args)
+
+	options, ok := task["options"].(map[string]any)
+	require.True(t, ok, "expected task.options to be an object")
+	env := toStringMap(t, options["env"])
+	assert.Equal(t, "1", env["ZED_GO_TEST_TASK_GENERATED"])
+	assert.Equal(t, "TestOne", env["ZED_GO_TEST_NAME"])
+	assert.Equal(t, "target_test.go", env["ZED_GO_TEST_FILE"])
+}
+
+func TestRunGenerateDebug_VSCode_WritesLaunchJSON(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	launchPath := filepath.Join(root, ".vscode", "launch.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOne(t *testing.T) {}
+`)
+
+	err := runGenerate([]string{
+		"-file", targetFile,
+		"-root", root,
+		"-editor", "vscode",
+		"-go-test-arg=-v",
+	}, generateTargetDebug)
+	require.NoError(t, err)
+
+	doc, configs, err := readVSCodeLaunchDocument(launchPath)
+	require.NoError(t, err)
+	assert.Equal(t, "0.2.0", doc["version"])
+	require.Len(t, configs, 1)
+
+	var config map[string]any
+	for _, candidate := range configs {
+		if name, ok := candidate["name"].(string); ok && name == "go:debug:TestOne" {
+			config = candidate
+			break
+		}
+	}
+	require.NotNil(t, config, "expected config with name %q", "go:debug:TestOne")
+	assert.Equal(t, "go", config["type"])
+	assert.Equal(t, "launch", config["request"])
+	assert.Equal(t, "test", config["mode"])
+	assert.Equal(t, "${workspaceFolder}", config["program"])
+
+	args := toStringSlice(t, config["args"])
+	assert.Equal(t, []string{"-test.v", "-test.run", "^TestOne$"}, args)
+
+	env := toStringMap(t, config["env"])
+	assert.Equal(t, "1", env["ZED_GO_TEST_TASK_GENERATED"])
+	assert.Equal(t, "TestOne", env["ZED_GO_TEST_NAME"])
+	assert.Equal(t, "target_test.go", env["ZED_GO_TEST_FILE"])
+}
+
+func TestRunClear_VSCode_RemovesOnlyGeneratedTasks(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	tasksPath := filepath.Join(root, ".vscode", "tasks.json")
+	writeFile(t, tasksPath, `{
+  "version": "2.0.0",
   "tasks": [
     {
       "label": "manual",
       "type": "shell",
       "command": "echo"
     },
-    {
-      "label": "go:Generated",
-      "type": "shell",
-      "command": "go",
-      "options": {
-        "env": {
+    {
+      "label": "go:Generated",
+      "type": "shell",
+      "command": "go",
+      "options": {
+        "env": {
+          "ZED_GO_TEST_TASK_GENERATED": "1"
+        }
+      }
+    },
+    {
+      "label": "go:Keep",
+      "type": "shell",
+      "command": "go",
+      "options": {
+        "env": {
+          "ZED_GO_TEST_TASK_GENERATED": "0"
+        }
+      }
+    }
+  ]
+}`)
+
+	err := runClear([]string{
+		"-root", root,
+		"-editor", "vscode",
+	})
+	require.NoError(t, err)
+
+	_, tasks, err := readVSCodeTasksDocument(tasksPath)
+	require.NoError(t, err)
+
+	labels := labelsFromTasks(tasks)
+	sort.Strings(labels)
+	assert.Equal(t, []string{"go:Keep", "manual"}, labels)
+}
+
+func TestRunGenerate_DiscoverSubtests_GeneratesTasksForDiscoveredSubtests(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	moduleDir := filepath.Join(root, "pkg")
+	targetFile := filepath.Join(moduleDir, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestWithSubtests(t *testing.T) {
+  cases := []string{"one", "two"}
+  for _, tc := range cases {
+    tc := tc
+    t.Run(tc, func(t *testing.T) {})
+  }
+
+  t.Run("nested", func(t *testing.T) {
+    t.Run("leaf", func(t *testing.T) {})
+  })
+}
+
+func TestPlain(t *testing.T) {}
+`)
+	writeFile(t, filepath.Join(moduleDir, "other_test.go"), `package sample
+import "testing"
+
+func TestFromOtherFile(t *testing.T) {}
+`)
+
+	out := captureStdout(t, func() {
+		err := runGenerate([]string{
+			"-file", targetFile,
+			"-root", root,
+			"-tasks", tasksPath,
+			"-discover-subtests",
+		}, generateTargetTasks)
+		require.NoError(t, err)
+	})
+	assert.Contains(t, out, "Discovered by runtime execution: 6 (new: 4, timeout 30s)")
+
+	tasks := readTasksForTest(t, tasksPath)
+	labels := labelsFromTasks(tasks)
+	sort.Strings(labels)
+	assert.Equal(t, []string{
+		"go:TestPlain",
+		"go:TestWithSubtests",
+		"go:TestWithSubtests/nested",
+		"go:TestWithSubtests/nested/leaf",
+		"go:TestWithSubtests/one",
+		"go:TestWithSubtests/two",
+	}, labels)
+
+	leafTask := taskByLabel(t, tasks, "go:TestWithSubtests/nested/leaf")
+	args := toStringSlice(t, leafTask["args"])
+	assert.Equal(t, []string{"test", "./pkg", "-run", "^TestWithSubtests$/^nested$/^leaf$"}, args)
+}
+
+func TestRunGenerate_HandlesUnicodeTestAndSubtestNames(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestÜbersicht(t *testing.T) {
+  t.Run("größe prüfen (€)", func(t *testing.T) {})
+}
+`)
+
+	err := runGenerate([]string{"-file", targetFile, "-root", root, "-discover-subtests"}, generateTargetTasks)
+	require.NoError(t, err)
+
+	tasks := readTasksForTest(t, tasksPath)
+	top := taskByLabel(t, tasks, "go:TestÜbersicht")
+	assert.Equal(t, []string{"test", ".", "-run", "^TestÜbersicht$"}, toStringSlice(t, top["args"]))
+
+	sub := taskByLabel(t, tasks, "go:TestÜbersicht/größe_prüfen_(€)")
+	assert.Equal(t, []string{"test", ".", "-run", `^TestÜbersicht$/^größe_prüfen_\(€\)$`}, toStringSlice(t, sub["args"]))
+}
+
+func TestRunGenerate_TestTimeoutWithPackageOverrides(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_TEST_TIMEOUT", "10m")
+	setEnv(t, "ZED_GO_TASKS_TEST_TIMEOUTS", "./slow/...:1h,./slow/db:2h")
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+
+	root := t.TempDir()
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	for _, dir := range []string{"fast", "slow/api", "slow/db"} {
+		name := "Test" + strings.ReplaceAll(dir, "/", "_")
+		writeFile(t, filepath.Join(root, dir, "x_test.go"), "package x\nimport \"testing\"\n\nfunc "+name+"(t *testing.T) {}\n")
+		require.NoError(t, runGenerate([]string{"-file", filepath.Join(root, dir, "x_test.go"), "-root", root}, generateTargetTasks))
+	}
+
+	argsFor := func(pkg string) []string {
+		for _, task := range readTasksForTest(t, tasksPath) {
+			env := toStringMap(t, task["env"])
+			if env[packageEnvKey] == pkg {
+				return toStringSlice(t, task["args"])
+			}
+		}
+		t.Fatalf("no task for %s", pkg)
+		return nil
+	}
+	assert.Contains(t, argsFor("./fast"), "-timeout=10m")
+	assert.Contains(t, argsFor("./slow/api"), "-timeout=1h")
+	assert.Contains(t, argsFor("./slow/db"), "-timeout=2h")
+
+	require.NoError(t, runGenerate([]string{"-file", filepath.Join(root, "fast", "x_test.go"), "-root", root, "-go-test-arg=-timeout=5s"}, generateTargetTasks))
+	args := argsFor("./fast")
+	assert.Contains(t, args, "-timeout=5s")
+	assert.NotContains(t, args, "-timeout=10m")
+}
+
+func TestLoadConfig_RejectsInvalidTestTimeout(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_TEST_TIMEOUTS", "./pkg:forever")
+
+	_, err := loadConfig(commonOptions{rootPath: t.TempDir()})
+	assert.ErrorContains(t, err, "test_timeouts")
+}
+
+func TestRunGenerate_ASTOnlyDiscoveryMarksEntriesUnverified(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	// GO_BINARY is never run without the go-list strategy.
+	setEnv(t, "ZED_GO_TASKS_GO_BINARY", filepath.Join(root, "missing-go"))
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestB(t *testing.T) {}
+func TestA(t *testing.T) {}
+`)
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+
+	tasks := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{"go:TestA", "go:TestB"}, labelsFromTasks(tasks))
+	assert.Equal(t, "1", toStringMap(t, taskByLabel(t, tasks, "go:TestA")["env"])[unverifiedEnvKey])
+}
+
+func TestRunGenerate_VerboseSummaryListsDroppedTests(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_GO_LIST_REGEX", "^TestKept")
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestKept(t *testing.T) {}
+func TestGone(t *testing.T) {}
+`)
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	})
+	assert.Contains(t, out, "Strategy ast: 2 tests (added 2, dropped 0) in ")
+	assert.Contains(t, out, "Strategy go-list: 1 tests (added 0, dropped 1) in ")
+	assert.NotContains(t, out, "dropped TestGone")
+
+	out = captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-verbose"}, generateTargetTasks))
+	})
+	assert.Contains(t, out, `  dropped TestGone: name does not match GO_LIST_REGEX "^TestKept"`+"\n")
+}
+
+func TestRunGenerate_WarnsAboutUnlistedTestsAndIncludesThemOnRequest(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_TEST_NAME_REGEX", "^(Test|Benchmark)")
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestOK(t *testing.T) {}
+func BenchmarkFast(b *testing.B) {}
+`)
+
+	stderr := captureStderr(t, func() {
+		require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	})
+	assert.Contains(t, stderr, `warning: BenchmarkFast is not listed by go test -list (name does not match GO_LIST_REGEX "^Test")`)
+	assert.Equal(t, []string{"go:TestOK"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	var out string
+	captureStderr(t, func() {
+		out = captureStdout(t, func() {
+			require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-include-unverified"}, generateTargetTasks))
+		})
+	})
+	assert.Contains(t, out, "Discovered in file: 2, runnable with go test -list: 1, unverified: 1\n")
+	tasks := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{"go:BenchmarkFast", "go:TestOK"}, labelsFromTasks(tasks))
+	assert.Equal(t, "1", toStringMap(t, taskByLabel(t, tasks, "go:BenchmarkFast")["env"])[unverifiedEnvKey])
+	assert.NotContains(t, toStringMap(t, taskByLabel(t, tasks, "go:TestOK")["env"]), unverifiedEnvKey)
+}
+
+func TestRunGenerate_PerKindNameRegexes(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_BENCHMARK_NAME_REGEX", "^BenchmarkHot")
+	setEnv(t, "ZED_GO_TASKS_EXAMPLE_NAME_REGEX", ".")
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestA(t *testing.T) {}
+func BenchmarkHotPath(b *testing.B) {}
+func BenchmarkCold(b *testing.B) {}
+func FuzzParse(f *testing.F) {}
+func ExampleHello() {
+	// Output:
+}
+`)
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	assert.Equal(t, []string{"go:BenchmarkHotPath", "go:ExampleHello", "go:TestA"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+}
+
+func TestRunGenerate_ExamplesNeedOutputComment(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_EXAMPLE_NAME_REGEX", ".")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	file := filepath.Join(root, "sample_test.go")
+	writeFile(t, file, `package sample
+
+import "fmt"
+
+func Example_greet() {
+	fmt.Println("hello")
+	// Output: hello
+}
+
+func Example_unordered() {
+	fmt.Println("b")
+	fmt.Println("a")
+	// Unordered output:
+	// a
+	// b
+}
+
+// Example_compileOnly only documents usage.
+func Example_compileOnly() {
+	// Output is not checked here.
+	fmt.Println("not run")
+}
+`)
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", file}, generateTargetTasks))
+	tasks := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{"go:Example_greet", "go:Example_unordered"}, labelsFromTasks(tasks))
+	assert.NotContains(t, toStringMap(t, taskByLabel(t, tasks, "go:Example_greet")["env"]), unverifiedEnvKey)
+
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", file}, generateTargetTasks))
+	assert.Equal(t, []string{"go:Example_greet", "go:Example_unordered"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+}
+
+func TestConfigGoListRegex_WidensForEnabledKinds(t *testing.T) {
+	assert.Equal(t, "^Test", Config{GoListRegex: "^Test"}.goListRegex())
+	assert.Equal(t, "(?:^Test)|(?:^BenchmarkHot)|(?:.)", Config{GoListRegex: "^Test", BenchmarkNameRegex: "^BenchmarkHot", ExampleNameRegex: "."}.goListRegex())
+
+	_, err := Config{TestNameRegex: "^Test", FuzzNameRegex: "("}.testNameFilter()
+	assert.ErrorContains(t, err, "invalid fuzz_name_regex")
+}
+
+func TestTestDeclProblem_MirrorsGoTestRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x_test.go")
+	writeFile(t, path, `package x
+import "testing"
+
+func TestOK(t *testing.T) {}
+func Test(t *testing.T) {}
+func Testlower(t *testing.T) {}
+func TestArgs(n int) {}
+func TestResult(t *testing.T) error { return nil }
+func BenchmarkWrongType(t *testing.T) {}
+func ExampleWithArgs(t *testing.T) {}
+func FuzzOK(f *testing.F) {}
+`)
+	decls, err := findTestDeclsInFile(path, regexp.MustCompile(`^(Test|Benchmark|Example|Fuzz)`))
+	require.NoError(t, err)
+
+	problems := make(map[string]string, len(decls))
+	for _, decl := range decls {
+		problems[decl.name] = decl.problem
+	}
+	assert.Equal(t, map[string]string{
+		"TestOK":             "",
+		"Test":               "",
+		"Testlower":          `go test ignores Testlower because the letter after "Test" is lower-case`,
+		"TestArgs":           "signature is not func(*testing.T)",
+		"TestResult":         "signature is not func(*testing.T)",
+		"BenchmarkWrongType": "signature is not func(*testing.B)",
+		"ExampleWithArgs":    "signature is not func()",
+		"FuzzOK":             "",
+	}, problems)
+}
+
+func TestNewDiscoveryPipeline_ComposesStrategies(t *testing.T) {
+	names := func(pipeline []Discoverer) []string {
+		var out []string
+		for _, discoverer := range pipeline {
+			out = append(out, discoverer.Name())
+		}
+		return out
+	}
+
+	pipeline, err := newDiscoveryPipeline(generateOptions{}, Config{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ast", "go-list"}, names(pipeline))
+
+	pipeline, err = newDiscoveryPipeline(generateOptions{discoverSubtests: true}, Config{DiscoveryStrategies: []string{"ast"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ast", "runtime"}, names(pipeline))
+
+	_, err = newDiscoveryPipeline(generateOptions{}, Config{DiscoveryStrategies: []string{"go-list"}})
+	assert.ErrorContains(t, err, "must start with ast")
+
+	_, err = newDiscoveryPipeline(generateOptions{}, Config{DiscoveryStrategies: []string{"ast", "bazel"}})
+	assert.ErrorContains(t, err, `unknown discovery strategy "bazel"`)
+}
+
+func TestRunGenerate_MergesExtraTaskFields(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_TASK_EXTRA_FIELDS", `{"tags": ["go-test"], "reveal_target": "dock"}`)
+	setEnv(t, "ZED_GO_TASKS_TASK_FIELD_REVEAL_TARGET", `"center"`)
+	setEnv(t, "ZED_GO_TASKS_TASK_FIELD_HIDE", `"on_success"`)
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+
+	task := taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:TestA")
+	assert.Equal(t, []string{"go-test"}, toStringSlice(t, task["tags"]))
+	assert.Equal(t, "center", task["reveal_target"])
+	assert.Equal(t, "on_success", task["hide"])
+	assert.Equal(t, "go", task["command"])
+}
+
+func TestLoadConfig_RejectsInvalidTaskFields(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_TASK_FIELD_REVEAL_TARGET", "center")
+	_, err := loadConfig(commonOptions{rootPath: t.TempDir()})
+	assert.ErrorContains(t, err, "ZED_GO_TASKS_TASK_FIELD_REVEAL_TARGET")
+
+	setEnv(t, "ZED_GO_TASKS_TASK_FIELD_REVEAL_TARGET", `"center"`)
+	setEnv(t, "ZED_GO_TASKS_TASK_FIELD_USE_NEW_TERMINAL", `"yes"`)
+	_, err = loadConfig(commonOptions{rootPath: t.TempDir()})
+	assert.ErrorContains(t, err, "invalid task field")
+	require.NoError(t, os.Unsetenv("ZED_GO_TASKS_TASK_FIELD_USE_NEW_TERMINAL"))
+
+	setEnv(t, "ZED_GO_TASKS_TASK_EXTRA_FIELDS", `["not", "an", "object"]`)
+	_, err = loadConfig(commonOptions{rootPath: t.TempDir()})
+	assert.ErrorContains(t, err, "task_extra_fields")
+}
+
+func TestRunGenerate_ExpandsTaskEnvTemplatesPerTest(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_TASK_ENV", "ZED_GO_TEST_OUTDIR:$ZED_WORKTREE_ROOT/tmp/test-out/{{.Test}},SUITE:{{base .Package}}")
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "pkg", "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package pkg\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\nfunc TestB(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	envA := toStringMap(t, taskByLabel(t, tasks, "go:TestA")["env"])
+	assert.Equal(t, "$ZED_WORKTREE_ROOT/tmp/test-out/TestA", envA["ZED_GO_TEST_OUTDIR"])
+	assert.Equal(t, "pkg", envA["SUITE"])
+	envB := toStringMap(t, taskByLabel(t, tasks, "go:TestB")["env"])
+	assert.Equal(t, "$ZED_WORKTREE_ROOT/tmp/test-out/TestB", envB["ZED_GO_TEST_OUTDIR"])
+
+	setEnv(t, "ZED_GO_TASKS_TASK_ENV", "OUT:{{.Missing}}")
+	_, err := loadConfig(commonOptions{rootPath: root})
+	assert.ErrorContains(t, err, "invalid task_env template for OUT")
+}
+
+func TestLoadConfig_RejectsInvalidExtraTestNameRegex(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_EXTRA_TEST_NAME_REGEX", "(")
+	_, err := loadConfig(commonOptions{rootPath: t.TempDir()})
+	assert.ErrorContains(t, err, "invalid extra_test_name_regex")
+}
+
+func TestRunGenerateDebug_DiscoverSubtests_GeneratesDebugConfigs(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	moduleDir := filepath.Join(root, "pkg")
+	targetFile := filepath.Join(moduleDir, "target_test.go")
+	debugPath := filepath.Join(root, ".zed", "debug.json")
+
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestWithSubtests(t *testing.T) {
+  t.Run("one", func(t *testing.T) {})
+}
+`)
+
+	out := captureStdout(t, func() {
+		err := runGenerate([]string{
+			"-file", targetFile,
+			"-root", root,
+			"-debug", debugPath,
+			"-discover-subtests",
+		}, generateTargetDebug)
+		require.NoError(t, err)
+	})
+	assert.Contains(t, out, "Discovered by runtime execution: 2 (new: 1, timeout 30s)")
+
+	configs := readTasksForTest(t, debugPath)
+	labels := labelsFromTasks(configs)
+	sort.Strings(labels)
+	assert.Equal(t, []string{
+		"go:debug:TestWithSubtests",
+		"go:debug:TestWithSubtests/one",
+	}, labels)
+
+	oneConfig := taskByLabel(t, configs, "go:debug:TestWithSubtests/one")
+	args := toStringSlice(t, oneConfig["args"])
+	assert.Equal(t, []string{"-test.run", "^TestWithSubtests$/^one$"}, args)
+}
+
+func TestRunClear_RemovesOnlyGeneratedTasks(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	// Intentionally uses relaxed JSON syntax.
+	writeFile(t, tasksPath, `[
+  {
+    "label": "manual",
+    "command": "echo",
+  },
+  {
+    "label": "go:Generated",
+    "command": "go",
+    "env": {
+      "ZED_GO_TEST_TASK_GENERATED": "1",
+    },
+  },
+  {
+    "label": "go:LooksGeneratedButIsNot",
+    "command": "go",
+    "env": {
+      "ZED_GO_TEST_TASK_GENERATED": "0",
+    },
+  },
+]`)
+
+	err := runClear([]string{
+		"-root", root,
+		"-tasks", tasksPath,
+	})
+	require.NoError(t, err)
+
+	tasks := readTasksForTest(t, tasksPath)
+	labels := labelsFromTasks(tasks)
+	sort.Strings(labels)
+	assert.Equal(t, []string{"go:LooksGeneratedButIsNot", "manual"}, labels)
+}
+
+func TestRunClear_FiltersByMatchPackageAndFile(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	content := `[
+  {"label": "manual", "command": "echo"},
+  {
+    "label": "go:TestA",
+    "command": "go",
+    "args": ["test", "./pkg/a", "-run", "^TestA$"],
+    "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_FILE": "pkg/a/a_test.go", "ZED_GO_TEST_PACKAGE": "./pkg/a"}
+  },
+  {
+    "label": "go:TestB",
+    "command": "go",
+    "args": ["test", "./pkg/b", "-run", "^TestB$"],
+    "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_FILE": "pkg/b/b_test.go"}
+  },
+  {
+    "label": "go:TestB2",
+    "command": "go",
+    "args": ["test", "./pkg/b", "-run", "^TestB2$"],
+    "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_FILE": "pkg/b/b2_test.go", "ZED_GO_TEST_PACKAGE": "./pkg/b"}
+  }
+]`
+
+	cases := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "match", args: []string{"-match", "^go:TestB"}, want: []string{"go:TestA", "manual"}},
+		{name: "pkg", args: []string{"-pkg", filepath.Join(root, "pkg", "b")}, want: []string{"go:TestA", "manual"}},
+		{name: "file", args: []string{"-file", filepath.Join(root, "pkg", "b", "b2_test.go")}, want: []string{"go:TestA", "go:TestB", "manual"}},
+		{name: "combined", args: []string{"-pkg", filepath.Join(root, "pkg", "b"), "-match", "B2$"}, want: []string{"go:TestA", "go:TestB", "manual"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			writeFile(t, tasksPath, content)
+			err := runClear(append([]string{"-root", root}, tc.args...))
+			require.NoError(t, err)
+
+			labels := labelsFromTasks(readTasksForTest(t, tasksPath))
+			sort.Strings(labels)
+			assert.Equal(t, tc.want, labels)
+		})
+	}
+
+	// Like generate -file, -pkg and -file are relative to the current
+	// directory, here a subdirectory of -root.
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "pkg", "b"), 0o755))
+	t.Chdir(filepath.Join(root, "pkg"))
+	for _, args := range [][]string{
+		{"-file", filepath.Join("b", "b2_test.go")},
+		{"-pkg", "b", "-match", "B2$"},
+		{"-pkg", "./b", "-file", filepath.Join("b", "b2_test.go")},
+	} {
+		writeFile(t, tasksPath, content)
+		require.NoError(t, runClear(append([]string{"-root", root}, args...)), "%v", args)
+
+		labels := labelsFromTasks(readTasksForTest(t, tasksPath))
+		sort.Strings(labels)
+		assert.Equal(t, []string{"go:TestA", "go:TestB", "manual"}, labels, "%v", args)
+	}
+
+	err := runClear([]string{"-root", root, "-match", "("})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid -match regex")
+}
+
+func TestRunList_GroupsByFileAndFlagsMissing(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "pkg", "a", "a_test.go"), "package a\n")
+	writeFile(t, filepath.Join(root, ".zed", "tasks.json"), `[
+  {"label": "manual", "command": "echo"},
+  {"label": "go:TestA", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_FILE": "pkg/a/a_test.go"}},
+  {"label": "go:TestGone", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_FILE": "pkg/gone/gone_test.go"}}
+]`)
+	writeFile(t, filepath.Join(root, ".zed", "debug.json"), `[
+  {"label": "debug:TestA", "adapter": "Delve", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_FILE": "pkg/a/a_test.go"}}
+]`)
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runList([]string{"-root", root}))
+	})
+	assert.Contains(t, out, "pkg/a/a_test.go: 1 tasks, 1 debug configs\n  go:TestA\n  debug:TestA\n")
+	assert.Contains(t, out, "pkg/gone/gone_test.go (missing): 1 tasks, 0 debug configs\n  go:TestGone\n")
+	assert.NotContains(t, out, "manual")
+
+	out = captureStdout(t, func() {
+		require.NoError(t, runList([]string{"-root", root, "-stale"}))
+	})
+	assert.NotContains(t, out, "pkg/a/a_test.go")
+	assert.Contains(t, out, "pkg/gone/gone_test.go (missing)")
+}
+
+func TestRunInit_ScaffoldsFilesOnce(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, ".gitignore"), "bin/")
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runInit([]string{"-root", root, "-gitignore"}))
+	})
+	assert.Contains(t, out, "Created "+filepath.Join(root, ".zed", "tasks.json"))
+
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, []string{"go-discover", "go-discover-debug"}, labelsFromTasks(tasks))
+	assert.Empty(t, readTasksForTest(t, filepath.Join(root, ".zed", "debug.json")))
+	assert.FileExists(t, filepath.Join(root, ".zed", "go-zed-tasks.env"))
+
+	writeFile(t, filepath.Join(root, ".zed", "tasks.json"), "[]\n")
+	out = captureStdout(t, func() {
+		require.NoError(t, runInit([]string{"-root", root, "-gitignore"}))
+	})
+	assert.Contains(t, out, "Kept existing "+filepath.Join(root, ".zed", "tasks.json"))
+	assert.Empty(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")))
+
+	gitignore, err := os.ReadFile(filepath.Join(root, ".gitignore"))
+	require.NoError(t, err)
+	assert.Equal(t, "bin/\n.zed/.go-zed-tasks/\n", string(gitignore))
+
+	require.NoError(t, runInit([]string{"-root", root, "-editor", "vscode"}))
+	_, vscodeTasks, err := readVSCodeTasksDocument(filepath.Join(root, ".vscode", "tasks.json"))
+	require.NoError(t, err)
+	assert.Len(t, vscodeTasks, 2)
+	assert.FileExists(t, filepath.Join(root, ".vscode", "launch.json"))
+}
+
+func TestLoadConfig_ReadsWorkspaceConfigFileUnderProcessEnv(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, ".zed", "go-zed-tasks.env"), `# comment
+ZED_GO_TASKS_LABEL_PREFIX=file:
+ZED_GO_TASKS_DEBUG_LABEL_PREFIX=file-debug:
+UNRELATED=1
+`)
+	setEnv(t, "ZED_GO_TASKS_DEBUG_LABEL_PREFIX", "env-debug:")
+
+	cfg, err := loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	assert.Equal(t, "file:", cfg.LabelPrefix)
+	assert.Equal(t, "env-debug:", cfg.DebugLabelPrefix)
+
+	setEnv(t, "ZED_GO_TASKS_CONFIG_PATH", "missing.env")
+	_, err = loadConfig(commonOptions{rootPath: root})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "read config file")
+}
+
+func TestLoadConfig_ResolvesPathsAgainstDetectedRootFromSubdirectory(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, ".zed", "go-zed-tasks.env"), "ZED_GO_TASKS_DOTENV_PATH=.env\n")
+	writeFile(t, filepath.Join(root, ".env"), "LOG_LEVEL=info\n")
+	targetFile := filepath.Join(root, "pkg", "a", "a_test.go")
+	writeFile(t, targetFile, "package a\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	t.Chdir(filepath.Dir(targetFile))
+
+	cfg, err := loadConfig(commonOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, ".env", cfg.DotenvPath)
+	assert.Equal(t, "info", cfg.TaskEnv["LOG_LEVEL"])
+
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-file", "a_test.go"}, generateTargetTasks))
+	})
+	env := toStringMap(t, taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:TestA")["env"])
+	assert.Equal(t, "info", env["LOG_LEVEL"])
+}
+
+func TestRunValidate_ReportsAndSyncsMissingTargets(t *testing.T) {
+	clearConfigEnv(t)
+
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "a_test.go"), `package sample
+import "testing"
+
+func TestA(t *testing.T) {}
+func TestB(t *testing.T) {}
+`)
+	env := func(test string) string {
+		return fmt.Sprintf(`{"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_FILE": "a_test.go", "ZED_GO_TEST_NAME": %q}`, test)
+	}
+	writeFile(t, filepath.Join(root, ".zed", "tasks.json"), `[
+  {"label": "go:TestA", "command": "go", "env": `+env("TestA")+`},
+  {"label": "go:TestB", "command": "go", "env": `+env("TestB")+`},
+  {"label": "go:TestB [update-golden]", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_FILE": "a_test.go", "ZED_GO_TEST_NAME": "TestB", "ZED_GO_TEST_VARIANT": "update-golden"}}
+]`)
+	writeFile(t, filepath.Join(root, ".zed", "debug.json"), `[
+  {"label": "go:debug:TestA", "adapter": "Delve", "env": `+env("TestA")+`},
+  {"label": "go:debug:TestGone", "adapter": "Delve", "env": `+env("TestGone")+`}
+]`)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = runValidate([]string{"-root", root})
+	})
+	assert.ErrorContains(t, err, "found 2 inconsistencies")
+	assert.Equal(t, "a_test.go: TestB has a task but no debug config\na_test.go: TestGone has a debug config but no task\n", out)
+
+	captureStdout(t, func() {
+		require.NoError(t, runValidate([]string{"-root", root, "-sync-targets"}))
+	})
+	assert.Equal(t, []string{"go:debug:TestA", "go:debug:TestB"}, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "debug.json"))))
+	assert.Equal(t, []string{"go:TestA", "go:TestB"}, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))))
+
+	out = captureStdout(t, func() {
+		require.NoError(t, runValidate([]string{"-root", root}))
+	})
+	assert.Equal(t, "Tasks and debug configs are consistent\n", out)
+}
+
+func TestRunGenerate_WatchCommandAddsWatchTasks(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_WATCH_COMMAND", "watchexec")
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "pkg", "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package pkg\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, []string{"go:TestA", "go:watch:TestA"}, labelsFromTasks(tasks))
+	watch := taskByLabel(t, tasks, "go:watch:TestA")
+	assert.Equal(t, "watchexec -e go -r -- go test ./pkg -run '^TestA$'", watch["command"])
+	assert.Nil(t, watch["args"])
+	assert.Equal(t, "watch", toStringMap(t, watch["env"])["ZED_GO_TEST_VARIANT"])
+
+	setEnv(t, "ZED_GO_TASKS_WATCH_COMMAND", "{{.Missing}}")
+	_, err := loadConfig(commonOptions{rootPath: root})
+	assert.ErrorContains(t, err, "invalid watch_command")
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "./pkg", shellQuote("./pkg"))
+	assert.Equal(t, "'^TestA$'", shellQuote("^TestA$"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+	assert.Equal(t, "''", shellQuote(""))
+}
+
+func TestRunGenerate_CoverageVariantsAddAggregateTask(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_COVERAGE_VARIANTS", "true")
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	first := filepath.Join(root, "a", "a_test.go")
+	second := filepath.Join(root, "b", "b_test.go")
+	writeFile(t, first, "package a\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	writeFile(t, second, "package b\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", first, "-root", root}, generateTargetTasks))
+	require.NoError(t, runGenerate([]string{"-file", second, "-root", root}, generateTargetTasks))
+
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, []string{"go:TestA", "go:TestA [cover]", "go:coverage", "go:TestB", "go:TestB [cover]"}, labelsFromTasks(tasks))
+	assert.Equal(t, []string{
+		"test", "-cover", "./a", "-run", "^TestA$",
+		"-args", "-test.gocoverdir=$ZED_WORKTREE_ROOT/.zed/.go-zed-tasks/cover",
+	}, toStringSlice(t, taskByLabel(t, tasks, "go:TestA [cover]")["args"]))
+	assert.Equal(t,
+		`go tool covdata textfmt -i="$ZED_WORKTREE_ROOT/.zed/.go-zed-tasks/cover" -o="$ZED_WORKTREE_ROOT/.zed/.go-zed-tasks/cover.out" && go tool cover -func="$ZED_WORKTREE_ROOT/.zed/.go-zed-tasks/cover.out"`,
+		taskByLabel(t, tasks, "go:coverage")["command"])
+	assert.DirExists(t, filepath.Join(root, ".zed", ".go-zed-tasks", "cover"))
+}
+
+func TestRunGenerate_InjectsRuntimeEnvIntoTasksOnly(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_GODEBUG", "asyncpreemptoff=1,panicnil=1")
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-targets", "tasks,debug"}, generateTargetTasks))
+
+	taskEnv := toStringMap(t, taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:TestA")["env"])
+	assert.Equal(t, "all", taskEnv["GOTRACEBACK"])
+	assert.Equal(t, "asyncpreemptoff=1,panicnil=1", taskEnv["GODEBUG"])
+	debugEnv := toStringMap(t, taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "debug.json")), "go:debug:TestA")["env"])
+	assert.NotContains(t, debugEnv, "GOTRACEBACK")
+	assert.NotContains(t, debugEnv, "GODEBUG")
+
+	setEnv(t, "ZED_GO_TASKS_RUNTIME_ENV_IN_DEBUG", "true")
+	setEnv(t, "ZED_GO_TASKS_TASK_ENV", "GOTRACEBACK:crash")
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-targets", "tasks,debug"}, generateTargetTasks))
+	debugEnv = toStringMap(t, taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "debug.json")), "go:debug:TestA")["env"])
+	assert.Equal(t, "crash", debugEnv["GOTRACEBACK"])
+
+	setEnv(t, "ZED_GO_TASKS_GOTRACEBACK", "everything")
+	_, err := loadConfig(commonOptions{rootPath: root})
+	assert.ErrorContains(t, err, "invalid gotraceback")
+	setEnv(t, "ZED_GO_TASKS_GOTRACEBACK", "2")
+	setEnv(t, "ZED_GO_TASKS_GODEBUG", "gctrace")
+	_, err = loadConfig(commonOptions{rootPath: root})
+	assert.ErrorContains(t, err, "invalid godebug")
+}
+
+func TestRunGenerate_SanitizerVariants(t *testing.T) {
+	if !slices.Contains(sanitizerPlatforms["asan"], runtime.GOOS+"/"+runtime.GOARCH) {
+		t.Skip("asan is not supported on this platform")
+	}
+	clearConfigEnv(t)
+	root := t.TempDir()
+	compiler := filepath.Join(root, "bin", "cc")
+	writeFile(t, compiler, "#!/bin/sh\n")
+	require.NoError(t, os.Chmod(compiler, 0o755))
+	setEnv(t, "ZED_GO_TASKS_SANITIZER_VARIANTS", "asan")
+	setEnv(t, "ZED_GO_TASKS_SANITIZER_CC", compiler)
+	setEnv(t, "ZED_GO_TASKS_SANITIZER_CXX", compiler)
+
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+
+	task := taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:TestA [asan]")
+	assert.Equal(t, []string{"test", "-asan", ".", "-run", "^TestA$"}, toStringSlice(t, task["args"]))
+	env := toStringMap(t, task["env"])
+	assert.Equal(t, "1", env["CGO_ENABLED"])
+	assert.Equal(t, compiler, env["CC"])
+
+	setEnv(t, "ZED_GO_TASKS_SANITIZER_CC", filepath.Join(root, "bin", "missing-cc"))
+	err := runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks)
+	assert.ErrorContains(t, err, "-asan needs a C toolchain")
+
+	setEnv(t, "ZED_GO_TASKS_SANITIZER_VARIANTS", "tsan")
+	_, err = loadConfig(commonOptions{rootPath: root})
+	assert.ErrorContains(t, err, `unknown sanitizer "tsan"`)
+}
+
+func TestRunGenerate_PropagatesCgoEnvForCgoPackages(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	setEnv(t, "ZED_GO_TASKS_PKG_CONFIG_PATH", "/opt/lib/pkgconfig")
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+	setEnv(t, "CGO_CFLAGS", "-I/opt/include")
+
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "native", "native.go"), "package native\n\n// #include <stdlib.h>\nimport \"C\"\n")
+	cgoFile := filepath.Join(root, "native", "native_test.go")
+	writeFile(t, cgoFile, "package native\nimport \"testing\"\n\nfunc TestNative(t *testing.T) {}\n")
+	plainFile := filepath.Join(root, "plain", "plain_test.go")
+	writeFile(t, plainFile, "package plain\nimport \"testing\"\n\nfunc TestPlain(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", cgoFile, "-root", root, "-targets", "tasks,debug"}, generateTargetTasks))
+	require.NoError(t, runGenerate([]string{"-file", plainFile, "-root", root}, generateTargetTasks))
+
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	env := toStringMap(t, taskByLabel(t, tasks, "go:TestNative")["env"])
+	assert.Equal(t, "1", env["CGO_ENABLED"])
+	assert.Equal(t, "-I/opt/include", env["CGO_CFLAGS"])
+	assert.Equal(t, "/opt/lib/pkgconfig", env["PKG_CONFIG_PATH"])
+	debugEnv := toStringMap(t, taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "debug.json")), "go:debug:TestNative")["env"])
+	assert.Equal(t, "/opt/lib/pkgconfig", debugEnv["PKG_CONFIG_PATH"])
+	assert.NotContains(t, toStringMap(t, taskByLabel(t, tasks, "go:TestPlain")["env"]), "CGO_ENABLED")
+}
+
+func TestRunGenerate_DiscoveryCacheDirectory(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_CACHE", ".discovery-cache")
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {\n\tt.Run(\"one\", func(t *testing.T) {})\n}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-discover-subtests"}, generateTargetTasks))
+
+	manifests, err := filepath.Glob(filepath.Join(root, ".discovery-cache", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, manifests, 1)
+	var manifest discoveryManifest
+	data, err := os.ReadFile(manifests[0])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	assert.Equal(t, []string{"TestA"}, manifest.Tests)
+	assert.Equal(t, []string{"TestA", "TestA/one"}, manifest.Discovered)
+
+	// A cache hit is used as is, so a planted subtest shows up.
+	manifest.Discovered = append(manifest.Discovered, "TestA/cached")
+	data, err = json.Marshal(manifest)
+	require.NoError(t, err)
+	writeFile(t, manifests[0], string(data))
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-discover-subtests"}, generateTargetTasks))
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	assert.Contains(t, labelsFromTasks(readTasksForTest(t, tasksPath)), "go:TestA/cached")
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-discover-subtests", "-no-discovery-cache"}, generateTargetTasks))
+	assert.NotContains(t, labelsFromTasks(readTasksForTest(t, tasksPath)), "go:TestA/cached")
+}
+
+func TestHTTPManifestStore_GetAndPut(t *testing.T) {
+	stored := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			stored[r.URL.Path] = data
+		case http.MethodGet:
+			data, ok := stored[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	store, err := newManifestStore(Config{DiscoveryCache: server.URL + "/manifests/", DiscoveryCacheToken: "secret"}, t.TempDir())
+	require.NoError(t, err)
+
+	manifest, err := store.get("abc")
+	require.NoError(t, err)
+	assert.Nil(t, manifest)
+
+	require.NoError(t, store.put(discoveryManifest{Key: "abc", Package: "./pkg", Tests: []string{"TestA"}, Discovered: []string{"TestA/one"}}))
+	assert.Contains(t, stored, "/manifests/abc.json")
+	manifest, err = store.get("abc")
+	require.NoError(t, err)
+	require.NotNil(t, manifest)
+	assert.Equal(t, []string{"TestA/one"}, manifest.Discovered)
+
+	_, err = newManifestStore(Config{DiscoveryCache: "s3://bucket/prefix"}, t.TempDir())
+	assert.ErrorContains(t, err, "unsupported discovery_cache")
+}
+
+func TestNewManifestStore_HonorsCABundleAndOffline(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	root := t.TempDir()
+	store, err := newManifestStore(Config{DiscoveryCache: server.URL}, root)
+	require.NoError(t, err)
+	_, err = store.get("abc")
+	assert.ErrorContains(t, err, "certificate")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	writeFile(t, filepath.Join(root, "ca.pem"), string(certPEM))
+	store, err = newManifestStore(Config{DiscoveryCache: server.URL, CABundle: "ca.pem"}, root)
+	require.NoError(t, err)
+	manifest, err := store.get("abc")
+	require.NoError(t, err)
+	assert.Nil(t, manifest)
+
+	writeFile(t, filepath.Join(root, "empty.pem"), "not a certificate\n")
+	_, err = newManifestStore(Config{DiscoveryCache: server.URL, CABundle: "empty.pem"}, root)
+	assert.ErrorContains(t, err, "no PEM certificates")
+
+	store, err = newManifestStore(Config{DiscoveryCache: server.URL, Offline: true}, root)
+	require.NoError(t, err)
+	assert.Nil(t, store)
+	_, err = newHTTPClient(Config{Offline: true}, root)
+	assert.ErrorContains(t, err, "-offline")
+}
+
+func TestRunComplete_SuggestsSubcommandsFilesLabelsAndGroups(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	targetFile := filepath.Join(root, "pay", "pay_test.go")
+	writeFile(t, targetFile, "package pay\nimport \"testing\"\n\n// zed:group smoke\nfunc TestRefund(t *testing.T) {}\n\nfunc TestCharge(t *testing.T) {}\n")
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+
+	complete := func(args ...string) []string {
+		var out bytes.Buffer
+		require.NoError(t, runComplete(args, &out))
+		return strings.Split(strings.TrimSpace(out.String()), "\n")
+	}
+	assert.Equal(t, []string{"generate", "generate-debug", "generate-package"}, complete("gen"))
+	assert.Equal(t, []string{"./pay"}, complete("generate-package", "-root", root, "-package", "./p"))
+	assert.Equal(t, []string{"pay/pay_test.go"}, complete("generate", "-root", root, "-file", "pa"))
+	assert.Equal(t, []string{"smoke"}, complete("generate", "-root", root, "-group", ""))
+	assert.Equal(t, []string{"go:TestCharge\tpay/pay_test.go", "go:TestRefund\tpay/pay_test.go"}, complete("clear", "-root", root, "-match", "go:"))
+	assert.Equal(t, []string{"./pay"}, complete("clear", "-root", root, "-pkg", ""))
+	assert.Equal(t, []string{"vscode"}, complete("clear", "-editor", "v"))
+}
+
+func TestRunWhich_MapsCommandsAndEntriesToTests(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "pay", "pay_test.go"), "package pay\nimport \"testing\"\n\nfunc TestRefund(t *testing.T) {}\n\nfunc TestRefundPartial(t *testing.T) {}\n")
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runWhich([]string{"-root", root, "--", "go", "test", "-count=1", "./pay", "-run", "^TestRefund$/^full$"}))
+	})
+	assert.Equal(t, "Package ./pay, -run ^TestRefund$/^full$\npay/pay_test.go:4: TestRefund (subtests matching \"^full$\")\n", out)
+
+	debugConfig := `{
+		"label": "go:debug:TestRefund",
+		"adapter": "Delve",
+		"program": "$ZED_WORKTREE_ROOT/pay",
+		"args": ["-test.run", "TestRefund"],
+		"env": {"ZED_GO_TEST_NAME": "TestGone"}, // recorded on another machine
+	}`
+	var stderr string
+	out = captureStdout(t, func() {
+		stderr = captureStderr(t, func() {
+			require.NoError(t, runWhich([]string{"-root", root, "-json", debugConfig}))
+		})
+	})
+	assert.Contains(t, out, "pay/pay_test.go:4: TestRefund\n")
+	assert.Contains(t, out, "pay/pay_test.go:6: TestRefundPartial\n")
+	assert.Contains(t, stderr, "ZED_GO_TEST_NAME=TestGone")
+
+	err := runWhich([]string{"-root", root, "-json", `{"command": "go", "args": ["-C", "$ZED_WORKTREE_ROOT/pay", "test", ".", "-run", "^TestMissing$"]}`})
+	assert.ErrorContains(t, err, `no test in ./pay matches -run "^TestMissing$"`)
+}
+
+func TestSplitRunPattern_IgnoresSlashesInGroups(t *testing.T) {
+	assert.Equal(t, []string{"^TestA$", "^(a/b)$", "c"}, splitRunPattern("^TestA$/^(a/b)$/c"))
+	assert.Equal(t, []string{"[/]x"}, splitRunPattern("[/]x"))
+}
+
+func TestGoRunner_LimitsParallelismAndPriority(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_GOMAXPROCS", "2")
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_PROCS", "1")
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_NICE", "10")
+	cfg, err := loadConfig(commonOptions{rootPath: t.TempDir()})
+	require.NoError(t, err)
+
+	cgoEnv := map[string]string{"CGO_ENABLED": "1"}
+	runner := cfg.goRunner(cgoEnv)
+	assert.Equal(t, map[string]string{"CGO_ENABLED": "1"}, cgoEnv)
+
+	cmd := runner.Command("/tmp", "test", "-list", "^Test", ".")
+	args := cmd.Args
+	if _, err := exec.LookPath("nice"); err == nil {
+		assert.Equal(t, []string{"-n", "10", "go"}, args[1:4])
+		args = args[3:]
+	}
+	assert.Equal(t, []string{"go", "test", "-p", "1", "-list", "^Test", "."}, args)
+	assert.Contains(t, cmd.Env, "GOMAXPROCS=2")
+	assert.Contains(t, cmd.Env, "CGO_ENABLED=1")
+
+	cmd = discovery.Runner{Binary: "go", Procs: 4}.Command("/tmp", "test", "-p=8", ".")
+	assert.Equal(t, []string{"go", "test", "-p=8", "."}, cmd.Args)
+	assert.Nil(t, cmd.Env)
+
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_NICE", "20")
+	_, err = loadConfig(commonOptions{rootPath: t.TempDir()})
+	assert.ErrorContains(t, err, "invalid discovery_nice")
+}
+
+func TestRecordEnvFingerprint_WarnsOnInvalidatingChanges(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	goBinary := filepath.Join(root, "go-env")
+	writeEnv := func(version string) {
+		writeFile(t, goBinary, `#!/bin/sh
+echo '{"GOVERSION": "`+version+`", "GOOS": "linux", "GOARCH": "amd64", "CGO_ENABLED": "1", "CC": "gcc"}'
+`)
+		require.NoError(t, os.Chmod(goBinary, 0o755))
+	}
+	setEnv(t, "ZED_GO_TASKS_GO_BINARY", goBinary)
+	cfg, err := loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	record := func() {
+		var tx fileTransaction
+		recordEnvFingerprint(cfg, root, &tx)
+		require.NoError(t, tx.commit())
+	}
+
+	writeEnv("go1.22.1")
+	assert.Empty(t, captureStderr(t, record))
+	recorded, err := readEnvFingerprint(filepath.Join(root, envFingerprintPath))
+	require.NoError(t, err)
+	require.NotNil(t, recorded)
+	assert.Equal(t, "go1.22.1", recorded.GoVersion)
+	assert.False(t, recorded.Generated.IsZero())
+
+	writeEnv("go1.22.5")
+	assert.Empty(t, captureStderr(t, record))
+
+	writeEnv("go1.23rc1")
+	stderr := captureStderr(t, record)
+	assert.Contains(t, stderr, "warning: Go environment changed since the last generate (Go go1.22.5 -> go1.23rc1)")
+
+	changes := envFingerprint{GoVersion: "go1.23.0", GOOS: "linux", GOARCH: "amd64", CgoEnabled: "1"}.
+		invalidatingChanges(envFingerprint{GoVersion: "go1.23.2 X:nocoverageredesign", GOOS: "darwin", GOARCH: "arm64", CgoEnabled: "0"})
+	assert.Equal(t, []string{"platform linux/amd64 -> darwin/arm64", "CGO_ENABLED 1 -> 0"}, changes)
+
+	setEnv(t, "ZED_GO_TASKS_GO_BINARY", filepath.Join(root, "missing-go"))
+	cfg, err = loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	assert.Empty(t, captureStderr(t, record))
+}
+
+func TestRunEditorProtocol_GeneratesAndResolvesPosition(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	saved := "package sample\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {\n\tt.Log(\"alpha\")\n}\n\nfunc TestBeta(t *testing.T) {}\n"
+	file := filepath.Join(root, "sample_test.go")
+	writeFile(t, file, saved)
+
+	buffer := saved + "\nfunc TestGamma(t *testing.T) {}\n"
+	request, err := json.Marshal(editorRequest{
+		Action:   "generate",
+		Root:     root,
+		File:     file,
+		Position: &editorPosition{Line: 6, Column: 2},
+		Buffer:   &buffer,
+	})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	require.NoError(t, runEditorProtocol(bytes.NewReader(request), &out))
+
+	var response editorResponse
+	require.NoError(t, json.Unmarshal(out.Bytes(), &response))
+	assert.Empty(t, response.Error)
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestBeta"}, response.Labels)
+	assert.Equal(t, "TestAlpha", response.Test)
+	assert.Equal(t, "go:TestAlpha", response.Label)
+	assert.Equal(t, []editorDiagnostic{{Severity: "info", File: file, Line: 11, Message: "save the file to generate an entry for TestGamma"}}, response.Diagnostics)
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestBeta"}, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))))
+
+	out.Reset()
+	require.NoError(t, runEditorProtocol(strings.NewReader(`{"action": "run", "file": "x_test.go"}`), &out))
+	require.NoError(t, json.Unmarshal(out.Bytes(), &response))
+	assert.Equal(t, `unsupported action "run" (expected generate or generate-debug)`, response.Error)
+	assert.Equal(t, []string{}, response.Labels)
+}
+
+func TestFileTransaction_RollsBackOnFailedCommit(t *testing.T) {
+	root := t.TempDir()
+	modes := fileModes{file: 0o644, dir: 0o755}
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	debugPath := filepath.Join(root, ".zed", "debug.json")
+	statePath := filepath.Join(root, ".zed", ".go-zed-tasks", "environment.json")
+	writeFile(t, tasksPath, "old tasks")
+	require.NoError(t, os.Chmod(tasksPath, 0o600))
+	writeFile(t, debugPath, "old debug")
+
+	var tx fileTransaction
+	require.NoError(t, tx.stage(tasksPath, []byte("new tasks"), modes))
+	require.NoError(t, tx.stage(statePath, []byte("new state"), modes))
+	require.NoError(t, tx.stage(debugPath, []byte("new debug"), modes))
+	// Losing the last staged file makes its rename fail after the others
+	// were already replaced.
+	require.NoError(t, os.Remove(tx.staged[2].temp))
+	require.ErrorContains(t, tx.commit(), "replace "+debugPath)
+
+	data, err := os.ReadFile(tasksPath)
+	require.NoError(t, err)
+	assert.Equal(t, "old tasks", string(data))
+	data, err = os.ReadFile(debugPath)
+	require.NoError(t, err)
+	assert.Equal(t, "old debug", string(data))
+	assert.NoFileExists(t, statePath)
+	entries, err := os.ReadDir(filepath.Join(root, ".zed"))
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{".go-zed-tasks", "debug.json", "tasks.json"}, names)
+
+	require.NoError(t, tx.stage(tasksPath, []byte("new tasks"), modes))
+	require.NoError(t, tx.stage(statePath, []byte("new state"), modes))
+	require.NoError(t, tx.commit())
+	data, err = os.ReadFile(tasksPath)
+	require.NoError(t, err)
+	assert.Equal(t, "new tasks", string(data))
+	info, err := os.Stat(tasksPath)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	}
+	assert.FileExists(t, statePath)
+}
+
+func TestRunGenerate_MergeStrategies(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	file := filepath.Join(root, "sample_test.go")
+	writeFile(t, file, "package sample\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n\nfunc TestBeta(t *testing.T) {}\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	existing := `[
+  {"label": "go:TestAlpha", "command": "make", "args": ["alpha"]},
+  {"label": "go:TestOld", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1"}}
+]
+`
+	writeFile(t, tasksPath, existing)
+
+	stdout := captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-merge-strategy", "append-only"}, generateTargetTasks))
+	})
+	assert.Contains(t, stdout, "Tasks added: 1, updated: 0, removed: 0, kept: 1")
+	entries := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestOld", "go:TestBeta"}, labelsFromTasks(entries))
+	assert.Equal(t, "make", taskByLabel(t, entries, "go:TestAlpha")["command"])
+
+	writeFile(t, tasksPath, existing)
+	cfg, err := loadConfig(commonOptions{rootPath: root, mergeStrategy: mergeInteractive})
+	require.NoError(t, err)
+	var asked []string
+	cfg.ConfirmReplace = func(label string) bool {
+		asked = append(asked, label)
+		return false
+	}
+	generated := []Task{{Label: "go:TestAlpha", Command: "go"}, {Label: "go:TestBeta", Command: "go"}}
+	merged, stats, err := tasks.MergeFile(tasksPath, generated, cfg.mergePolicy())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"go:TestAlpha"}, asked)
+	assert.Equal(t, mergeStats{Added: 1, Removed: 1, Kept: 1}, stats)
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestBeta"}, labelsFromTasks(merged.Values()))
+
+	// Entries that would not change are replaced without asking.
+	data, err := merged.Marshal()
+	require.NoError(t, err)
+	writeFile(t, tasksPath, string(data))
+	asked = nil
+	_, stats, err = tasks.MergeFile(tasksPath, []Task{{Label: "go:TestBeta", Command: "go"}}, cfg.mergePolicy())
+	require.NoError(t, err)
+	assert.Empty(t, asked)
+	assert.Equal(t, mergeStats{Updated: 1}, stats)
+
+	var prompts bytes.Buffer
+	confirm := newReplacePrompt(strings.NewReader("n\nyes\na\n"), &prompts)
+	assert.False(t, confirm("go:A"))
+	assert.True(t, confirm("go:B"))
+	assert.True(t, confirm("go:C"))
+	assert.True(t, confirm("go:D"))
+	assert.Equal(t, 3, strings.Count(prompts.String(), "[y/N/a]"))
+	assert.False(t, newReplacePrompt(strings.NewReader(""), io.Discard)("go:E"))
+
+	_, err = loadConfig(commonOptions{rootPath: root, mergeStrategy: "merge"})
+	assert.ErrorContains(t, err, "invalid merge_strategy")
+}
+
+func TestPrune_KeepsMarkedEntriesThatDoNotRunGo(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	existing := `[
+  {"label": "go:TestOld", "command": "go", "args": ["test"], "env": {"ZED_GO_TEST_TASK_GENERATED": "1"}},
+  {"label": "go:cover", "command": "'go' tool covdata textfmt", "env": {"ZED_GO_TEST_TASK_GENERATED": "1"}},
+  {"label": "lint", "command": "golangci-lint", "args": ["run"], "env": {"ZED_GO_TEST_TASK_GENERATED": "1"}}
+]
+`
+	writeFile(t, tasksPath, existing)
+
+	stderr := captureStderr(t, func() {
+		captureStdout(t, func() {
+			require.NoError(t, runClear([]string{"-root", root}))
+		})
+	})
+	assert.Contains(t, stderr, `warning: kept "lint": it has ZED_GO_TEST_TASK_GENERATED=1 but does not run go; use -force to remove it`)
+	assert.Equal(t, []string{"lint"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	captureStdout(t, func() {
+		require.NoError(t, runClear([]string{"-root", root, "-force"}))
+	})
+	assert.Empty(t, readTasksForTest(t, tasksPath))
+
+	writeFile(t, tasksPath, existing)
+	cfg, err := loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	var merged *tasks.File
+	stderr = captureStderr(t, func() {
+		merged, _, err = tasks.MergeFile(tasksPath, []Task{{Label: "go:TestNew", Command: "go"}}, cfg.mergePolicy())
+	})
+	require.NoError(t, err)
+	// The merge only collects the label; the command warns once it is done.
+	assert.Empty(t, stderr)
+	assert.Equal(t, []string{"lint"}, cfg.KeptForeign.labels)
+	assert.Equal(t, []string{"lint", "go:TestNew"}, labelsFromTasks(merged.Values()))
+
+	setEnv(t, "ZED_GO_TASKS_WATCH_COMMAND", "reflex")
+	cfg, err = loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	owns := cfg.entryOwner()
+	assert.True(t, owns(map[string]any{"command": "reflex -s -- go test ./a"}))
+	assert.True(t, owns(map[string]any{"adapter": "Delve"}))
+	assert.True(t, owns(map[string]any{"type": "go", "request": "launch"}))
+	assert.False(t, owns(map[string]any{"type": "node"}))
+}
+
+func TestRunGenerate_ConcurrentRunsPolicy(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "unit", "unit_test.go"), "package unit\n\nimport \"testing\"\n\nfunc TestUnit(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "store", "pg", "pg_test.go"), "package pg\n\nimport \"testing\"\n\nfunc TestQuery(t *testing.T) {}\n")
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+	setEnv(t, "ZED_GO_TASKS_CONCURRENT_RUNS_POLICY", "auto")
+	setEnv(t, "ZED_GO_TASKS_SERIAL_PACKAGES", "./store/...")
+
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", filepath.Join(root, "unit", "unit_test.go")}, generateTargetTasks))
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", filepath.Join(root, "store", "pg", "pg_test.go")}, generateTargetTasks))
+	})
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, true, taskByLabel(t, tasks, "go:TestUnit")["allow_concurrent_runs"])
+	assert.Equal(t, false, taskByLabel(t, tasks, "go:TestQuery")["allow_concurrent_runs"])
+
+	cfg, err := loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	assert.False(t, cfg.allowConcurrentRuns(goldenVariantName, "./unit"))
+	assert.False(t, cfg.allowConcurrentRuns("", "./unit", "./store/pg"))
+	assert.True(t, cfg.allowConcurrentRuns(coverVariantName, "./unit"))
+
+	cfg.ConcurrentRunsPolicy = concurrentRunsGlobal
+	assert.False(t, cfg.allowConcurrentRuns("", "./unit"))
+
+	setEnv(t, "ZED_GO_TASKS_CONCURRENT_RUNS_POLICY", "sometimes")
+	_, err = loadConfig(commonOptions{rootPath: root})
+	assert.ErrorContains(t, err, "invalid concurrent_runs_policy")
+}
+
+func TestRunCompose_CombinesTestsAndLabels(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "a", "a_test.go"), "package a\n\nimport \"testing\"\n\nfunc TestLogin(t *testing.T) {}\n\nfunc TestLogout(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "b", "b_test.go"), "package b\n\nimport \"testing\"\n\nfunc TestCheckout(t *testing.T) {}\n")
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", filepath.Join(root, "a", "a_test.go")}, generateTargetTasks))
+	})
+
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	stdout := captureStdout(t, func() {
+		require.NoError(t, runCompose([]string{"-root", root, "-name", "focus", "go:TestLogin", "TestCheckout"}))
+	})
+	assert.Contains(t, stdout, "Composed task go:focus: 2 tests in 2 packages")
+	task := taskByLabel(t, readTasksForTest(t, tasksPath), "go:focus")
+	assert.Equal(t, []string{"test", "./a", "./b", "-run", "^(TestCheckout|TestLogin)$"}, toStringSlice(t, task["args"]))
+	env := toStringMap(t, task["env"])
+	assert.Equal(t, "./a:TestLogin,./b:TestCheckout", env["ZED_GO_TEST_COMPOSE"])
+	assert.NotContains(t, env, "ZED_GO_TEST_TASK_GENERATED")
+
+	captureStdout(t, func() {
+		require.NoError(t, runCompose([]string{"-root", root, "-name", "go:focus", "-append", "TestLogout"}))
+	})
+	tasks := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{"go:TestLogin", "go:TestLogout", "go:focus"}, labelsFromTasks(tasks))
+	assert.Equal(t, []string{"test", "./a", "./b", "-run", "^(TestCheckout|TestLogin|TestLogout)$"}, toStringSlice(t, taskByLabel(t, tasks, "go:focus")["args"]))
+
+	// Regenerating prunes generated entries only.
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", filepath.Join(root, "b", "b_test.go")}, generateTargetTasks))
+	})
+	assert.Equal(t, []string{"go:focus", "go:TestCheckout"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	err := runCompose([]string{"-root", root, "-name", "focus", "TestMissing"})
+	assert.ErrorContains(t, err, `no generated task labeled "TestMissing" and no test TestMissing`)
+}
+
+func TestRunGenerate_GroupParallelFromTParallelCalls(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "a", "a_test.go"), `package a
+
+import "testing"
+
+// zed:group api
+func TestList(t *testing.T) {
+	t.Parallel()
+	for _, name := range []string{"x", "y"} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+		})
+	}
+}
+
+// zed:group api
+func TestGet(t *testing.T) {}
+`)
+	setEnv(t, "ZED_GO_TASKS_AGGREGATE_PARALLEL", "true")
+
+	// Call sites are counted, so the loop counts once.
+	stdout := captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-group", "api"}, generateTargetTasks))
+	})
+	assert.Contains(t, stdout, "Parallel: 2 t.Parallel() calls in 2 tests; -parallel=2")
+	task := taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:group:api")
+	assert.Equal(t, []string{"test", "-parallel=2", "./a", "-run", "^(TestGet|TestList)$"}, toStringSlice(t, task["args"]))
+
+	stdout = captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-group", "api", "--", "-parallel=1"}, generateTargetTasks))
+	})
+	assert.Contains(t, stdout, "kept the -parallel from the go test args")
+	task = taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:group:api")
+	assert.Equal(t, []string{"test", "-parallel=1", "./a", "-run", "^(TestGet|TestList)$"}, toStringSlice(t, task["args"]))
+
+	members := groupMembers{tests: []string{"TestA"}, parallelCalls: 1000}
+	cfg, err := loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	assert.Equal(t, 4*runtime.NumCPU(), members.parallelism(cfg))
+	assert.Equal(t, 0, groupMembers{tests: []string{"TestA"}}.parallelism(cfg))
+}
+
+func TestParseRunEvents_AttributesAndUnknownActionsFeedQueryTree(t *testing.T) {
+	output := strings.Join([]string{
+		`{"Action":"start","Package":"example.com/sample"}`,
+		`{"Action":"run","Test":"TestA"}`,
+		`{"Action":"attr","Test":"TestA","Key":"owner","Value":"db team"}`,
+		`{"Action":"output","Test":"TestA","Output":"=== ATTR  TestA owner db team\n","OutputType":"frame"}`,
+		`{"Action":"artifacts","Test":"TestA","Path":"/tmp/_artifacts/TestA/1"}`,
+		`{"Action":"checkpoint","Test":"TestA","Future":{"nested":true}}`,
+		`{"Action":"pass","Test":"TestA","Elapsed":0.01}`,
+		`{"Action":"build-output","ImportPath":"example.com/sample","Output":"note\n"}`,
+		`{"Action":"run","Test":"TestA/sub"}`,
+		`{"Action":"attr","Test":"TestA/sub","Key":"issue","Value":"123"}`,
+	}, "\n")
+
+	events, err := discovery.ParseRunEvents([]byte(output))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TestA", "TestA/sub"}, events.Tests)
+	assert.Equal(t, map[string]map[string]string{"TestA": {"owner": "db team"}, "TestA/sub": {"issue": "123"}}, events.Attributes)
+	assert.Equal(t, map[string]string{"TestA": "/tmp/_artifacts/TestA/1"}, events.Artifacts)
+	assert.Empty(t, events.Skipped)
+
+	result := discoveryResult{
+		selectedTests:  events.Tests,
+		testAttributes: events.Attributes,
+		testArtifacts:  events.Artifacts,
+		testDecls:      map[string]testDecl{"TestA": {name: "TestA", line: 3}},
+	}
+	tree := result.queryTree()
+	require.Len(t, tree.Tests, 1)
+	assert.Equal(t, map[string]string{"owner": "db team"}, tree.Tests[0].Attributes)
+	assert.Equal(t, "/tmp/_artifacts/TestA/1", tree.Tests[0].Artifacts)
+	require.Len(t, tree.Tests[0].Subtests, 1)
+	assert.Equal(t, map[string]string{"issue": "123"}, tree.Tests[0].Subtests[0].Attributes)
+}
+
+func TestRunGenerate_SkippedTests(t *testing.T) {
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+import "testing"
+
+func TestDocker(t *testing.T) {
+	t.Skip("needs DOCKER")
+}
+
+func TestPlain(t *testing.T) {
+	t.Run("skips", func(t *testing.T) { t.Skip() })
+}
+`)
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_SKIPPED_TESTS", "annotate")
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-discover-subtests"}, generateTargetTasks))
+	assert.Equal(t, []string{"go:TestDocker [skipped: needs DOCKER]", "go:TestPlain", "go:TestPlain/skips [skipped]"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	setEnv(t, "ZED_GO_TASKS_SKIPPED_TESTS", "exclude")
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-discover-subtests"}, generateTargetTasks))
+	assert.Equal(t, []string{"go:TestPlain"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	setEnv(t, "ZED_GO_TASKS_SKIPPED_TESTS", "hide")
+	err := runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks)
+	assert.ErrorContains(t, err, "invalid skipped_tests")
+}
+
+func TestRunGenerate_GroupFailfastVariant(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_FAILFAST_VARIANTS", "true")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "a", "a_test.go"), "package a\n\nimport \"testing\"\n\n// zed:group smoke\nfunc TestLogin(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-root", root, "-group", "smoke", "-go-test-arg=-count=1"}, generateTargetTasks))
+
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, []string{"go:group:smoke", "go:group:smoke [failfast]"}, labelsFromTasks(tasks))
+	assert.Equal(t, []string{"test", "-count=1", "./a", "-run", "^(TestLogin)$"}, toStringSlice(t, taskByLabel(t, tasks, "go:group:smoke")["args"]))
+	failfast := taskByLabel(t, tasks, "go:group:smoke [failfast]")
+	assert.Equal(t, []string{"test", "-count=1", "-failfast", "./a", "-run", "^(TestLogin)$"}, toStringSlice(t, failfast["args"]))
+	env := toStringMap(t, failfast["env"])
+	assert.Equal(t, "failfast", env["ZED_GO_TEST_VARIANT"])
+	assert.Equal(t, "smoke", env["ZED_GO_TEST_GROUP"])
+
+	// A -failfast in the go test args is not repeated.
+	require.NoError(t, runGenerate([]string{"-root", root, "-group", "smoke", "-go-test-arg=-failfast"}, generateTargetTasks))
+	tasks = readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, []string{"test", "-failfast", "./a", "-run", "^(TestLogin)$"}, toStringSlice(t, taskByLabel(t, tasks, "go:group:smoke [failfast]")["args"]))
+}
+
+func TestRunGenerate_GroupSplitsOversizedRunPattern(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_MAX_RUN_PATTERN", "30")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "a", "a_test.go"), "package a\n\nimport \"testing\"\n\n// zed:group smoke\nfunc TestAlpha(t *testing.T) {}\n\n// zed:group smoke\nfunc TestBravo(t *testing.T) {}\n\n// zed:group smoke\nfunc TestCharlie(t *testing.T) {}\n")
+
+	var err error
+	out := captureStdout(t, func() {
+		err = runGenerate([]string{"-root", root, "-group", "smoke"}, generateTargetTasks)
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out, "Warning: the -run pattern of group smoke is 35 bytes, over the 30 byte limit; split into 2 tasks")
+
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, []string{"go:group:smoke [part 1/2]", "go:group:smoke [part 2/2]"}, labelsFromTasks(tasks))
+	first := taskByLabel(t, tasks, "go:group:smoke [part 1/2]")
+	assert.Equal(t, []string{"test", "./a", "-run", "^(TestAlpha|TestBravo)$"}, toStringSlice(t, first["args"]))
+	assert.Equal(t, "1/2", toStringMap(t, first["env"])["ZED_GO_TEST_PART"])
+	assert.Equal(t, []string{"test", "./a", "-run", "^(TestCharlie)$"}, toStringSlice(t, taskByLabel(t, tasks, "go:group:smoke [part 2/2]")["args"]))
+
+	// Once the pattern fits again the parts collapse into one task.
+	setEnv(t, "ZED_GO_TASKS_MAX_RUN_PATTERN", "0")
+	require.NoError(t, runGenerate([]string{"-root", root, "-group", "smoke"}, generateTargetTasks))
+	tasks = readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, []string{"go:group:smoke"}, labelsFromTasks(tasks))
+}
+
+func TestRunGenerate_ExclusiveFileOwnership(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_FILE_OWNERSHIP", "exclusive")
+	setEnv(t, "ZED_GO_TASKS_MERGE_STRATEGY", "append-only")
+	setEnv(t, "ZED_GO_TASKS_TASKS_PATH", ".zed/tasks.generated.json")
+	setEnv(t, "ZED_GO_TASKS_DEBUG_PATH", ".zed/debug.generated.json")
+
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	mainTasks := `[{"label": "serve", "command": "make serve"}]`
+	writeFile(t, filepath.Join(root, ".zed", "tasks.json"), mainTasks)
+	generatedPath := filepath.Join(root, ".zed", "tasks.generated.json")
+	writeFile(t, generatedPath, `[
+  {"label": "stray", "command": "echo"},
+  {"label": "go:TestA", "command": "go", "args": ["old"], "env": {"ZED_GO_TEST_TASK_GENERATED": "1"}},
+  {"label": "go:TestGone", "command": "./run.sh", "env": {"ZED_GO_TEST_TASK_GENERATED": "1"}}
+]`)
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+
+	tasks := readTasksForTest(t, generatedPath)
+	assert.Equal(t, []string{"go:TestA"}, labelsFromTasks(tasks))
+	assert.NotEqual(t, []string{"old"}, toStringSlice(t, taskByLabel(t, tasks, "go:TestA")["args"]))
+	data, err := os.ReadFile(filepath.Join(root, ".zed", "tasks.json"))
+	require.NoError(t, err)
+	assert.Equal(t, mainTasks, string(data))
+
+	setEnv(t, "ZED_GO_TASKS_DEBUG_PATH", ".zed/debug.json")
+	err = runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks)
+	assert.ErrorContains(t, err, "file_ownership=exclusive would overwrite .zed/debug.json")
+	setEnv(t, "ZED_GO_TASKS_FILE_OWNERSHIP", "mine")
+	err = runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks)
+	assert.ErrorContains(t, err, "invalid file_ownership")
+}
+
+func TestConfigFallbackDir(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "workspace")
+	state := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+
+	dir, err := Config{}.fallbackDir(root)
+	require.NoError(t, err)
+	assert.Empty(t, dir)
+
+	dir, err = Config{FallbackDir: "state"}.fallbackDir(root)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		assert.Equal(t, filepath.Join(state, "go-zed-tasks", "workspace-"+shortHash(root)), dir)
+	}
+
+	dir, err = Config{FallbackDir: "out/zed"}.fallbackDir(root)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "out", "zed"), dir)
+}
+
+func TestRunGenerate_ReadOnlyTasksDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs directory permissions that apply to the current user")
+	}
+	clearConfigEnv(t)
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	zedDir := filepath.Join(root, ".zed")
+	require.NoError(t, os.MkdirAll(zedDir, 0o755))
+	require.NoError(t, os.Chmod(zedDir, 0o555))
+	t.Cleanup(func() { _ = os.Chmod(zedDir, 0o755) })
+
+	err := runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.ErrorContains(t, err, "set FALLBACK_DIR")
+
+	setEnv(t, "ZED_GO_TASKS_FALLBACK_DIR", "fallback")
+	stderr := captureStderr(t, func() {
+		require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	})
+	fallback := filepath.Join(root, "fallback", ".zed", "tasks.json")
+	assert.Contains(t, stderr, "wrote "+fallback+" instead")
+	assert.Equal(t, []string{"go:TestA"}, labelsFromTasks(readTasksForTest(t, fallback)))
+	assert.NoFileExists(t, filepath.Join(zedDir, "tasks.json"))
+}
+
+func TestRunStats_CountsPerPackage(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	aFile := filepath.Join(root, "a", "a_test.go")
+	writeFile(t, aFile, `package a
+
+import "testing"
+
+func TestOne(t *testing.T) {
+	t.Run("sub", func(t *testing.T) {})
+}
+
+func TestTwo(t *testing.T) {}
+
+func BenchmarkOne(b *testing.B) {}
+
+func FuzzOne(f *testing.F) {}
+
+func Example() {}
+`)
+	writeFile(t, filepath.Join(root, "a", "more_test.go"), "package a\n\nimport \"testing\"\n\nfunc TestThree(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "b", "b_test.go"), "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n")
+	require.NoError(t, runGenerate([]string{"-file", aFile, "-root", root, "-targets", "tasks,debug"}, generateTargetTasks))
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runStats([]string{"-root", root, "-output", "json", "-discover-subtests"}))
+	})
+	var inventory statsOutput
+	require.NoError(t, json.Unmarshal([]byte(out), &inventory))
+	assert.Equal(t, []packageStats{
+		{Package: "./a", Files: 2, Tests: 3, Subtests: 1, Benchmarks: 1, Fuzz: 1, Examples: 1, Tasks: 2, DebugConfigs: 2},
+		{Package: "./b", Files: 1, Tests: 1},
+	}, inventory.Packages)
+	assert.Equal(t, packageStats{Package: "total", Files: 3, Tests: 4, Subtests: 1, Benchmarks: 1, Fuzz: 1, Examples: 1, Tasks: 2, DebugConfigs: 2}, inventory.Total)
+
+	table := captureStdout(t, func() {
+		require.NoError(t, runStats([]string{"-root", root}))
+	})
+	lines := strings.Split(strings.TrimSpace(table), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, []string{"PACKAGE", "FILES", "TESTS", "SUBTESTS", "BENCHMARKS", "FUZZ", "EXAMPLES", "TASKS", "DEBUG"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"./a", "2", "3", "0", "1", "1", "1", "2", "2"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"total", "3", "4", "0", "1", "1", "1", "2", "2"}, strings.Fields(lines[3]))
+
+	assert.ErrorContains(t, runStats([]string{"-root", root, "-output", "csv"}), "unsupported -output")
+
+	// A package that does not compile is counted from its source, without
+	// the generate wording about entries.
+	writeFile(t, filepath.Join(root, "c", "c_test.go"), "package c\n\nimport \"testing\"\n\nfunc TestC(t *testing.T) { undefinedCall() }\n")
+	stderr := captureStderr(t, func() {
+		captureStdout(t, func() {
+			require.NoError(t, runStats([]string{"-root", root}))
+		})
+	})
+	assert.Contains(t, stderr, "warning: c_test.go counted from source only; package does not compile")
+	assert.NotContains(t, stderr, "generating unverified entries")
+}
+
+func TestRunGenerate_RunnerScripts(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+	setEnv(t, "ZED_GO_TASKS_GOLDEN_VARIANTS", "false")
+	setEnv(t, "ZED_GO_TASKS_RUNNER_SCRIPTS", "./...=make test PKG={{.Package}} RUN={{.Run}};./svc/...=./scripts/test.sh {{.Package}} -run {{.Run}} {{.Args}}")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	libFile := filepath.Join(root, "lib", "lib_test.go")
+	writeFile(t, libFile, "package lib\nimport \"testing\"\n\nfunc TestLib(t *testing.T) {}\n")
+	svcFile := filepath.Join(root, "svc", "api", "api_test.go")
+	writeFile(t, svcFile, "package api\nimport \"testing\"\n\nfunc TestAPI(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", libFile, "-root", root}, generateTargetTasks))
+	require.NoError(t, runGenerate([]string{"-file", svcFile, "-root", root, "-go-test-arg=-count=1"}, generateTargetTasks))
+
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	tasks := readTasksForTest(t, tasksPath)
+	lib := taskByLabel(t, tasks, "go:TestLib")
+	assert.Equal(t, "make test PKG=./lib RUN='^TestLib$'", lib["command"])
+	assert.NotContains(t, lib, "args")
+	assert.Equal(t, "./scripts/test.sh ./svc/api -run '^TestAPI$' -count=1", taskByLabel(t, tasks, "go:TestAPI")["command"])
+	assert.Equal(t, "1", toStringMap(t, lib["env"])["ZED_GO_TEST_TASK_GENERATED"])
+
+	// Runner tasks count as the tool's own entries when pruning.
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "true")
+	require.NoError(t, runGenerate([]string{"-file", libFile, "-root", root}, generateTargetTasks))
+	assert.Equal(t, []string{"go:TestLib"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	setEnv(t, "ZED_GO_TASKS_RUNNER_SCRIPTS", "./...=run {{.Nope}}")
+	err := runGenerate([]string{"-file", libFile, "-root", root}, generateTargetTasks)
+	assert.ErrorContains(t, err, "invalid runner_scripts entry for ./...")
+}
+
+func TestRunGenerate_RecordsMetrics(t *testing.T) {
+	clearConfigEnv(t)
+	metricsPath := filepath.Join(t.TempDir(), "metrics.jsonl")
+	setEnv(t, "ZED_GO_TASKS_METRICS", "true")
+	setEnv(t, "ZED_GO_TASKS_METRICS_PATH", metricsPath)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "secret_name_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestPrivate(t *testing.T) {}\n")
+
+	for range 2 {
+		captureStdout(t, func() {
+			require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+		})
+	}
+
+	data, err := os.ReadFile(metricsPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret_name")
+	assert.NotContains(t, string(data), "TestPrivate")
+	records, err := readMetrics(metricsPath)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, 1, records[0].Tests)
+	assert.ElementsMatch(t, []string{"discovery", "discovery/ast", "write", "total"}, slices.Collect(maps.Keys(records[0].Phases)))
+	assert.Equal(t, map[string]string{"DISCOVERY_STRATEGIES": "ast"}, records[0].Settings)
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runMetrics([]string{"-root", root, "-output", "json"}))
+	})
+	var summary metricsSummary
+	require.NoError(t, json.Unmarshal([]byte(out), &summary))
+	assert.Equal(t, 2, summary.Runs)
+	require.Len(t, summary.Phases, 4)
+	assert.Equal(t, "discovery", summary.Phases[0].Name)
+	assert.Equal(t, 2, summary.Phases[0].Runs)
+	assert.Empty(t, summary.Settings)
+
+	captureStdout(t, func() {
+		require.NoError(t, runMetrics([]string{"-root", root, "-clear"}))
+	})
+	assert.NoFileExists(t, metricsPath)
+}
+
+func TestSummarizeMetrics_PercentilesPerPhaseAndSettings(t *testing.T) {
+	var records []metricsRecord
+	for i := 1; i <= 20; i++ {
+		cache := "off"
+		if i%2 == 0 {
+			cache = "readwrite (hit)"
+		}
+		records = append(records, metricsRecord{
+			Phases:   map[string]float64{"total": float64(i)},
+			Settings: map[string]string{"DISCOVERY_CACHE": cache},
+		})
+	}
+
+	summary := summarizeMetrics(records)
+	assert.Equal(t, 20, summary.Runs)
+	assert.Equal(t, []metricsQuant{{Name: "total", Runs: 20, P50: 10, P95: 19}}, summary.Phases)
+	assert.Equal(t, []metricsQuant{
+		{Name: "DISCOVERY_CACHE=off", Runs: 10, P50: 9, P95: 19},
+		{Name: "DISCOVERY_CACHE=readwrite (hit)", Runs: 10, P50: 10, P95: 20},
+	}, summary.Settings)
+}
+
+func TestRunGenerate_TaskLogsTeeOutputAndRotate(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs a POSIX shell")
+	}
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_TASK_LOGS", "true")
+	setEnv(t, "ZED_GO_TASKS_TASK_LOG_KEEP", "1")
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestOK(t *testing.T) { t.Log(\"run ok\") }\n\nfunc TestBad(t *testing.T) { t.Fatal(\"broken\") }\n")
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-go-test-arg=-v"}, generateTargetTasks))
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	tasks := readTasksForTest(t, tasksPath)
+	ok := taskByLabel(t, tasks, "go:TestOK")
+	assert.Nil(t, ok["args"])
+	command, _ := ok["command"].(string)
+	assert.Contains(t, command, `| tee "$ZED_WORKTREE_ROOT/.zed/.go-zed-tasks/logs/go_TestOK-4bd1b61.log"`)
+
+	runTask := func(label string) error {
+		cmd := exec.Command("sh", "-c", taskByLabel(t, tasks, label)["command"].(string))
+		cmd.Dir = root
+		cmd.Env = append(os.Environ(), "ZED_WORKTREE_ROOT="+root)
+		return cmd.Run()
+	}
+	require.NoError(t, runTask("go:TestOK"))
+	require.NoError(t, runTask("go:TestOK"))
+	assert.Error(t, runTask("go:TestBad"), "the task keeps the exit status of go test")
+
+	logDir := filepath.Join(root, ".zed", ".go-zed-tasks", "logs")
+	assert.FileExists(t, filepath.Join(logDir, "go_TestOK-4bd1b61.log.1"))
+	assert.NoFileExists(t, filepath.Join(logDir, "go_TestOK-4bd1b61.log.2"))
+	out := captureStdout(t, func() {
+		require.NoError(t, runLogs([]string{"-root", root, "go:TestBad"}))
+	})
+	assert.Contains(t, out, "broken")
+	out = captureStdout(t, func() {
+		require.NoError(t, runLogs([]string{"-root", root, "-lines", "1", "go:TestOK"}))
+	})
+	assert.Equal(t, "ok", strings.Fields(out)[0])
+	out = captureStdout(t, func() {
+		require.NoError(t, runLogs([]string{"-root", root}))
+	})
+	assert.Contains(t, out, "go_TestBad")
+	assert.Contains(t, out, "go_TestOK")
+	assert.Error(t, runLogs([]string{"-root", root, "go:TestMissing"}))
+
+	// Tee'd tasks are still this tool's own: regenerating replaces them
+	// instead of keeping them as foreign entries.
+	stderr := captureStderr(t, func() {
+		require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	})
+	assert.NotContains(t, stderr, "warning")
+	assert.Equal(t, []string{"go:TestBad", "go:TestOK"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+}
+
+func TestRunGenerate_TaskLogsVSCodeRunsUnwrappedOnWindows(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	setEnv(t, "ZED_GO_TASKS_TASK_LOGS", "true")
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) { t.Run(\"b\", func(t *testing.T) {}) }\n\nfunc TestA_b(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-editor", "vscode", "-static-subtests"}, generateTargetTasks))
+	_, entries, err := readVSCodeTasksDocument(filepath.Join(root, ".vscode", "tasks.json"))
+	require.NoError(t, err)
+
+	task := taskByLabel(t, entries, "go:TestA")
+	assert.Nil(t, task["args"])
+	assert.Contains(t, task["command"], "| tee ")
+	windows, ok := task["windows"].(map[string]any)
+	require.True(t, ok, "tee'd VS Code tasks need a plain command for PowerShell and cmd.exe")
+	assert.Equal(t, "go", windows["command"])
+	assert.Contains(t, toStringSlice(t, windows["args"]), "^TestA$")
+
+	// A subtest and a test whose names only differ in a replaced character
+	// log to different files.
+	subtest, _ := taskByLabel(t, entries, "go:TestA/b")["command"].(string)
+	test, _ := taskByLabel(t, entries, "go:TestA_b")["command"].(string)
+	assert.Contains(t, subtest, "/"+tasks.LogFile("go:TestA/b")+`"`)
+	assert.Contains(t, test, "/"+tasks.LogFile("go:TestA_b")+`"`)
+	assert.NotEqual(t, tasks.LogFile("go:TestA/b"), tasks.LogFile("go:TestA_b"))
+}
+
+func TestRunGenerate_ShortVariantOnlyForTestsCallingShort(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
+
+import gotesting "testing"
+
+func TestSlow(t *gotesting.T) {
+	if gotesting.Short() {
+		t.Skip("slow")
+	}
+}
+
+func TestNested(t *gotesting.T) {
+	t.Run("inner", func(t *gotesting.T) {
+		_ = gotesting.Short()
+	})
+}
+
+func TestFast(t *gotesting.T) {}
+`)
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	tasks := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{"go:TestFast", "go:TestNested", "go:TestNested [short]", "go:TestSlow", "go:TestSlow [short]"}, labelsFromTasks(tasks))
+	short := taskByLabel(t, tasks, "go:TestSlow [short]")
+	assert.Contains(t, toStringSlice(t, short["args"]), "-short")
+	assert.Equal(t, "short", toStringMap(t, short["env"])["ZED_GO_TEST_VARIANT"])
+	assert.NotContains(t, toStringSlice(t, taskByLabel(t, tasks, "go:TestSlow")["args"]), "-short")
+
+	// With -short in the go test args every task is short already.
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-go-test-arg=-short"}, generateTargetTasks))
+	assert.Equal(t, []string{"go:TestFast", "go:TestNested", "go:TestSlow"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	setEnv(t, "ZED_GO_TASKS_SHORT_VARIANTS", "false")
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	assert.Equal(t, []string{"go:TestFast", "go:TestNested", "go:TestSlow"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+}
+
+func TestRunPrune_OlderThanRemovesOldEntriesWhoseTestIsGone(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n\nfunc TestB(t *testing.T) {}\n")
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	tasks := readTasksForTest(t, tasksPath)
+	tasks = append(tasks, map[string]any{
+		"label":   "go:TestOld",
+		"command": "go",
+		"env":     map[string]any{"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestOld", "ZED_GO_TEST_FILE": "gone_test.go"},
+	})
+	data, err := json.Marshal(tasks)
+	require.NoError(t, err)
+	writeFile(t, tasksPath, string(data))
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+
+	assert.ErrorContains(t, runPrune([]string{"-root", root}), "-older-than")
+	assert.ErrorContains(t, runPrune([]string{"-root", root, "-older-than", "soon"}), "invalid -older-than")
+
+	// TestB is gone but was generated just now; TestOld has no recorded
+	// time and counts as old.
+	require.NoError(t, runPrune([]string{"-root", root, "-older-than", "30d"}))
+	assert.Equal(t, []string{"go:TestA", "go:TestB"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	timesPath := filepath.Join(root, ".zed", ".go-zed-tasks", "generated.json")
+	var times map[string]map[string]time.Time
+	data, err = os.ReadFile(timesPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &times))
+	require.Contains(t, times[".zed/tasks.json"], "go:TestB")
+	old := time.Now().Add(-60 * 24 * time.Hour).UTC()
+	times[".zed/tasks.json"]["go:TestA"] = old
+	times[".zed/tasks.json"]["go:TestB"] = old
+	data, err = json.Marshal(times)
+	require.NoError(t, err)
+	writeFile(t, timesPath, string(data))
+
+	// TestA is old but still declared, so only TestB goes.
+	require.NoError(t, runPrune([]string{"-root", root, "-older-than", "2w"}))
+	assert.Equal(t, []string{"go:TestA"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+	data, err = os.ReadFile(timesPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "go:TestB")
+}
+
+func TestRunPrune_DryRunListsLabelsAndReasons(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a_test.go"), "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	content := `[
+  {"label": "manual", "command": "echo"},
+  {"label": "go:TestA", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestA", "ZED_GO_TEST_FILE": "a_test.go"}},
+  {"label": "go:TestGone", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestGone", "ZED_GO_TEST_FILE": "a_test.go"}},
+  {"label": "go:TestOld", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestOld", "ZED_GO_TEST_FILE": "gone_test.go"}}
+]`
+	writeFile(t, tasksPath, content)
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runPrune([]string{"-root", root, "-older-than", "30d", "-dry-run"}))
+	})
+	assert.Contains(t, out, "Would remove 2 generated tasks from "+tasksPath)
+	assert.Regexp(t, `go:TestGone +generated marker ZED_GO_TEST_TASK_GENERATED=1; no recorded generation time; TestGone is no longer declared in a_test.go`, out)
+	assert.Regexp(t, `go:TestOld +.*gone_test.go is gone`, out)
+	assert.NotContains(t, out, "go:TestA")
+	assert.NotContains(t, out, `"label"`)
+
+	out = captureStdout(t, func() {
+		require.NoError(t, runClear([]string{"-root", root, "-match", "Old$", "-dry-run", "-output", "json"}))
+	})
+	var report clearReport
+	require.NoError(t, json.Unmarshal([]byte(out), &report))
+	assert.True(t, report.DryRun)
+	assert.Equal(t, []clearRemoval{{Label: "go:TestOld", Reasons: []string{"generated marker ZED_GO_TEST_TASK_GENERATED=1", "label matches -match Old$"}}}, report.Removed)
+
+	// Nothing was written.
+	assert.Len(t, readTasksForTest(t, tasksPath), 4)
+	assert.ErrorContains(t, runClear([]string{"-root", root, "-output", "yaml"}), "unsupported -output")
+}
+
+func TestRunGenerate_KeymapBindsAliasesAndRecentLabels(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	setEnv(t, "ZED_GO_TASKS_KEYMAP_PATH", ".zed/keymap.json")
+	setEnv(t, "ZED_GO_TASKS_KEYMAP_BINDINGS", "ctrl-alt-t=go:TestB")
+	setEnv(t, "ZED_GO_TASKS_KEYMAP_RECENT", "2")
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n\nfunc TestB(t *testing.T) {}\n")
+	keymapPath := filepath.Join(root, ".zed", "keymap.json")
+	writeFile(t, keymapPath, `[
+  // my own bindings
+  {"context": "Editor", "bindings": {"ctrl-x": "editor::Cut"}},
+  {"context": "Workspace", "bindings": {"ctrl-alt-m": ["task::Spawn", {"task_name": "manual"}]}},
+]`)
+
+	for range 2 {
+		require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	}
+
+	data, err := os.ReadFile(keymapPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "// my own bindings")
+	assert.Equal(t, 1, strings.Count(string(data), keymapMarker))
+	sections := readTasksForTest(t, keymapPath)
+	require.Len(t, sections, 3)
+	assert.Equal(t, map[string]any{
+		"ctrl-alt-t": []any{"task::Spawn", map[string]any{"task_name": "go:TestB"}},
+		"alt-g 1":    []any{"task::Spawn", map[string]any{"task_name": "go:TestA"}},
+		"alt-g 2":    []any{"task::Spawn", map[string]any{"task_name": "go:TestB"}},
+	}, sections[0]["bindings"])
+	assert.Equal(t, "Editor", sections[1]["context"])
+	// An unmarked section that only spawns tasks is the user's.
+	assert.Equal(t, map[string]any{"ctrl-alt-m": []any{"task::Spawn", map[string]any{"task_name": "manual"}}}, sections[2]["bindings"])
+
+	// Without bindings the marked section goes away and the rest stays.
+	setEnv(t, "ZED_GO_TASKS_KEYMAP_BINDINGS", "")
+	setEnv(t, "ZED_GO_TASKS_KEYMAP_RECENT", "0")
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks))
+	data, err = os.ReadFile(keymapPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), keymapMarker)
+	assert.Contains(t, string(data), "// my own bindings")
+	assert.Len(t, readTasksForTest(t, keymapPath), 2)
+
+	setEnv(t, "ZED_GO_TASKS_KEYMAP_RECENT", "10")
+	assert.ErrorContains(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks), "invalid keymap_recent")
+
+	setEnv(t, "ZED_GO_TASKS_KEYMAP_RECENT", "1")
+	setEnv(t, "ZED_GO_TASKS_KEYMAP_PATH", filepath.Join(t.TempDir(), "keymap.json"))
+	assert.ErrorContains(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks), "outside the workspace")
+}
+
+func TestRunGenerate_ReproducibleSortsGeneratedEntriesInPlace(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	setEnv(t, "ZED_GO_TASKS_REPRODUCIBLE", "true")
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n\nfunc TestA(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, ".zed", "tasks.json"), `[
+  {"label": "go:TestZ", "command": "go", "env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestZ", "ZED_GO_TEST_FILE": "other_test.go"}},
+  {"label": "manual", "command": "echo"}
+]`)
+	writeFile(t, filepath.Join(root, ".vscode", "tasks.json"), `{"version": "2.0.0", "tasks": [
+  {"label": "go:TestZ", "command": "go", "options": {"env": {"ZED_GO_TEST_TASK_GENERATED": "1", "ZED_GO_TEST_NAME": "TestZ", "ZED_GO_TEST_FILE": "other_test.go"}}},
+  {"label": "manual", "command": "echo"}
+]}`)
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-editor", "zed,vscode"}, generateTargetTasks))
+
+	want := []string{"go:TestA", "manual", "go:TestB", "go:TestZ"}
+	assert.Equal(t, want, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))))
+	_, vscodeTasks, err := readVSCodeTasksDocument(filepath.Join(root, ".vscode", "tasks.json"))
+	require.NoError(t, err)
+	assert.Equal(t, want, labelsFromTasks(vscodeTasks))
+
+	cfg := Config{Reproducible: true}
+	assert.Equal(t, 6<<10, cfg.runPatternLimit())
+
+	setEnv(t, "ZED_GO_TASKS_GO_BINARY", "/usr/local/go/bin/go")
+	assert.ErrorContains(t, runGenerate([]string{"-file", targetFile, "-root", root}, generateTargetTasks), "invalid go_binary")
+}
+
+func TestParseConfigOverrideFlags_ConvertsJSONValues(t *testing.T) {
+	clearConfigEnv(t)
+
+	args, err := parseConfigOverrideFlags([]string{
+		"-config-json", `{"label_prefix": "unit:", "ZED_GO_TASKS_GO_TEST_CHDIR": true, "TASK_LOG_KEEP": 5}`,
+		"--config-json={\"BUILD_FLAGS\": [\"-race\", \"-tags=e2e\"], \"TASK_ENV\": {\"B\": \"2\", \"A\": \"1\"}}",
+		"--stdin-config", "generate", "-file", "a_test.go",
+	}, strings.NewReader(`{"RUNNER_SCRIPTS": {"./...": "make test"}, "TASK_EXTRA_FIELDS": {"tags": ["go"]}, "TEST_TIMEOUT": null}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"generate", "-file", "a_test.go"}, args)
+	assert.Equal(t, map[string]string{
+		"ZED_GO_TASKS_LABEL_PREFIX":      "unit:",
+		"ZED_GO_TASKS_GO_TEST_CHDIR":     "true",
+		"ZED_GO_TASKS_TASK_LOG_KEEP":     "5",
+		"ZED_GO_TASKS_BUILD_FLAGS":       "-race,-tags=e2e",
+		"ZED_GO_TASKS_TASK_ENV":          "A:1,B:2",
+		"ZED_GO_TASKS_RUNNER_SCRIPTS":    "./...=make test",
+		"ZED_GO_TASKS_TASK_EXTRA_FIELDS": `{"tags":["go"]}`,
+		"ZED_GO_TASKS_TEST_TIMEOUT":      "",
+	}, configOverrides)
+
+	setEnv(t, "ZED_GO_TASKS_LABEL_PREFIX", "env:")
+	cfg, err := loadConfig(commonOptions{rootPath: t.TempDir()})
+	require.NoError(t, err)
+	assert.Equal(t, "unit:", cfg.LabelPrefix)
+	assert.Equal(t, []string{"-race", "-tags=e2e"}, cfg.BuildFlags)
+	assert.Equal(t, map[string]string{"A": "1", "B": "2"}, cfg.TaskEnv)
+	assert.Equal(t, 5, cfg.TaskLogKeep)
+
+	for input, want := range map[string]string{
+		`{"NO_SUCH_KEY": "x"}`:    `unknown config key "NO_SUCH_KEY"`,
+		`{"LABEL_PREFIX": ["a"]}`: "does not take a list",
+		`{"TASK_ENV": {"A": 1}}`:  `value of "A" must be a string`,
+		`["LABEL_PREFIX"]`:        "expected an object of config keys",
+	} {
+		_, err := parseConfigOverrideFlags([]string{"-config-json", input}, nil)
+		assert.ErrorContains(t, err, want, input)
+	}
+	_, err = parseConfigOverrideFlags([]string{"--stdin-config", "--editor-protocol"}, strings.NewReader("{}"))
+	assert.ErrorContains(t, err, "cannot be combined")
+}
+
+func TestRunEditorProtocol_AppliesRequestConfig(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	file := filepath.Join(root, "sample_test.go")
+	writeFile(t, file, "package sample\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n")
+
+	request := fmt.Sprintf(`{"action": "generate", "root": %q, "file": %q, "config": {"LABEL_PREFIX": "unit:", "DISCOVERY_STRATEGIES": ["ast"]}}`, root, file)
+	var out bytes.Buffer
+	require.NoError(t, runEditorProtocol(strings.NewReader(request), &out))
+	var response editorResponse
+	require.NoError(t, json.Unmarshal(out.Bytes(), &response))
+	assert.Empty(t, response.Error)
+	assert.Equal(t, []string{"unit:TestAlpha"}, response.Labels)
+}
+
+func TestRunGenerate_FilesFromMergesOneBatch(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	alpha := filepath.Join(root, "a", "alpha_test.go")
+	beta := filepath.Join(root, "b", "beta_test.go")
+	writeFile(t, alpha, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n")
+	writeFile(t, beta, "package b\n\nimport \"testing\"\n\nfunc TestBeta(t *testing.T) {}\n")
+	list := filepath.Join(root, "files.txt")
+	writeFile(t, list, "# saved files\n"+alpha+"\n\n"+beta+"\n"+alpha+"\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	output := captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-files-from", list}, generateTargetTasks))
+	})
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestBeta"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+	assert.Equal(t, 1, strings.Count(output, "Updated "), output)
+	assert.Contains(t, output, "Discovered in a/alpha_test.go: 1")
+	assert.Contains(t, output, "Discovered in b/beta_test.go: 1")
+
+	writeFile(t, list, filepath.Join(root, "missing_test.go")+"\n"+beta+"\n")
+	err := runGenerate([]string{"-root", root, "-files-from", list}, generateTargetTasks)
+	assert.ErrorContains(t, err, "missing_test.go")
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestBeta"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	request := fmt.Sprintf(`{"action": "generate", "root": %q, "files": [%q, %q], "config": {"LABEL_PREFIX": "unit:"}}`, root, alpha, beta)
+	var out bytes.Buffer
+	require.NoError(t, runEditorProtocol(strings.NewReader(request), &out))
+	var response editorResponse
+	require.NoError(t, json.Unmarshal(out.Bytes(), &response))
+	assert.Empty(t, response.Error)
+	assert.Equal(t, []string{"unit:TestAlpha", "unit:TestBeta"}, response.Labels)
+}
+
+func TestWatchWorkspace_RegeneratesSavedTestFiles(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "a", "alpha_test.go"), "package a\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	var opts generateOptions
+	fs := opts.newFlagSet("watch", generateTargetTasks)
+	targets, err := opts.parse(fs, []string{"-root", root})
+	require.NoError(t, err)
+
+	output := captureStdout(t, func() {
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() { done <- watchWorkspace(opts, root, 20*time.Millisecond, targets, nil, stop) }()
+		// Let the watcher add the directories before the first save.
+		time.Sleep(100 * time.Millisecond)
+
+		writeFile(t, filepath.Join(root, "a", "alpha_test.go"), "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n")
+		writeFile(t, filepath.Join(root, "b", "beta_test.go"), "package b\n\nimport \"testing\"\n\nfunc TestBeta(t *testing.T) {}\n")
+		writeFile(t, filepath.Join(root, "a", "notes.go"), "package a\n")
+		assert.Eventually(t, func() bool {
+			if !fileExists(tasksPath) {
+				return false
+			}
+			return slices.Equal(labelsFromTasks(readTasksForTest(t, tasksPath)), []string{"go:TestAlpha", "go:TestBeta"})
+		}, 5*time.Second, 20*time.Millisecond)
+
+		close(stop)
+		require.NoError(t, <-done)
+	})
+	assert.Contains(t, output, "Discovered in a/alpha_test.go: 1")
+}
+
+func TestWatchWorkspace_ReverifiesOnModuleChange(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	alpha := filepath.Join(root, "a", "alpha_test.go")
+	writeFile(t, alpha, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", alpha}, generateTargetTasks))
+	})
+	// A test that only the next verification can pick up, as when it starts
+	// compiling with a new dependency.
+	writeFile(t, alpha, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n\nfunc TestBeta(t *testing.T) {}\n")
+
+	var opts generateOptions
+	fs := opts.newFlagSet("watch", generateTargetTasks)
+	targets, err := opts.parse(fs, []string{"-root", root})
+	require.NoError(t, err)
+
+	output := captureStdout(t, func() {
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() { done <- watchWorkspace(opts, root, 20*time.Millisecond, targets, nil, stop) }()
+		time.Sleep(100 * time.Millisecond)
+
+		writeFile(t, filepath.Join(root, "go.sum"), "example.com/dep v1.0.0 h1:abc=\n")
+		assert.Eventually(t, func() bool {
+			return slices.Equal(labelsFromTasks(readTasksForTest(t, tasksPath)), []string{"go:TestAlpha", "go:TestBeta"})
+		}, 5*time.Second, 20*time.Millisecond)
+
+		close(stop)
+		require.NoError(t, <-done)
+	})
+	assert.Contains(t, output, "Module files changed; verifying the 1 test files with generated entries again")
+}
+
+func TestRunGenerate_FileWithoutTestsPrunesOnlyItsEntries(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	alpha := filepath.Join(root, "a", "alpha_test.go")
+	beta := filepath.Join(root, "b", "beta_test.go")
+	writeFile(t, alpha, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n")
+	writeFile(t, beta, "package b\n\nimport \"testing\"\n\nfunc TestBeta(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "a", "alpha.go"), "package a\n\nfunc Alpha() {}\n")
+	list := filepath.Join(root, "files.txt")
+	writeFile(t, list, alpha+"\n"+beta+"\n")
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-files-from", list, "-targets", "tasks,debug"}, generateTargetTasks))
+	})
+
+	output := captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", filepath.Join(root, "a", "alpha.go")}, generateTargetTasks))
+	})
+	assert.Contains(t, output, "No tests in a/alpha.go; removed 0 generated entries recorded for it")
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestBeta"}, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))))
+
+	writeFile(t, alpha, "package a\n\n// Every test moved elsewhere.\n")
+	output = captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", alpha, "-targets", "tasks,debug"}, generateTargetTasks))
+	})
+	assert.Contains(t, output, "No tests in a/alpha_test.go; removed 2 generated entries recorded for it")
+	assert.Equal(t, []string{"go:TestBeta"}, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))))
+	assert.Equal(t, []string{"go:debug:TestBeta"}, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "debug.json"))))
+}
+
+func TestRunGenerate_MaxTasksEvictsLeastRecentlyUsed(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	generate := func(name string, args ...string) string {
+		file := filepath.Join(root, strings.ToLower(name), strings.ToLower(name)+"_test.go")
+		writeFile(t, file, "package "+strings.ToLower(name)+"\n\nimport \"testing\"\n\nfunc Test"+name+"(t *testing.T) {}\n")
+		return captureStdout(t, func() {
+			require.NoError(t, runGenerate(append([]string{"-root", root, "-file", file}, args...), generateTargetTasks))
+		})
+	}
+	setGenerated := func(times map[string]time.Time) {
+		data, err := json.Marshal(generatedTimes{".zed/tasks.json": times})
+		require.NoError(t, err)
+		writeFile(t, filepath.Join(root, generatedTimesPath), string(data))
+	}
+
+	generate("Alpha")
+	generate("Beta")
+	now := time.Now()
+	setGenerated(map[string]time.Time{"go:TestAlpha": now.Add(-time.Hour), "go:TestBeta": now.Add(-2 * time.Hour)})
+	output := generate("Gamma", "-max-tasks", "2")
+	assert.Contains(t, output, "Evicted over max_tasks: go:TestBeta")
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestGamma"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	// A run logged by TASK_LOGS makes a task recent again.
+	setEnv(t, "ZED_GO_TASKS_MAX_TASKS", "2")
+	setEnv(t, "ZED_GO_TASKS_MAX_TASKS_EVICTION", "run")
+	setGenerated(map[string]time.Time{"go:TestAlpha": now.Add(-2 * time.Hour), "go:TestGamma": now.Add(-time.Hour)})
+	log := filepath.Join(root, filepath.FromSlash(taskLogDir), tasks.LogFile("go:TestAlpha"))
+	writeFile(t, log, "ok\n")
+	require.NoError(t, os.Chtimes(log, now, now))
+	output = generate("Delta")
+	assert.Contains(t, output, "Evicted over max_tasks: go:TestGamma")
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestDelta"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	setEnv(t, "ZED_GO_TASKS_MAX_TASKS_EVICTION", "oldest")
+	err := runGenerate([]string{"-root", root, "-file", filepath.Join(root, "delta", "delta_test.go")}, generateTargetTasks)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid max_tasks_eviction")
+}
+
+func TestRunGenerate_FormatTaskfileMergesGeneratedTasks(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	alpha := filepath.Join(root, "a", "alpha_test.go")
+	beta := filepath.Join(root, "b", "beta_test.go")
+	writeFile(t, alpha, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n")
+	writeFile(t, beta, "package b\n\nimport \"testing\"\n\nfunc TestBeta(t *testing.T) {}\n")
+	taskfile := filepath.Join(root, "Taskfile.yml")
+	handWritten := "version: '3'\n\ntasks:\n  # Builds everything.\n  build:\n    cmds:\n      - go build ./...\n  \"test:TestBeta\":\n    cmds:\n      - make beta\n\nincludes:\n  docs: ./docs\n"
+	writeFile(t, taskfile, handWritten)
+
+	output := captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", alpha, "-format", "taskfile"}, generateTargetTasks))
+	})
+	assert.Contains(t, output, "Generated task: test:TestAlpha")
+	want := strings.Replace(handWritten, "\nincludes:", `
+  # go-zed-tasks:generated a/alpha_test.go
+  "test:TestAlpha":
+    desc: "TestAlpha in ./a"
+    env:
+      GOTRACEBACK: "all"
+      ZED_GO_TEST_FILE: "a/alpha_test.go"
+      ZED_GO_TEST_NAME: "TestAlpha"
+      ZED_GO_TEST_PACKAGE: "./a"
+      ZED_GO_TEST_TASK_GENERATED: "1"
+    cmds:
+      - "go test ./a -run '^TestAlpha$'"
+
+includes:`, 1)
+	data, err := os.ReadFile(taskfile)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(data))
+	_, err = os.Stat(filepath.Join(root, ".zed", "tasks.json"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Regenerating is stable; another file prunes the generated task, and
+	// a hand-written task keeps its name.
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", alpha, "-format", "taskfile"}, generateTargetTasks))
+	})
+	data, err = os.ReadFile(taskfile)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(data))
+	output = captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", beta, "-format", "taskfile"}, generateTargetTasks))
+	})
+	assert.Contains(t, output, "Tasks added: 0, updated: 0, removed: 1, kept: 1")
+	data, err = os.ReadFile(taskfile)
+	require.NoError(t, err)
+	assert.Equal(t, handWritten, string(data))
+
+	err = runGenerate([]string{"-root", root, "-file", alpha, "-format", "taskfile", "-targets", "tasks,debug"}, generateTargetTasks)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "-format taskfile only writes tasks")
+}
+
+func TestRunGenerate_FormatMakefileWritesPhonyTargets(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	alpha := filepath.Join(root, "a", "alpha_test.go")
+	writeFile(t, alpha, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n")
+	makefile := filepath.Join(root, "tests.mk")
+	writeFile(t, makefile, "lint:\n\tgolangci-lint run\n")
+
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", alpha, "-format", "makefile", "-go-test-arg=-race"}, generateTargetTasks))
+	})
+	want := "lint:\n\tgolangci-lint run\n" + `
+# go-zed-tasks:generated a/alpha_test.go
+.PHONY: test-TestAlpha
+test-TestAlpha:
+	GOTRACEBACK=all ZED_GO_TEST_FILE=a/alpha_test.go ZED_GO_TEST_NAME=TestAlpha ZED_GO_TEST_PACKAGE=./a ZED_GO_TEST_TASK_GENERATED=1 go test -race ./a -run '^TestAlpha$$'
+`
+	data, err := os.ReadFile(makefile)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(data))
+
+	// Regenerating replaces the target in place; a file without it prunes
+	// it.
+	writeFile(t, alpha, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n\nfunc TestBeta(t *testing.T) {}\n")
+	output := captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", alpha, "-format", "makefile", "-go-test-arg=-race"}, generateTargetTasks))
+	})
+	assert.Contains(t, output, "Tasks added: 1, updated: 1, removed: 0")
+	data, err = os.ReadFile(makefile)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), want+"\n# go-zed-tasks:generated a/alpha_test.go\n.PHONY: test-TestBeta\n"), string(data))
+
+	beta := filepath.Join(root, "b", "beta_test.go")
+	writeFile(t, beta, "package b\n\nimport \"testing\"\n\nfunc TestGamma(t *testing.T) {}\n")
+	setEnv(t, "ZED_GO_TASKS_MAKEFILE_PREFIX", "check-")
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", beta, "-format", "makefile"}, generateTargetTasks))
+	})
+	data, err = os.ReadFile(makefile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "test-TestAlpha")
+	assert.Contains(t, string(data), "lint:\n\tgolangci-lint run\n\n# go-zed-tasks:generated b/beta_test.go\n.PHONY: check-TestGamma\n")
+}
+
+func TestMakeTargetName_SpellsVariantsAsSuffixes(t *testing.T) {
+	assert.Equal(t, "test-TestFoo-race", makeTargetName("test-TestFoo [race]"))
+	assert.Equal(t, "test-TestFoo/a_b_c", makeTargetName("test-TestFoo/a:b%c"))
+}
+
+func TestRunGenerate_FormatYAMLExportsTestsAndTasks(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	alpha := filepath.Join(root, "a", "alpha_test.go")
+	writeFile(t, alpha, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {\n\tt.Run(\"one\", func(t *testing.T) {})\n}\n")
+	exportPath := filepath.Join(root, "go-tests.yaml")
+
+	generate := func() string {
+		return captureStdout(t, func() {
+			require.NoError(t, runGenerate([]string{"-root", root, "-file", alpha, "-format", "yaml", "-static-subtests"}, generateTargetTasks))
+		})
+	}
+	generate()
+	want := exportHeader + `files:
+  # go-zed-tasks:generated a/alpha_test.go, discovered by ast, go-list, static
+  - file: "a/alpha_test.go"
+    package: "./a"
+    tests:
+      # a/alpha_test.go:5
+      - name: "TestAlpha"
+        kind: "test"
+        subtests:
+          - name: "TestAlpha/one"
+            kind: "subtest"
+    tasks:
+      - label: "go:TestAlpha"
+        command: "go"
+        args:
+          - "test"
+          - "./a"
+          - "-run"
+          - "^TestAlpha$"
+        env:
+          "GOTRACEBACK": "all"
+          "ZED_GO_TEST_FILE": "a/alpha_test.go"
+          "ZED_GO_TEST_NAME": "TestAlpha"
+          "ZED_GO_TEST_PACKAGE": "./a"
           "ZED_GO_TEST_TASK_GENERATED": "1"
-        }
-      }
-    },
-    {
-      "label": "go:Keep",
-      "type": "shell",
-      "command": "go",
-      "options": {
-        "env": {
-          "ZED_GO_TEST_TASK_GENERATED": "0"
-        }
-      }
-    }
-  ]
-}`)
+      - label: "go:TestAlpha/one"
+        command: "go"
+        args:
+          - "test"
+          - "./a"
+          - "-run"
+          - "^TestAlpha$/^one$"
+        env:
+          "GOTRACEBACK": "all"
+          "ZED_GO_TEST_FILE": "a/alpha_test.go"
+          "ZED_GO_TEST_NAME": "TestAlpha/one"
+          "ZED_GO_TEST_PACKAGE": "./a"
+          "ZED_GO_TEST_TASK_GENERATED": "1"
+`
+	data, err := os.ReadFile(exportPath)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(data))
+
+	// The export is rewritten, byte for byte the same for the same tests,
+	// and the summary compares its labels with the previous export.
+	output := generate()
+	assert.Contains(t, output, "Tasks added: 0, updated: 2, removed: 0")
+	data, err = os.ReadFile(exportPath)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(data))
+
+	writeFile(t, alpha, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n")
+	output = generate()
+	assert.Contains(t, output, "Tasks added: 0, updated: 1, removed: 1")
+}
+
+func TestRunGenerate_ExcludeTestRegexSkipsTestsAndSubtests(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_EXCLUDE_TEST_REGEX", "TestAlpha/slow|Beta")
+	setEnv(t, "ZED_GO_TASKS_ALL_GENERATED_TASK", "true")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	marker := filepath.Join(root, "slow-ran")
+	file := filepath.Join(root, "alpha_test.go")
+	writeFile(t, file, fmt.Sprintf(`package sample
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAlpha(t *testing.T) {
+	t.Run("fast", func(t *testing.T) {})
+	t.Run("slow", func(t *testing.T) { _ = os.WriteFile(%q, nil, 0o644) })
+}
+
+func TestBeta(t *testing.T) {}
+`, marker))
+
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-discover-subtests"}, generateTargetTasks))
+	})
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestAlpha/fast", "go:all-generated"}, labelsFromTasks(tasks))
+	assert.NoFileExists(t, marker, "discovery passes -skip instead of running the excluded subtest")
+	task := taskByLabel(t, tasks, "go:all-generated")
+	assert.Equal(t, []string{"test", "-skip", "TestAlpha/slow|Beta", "."}, toStringSlice(t, task["args"]))
+
+	err := runGenerate([]string{"-root", root, "-file", file, "-test", "TestBeta"}, generateTargetTasks)
+	assert.ErrorContains(t, err, `test "TestBeta" not found`)
+}
+
+func TestGoVersionAtLeast_ComparesReleases(t *testing.T) {
+	assert.Equal(t, "go1.19.13", goVersionFromOutput("go version go1.19.13 linux/amd64\n"))
+	assert.Equal(t, "", goVersionFromOutput("go version devel go1.24-0123abcd +0000 linux/amd64"))
+	assert.False(t, goVersionAtLeast("go1.19.13", 1, 20))
+	assert.True(t, goVersionAtLeast("go1.20rc1", 1, 20))
+	assert.True(t, goVersionAtLeast("go1.22.3", 1, 20))
+	assert.True(t, goVersionAtLeast("go2.0", 1, 20))
+}
+
+func TestRunGenerate_OutputJSONPrintsSummary(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	file := filepath.Join(root, "alpha_test.go")
+	writeFile(t, file, "package sample\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {\n\tt.Run(\"one\", func(t *testing.T) {})\n}\n")
+
+	output := captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-static-subtests", "-targets", "tasks,debug", "-output", "json"}, generateTargetTasks))
+	})
+	var report generateReport
+	require.NoError(t, json.Unmarshal([]byte(output), &report), output)
+	require.Len(t, report.Files, 1)
+	assert.Equal(t, "alpha_test.go", report.Files[0].File)
+	assert.Equal(t, ".", report.Files[0].Package)
+	assert.Equal(t, 1, report.Files[0].Declared)
+	assert.Equal(t, 1, report.Files[0].Runnable)
+	assert.Equal(t, 1, report.Files[0].NewSubtests)
+	assert.Equal(t, []string{"TestAlpha", "TestAlpha/one"}, report.Files[0].Tests)
+	var strategies []string
+	for _, strategy := range report.Files[0].Strategies {
+		strategies = append(strategies, strategy.Name)
+	}
+	assert.Equal(t, []string{"ast", "go-list", "static"}, strategies)
+	assert.Positive(t, report.Files[0].DurationMs)
+
+	require.Len(t, report.Outputs, 2)
+	assert.Equal(t, filepath.Join(root, ".zed", "tasks.json"), report.Outputs[0].Path)
+	assert.Equal(t, "zed", report.Outputs[0].Editor)
+	assert.Equal(t, "tasks", report.Outputs[0].Target)
+	assert.Equal(t, 2, report.Outputs[0].Added)
+	assert.Equal(t, []string{"go:TestAlpha", "go:TestAlpha/one"}, report.Outputs[0].Labels)
+	assert.Equal(t, "debug", report.Outputs[1].Target)
+
+	// A file without tests reports the entries it pruned.
+	writeFile(t, file, "package sample\n")
+	output = captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-output", "json"}, generateTargetTasks))
+	})
+	require.NoError(t, json.Unmarshal([]byte(output), &report), output)
+	require.Len(t, report.Outputs, 1)
+	assert.Equal(t, 2, report.Outputs[0].Removed)
+	assert.Empty(t, report.Files[0].Tests)
+
+	// A package that does not compile reports its errors.
+	writeFile(t, file, "package sample\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {\n\tundefinedCall()\n}\n")
+	output = captureStdout(t, func() {
+		captureStderr(t, func() {
+			require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-output", "json"}, generateTargetTasks))
+		})
+	})
+	report = generateReport{}
+	require.NoError(t, json.Unmarshal([]byte(output), &report), output)
+	require.Len(t, report.Files, 1)
+	assert.True(t, report.Files[0].Unverified)
+	require.NotEmpty(t, report.Files[0].Diagnostics, output)
+	assert.Equal(t, 6, report.Files[0].Diagnostics[0].Line)
+	assert.Contains(t, report.Files[0].Diagnostics[0].Message, "undefinedCall")
+
+	err := runGenerate([]string{"-root", root, "-file", file, "-output", "json", "-dry-run"}, generateTargetTasks)
+	assert.ErrorContains(t, err, "-output prints the summary")
+	err = runGenerate([]string{"-root", root, "-file", file, "-output", "yaml"}, generateTargetTasks)
+	assert.ErrorContains(t, err, `unsupported -output "yaml"`)
+}
+
+func TestRunGenerate_OldToolchainDropsNewerFlags(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake go binary is a shell script")
+	}
+	realGo, err := exec.LookPath("go")
+	require.NoError(t, err)
+	clearConfigEnv(t)
+	root := t.TempDir()
+	goBinary := filepath.Join(root, "go1.19")
+	writeFile(t, goBinary, `#!/bin/sh
+if [ "$1" = version ]; then
+	echo "go version go1.19.13 linux/amd64"
+	exit 0
+fi
+exec `+realGo+` "$@"
+`)
+	require.NoError(t, os.Chmod(goBinary, 0o755))
+	setEnv(t, "ZED_GO_TASKS_GO_BINARY", goBinary)
+	setEnv(t, "ZED_GO_TASKS_GO_TEST_CHDIR", "true")
+	setEnv(t, "ZED_GO_TASKS_EXCLUDE_TEST_REGEX", "TestAlpha/slow")
+	setEnv(t, "ZED_GO_TASKS_ALL_GENERATED_TASK", "true")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.19\n")
+	file := filepath.Join(root, "a", "alpha_test.go")
+	writeFile(t, file, "package a\n\nimport \"testing\"\n\nfunc TestAlpha(t *testing.T) {}\n")
+
+	var stderr string
+	captureStdout(t, func() {
+		stderr = captureStderr(t, func() {
+			require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-go-test-arg=-fullpath", "-go-test-arg=-v"}, generateTargetTasks))
+		})
+	})
+	assert.Equal(t, 1, strings.Count(stderr, "note: "+goBinary+" is go1.19.13; doing without go test -skip (go1.20), go test -fullpath (go1.21), go -C (go1.20)\n"), stderr)
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	task := taskByLabel(t, tasks, "go:TestAlpha")
+	assert.Equal(t, []string{"test", "-v", "./a", "-run", "^TestAlpha$"}, toStringSlice(t, task["args"]))
+	task = taskByLabel(t, tasks, "go:all-generated")
+	assert.Equal(t, []string{"test", "./a"}, toStringSlice(t, task["args"]))
+
+	assert.Equal(t, []string{"-v", "-count=1"}, newGoToolchain("go1.19").goTestArgs([]string{"-skip", "Slow", "-v", "-test.fullpath", "-count=1"}))
+	assert.Empty(t, newGoToolchain("").missing())
+}
+
+func TestRunGenerate_WarnsOnceAboutKeptForeignEntries(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, ".zed", "tasks.json"), `[{"label": "lint", "command": "golangci-lint", "env": {"ZED_GO_TEST_TASK_GENERATED": "1"}}]`)
+	writeFile(t, filepath.Join(root, ".zed", "debug.json"), `[{"label": "lint", "adapter": "CodeLLDB", "env": {"ZED_GO_TEST_TASK_GENERATED": "1"}}]`)
+	writeFile(t, filepath.Join(root, ".vscode", "tasks.json"), `{"version": "2.0.0", "tasks": [{"label": "lint", "command": "golangci-lint", "options": {"env": {"ZED_GO_TEST_TASK_GENERATED": "1"}}}]}`)
+
+	for range 2 {
+		stderr := captureStderr(t, func() {
+			captureStdout(t, func() {
+				require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-editor", "zed,vscode", "-targets", "tasks,debug"}, generateTargetTasks))
+			})
+		})
+		assert.Equal(t, 1, strings.Count(stderr, `warning: kept "lint"`), stderr)
+	}
+	assert.Equal(t, []string{"lint", "go:TestA"}, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))))
+}
+
+func TestRunGenerate_LabelOverridesSelectedTest(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	file := filepath.Join(root, "checkout_test.go")
+	writeFile(t, file, `package sample
+
+import "testing"
+
+func TestCart(t *testing.T) {}
+
+func TestCheckout(t *testing.T) {
+	t.Run("card", func(t *testing.T) {})
+}
+`)
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	generate := func(args ...string) error {
+		return runGenerate(append([]string{"-root", root, "-file", file}, args...), generateTargetTasks)
+	}
+
+	require.NoError(t, generate("-line", "8", "-static-subtests", "-label", "Checkout flow"))
+	tasks := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{"Checkout flow", "go:TestCheckout/card"}, labelsFromTasks(tasks))
+	assert.Equal(t, "TestCheckout", toStringMap(t, taskByLabel(t, tasks, "Checkout flow")["env"])[testNameEnvKey])
+
+	// The stable ID lets a later full generate replace the renamed entry.
+	require.NoError(t, generate())
+	assert.Equal(t, []string{"go:TestCart", "go:TestCheckout"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	require.NoError(t, generate("-test", "TestCart"))
+	assert.Equal(t, []string{"go:TestCart"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	assert.ErrorContains(t, generate("-label", "x"), "-label requires -test or -line")
+	assert.ErrorContains(t, generate("-test", "TestCart", "-line", "5"), "cannot be combined")
+	assert.ErrorContains(t, generate("-test", "TestMissing"), `test "TestMissing" not found in checkout_test.go`)
+	assert.ErrorContains(t, generate("-line", "2"), "no test declared at line 2 of checkout_test.go")
+}
+
+func TestRunGenerate_GinkgoSpecs(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	setEnv(t, "ZED_GO_TASKS_GINKGO_SPECS", "true")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "cart", "suite_test.go"), `package cart_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+)
+
+func TestCart(t *testing.T) {
+	RunSpecs(t, "Cart Suite")
+}
+`)
+	file := filepath.Join(root, "cart", "cart_test.go")
+	writeFile(t, file, `package cart_test
+
+import . "github.com/onsi/ginkgo/v2"
+
+const emptyText = "is empty"
+
+var _ = Describe("Cart", func() {
+	It(emptyText, func() {})
+	Context("with items", func() {
+		It("sums prices", func() {})
+		PIt("applies coupons", func() {})
+	})
+	XContext("later", func() {
+		It("never runs", func() {})
+	})
+	DescribeTable("discounts", func(n int) {},
+		Entry("none", 0),
+		Entry("half", 50),
+	)
+	It(dynamicText(), func() {})
+})
+
+func dynamicText() string { return "dynamic" }
+`)
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", file}, generateTargetTasks))
+	tasks := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{
+		"ginkgo:Cart",
+		"ginkgo:Cart is empty",
+		"ginkgo:Cart with items",
+		"ginkgo:Cart with items sums prices",
+		"ginkgo:Cart discounts",
+		"ginkgo:Cart discounts none",
+		"ginkgo:Cart discounts half",
+	}, labelsFromTasks(tasks))
+	task := taskByLabel(t, tasks, "ginkgo:Cart with items sums prices")
+	assert.Equal(t, []string{"test", "./cart", "-run", "^TestCart$", "-args", `-ginkgo.focus=^Cart with items sums prices$`}, toStringSlice(t, task["args"]))
+	assert.Equal(t, []string{"test", "./cart", "-run", "^TestCart$", "-args", `-ginkgo.focus=^Cart with items(\s|$)`}, toStringSlice(t, taskByLabel(t, tasks, "ginkgo:Cart with items")["args"]))
+	assert.Equal(t, "Cart with items sums prices", toStringMap(t, task["env"])[specEnvKey])
+
+	setEnv(t, "ZED_GO_TASKS_GINKGO_BINARY", "ginkgo")
+	setEnv(t, "ZED_GO_TASKS_GINKGO_LABEL_PREFIX", "spec:")
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", file}, generateTargetTasks))
+	task = taskByLabel(t, readTasksForTest(t, tasksPath), "spec:Cart discounts half")
+	assert.Equal(t, "ginkgo", task["command"])
+	assert.Equal(t, []string{"--focus=^Cart discounts half$", "./cart"}, toStringSlice(t, task["args"]))
+}
+
+func TestRunGenerate_AutoSubtestsUseRecordedDuration(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	file := filepath.Join(root, "sample_test.go")
+	writeFile(t, file, `package sample
+
+import "testing"
+
+func caseName(i int) string { return string(rune('a' + i)) }
+
+func TestCases(t *testing.T) {
+	t.Run("fixed", func(t *testing.T) {})
+	for i := range 2 {
+		t.Run(caseName(i), func(t *testing.T) {})
+	}
+}
+
+func TestPlain(t *testing.T) {}
+`)
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	generate := func() []string {
+		t.Helper()
+		captureStdout(t, func() {
+			require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-auto-subtests"}, generateTargetTasks))
+		})
+		return labelsFromTasks(readTasksForTest(t, tasksPath))
+	}
+	static := []string{"go:TestCases", "go:TestCases/fixed", "go:TestPlain"}
+	runtime := []string{"go:TestCases", "go:TestCases/a", "go:TestCases/b", "go:TestCases/fixed", "go:TestPlain"}
+
+	// Nothing is recorded yet, so nothing runs.
+	assert.Equal(t, static, generate())
+	_, err := os.Stat(filepath.Join(root, testDurationsPath))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	captureStdout(t, func() {
+		require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-discover-subtests"}, generateTargetTasks))
+	})
+	durations, err := readTestDurations(root)
+	require.NoError(t, err)
+	require.Len(t, durations, 1)
+	assert.Equal(t, runtime, generate())
+
+	for pkg := range durations {
+		durations[pkg] = testDuration{Seconds: 600}
+	}
+	cfg, err := loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	require.NoError(t, writeTestDurations(cfg, root, durations))
+	assert.Equal(t, static, generate())
+
+	setEnv(t, "ZED_GO_TASKS_AUTO_SUBTESTS_MAX_DURATION", "20m")
+	assert.Equal(t, runtime, generate())
+
+	setEnv(t, "ZED_GO_TASKS_AUTO_SUBTESTS_MAX_DURATION", "soon")
+	_, err = loadConfig(commonOptions{rootPath: root})
+	assert.ErrorContains(t, err, "invalid auto_subtests_max_duration")
+}
 
-	err := runClear([]string{
-		"-root", root,
-		"-editor", "vscode",
+func TestRunGenerate_GroupSkipsGeneratedTestFiles(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "a", "a_test.go"), "package a\n\nimport \"testing\"\n\n// zed:group smoke\nfunc TestLogin(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "a", "mock_store_test.go"), "package a\n\nimport \"testing\"\n\n// zed:group smoke\nfunc TestMock(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "a", "table_test.go"), "// Code generated by tablegen. DO NOT EDIT.\n\npackage a\n\nimport \"testing\"\n\n// zed:group smoke\nfunc TestTable(t *testing.T) {}\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	require.NoError(t, runGenerate([]string{"-root", root, "-group", "smoke"}, generateTargetTasks))
+	task := taskByLabel(t, readTasksForTest(t, tasksPath), "go:group:smoke")
+	assert.Equal(t, []string{"test", "./a", "-run", "^(TestLogin)$"}, toStringSlice(t, task["args"]))
+
+	require.NoError(t, runGenerate([]string{"-root", root, "-group", "smoke", "-include-generated"}, generateTargetTasks))
+	task = taskByLabel(t, readTasksForTest(t, tasksPath), "go:group:smoke")
+	assert.Equal(t, []string{"test", "./a", "-run", "^(TestLogin|TestMock|TestTable)$"}, toStringSlice(t, task["args"]))
+
+	setEnv(t, "ZED_GO_TASKS_GENERATED_FILE_GLOBS", "table_*.go")
+	require.NoError(t, runGenerate([]string{"-root", root, "-group", "smoke"}, generateTargetTasks))
+	task = taskByLabel(t, readTasksForTest(t, tasksPath), "go:group:smoke")
+	assert.Equal(t, []string{"test", "./a", "-run", "^(TestLogin|TestMock)$"}, toStringSlice(t, task["args"]))
+
+	setEnv(t, "ZED_GO_TASKS_GENERATED_FILE_GLOBS", "[")
+	assert.ErrorContains(t, runGenerate([]string{"-root", root, "-group", "smoke"}, generateTargetTasks), "invalid generated_file_globs")
+}
+
+func TestRunGeneratePackage_WritesEveryTestFileInOneMerge(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "internal", "foo", "a_test.go"), "package foo\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "internal", "foo", "b_test.go"), "package foo\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "internal", "foo", "mock_store_test.go"), "package foo\n\nimport \"testing\"\n\nfunc TestMock(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "internal", "foo", "bar", "c_test.go"), "package bar\n\nimport \"testing\"\n\nfunc TestC(t *testing.T) {}\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runGeneratePackage([]string{"-root", root, "-package", "./internal/foo", "-targets", "tasks,debug"}))
 	})
+	assert.Contains(t, out, "Discovered in internal/foo/a_test.go: 1")
+	assert.Contains(t, out, "Discovered in internal/foo/b_test.go: 1")
+	assert.Equal(t, []string{"go:TestA", "go:TestB"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+	assert.Equal(t, []string{"go:debug:TestA", "go:debug:TestB"}, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "debug.json"))))
+	task := taskByLabel(t, readTasksForTest(t, tasksPath), "go:TestB")
+	assert.Equal(t, "internal/foo/b_test.go", toStringMap(t, task["env"])["ZED_GO_TEST_FILE"])
+
+	require.NoError(t, runGeneratePackage([]string{"-root", root, "-package", "internal/foo", "-include-generated"}))
+	assert.Equal(t, []string{"go:TestA", "go:TestB", "go:TestMock"}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+
+	assert.ErrorContains(t, runGeneratePackage([]string{"-root", root}), "missing required flag: -package")
+	assert.ErrorContains(t, runGeneratePackage([]string{"-root", root, "-package", "."}), "no test files")
+}
+
+func TestRunGenerate_CwdDirectiveMovesTaskAndDebugCwd(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	file := filepath.Join(root, "internal", "foo", "foo_test.go")
+	writeFile(t, file, "package foo\n\nimport \"testing\"\n\n// TestFixtures reads testdata from the repo root.\n//\n// zed:cwd ../..\nfunc TestFixtures(t *testing.T) {}\n\n// zed:cwd ../../..\nfunc TestEscapes(t *testing.T) {}\n\nfunc TestPlain(t *testing.T) {}\n")
+
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-targets", "tasks,debug"}, generateTargetTasks))
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	task := taskByLabel(t, tasks, "go:TestFixtures")
+	assert.Equal(t, "$ZED_WORKTREE_ROOT", task["cwd"])
+	assert.Equal(t, []string{"test", "./internal/foo", "-run", "^TestFixtures$"}, toStringSlice(t, task["args"]))
+	assert.NotContains(t, taskByLabel(t, tasks, "go:TestEscapes"), "cwd")
+	assert.NotContains(t, taskByLabel(t, tasks, "go:TestPlain"), "cwd")
+
+	config := taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "debug.json")), "go:debug:TestFixtures")
+	assert.Equal(t, "$ZED_WORKTREE_ROOT", config["cwd"])
+	assert.Equal(t, "./internal/foo", config["program"])
+
+	setEnv(t, "ZED_GO_TASKS_TASK_CWD", "package")
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-targets", "tasks,debug"}, generateTargetTasks))
+	tasks = readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, "$ZED_WORKTREE_ROOT", taskByLabel(t, tasks, "go:TestFixtures")["cwd"])
+	task = taskByLabel(t, tasks, "go:TestPlain")
+	assert.Equal(t, "$ZED_WORKTREE_ROOT/internal/foo", task["cwd"])
+	assert.Equal(t, []string{"test", ".", "-run", "^TestPlain$"}, toStringSlice(t, task["args"]))
+}
+
+func TestRunGenerate_AllGeneratedTaskCoversGeneratedPackages(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+	setEnv(t, "ZED_GO_TASKS_ALL_GENERATED_TASK", "true")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	fileA := filepath.Join(root, "a", "a_test.go")
+	writeFile(t, fileA, "package a\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	fileB := filepath.Join(root, "b", "b_test.go")
+	writeFile(t, fileB, "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n")
+	writeFile(t, filepath.Join(root, "c", "c_test.go"), "package c\n\nimport \"testing\"\n\nfunc TestC(t *testing.T) {}\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", fileB}, generateTargetTasks))
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", fileA}, generateTargetTasks))
+	tasks := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{"go:TestB", "go:all-generated", "go:TestA"}, labelsFromTasks(tasks))
+	task := taskByLabel(t, tasks, "go:all-generated")
+	assert.Equal(t, []string{"test", "./a", "./b"}, toStringSlice(t, task["args"]))
+	assert.Equal(t, "all-generated", toStringMap(t, task["env"])["ZED_GO_TEST_AGGREGATE"])
+
+	require.NoError(t, runClear([]string{"-root", root, "-pkg", filepath.Join(root, "a")}))
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", fileB}, generateTargetTasks))
+	task = taskByLabel(t, readTasksForTest(t, tasksPath), "go:all-generated")
+	assert.Equal(t, []string{"test", "./b"}, toStringSlice(t, task["args"]))
+
+	vscodeTasks := filepath.Join(root, ".vscode", "tasks.json")
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", fileA, "-editor", "vscode"}, generateTargetTasks))
+	_, entries, err := readVSCodeTasksDocument(vscodeTasks)
 	require.NoError(t, err)
+	assert.Equal(t, []string{"go:TestA", "go:all-generated"}, labelsFromTasks(entries))
+}
 
-	_, tasks, err := readVSCodeTasksDocument(tasksPath)
+func TestTruncateLabel(t *testing.T) {
+	assert.Equal(t, "go:TestShort", truncateLabel("go:TestShort", 20))
+	assert.Equal(t, "go:TestShort", truncateLabel("go:TestShort", 0))
+
+	label := "go:TestCheckoutAppliesEveryDiscountCodeInOrder"
+	truncated := truncateLabel(label, 24)
+	assert.Equal(t, 24, utf8.RuneCountInString(truncated))
+	assert.Equal(t, "go:TestC…InOrder~"+shortHash(label), truncated)
+	assert.NotEqual(t, truncated, truncateLabel("go:TestCheckoutAppliesEveryCouponCodeInOrder", 24))
+}
+
+func TestRunGenerate_MaxLabelLength(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	setEnv(t, "ZED_GO_TASKS_MAX_LABEL_LENGTH", "30")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	file := filepath.Join(root, "sample_test.go")
+	writeFile(t, file, "package sample\n\nimport \"testing\"\n\nfunc TestShort(t *testing.T) {}\n\nfunc TestCheckoutAppliesEveryDiscountCodeInOrder(t *testing.T) {}\n")
+	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", file, "-targets", "tasks,debug"}, generateTargetTasks))
+	long := truncateLabel("go:TestCheckoutAppliesEveryDiscountCodeInOrder", 30)
+	tasks := readTasksForTest(t, tasksPath)
+	assert.Equal(t, []string{long, "go:TestShort"}, labelsFromTasks(tasks))
+	task := taskByLabel(t, tasks, long)
+	assert.Equal(t, []string{"test", ".", "-run", "^TestCheckoutAppliesEveryDiscountCodeInOrder$"}, toStringSlice(t, task["args"]))
+	assert.Contains(t, labelsFromTasks(readTasksForTest(t, filepath.Join(root, ".zed", "debug.json"))), truncateLabel("go:debug:TestCheckoutAppliesEveryDiscountCodeInOrder", 30))
+
+	setEnv(t, "ZED_GO_TASKS_LABEL_LENGTH_POLICY", "fail")
+	err := runGenerate([]string{"-root", root, "-file", file}, generateTargetTasks)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1 labels exceed max_label_length 30")
+	assert.Contains(t, err.Error(), "TestCheckoutAppliesEveryDiscountCodeInOrder")
+
+	setEnv(t, "ZED_GO_TASKS_LABEL_LENGTH_POLICY", "warn")
+	assert.ErrorContains(t, runGenerate([]string{"-root", root, "-file", file}, generateTargetTasks), "invalid label_length_policy")
+	setEnv(t, "ZED_GO_TASKS_MAX_LABEL_LENGTH", "10")
+	assert.ErrorContains(t, runGenerate([]string{"-root", root, "-file", file}, generateTargetTasks), "invalid max_label_length")
+}
+
+func TestLockFile_Serializes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	unlock, err := lockFile(path)
 	require.NoError(t, err)
 
-	labels := labelsFromTasks(tasks)
-	sort.Strings(labels)
-	assert.Equal(t, []string{"go:Keep", "manual"}, labels)
+	acquired := make(chan func(), 1)
+	go func() {
+		second, err := lockFile(path)
+		if err == nil {
+			acquired <- second
+		}
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second lock acquired while the first is held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case second := <-acquired:
+		second()
+	case <-time.After(5 * time.Second):
+		t.Fatal("second lock not acquired after unlock")
+	}
 }
 
-func TestRunGenerate_DiscoverSubtests_GeneratesTasksForDiscoveredSubtests(t *testing.T) {
+func TestRunProcessTree_ReportsExitStatus(t *testing.T) {
+	require.NoError(t, runProcessTree(exec.Command(os.Args[0], "-test.run=^$")))
+
+	err := runProcessTree(exec.Command(os.Args[0], "-test.run=^$", "-test.badflag"))
+	var exitErr *exec.ExitError
+	assert.ErrorAs(t, err, &exitErr)
+}
+
+func TestRootRelPath(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "Repo")
+	rel, err := rootRelPath(root, filepath.Join(root, "pkg", "a_test.go"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("pkg", "a_test.go"), rel)
+
+	rel, err = rootRelPath(root, filepath.Join(filepath.Dir(root), "repo", "pkg"))
+	require.NoError(t, err)
+	if pathsFoldCase {
+		assert.Equal(t, "pkg", rel)
+	} else {
+		assert.Equal(t, filepath.Join("..", "repo", "pkg"), rel)
+	}
+}
+
+func TestRunInit_Presets(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	file := filepath.Join(root, "lib", "lib_test.go")
+	writeFile(t, file, "package lib\n\nimport \"testing\"\n\nfunc TestLib(t *testing.T) {}\n")
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runInit([]string{"-root", root, "-preset", "bazel"}))
+	})
+	script := filepath.Join(root, ".zed", "scripts", "go-test-bazel.sh")
+	assert.Contains(t, out, "Created "+script)
+	info, err := os.Stat(script)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Mode().Perm()&0o100)
+	config, err := os.ReadFile(filepath.Join(root, ".zed", "go-zed-tasks.env"))
+	require.NoError(t, err)
+	assert.Contains(t, string(config), "ZED_GO_TASKS_RUNNER_SCRIPTS=./...=sh .zed/scripts/go-test-bazel.sh {{.Package}} {{.Run}}\n")
+
+	require.NoError(t, runGenerate([]string{"-root", root, "-file", file}, generateTargetTasks))
+	task := taskByLabel(t, readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json")), "go:TestLib")
+	assert.Equal(t, "sh .zed/scripts/go-test-bazel.sh ./lib '^TestLib$'", task["command"])
+
+	out = captureStdout(t, func() {
+		require.NoError(t, runInit([]string{"-root", root, "-preset", "testify"}))
+	})
+	assert.Contains(t, out, "note: the testify preset settings were not added")
+
+	testifyRoot := t.TempDir()
+	require.NoError(t, runInit([]string{"-root", testifyRoot, "-preset", "testify"}))
+	cfg, err := loadConfig(commonOptions{rootPath: testifyRoot})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-count=1"}, cfg.AdditionalGoTestArgs)
+	assert.NoDirExists(t, filepath.Join(testifyRoot, ".zed", "scripts"))
+
+	assert.ErrorContains(t, runInit([]string{"-root", root, "-preset", "maven"}), `unsupported -preset "maven" (expected bazel, docker, ginkgo, testify)`)
+}
+
+func TestRunGenerate_StaticSubtestsWithoutRunning(t *testing.T) {
 	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_DISCOVERY_STRATEGIES", "ast")
 
 	root := t.TempDir()
-	moduleDir := filepath.Join(root, "pkg")
-	targetFile := filepath.Join(moduleDir, "target_test.go")
+	targetFile := filepath.Join(root, "target_test.go")
 	tasksPath := filepath.Join(root, ".zed", "tasks.json")
-
 	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	// Nothing is built or run: the go binary does not exist.
+	setEnv(t, "ZED_GO_TASKS_GO_BINARY", filepath.Join(root, "missing-go"))
 	writeFile(t, targetFile, `package sample
 import "testing"
 
-func TestWithSubtests(t *testing.T) {
-  cases := []string{"one", "two"}
-  for _, tc := range cases {
-    tc := tc
-    t.Run(tc, func(t *testing.T) {})
-  }
+func TestOuter(t *testing.T) {
+	t.Run("first case", func(t *testing.T) {
+		t.Run("inner", func(st *testing.T) {})
+	})
+	for _, name := range []string{"x", "y"} {
+		t.Run(name, func(t *testing.T) {})
+	}
+	helper(t)
+}
 
-  t.Run("nested", func(t *testing.T) {
-    t.Run("leaf", func(t *testing.T) {})
-  })
+func TestShadowed(tt *testing.T) {
+	tt.Run("second", func(t *testing.T) {
+		t.Run("deep", func(t *testing.T) {})
+	})
 }
 
-func TestPlain(t *testing.T) {}
+func helper(t *testing.T) {
+	t.Run("not a test", func(t *testing.T) {})
+}
 `)
-	writeFile(t, filepath.Join(moduleDir, "other_test.go"), `package sample
+
+	require.NoError(t, runGenerate([]string{"-file", targetFile, "-root", root, "-static-subtests"}, generateTargetTasks))
+
+	assert.Equal(t, []string{
+		"go:TestOuter",
+		"go:TestOuter/first_case",
+		"go:TestOuter/first_case/inner",
+		"go:TestShadowed",
+		"go:TestShadowed/second",
+		"go:TestShadowed/second/deep",
+	}, labelsFromTasks(readTasksForTest(t, tasksPath)))
+}
+
+func TestLoadConfig_AppliesSectionForThisOS(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	other := "plan9"
+	if runtime.GOOS == other {
+		other = "windows"
+	}
+	writeFile(t, filepath.Join(root, ".zed", "go-zed-tasks.env"), `ZED_GO_TASKS_GO_BINARY=go
+ZED_GO_TASKS_LABEL_PREFIX=test:
+ZED_GO_TASKS_RUNNER_SCRIPTS=./...=sh run.sh
+
+[`+other+`]
+ZED_GO_TASKS_LABEL_PREFIX=other:
+
+[`+strings.ToUpper(runtime.GOOS)+`]
+ZED_GO_TASKS_GO_BINARY=/opt/go/bin/go
+ZED_GO_TASKS_RUNNER_SCRIPTS=./...=wrap {{.Package}}
+`)
+
+	cfg, err := loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	assert.Equal(t, "/opt/go/bin/go", cfg.GoBinary)
+	assert.Equal(t, "test:", cfg.LabelPrefix)
+	assert.Equal(t, map[string]string{"./...": "wrap {{.Package}}"}, cfg.RunnerScripts)
+
+	// The process environment still wins over the section.
+	setEnv(t, "ZED_GO_TASKS_GO_BINARY", "go1.25")
+	cfg, err = loadConfig(commonOptions{rootPath: root})
+	require.NoError(t, err)
+	assert.Equal(t, "go1.25", cfg.GoBinary)
+
+	writeFile(t, filepath.Join(root, ".zed", "go-zed-tasks.env"), "[windoze]\nZED_GO_TASKS_GO_BINARY=go\n")
+	_, err = loadConfig(commonOptions{rootPath: root})
+	assert.ErrorContains(t, err, "line 1: unknown section [windoze]")
+}
+
+func TestParseAge(t *testing.T) {
+	for value, want := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "2w": 14 * 24 * time.Hour, "90m": 90 * time.Minute} {
+		got, err := parseAge(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, want, got, value)
+	}
+	for _, value := range []string{"1.5d", "-1d", "-3h", "soon"} {
+		_, err := parseAge(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRunGenerate_GroupBuildsAggregatedTask(t *testing.T) {
+	clearConfigEnv(t)
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "a", "a_test.go"), `package a
+
 import "testing"
 
-func TestFromOtherFile(t *testing.T) {}
+// zed:group smoke, fast
+func TestLogin(t *testing.T) {}
+
+// zed:group slow
+func TestReport(t *testing.T) {}
 `)
+	writeFile(t, filepath.Join(root, "b", "b_test.go"), `package b
 
-	out := captureStdout(t, func() {
-		err := runGenerate([]string{
-			"-file", targetFile,
-			"-root", root,
-			"-tasks", tasksPath,
-			"-discover-subtests",
-		}, generateTargetTasks)
-		require.NoError(t, err)
-	})
-	assert.Contains(t, out, "Discovered by runtime execution: 6 (new: 4, timeout 30s)")
+import "testing"
 
-	tasks := readTasksForTest(t, tasksPath)
-	labels := labelsFromTasks(tasks)
-	sort.Strings(labels)
-	assert.Equal(t, []string{
-		"go:TestPlain",
-		"go:TestWithSubtests",
-		"go:TestWithSubtests/nested",
-		"go:TestWithSubtests/nested/leaf",
-		"go:TestWithSubtests/one",
-		"go:TestWithSubtests/two",
-	}, labels)
+// TestCheckout covers the cart.
+// zed:group smoke
+func TestCheckout(t *testing.T) {}
+`)
+	writeFile(t, filepath.Join(root, "testdata", "x_test.go"), "package x\n\n// zed:group smoke\nfunc TestIgnored(t *testing.T) {}\n")
 
-	leafTask := taskByLabel(t, tasks, "go:TestWithSubtests/nested/leaf")
-	args := toStringSlice(t, leafTask["args"])
-	assert.Equal(t, []string{"test", "./pkg", "-run", "^TestWithSubtests$/^nested$/^leaf$"}, args)
+	require.NoError(t, runGenerate([]string{"-root", root, "-group", "smoke"}, generateTargetTasks))
+	require.NoError(t, runGenerate([]string{"-root", root, "-group", "smoke"}, generateTargetTasks))
+
+	tasks := readTasksForTest(t, filepath.Join(root, ".zed", "tasks.json"))
+	assert.Equal(t, []string{"go:group:smoke"}, labelsFromTasks(tasks))
+	task := taskByLabel(t, tasks, "go:group:smoke")
+	assert.Equal(t, []string{"test", "./a", "./b", "-run", "^(TestCheckout|TestLogin)$"}, toStringSlice(t, task["args"]))
+	env := toStringMap(t, task["env"])
+	assert.Equal(t, "smoke", env["ZED_GO_TEST_GROUP"])
+	assert.Equal(t, "1", env["ZED_GO_TEST_TASK_GENERATED"])
+
+	err := runGenerate([]string{"-root", root, "-group", "missing"}, generateTargetTasks)
+	assert.ErrorContains(t, err, "no tests tagged // zed:group missing")
+	err = runGenerate([]string{"-root", root, "-group", "smoke"}, generateTargetDebug)
+	assert.ErrorContains(t, err, "-group only generates tasks")
 }
 
-func TestRunGenerateDebug_DiscoverSubtests_GeneratesDebugConfigs(t *testing.T) {
+func TestRunQuery_PrintsTestTree(t *testing.T) {
 	clearConfigEnv(t)
+	setEnv(t, envPrefix+"BENCHMARK_NAME_REGEX", ".")
 
 	root := t.TempDir()
-	moduleDir := filepath.Join(root, "pkg")
-	targetFile := filepath.Join(moduleDir, "target_test.go")
-	debugPath := filepath.Join(root, ".zed", "debug.json")
-
+	targetFile := filepath.Join(root, "pkg", "target_test.go")
 	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
-	writeFile(t, targetFile, `package sample
+	writeFile(t, targetFile, `package pkg
 import "testing"
 
-func TestWithSubtests(t *testing.T) {
-  t.Run("one", func(t *testing.T) {})
+func TestA(t *testing.T) {
+  t.Run("one", func(t *testing.T) {
+    t.Run("deep", func(t *testing.T) {})
+  })
 }
+
+func BenchmarkB(b *testing.B) {}
 `)
 
 	out := captureStdout(t, func() {
-		err := runGenerate([]string{
-			"-file", targetFile,
-			"-root", root,
-			"-debug", debugPath,
-			"-discover-subtests",
-		}, generateTargetDebug)
-		require.NoError(t, err)
+		require.NoError(t, runQuery([]string{"-file", targetFile, "-root", root, "-discover-subtests"}))
 	})
-	assert.Contains(t, out, "Discovered by runtime execution: 2 (new: 1, timeout 30s)")
-
-	configs := readTasksForTest(t, debugPath)
-	labels := labelsFromTasks(configs)
-	sort.Strings(labels)
-	assert.Equal(t, []string{
-		"go:debug:TestWithSubtests",
-		"go:debug:TestWithSubtests/one",
-	}, labels)
 
-	oneConfig := taskByLabel(t, configs, "go:debug:TestWithSubtests/one")
-	args := toStringSlice(t, oneConfig["args"])
-	assert.Equal(t, []string{"-test.run", "^TestWithSubtests$/^one$"}, args)
+	var got queryOutput
+	require.NoError(t, json.Unmarshal([]byte(out), &got))
+	assert.Equal(t, "pkg/target_test.go", got.File)
+	assert.Equal(t, "./pkg", got.Package)
+	require.Len(t, got.Tests, 2)
+
+	bench := got.Tests[0]
+	assert.Equal(t, "BenchmarkB", bench.Name)
+	assert.Equal(t, "benchmark", bench.Kind)
+	assert.Equal(t, 10, bench.Line)
+
+	test := got.Tests[1]
+	assert.Equal(t, "TestA", test.Name)
+	assert.Equal(t, "test", test.Kind)
+	assert.Equal(t, "pkg/target_test.go", test.File)
+	assert.Equal(t, 4, test.Line)
+	require.Len(t, test.Subtests, 1)
+	assert.Equal(t, "TestA/one", test.Subtests[0].Name)
+	assert.Equal(t, "subtest", test.Subtests[0].Kind)
+	require.Len(t, test.Subtests[0].Subtests, 1)
+	assert.Equal(t, "TestA/one/deep", test.Subtests[0].Subtests[0].Name)
+
+	_, err := os.Stat(filepath.Join(root, ".zed"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, runQuery([]string{"-file", targetFile, "-root", root, "-output", "yaml"}))
 }
 
-func TestRunClear_RemovesOnlyGeneratedTasks(t *testing.T) {
+func TestRunQuery_NestsSlashedSubtestNames(t *testing.T) {
 	clearConfigEnv(t)
-
 	root := t.TempDir()
-	tasksPath := filepath.Join(root, ".zed", "tasks.json")
+	targetFile := filepath.Join(root, "target_test.go")
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, targetFile, `package sample
 
-	// Intentionally uses relaxed JSON syntax.
-	writeFile(t, tasksPath, `[
-  {
-    "label": "manual",
-    "command": "echo",
-  },
-  {
-    "label": "go:Generated",
-    "command": "go",
-    "env": {
-      "ZED_GO_TEST_TASK_GENERATED": "1",
-    },
-  },
-  {
-    "label": "go:LooksGeneratedButIsNot",
-    "command": "go",
-    "env": {
-      "ZED_GO_TEST_TASK_GENERATED": "0",
-    },
-  },
-]`)
+import "testing"
 
-	err := runClear([]string{
-		"-root", root,
-		"-tasks", tasksPath,
-	})
-	require.NoError(t, err)
+func TestA(t *testing.T) {
+	t.Run("a/b", func(t *testing.T) {})
+}
+`)
 
-	tasks := readTasksForTest(t, tasksPath)
-	labels := labelsFromTasks(tasks)
-	sort.Strings(labels)
-	assert.Equal(t, []string{"go:LooksGeneratedButIsNot", "manual"}, labels)
+	for _, mode := range []string{"-static-subtests", "-discover-subtests"} {
+		out := captureStdout(t, func() {
+			require.NoError(t, runQuery([]string{"-file", targetFile, "-root", root, mode}))
+		})
+		var got queryOutput
+		require.NoError(t, json.Unmarshal([]byte(out), &got), mode)
+		require.Len(t, got.Tests, 1, mode)
+		require.Len(t, got.Tests[0].Subtests, 1, mode)
+		intermediate := got.Tests[0].Subtests[0]
+		assert.Equal(t, "TestA/a", intermediate.Name, mode)
+		assert.Equal(t, "subtest", intermediate.Kind, mode)
+		require.Len(t, intermediate.Subtests, 1, mode)
+		assert.Equal(t, "TestA/a/b", intermediate.Subtests[0].Name, mode)
+		assert.Equal(t, "subtest", intermediate.Subtests[0].Kind, mode)
+	}
+}
+
+func TestRunSelftest_Passes(t *testing.T) {
+	clearConfigEnv(t)
+	setEnv(t, "ZED_GO_TASKS_PRUNE_GENERATED", "false")
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runSelftest(nil))
+	})
+	assert.Contains(t, out, "ok   subtests (tasks)")
+	assert.Contains(t, out, "ok   build tags (debug)")
+	assert.Contains(t, out, "Selftest passed")
 }
 
 func TestRunClear_UsesCustomGeneratedMarker(t *testing.T) {
@@ -705,15 +4681,13 @@ func TestRunClear_UsesCustomGeneratedMarker(t *testing.T) {
 	assert.Equal(t, []string{"manual", "unit:Keep"}, labels)
 }
 
-func TestStripJSONComments_UnterminatedBlockCommentReturnsError(t *testing.T) {
-	_, err := stripJSONComments([]byte(`[{/* broken`))
-	require.Error(t, err)
-	assert.Contains(t, err.Error(), "unterminated block comment")
-}
+func TestRunPrintPattern_SpellsSubtestsLikeTheTestingPackage(t *testing.T) {
+	output := captureStdout(t, func() {
+		require.NoError(t, run([]string{"pattern", "TestFoo/sub", "case+1"}))
+	})
+	assert.Equal(t, "-run ^TestFoo$/^sub_case\\+1$\n-test.run ^TestFoo$/^sub_case\\+1$\n", output)
 
-func TestRunPatternForTestName_BuildsSegmentAwarePattern(t *testing.T) {
-	assert.Equal(t, "^TestTop$", runPatternForTestName("TestTop"))
-	assert.Equal(t, "^TestTop$/^child$/^leaf$", runPatternForTestName("TestTop/child/leaf"))
+	assert.ErrorContains(t, run([]string{"pattern"}), "missing test name")
 }
 
 func writeFile(t *testing.T, path string, content string) {
@@ -724,7 +4698,7 @@ func writeFile(t *testing.T, path string, content string) {
 
 func readTasksForTest(t *testing.T, path string) []map[string]any {
 	t.Helper()
-	tasks, err := readTasks(path)
+	tasks, err := tasks.ReadArray(path)
 	require.NoError(t, err)
 	return tasks
 }
@@ -798,13 +4772,23 @@ func toStringMap(t *testing.T, v any) map[string]string {
 
 func captureStdout(t *testing.T, fn func()) string {
 	t.Helper()
+	return captureFile(t, &os.Stdout, fn)
+}
+
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	return captureFile(t, &os.Stderr, fn)
+}
 
-	old := os.Stdout
+func captureFile(t *testing.T, file **os.File, fn func()) string {
+	t.Helper()
+
+	old := *file
 	r, w, err := os.Pipe()
 	require.NoError(t, err)
-	os.Stdout = w
+	*file = w
 	defer func() {
-		os.Stdout = old
+		*file = old
 	}()
 
 	fn()
@@ -821,6 +4805,8 @@ func captureStdout(t *testing.T, fn func()) string {
 
 func clearConfigEnv(t *testing.T) {
 	t.Helper()
+	configOverrides = nil
+	t.Cleanup(func() { configOverrides = nil })
 	for _, envKey := range configEnvKeys {
 		key := envKey
 		oldValue, wasSet := os.LookupEnv(key)
@@ -864,3 +4850,51 @@ func TestSubtest(t *testing.T) {
 		t.Fail()
 	})
 }
+
+func BenchmarkMergeTasks_10kEntries(b *testing.B) {
+	for _, key := range configEnvKeys {
+		b.Setenv(key, "")
+		require.NoError(b, os.Unsetenv(key))
+	}
+	cfg, err := loadConfig(commonOptions{})
+	require.NoError(b, err)
+
+	// A large hand-maintained file plus the tasks of one test file, which is
+	// what a regular generate run touches.
+	const total = 10000
+	const perFile = 50
+	existing := make([]map[string]any, 0, total)
+	generated := make([]Task, 0, perFile)
+	for i := 0; i < total; i++ {
+		task := Task{
+			Label:   fmt.Sprintf("go:Test%05d", i),
+			Command: "go",
+			Args:    []string{"test", "./pkg", "-run", fmt.Sprintf("^Test%05d$", i)},
+			Reveal:  "always",
+		}
+		if i >= total-perFile {
+			task.Env = map[string]string{cfg.GeneratedEnvKey: cfg.GeneratedEnvValue, testFileEnvKey: "pkg/a_test.go"}
+			generated = append(generated, task)
+		}
+		entry := map[string]any{"label": task.Label, "command": task.Command, "args": task.Args, "reveal": task.Reveal}
+		if task.Env != nil {
+			entry["env"] = task.Env
+		}
+		existing = append(existing, entry)
+	}
+	data, err := marshalTasks(existing)
+	require.NoError(b, err)
+	path := filepath.Join(b.TempDir(), "tasks.json")
+	require.NoError(b, os.WriteFile(path, data, 0o644))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		merged, _, err := tasks.MergeFile(path, generated, cfg.mergePolicy())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := merged.Marshal(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// keepOwner is a no-op where files have no unix owner.
+func keepOwner(string, os.FileInfo) {}
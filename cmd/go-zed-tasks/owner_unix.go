@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// keepOwner gives path the owner and group of the file it replaces. Only
+// root may give files to other users, so this is best effort.
+func keepOwner(path string, replaced os.FileInfo) {
+	if stat, ok := replaced.Sys().(*syscall.Stat_t); ok {
+		_ = os.Lchown(path, int(stat.Uid), int(stat.Gid))
+	}
+}
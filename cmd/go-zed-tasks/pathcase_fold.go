@@ -0,0 +1,7 @@
+//go:build darwin || ios || windows
+
+package main
+
+// pathsFoldCase is set where the default file systems ignore case, so two
+// spellings of a path can name the same file.
+const pathsFoldCase = true
@@ -0,0 +1,21 @@
+//go:build !unix && !plan9 && !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// terminationSignals stop the tool and, through runProcessTree, the
+// processes it started.
+var terminationSignals = []os.Signal{os.Interrupt}
+
+// startProcessTree is a no-op where processes have no groups.
+func startProcessTree(*exec.Cmd) {}
+
+// killProcessTree kills only the process itself where processes have no
+// groups.
+func killProcessTree(process *os.Process) error {
+	return process.Kill()
+}
@@ -0,0 +1,29 @@
+//go:build plan9
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// terminationSignals stop the tool and, through runProcessTree, the
+// processes it started.
+var terminationSignals = []os.Signal{os.Interrupt, syscall.Note("hangup")}
+
+// startProcessTree gives cmd a note group of its own, the Plan 9
+// counterpart of a process group.
+func startProcessTree(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Rfork: syscall.RFNOTEG}
+}
+
+// killProcessTree posts a kill note to the note group started by
+// startProcessTree.
+func killProcessTree(process *os.Process) error {
+	if err := os.WriteFile("/proc/"+strconv.Itoa(process.Pid)+"/notepg", []byte("kill"), 0); err != nil {
+		return process.Kill()
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// terminationSignals stop the tool and, through runProcessTree, the
+// processes it started.
+var terminationSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// startProcessTree puts cmd in a process group of its own, so that go test
+// and the test binary it runs can be killed together.
+func startProcessTree(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessTree kills the process group started by startProcessTree.
+func killProcessTree(process *os.Process) error {
+	if err := syscall.Kill(-process.Pid, syscall.SIGKILL); err != nil {
+		return process.Kill()
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// terminationSignals stop the tool and, through runProcessTree, the
+// processes it started.
+var terminationSignals = []os.Signal{os.Interrupt}
+
+// startProcessTree starts cmd in a new process group, which keeps the
+// console's Ctrl+C from reaching it before runProcessTree does.
+func startProcessTree(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessTree kills cmd and its descendants with taskkill /T, as
+// Windows has no signal that reaches a whole process group.
+func killProcessTree(process *os.Process) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(process.Pid)).Run(); err != nil {
+		return process.Kill()
+	}
+	return nil
+}
@@ -4,10 +4,14 @@ go 1.25
 
 require github.com/stretchr/testify v1.10.0
 
-require github.com/caarlos0/env/v11 v11.3.1
+require (
+	github.com/caarlos0/env/v11 v11.3.1
+	github.com/fsnotify/fsnotify v1.9.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,271 @@
+// Package discovery finds the tests of a Go test file: from its source,
+// the test, benchmark, fuzz and example functions it declares, the
+// subtests they run with literal names or from table literals, and the
+// go test -run patterns that select them; and from the go command, the
+// tests go test -list reports (ListTests) and the subtests a go test -json
+// run reports (RunTests).
+package discovery
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Test is a test function declared in a file.
+type Test struct {
+	Name    string
+	Line    int
+	EndLine int
+	// ParallelCalls counts .Parallel() calls in the body, subtests
+	// included.
+	ParallelCalls int
+	// Problem explains why go test would not treat the function as a
+	// test, if it can tell from the declaration, and is "" otherwise.
+	Problem string
+	// Groups are the names from `// zed:group <name>...` doc comment
+	// lines.
+	Groups []string
+	// CallsShort is set when the body, subtests included, calls
+	// testing.Short().
+	CallsShort bool
+	// Cwd is the directory of a `// zed:cwd <dir>` doc comment line,
+	// relative to the package directory.
+	Cwd string
+	// CompileOnly is set for examples without an output comment, which go
+	// test compiles but never runs.
+	CompileOnly bool
+}
+
+// NameMatcher selects test functions by name; *regexp.Regexp is one.
+type NameMatcher interface {
+	MatchString(name string) bool
+}
+
+// Kind classifies a top-level test function by its name prefix: "test",
+// "benchmark", "fuzz" or "example".
+func Kind(name string) string {
+	switch {
+	case strings.HasPrefix(name, "Benchmark"):
+		return "benchmark"
+	case strings.HasPrefix(name, "Fuzz"):
+		return "fuzz"
+	case strings.HasPrefix(name, "Example"):
+		return "example"
+	default:
+		return "test"
+	}
+}
+
+// FindTests returns the top-level functions of a test file whose names
+// match, in declaration order. It parses src, or the file at path when src
+// is nil. A function declared twice is reported once.
+func FindTests(path string, src []byte, match NameMatcher) ([]Test, error) {
+	fset := token.NewFileSet()
+	var source any
+	if src != nil {
+		source = src
+	}
+	parsed, err := parser.ParseFile(fset, path, source, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	testingName := ImportName(parsed, "testing")
+	seen := make(map[string]struct{})
+	var tests []Test
+	for _, decl := range parsed.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+		name := fn.Name.Name
+		if !match.MatchString(name) {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		test := Test{
+			Name:          name,
+			Line:          fset.Position(fn.Pos()).Line,
+			EndLine:       fset.Position(fn.End()).Line,
+			Problem:       testDeclProblem(fn),
+			Groups:        testGroups(fn.Doc),
+			ParallelCalls: countParallelCalls(fn.Body),
+			CallsShort:    callsTestingShort(fn.Body, testingName),
+			Cwd:           testCwdDirective(fn.Doc),
+		}
+		if Kind(name) == "example" && test.Problem == "" && !hasExampleOutput(parsed, fn) {
+			test.CompileOnly = true
+			test.Problem = "example has no // Output: comment, so go test compiles it but does not run it"
+		}
+		tests = append(tests, test)
+	}
+	return tests, nil
+}
+
+// exampleOutputPattern matches the comment go test takes as the expected
+// output of an example, as go/doc does.
+var exampleOutputPattern = regexp.MustCompile(`(?i)^[[:space:]]*(unordered )?output:`)
+
+// hasExampleOutput reports whether the last comment in the body of the
+// example fn is an // Output: or // Unordered output: comment, without
+// which go test does not run the example.
+func hasExampleOutput(file *ast.File, fn *ast.FuncDecl) bool {
+	if fn.Body == nil {
+		return false
+	}
+	var last *ast.CommentGroup
+	for _, group := range file.Comments {
+		if group.Pos() > fn.Body.Lbrace && group.End() < fn.Body.Rbrace {
+			last = group
+		}
+	}
+	return last != nil && exampleOutputPattern.MatchString(last.Text())
+}
+
+// ImportName is the name file refers to the package importPath by, or ""
+// when file does not import it or imports it with _ or a dot.
+func ImportName(file *ast.File, importPath string) string {
+	for _, spec := range file.Imports {
+		if path, err := strconv.Unquote(spec.Path.Value); err != nil || path != importPath {
+			continue
+		}
+		if spec.Name == nil {
+			return filepath.Base(importPath)
+		}
+		if spec.Name.Name == "_" || spec.Name.Name == "." {
+			return ""
+		}
+		return spec.Name.Name
+	}
+	return ""
+}
+
+// callsTestingShort reports whether body calls testingName.Short(). Calls
+// in helpers the test calls are not followed.
+func callsTestingShort(body *ast.BlockStmt, testingName string) bool {
+	if body == nil || testingName == "" {
+		return false
+	}
+	found := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || found {
+			return !found
+		}
+		if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Short" {
+			if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == testingName {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// countParallelCalls counts the argument-less .Parallel() calls in body,
+// such as t.Parallel() in a test and in its t.Run closures.
+func countParallelCalls(body *ast.BlockStmt) int {
+	if body == nil {
+		return 0
+	}
+	count := 0
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 0 {
+			return true
+		}
+		if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Parallel" {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// testGroups reads `// zed:group smoke, fast` lines from a doc comment.
+func testGroups(doc *ast.CommentGroup) []string {
+	if doc == nil {
+		return nil
+	}
+	var groups []string
+	for _, comment := range doc.List {
+		text := strings.TrimSpace(strings.TrimPrefix(comment.Text, "//"))
+		rest, ok := strings.CutPrefix(text, "zed:group")
+		if !ok || (rest != "" && rest[0] != ' ' && rest[0] != '\t') {
+			continue
+		}
+		groups = append(groups, strings.FieldsFunc(rest, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })...)
+	}
+	return groups
+}
+
+// testCwdDirective reads the directory of a `// zed:cwd ../..` doc
+// comment line; the last one wins.
+func testCwdDirective(doc *ast.CommentGroup) string {
+	if doc == nil {
+		return ""
+	}
+	cwd := ""
+	for _, comment := range doc.List {
+		text := strings.TrimSpace(strings.TrimPrefix(comment.Text, "//"))
+		if rest, ok := strings.CutPrefix(text, "zed:cwd"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			cwd = strings.TrimSpace(rest)
+		}
+	}
+	return cwd
+}
+
+// testDeclProblem mirrors the checks go test applies to test, benchmark,
+// fuzz and example functions, returning "" for a well-formed one.
+func testDeclProblem(fn *ast.FuncDecl) string {
+	name := fn.Name.Name
+	kinds := []struct{ prefix, param string }{
+		{"Test", "T"}, {"Benchmark", "B"}, {"Fuzz", "F"}, {"Example", ""},
+	}
+	for _, kind := range kinds {
+		rest, ok := strings.CutPrefix(name, kind.prefix)
+		if !ok {
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(rest); rest != "" && unicode.IsLower(r) {
+			return fmt.Sprintf("go test ignores %s because the letter after %q is lower-case", name, kind.prefix)
+		}
+		want := "func()"
+		if kind.param != "" {
+			want = "func(*testing." + kind.param + ")"
+		}
+		if fn.Type.TypeParams != nil || fn.Type.Results != nil || !hasTestingParam(fn.Type.Params, kind.param) {
+			return "signature is not " + want
+		}
+		return ""
+	}
+	return ""
+}
+
+// hasTestingParam reports whether params is exactly one *testing.<typ>, or
+// empty when typ is "".
+func hasTestingParam(params *ast.FieldList, typ string) bool {
+	if typ == "" {
+		return params.NumFields() == 0
+	}
+	if params.NumFields() != 1 {
+		return false
+	}
+	star, ok := params.List[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == typ
+}
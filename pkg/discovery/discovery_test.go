@@ -0,0 +1,143 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func TestFindTests_ReportsDeclarations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample_test.go")
+	writeFile(t, path, `package sample
+
+import "testing"
+
+// zed:group smoke, fast
+// zed:cwd ../..
+func TestAlpha(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip()
+	}
+}
+
+func Testlower(t *testing.T) {}
+
+func ExampleAlpha() {}
+
+func helper() {}
+`)
+
+	tests, err := FindTests(path, nil, regexp.MustCompile(`^(Test|Example)`))
+	require.NoError(t, err)
+	require.Len(t, tests, 3)
+	assert.Equal(t, Test{Name: "TestAlpha", Line: 7, EndLine: 12, ParallelCalls: 1, Groups: []string{"smoke", "fast"}, CallsShort: true, Cwd: "../.."}, tests[0])
+	assert.Contains(t, tests[1].Problem, "lower-case")
+	assert.True(t, tests[2].CompileOnly)
+	assert.Equal(t, "example", Kind(tests[2].Name))
+}
+
+func TestStaticSubtests_ResolvesTableCases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table_test.go")
+	writeFile(t, path, `package sample
+import "testing"
+
+const slowName = "slow path"
+
+type parseCase struct {
+	name, input string
+}
+
+var parseCases = []parseCase{
+	{"empty", ""},
+	{name: slowName, input: "x"},
+}
+
+func TestLocal(t *testing.T) {
+	tests := []struct {
+		name string
+		want int
+	}{
+		{name: "one", want: 1},
+		{name: "one", want: 2},
+		{want: 3, name: "three"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run("check", func(t *testing.T) {})
+		})
+	}
+}
+
+func TestPackageTable(t *testing.T) {
+	for _, tc := range parseCases {
+		t.Run(tc.name, func(t *testing.T) {})
+	}
+}
+
+func TestInline(t *testing.T) {
+	for _, tc := range []*struct{ label string }{{"a"}, {"b"}} {
+		t.Run(tc.label, func(t *testing.T) {})
+	}
+}
+
+func TestUnresolved(t *testing.T) {
+	tests := []struct{ name string }{{name: "ok"}, {name: dynamicName()}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run("inner", func(t *testing.T) {})
+		})
+	}
+}
+
+func dynamicName() string { return "later" }
+`)
+
+	subtests, err := StaticSubtests(path, []string{"TestLocal", "TestPackageTable", "TestInline", "TestUnresolved"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"TestLocal/one",
+		"TestLocal/one/check",
+		"TestLocal/one#01",
+		"TestLocal/one#01/check",
+		"TestLocal/three",
+		"TestLocal/three/check",
+		"TestPackageTable/empty",
+		"TestPackageTable/slow_path",
+		"TestInline/a",
+		"TestInline/b",
+	}, subtests)
+}
+
+func TestRunPattern_BuildsSegmentAwarePattern(t *testing.T) {
+	assert.Equal(t, "^TestTop$", RunPattern("TestTop"))
+	assert.Equal(t, "^TestTop$/^child$/^leaf$", RunPattern("TestTop/child/leaf"))
+	assert.Equal(t, "^(TestA|TestB)$", TopLevelPattern([]string{"TestB", "TestA"}))
+	assert.Equal(t, "a\\x00b_c", SubtestName("a\x00b c"))
+}
+
+func TestCompileSkip_MatchesLikeGoTestSkip(t *testing.T) {
+	pattern, err := CompileSkip("Slow|TestDB/(postgres|mysql)/^large$")
+	require.NoError(t, err)
+	assert.True(t, pattern.Skips("TestSlowPath"))
+	assert.True(t, pattern.Skips("TestSlowPath/child"))
+	assert.False(t, pattern.Skips("TestDB"), "the parent runs to reach its other subtests")
+	assert.False(t, pattern.Skips("TestDB/postgres"))
+	assert.True(t, pattern.Skips("TestDB/mysql/large"))
+	assert.False(t, pattern.Skips("TestDB/sqlite/large"))
+
+	_, err = CompileSkip("TestA/(")
+	assert.Error(t, err)
+	pattern, err = CompileSkip("")
+	require.NoError(t, err)
+	assert.False(t, pattern.Skips("TestA"))
+}
@@ -0,0 +1,163 @@
+package discovery
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// GinkgoSpec is a Ginkgo container (Describe, Context, When,
+// DescribeTable) or spec (It, Specify, Entry) with a literal text. Text is
+// the full text Ginkgo focuses on: the texts of the enclosing containers
+// and its own, joined by spaces. Leaf is set for specs.
+type GinkgoSpec struct {
+	Text string
+	Leaf bool
+	Line int
+}
+
+var (
+	ginkgoContainers = []string{"Describe", "FDescribe", "Context", "FContext", "When", "FWhen", "DescribeTable", "FDescribeTable", "DescribeTableSubtree", "FDescribeTableSubtree"}
+	ginkgoLeaves     = []string{"It", "FIt", "Specify", "FSpecify", "Entry", "FEntry"}
+	// ginkgoPending are the nodes Ginkgo never runs; nothing in them is
+	// generated.
+	ginkgoPending = []string{"PDescribe", "XDescribe", "PContext", "XContext", "PWhen", "XWhen", "PDescribeTable", "XDescribeTable", "PIt", "XIt", "PSpecify", "XSpecify", "PEntry", "XEntry"}
+)
+
+// FindGinkgoSpecs lists the containers and specs of the Ginkgo file at
+// path in source order, or none when it does not import Ginkgo. Nodes
+// whose text is not a string literal or constant are skipped with all
+// they contain.
+func FindGinkgoSpecs(path string) ([]GinkgoSpec, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := ginkgoImportName(file)
+	if !ok {
+		return nil, nil
+	}
+	scanner := newStaticSubtestScanner(file)
+	var specs []GinkgoSpec
+	var visit func(node ast.Node, parent string)
+	visit = func(node ast.Node, parent string) {
+		ast.Inspect(node, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			fn := ginkgoFuncName(call.Fun, name)
+			switch {
+			case slices.Contains(ginkgoPending, fn):
+				return false
+			case slices.Contains(ginkgoContainers, fn), slices.Contains(ginkgoLeaves, fn):
+			default:
+				return true
+			}
+			if len(call.Args) == 0 {
+				return false
+			}
+			text, ok := scanner.stringValue(call.Args[0])
+			if !ok {
+				return false
+			}
+			if parent != "" {
+				text = parent + " " + text
+			}
+			leaf := slices.Contains(ginkgoLeaves, fn)
+			specs = append(specs, GinkgoSpec{Text: text, Leaf: leaf, Line: fset.Position(call.Pos()).Line})
+			if !leaf {
+				for _, arg := range call.Args[1:] {
+					visit(arg, text)
+				}
+			}
+			return false
+		})
+	}
+	visit(file, "")
+	return specs, nil
+}
+
+// ginkgoImportName is the name file calls Ginkgo by, "" for a dot import,
+// and false when it does not import Ginkgo.
+func ginkgoImportName(file *ast.File) (string, bool) {
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || path != "github.com/onsi/ginkgo/v2" && path != "github.com/onsi/ginkgo" {
+			continue
+		}
+		switch {
+		case spec.Name == nil:
+			return "ginkgo", true
+		case spec.Name.Name == ".":
+			return "", true
+		case spec.Name.Name != "_":
+			return spec.Name.Name, true
+		}
+	}
+	return "", false
+}
+
+// ginkgoFuncName is the Ginkgo function fun calls, or "" when it is not
+// one, given the name Ginkgo is imported as.
+func ginkgoFuncName(fun ast.Expr, importName string) string {
+	switch fun := fun.(type) {
+	case *ast.Ident:
+		if importName == "" {
+			return fun.Name
+		}
+	case *ast.SelectorExpr:
+		if pkg, ok := fun.X.(*ast.Ident); ok && importName != "" && pkg.Name == importName {
+			return fun.Sel.Name
+		}
+	}
+	return ""
+}
+
+// FindGinkgoSuite returns the test in the _test.go files of dir that calls
+// RunSpecs, or "" when there is none.
+func FindGinkgoSuite(dir string) string {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	for _, path := range paths {
+		file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.SkipObjectResolution)
+		if err != nil {
+			continue
+		}
+		name, ok := ginkgoImportName(file)
+		if !ok {
+			continue
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || fn.Body == nil || !strings.HasPrefix(fn.Name.Name, "Test") {
+				continue
+			}
+			found := false
+			ast.Inspect(fn.Body, func(node ast.Node) bool {
+				if call, ok := node.(*ast.CallExpr); ok && ginkgoFuncName(call.Fun, name) == "RunSpecs" {
+					found = true
+				}
+				return !found
+			})
+			if found {
+				return fn.Name.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Focus is the focus regex that selects s and nothing else: its exact
+// full text, or every spec in a container.
+func (s GinkgoSpec) Focus() string {
+	if s.Leaf {
+		return "^" + regexp.QuoteMeta(s.Text) + "$"
+	}
+	return "^" + regexp.QuoteMeta(s.Text) + `(\s|$)`
+}
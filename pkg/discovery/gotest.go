@@ -0,0 +1,504 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runner starts the go commands of ListTests and RunTests.
+type Runner struct {
+	// Binary is the go command.
+	Binary string
+	// Env is added to the process environment.
+	Env map[string]string
+	// Procs is the go -p build parallelism; 0 keeps the go default.
+	Procs int
+	// Nice lowers the CPU priority through nice(1) where it exists.
+	Nice int
+	// Run runs the go test -json command of RunTests; nil is
+	// (*exec.Cmd).Run. A Run that stops the command early, e.g. on a
+	// signal, returns an error wrapping ErrInterrupted.
+	Run func(cmd *exec.Cmd) error
+}
+
+// ErrInterrupted is wrapped by the errors of a Runner.Run that stopped its
+// command. RunTests returns such an error even when tests already ran.
+var ErrInterrupted = errors.New("interrupted")
+
+// Command builds `go <args>` in dir. args start with the go subcommand.
+func (r Runner) Command(dir string, args ...string) *exec.Cmd {
+	if r.Procs > 0 && len(args) > 0 && !hasFlag(args, "p") {
+		args = append([]string{args[0], "-p", strconv.Itoa(r.Procs)}, args[1:]...)
+	}
+	name := r.Binary
+	if r.Nice > 0 {
+		if nice, err := exec.LookPath("nice"); err == nil {
+			args = append([]string{"-n", strconv.Itoa(r.Nice), r.Binary}, args...)
+			name = nice
+		}
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	if len(r.Env) > 0 {
+		cmd.Env = os.Environ()
+		for key, value := range r.Env {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
+	return cmd
+}
+
+func (r Runner) run(cmd *exec.Cmd) error {
+	if r.Run == nil {
+		return cmd.Run()
+	}
+	return r.Run(cmd)
+}
+
+// hasFlag reports whether args set the named flag, in either its go test
+// or its -test. form.
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+			continue
+		}
+		flagName, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+		if flagName == name || flagName == "test."+name {
+			return true
+		}
+	}
+	return false
+}
+
+// Diagnostic is one "file:line:col: message" compiler error.
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	if d.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+}
+
+var diagnosticPattern = regexp.MustCompile(`^(.+?\.go):(\d+)(?::(\d+))?: (.+)$`)
+
+// ParseDiagnostics extracts compiler errors from go build or go test
+// output, resolving relative file names against dir.
+func ParseDiagnostics(output, dir string) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		match := diagnosticPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		lineNo, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		file := match[1]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			File:    filepath.ToSlash(file),
+			Line:    lineNo,
+			Column:  column,
+			Message: match[4],
+		})
+	}
+	return diagnostics
+}
+
+// ListError is returned when go test -list fails. Diagnostics holds the
+// compiler errors found in its output, if the package does not build.
+type ListError struct {
+	Dir         string
+	Err         error
+	Output      string
+	Diagnostics []Diagnostic
+}
+
+func (e *ListError) Error() string {
+	return fmt.Sprintf("go test -list failed in %s: %v\n%s", e.Dir, e.Err, e.Output)
+}
+
+func (e *ListError) Unwrap() error {
+	return e.Err
+}
+
+// ListOptions configure ListTests.
+type ListOptions struct {
+	// Regex is the go test -list pattern; reported names must match it.
+	Regex string
+	// ExtraNameRegex, when set, accepts reported names that are not Go
+	// identifiers, for test mains and generators that report names such
+	// as Test-Login or TestCase#3.
+	ExtraNameRegex string
+	// BuildFlags go before -list, e.g. -tags integration.
+	BuildFlags []string
+	// JSON reads -json events first, which keep the names apart from
+	// toolchain summary lines. It falls back to plain stdout when the go
+	// binary, or a wrapper around it, does not emit JSON.
+	JSON bool
+}
+
+// ListTests runs go test -list in dir and returns the names it reports.
+func ListTests(runner Runner, dir string, opts ListOptions) (map[string]struct{}, error) {
+	nameRegex, err := regexp.Compile(opts.Regex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid list regex %q: %w", opts.Regex, err)
+	}
+	var extraNames *regexp.Regexp
+	if opts.ExtraNameRegex != "" {
+		if extraNames, err = regexp.Compile(opts.ExtraNameRegex); err != nil {
+			return nil, fmt.Errorf("invalid extra name regex %q: %w", opts.ExtraNameRegex, err)
+		}
+	}
+	filter := listedNameFilter{names: nameRegex, extra: extraNames}
+	if opts.JSON {
+		names, parsed, err := runTestList(runner, dir, opts, true, filter)
+		if parsed || err != nil {
+			return names, err
+		}
+	}
+	names, _, err := runTestList(runner, dir, opts, false, filter)
+	return names, err
+}
+
+// listedNameFilter picks the test names out of go test -list output lines.
+type listedNameFilter struct {
+	names *regexp.Regexp
+	// extra accepts names token.IsIdentifier rejects.
+	extra *regexp.Regexp
+}
+
+func (f listedNameFilter) matches(name string) bool {
+	if !token.IsIdentifier(name) && (f.extra == nil || !f.extra.MatchString(name)) {
+		return false
+	}
+	return f.names.MatchString(name)
+}
+
+// runTestList runs one go test -list. parsed is false when jsonMode found no
+// JSON events at all, so the caller should retry without -json.
+func runTestList(runner Runner, dir string, opts ListOptions, jsonMode bool, filter listedNameFilter) (names map[string]struct{}, parsed bool, err error) {
+	args := append([]string{"test"}, opts.BuildFlags...)
+	if jsonMode {
+		args = append(args, "-json")
+	}
+	args = append(args, "-list", opts.Regex, ".")
+	cmd := runner.Command(dir, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	lines := strings.Split(stdout.String(), "\n")
+	if jsonMode {
+		if lines, parsed = listOutputFromJSON(stdout.Bytes()); !parsed {
+			return nil, false, nil
+		}
+	}
+	if runErr != nil {
+		output := strings.TrimSpace(strings.TrimSpace(stderr.String()) + "\n" + strings.TrimSpace(strings.Join(lines, "\n")))
+		return nil, true, &ListError{
+			Dir:         dir,
+			Err:         runErr,
+			Output:      output,
+			Diagnostics: ParseDiagnostics(output, dir),
+		}
+	}
+	return listedTestNames(lines, filter), true, nil
+}
+
+// testEvent is the part of a go test -json event discovery reads. Fields
+// and actions it does not know are ignored, so newer toolchains keep
+// working.
+type testEvent struct {
+	Action     string `json:"Action"`
+	Test       string `json:"Test"`
+	Output     string `json:"Output"`
+	OutputType string `json:"OutputType"`
+	// Key and Value are set for attr events (t.Attr, Go 1.25).
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+	// Path is set for artifacts events (t.ArtifactDir with -artifacts).
+	Path string `json:"Path"`
+	// Elapsed is the run time in seconds of pass and fail events.
+	Elapsed float64 `json:"Elapsed"`
+}
+
+// listOutputFromJSON returns the package-level output lines of go test
+// -json events, including build output. ok is false when no line was a
+// JSON event.
+func listOutputFromJSON(output []byte) (lines []string, ok bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		var ev testEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || ev.Action == "" {
+			continue
+		}
+		ok = true
+		if (ev.Action == "output" || ev.Action == "build-output") && ev.Test == "" {
+			lines = append(lines, strings.TrimSuffix(ev.Output, "\n"))
+		}
+	}
+	return lines, ok
+}
+
+// listedTestNames keeps the lines that are a single identifier matching
+// the list regex. Test binaries print each listed name on its own line, so
+// summaries, banners and log output never qualify.
+func listedTestNames(lines []string, filter listedNameFilter) map[string]struct{} {
+	names := make(map[string]struct{})
+	for _, line := range lines {
+		name := strings.TrimSpace(line)
+		if name != "" && filter.matches(name) {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}
+
+// RunEvents is what one go test -json run reported.
+type RunEvents struct {
+	// Tests are the tests and subtests that ran, sorted.
+	Tests []string
+	// Skipped maps the tests that reported skip to their skip message.
+	Skipped map[string]string
+	// Attributes are the t.Attr key/value pairs per test.
+	Attributes map[string]map[string]string
+	// Artifacts are the artifact directories per test.
+	Artifacts map[string]string
+	// BuildOutput holds the build-output events and BuildFailed is set by
+	// a build-fail event (Go 1.24 and later report builds in the stream).
+	BuildOutput []string
+	BuildFailed bool
+	// PackageOutput is the output not attributed to a test, such as a test
+	// binary rejecting a flag.
+	PackageOutput []string
+	// Elapsed is how long the test binary ran, from the package's final
+	// pass or fail event.
+	Elapsed time.Duration
+}
+
+// RunOptions configure RunTests.
+type RunOptions struct {
+	// Timeout is the go test -timeout.
+	Timeout time.Duration
+	// GoTestArgs are build and go test flags. RunTests sets -json, -run,
+	// -timeout and -count itself, so they must not be among them.
+	GoTestArgs []string
+	// BinaryArgs are passed to the test binary after -args.
+	BinaryArgs []string
+}
+
+// RunTests runs the top-level tests of the package in dir with go test
+// -json and returns the tests and subtests they ran. Tests that fail still
+// count; the run only fails when none ran.
+func RunTests(runner Runner, dir string, tests []string, opts RunOptions) (RunEvents, error) {
+	if len(tests) == 0 {
+		return RunEvents{Tests: []string{}}, nil
+	}
+
+	args := []string{"test", "-json", "-count=1", "-timeout", opts.Timeout.String()}
+	args = append(args, opts.GoTestArgs...)
+	args = append(args, "-run", TopLevelPattern(tests), ".")
+	if len(opts.BinaryArgs) > 0 {
+		args = append(args, "-args")
+		args = append(args, opts.BinaryArgs...)
+	}
+
+	cmd := runner.Command(dir, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := runner.run(cmd)
+	if errors.Is(err, ErrInterrupted) {
+		return RunEvents{}, err
+	}
+
+	events, parseErr := ParseRunEvents(stdout.Bytes())
+	if parseErr != nil {
+		return RunEvents{}, parseErr
+	}
+	if err != nil && len(events.Tests) == 0 {
+		return RunEvents{}, runFailure(dir, err, events, stderr.String())
+	}
+	return events, nil
+}
+
+// maxFailureLines bounds the output quoted in a RunTests error.
+const maxFailureLines = 20
+
+// runFailure explains a go test -json run that failed before any test
+// ran. A package that does not build gets its compile errors, from the
+// build events or from stderr on toolchains before Go 1.24. Anything else
+// gets the tail of stderr, where the go command reports its own errors,
+// and of the output the test binary printed outside any test.
+func runFailure(dir string, err error, events RunEvents, stderr string) error {
+	buildOutput := strings.Join(events.BuildOutput, "\n")
+	diagnostics := ParseDiagnostics(buildOutput+"\n"+stderr, dir)
+	if events.BuildFailed || len(diagnostics) > 0 {
+		lines := make([]string, 0, len(diagnostics))
+		for _, diagnostic := range diagnostics {
+			lines = append(lines, diagnostic.String())
+		}
+		if len(lines) == 0 {
+			lines = []string{buildOutput, stderr}
+		}
+		return fmt.Errorf("go test discovery failed in %s: package does not build:\n%s", dir, outputTail(strings.Join(lines, "\n")))
+	}
+
+	var details []string
+	if tail := outputTail(stderr); tail != "" {
+		details = append(details, "stderr:\n"+tail)
+	}
+	if tail := outputTail(strings.Join(events.PackageOutput, "\n")); tail != "" {
+		details = append(details, "test binary output:\n"+tail)
+	}
+	if len(details) == 0 {
+		return fmt.Errorf("go test discovery failed in %s: %w", dir, err)
+	}
+	return fmt.Errorf("go test discovery failed in %s: %w\n%s", dir, err, strings.Join(details, "\n"))
+}
+
+// outputTail shortens output to maxFailureLines non-empty lines: the first
+// few, which usually hold the error, and the rest from the end, noting how
+// many were left out in between.
+func outputTail(output string) string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, strings.TrimRight(line, "\r"))
+		}
+	}
+	if omitted := len(lines) - maxFailureLines; omitted > 0 {
+		head := maxFailureLines / 4
+		lines = slices.Concat(lines[:head], []string{fmt.Sprintf("... %d lines omitted", omitted)}, lines[head+omitted:])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// maxTestJSONLine bounds one go test -json line; tests logging large
+// blobs exceed bufio's default.
+const maxTestJSONLine = 16 << 20
+
+// ParseRunEvents collects the tests that ran in go test -json output,
+// with their skip messages, attributes and artifact directories. Lines
+// that are not JSON events are ignored.
+func ParseRunEvents(output []byte) (RunEvents, error) {
+	var events RunEvents
+	seen := make(map[string]struct{})
+	lastOutput := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, maxTestJSONLine)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var ev testEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			continue
+		}
+		switch {
+		case ev.Action == "build-output":
+			events.BuildOutput = append(events.BuildOutput, strings.TrimRight(ev.Output, "\n"))
+			continue
+		case ev.Action == "build-fail":
+			events.BuildFailed = true
+			continue
+		case ev.Test == "" && ev.Action == "output":
+			events.PackageOutput = append(events.PackageOutput, strings.TrimRight(ev.Output, "\n"))
+			continue
+		case ev.Test == "":
+			if ev.Action == "pass" || ev.Action == "fail" {
+				events.Elapsed = time.Duration(ev.Elapsed * float64(time.Second))
+			}
+			continue
+		}
+		switch ev.Action {
+		case "run":
+			seen[ev.Test] = struct{}{}
+		case "output":
+			if ev.OutputType == "frame" {
+				continue
+			}
+			if message := loggedMessage(ev.Output); message != "" {
+				lastOutput[ev.Test] = message
+			}
+		case "skip":
+			if events.Skipped == nil {
+				events.Skipped = make(map[string]string)
+			}
+			events.Skipped[ev.Test] = lastOutput[ev.Test]
+		case "attr":
+			if ev.Key == "" {
+				continue
+			}
+			if events.Attributes == nil {
+				events.Attributes = make(map[string]map[string]string)
+			}
+			if events.Attributes[ev.Test] == nil {
+				events.Attributes[ev.Test] = make(map[string]string)
+			}
+			events.Attributes[ev.Test][ev.Key] = ev.Value
+		case "artifacts":
+			if ev.Path == "" {
+				continue
+			}
+			if events.Artifacts == nil {
+				events.Artifacts = make(map[string]string)
+			}
+			events.Artifacts[ev.Test] = ev.Path
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return RunEvents{}, err
+	}
+
+	events.Tests = make([]string, 0, len(seen))
+	for name := range seen {
+		events.Tests = append(events.Tests, name)
+	}
+	sort.Strings(events.Tests)
+	return events, nil
+}
+
+// loggedMessage is the text a test logged on an output line, without the
+// file:line prefix, or "" for the framing lines go test adds itself.
+func loggedMessage(output string) string {
+	line := strings.TrimSpace(output)
+	for _, framing := range []string{"=== ", "--- "} {
+		if strings.HasPrefix(line, framing) {
+			return ""
+		}
+	}
+	// t.Skip() without arguments logs only the location.
+	if strings.HasSuffix(line, ":") && strings.Contains(line, ".go:") && !strings.Contains(line, " ") {
+		return ""
+	}
+	if location, message, ok := strings.Cut(line, ": "); ok && strings.Contains(location, ".go:") && !strings.Contains(location, " ") {
+		line = message
+	}
+	return line
+}
@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDiagnostics_ParsesFileLineColumn(t *testing.T) {
+	output := `# example.com/sample [example.com/sample.test]
+./broken_test.go:3:28: undefined: missing
+/abs/other.go:10: syntax error: unexpected }
+FAIL	example.com/sample [build failed]`
+
+	diagnostics := ParseDiagnostics(output, "/work/pkg")
+	assert.Equal(t, []Diagnostic{
+		{File: "/work/pkg/broken_test.go", Line: 3, Column: 28, Message: "undefined: missing"},
+		{File: "/abs/other.go", Line: 10, Message: "syntax error: unexpected }"},
+	}, diagnostics)
+	assert.Equal(t, "/work/pkg/broken_test.go:3:28: undefined: missing", diagnostics[0].String())
+}
+
+func TestListedNameFilter_AcceptsIdentifiersAndGeneratedNames(t *testing.T) {
+	filter := listedNameFilter{names: regexp.MustCompile(".")}
+	for _, name := range []string{
+		"TestÜbersicht", "Test_日本語2",
+		// Naming schemes of common test generators.
+		"Test_0001", "TestParse_case_12", "TestGen__v2__3", "Test_", "TestCase٣",
+	} {
+		assert.True(t, filter.matches(name), name)
+	}
+	for _, name := range []string{"2Test", "Test-Name", "TestCase#3", "Test Name", "func"} {
+		assert.False(t, filter.matches(name), name)
+	}
+
+	filter.extra = regexp.MustCompile(`^Test[\w-]+(#\d+)?$`)
+	assert.True(t, filter.matches("Test-Name"))
+	assert.True(t, filter.matches("TestCase#3"))
+	assert.False(t, filter.matches("Test Name"))
+	filter.names = regexp.MustCompile("^Bench")
+	assert.False(t, filter.matches("Test-Name"), "extra names still have to match the list regex")
+}
+
+func TestListTests_ExtraNameRegexAcceptsNonIdentifiers(t *testing.T) {
+	root := t.TempDir()
+	goBinary := filepath.Join(root, "go-wrapper")
+	writeFile(t, goBinary, "#!/bin/sh\necho TestA\necho Test-B\n")
+	require.NoError(t, os.Chmod(goBinary, 0o755))
+
+	names, err := ListTests(Runner{Binary: goBinary}, root, ListOptions{Regex: "^Test"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"TestA": {}}, names)
+	names, err = ListTests(Runner{Binary: goBinary}, root, ListOptions{Regex: "^Test", ExtraNameRegex: "-"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"TestA": {}, "Test-B": {}}, names)
+
+	_, err = ListTests(Runner{Binary: goBinary}, root, ListOptions{Regex: "^Test", ExtraNameRegex: "("})
+	assert.ErrorContains(t, err, "invalid extra name regex")
+}
+
+func TestListOutputFromJSON_KeepsPackageOutputOnly(t *testing.T) {
+	output := strings.Join([]string{
+		`{"Action":"start","Package":"ex"}`,
+		`{"Action":"build-output","ImportPath":"ex","Output":"# ex\n"}`,
+		`{"Action":"output","Package":"ex","Output":"log noise from init\n"}`,
+		`{"Action":"output","Package":"ex","Output":"TestA\n"}`,
+		`{"Action":"output","Package":"ex","Test":"TestB","Output":"TestB\n"}`,
+		`wrapper banner`,
+		`{"Action":"output","Package":"ex","Output":"ok  \tex\t0.002s\n"}`,
+	}, "\n")
+	lines, ok := listOutputFromJSON([]byte(output))
+	require.True(t, ok)
+	assert.Equal(t, []string{"# ex", "log noise from init", "TestA", "ok  \tex\t0.002s"}, lines)
+	assert.Equal(t, map[string]struct{}{"TestA": {}}, listedTestNames(lines, listedNameFilter{names: regexp.MustCompile("^Test")}))
+
+	_, ok = listOutputFromJSON([]byte("TestA\nok  \tex\t0.002s\n"))
+	assert.False(t, ok)
+	assert.Equal(t, map[string]struct{}{"TestA": {}, "ok": {}}, listedTestNames([]string{"TestA", "ok", "PASS x", "Test A"}, listedNameFilter{names: regexp.MustCompile(".")}))
+}
+
+func TestListTests_FallsBackToPlainOutputWithoutJSON(t *testing.T) {
+	root := t.TempDir()
+	goBinary := filepath.Join(root, "go-wrapper")
+	writeFile(t, goBinary, "#!/bin/sh\necho '== wrapped runner =='\necho TestA\necho TestB\necho 'ok   ex 0.1s'\n")
+	require.NoError(t, os.Chmod(goBinary, 0o755))
+
+	names, err := ListTests(Runner{Binary: goBinary}, root, ListOptions{Regex: "^TestA$", JSON: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"TestA": {}}, names)
+}
+
+func TestParseRunEvents_RecordsSkips(t *testing.T) {
+	output := strings.Join([]string{
+		`{"Action":"run","Test":"TestA"}`,
+		`{"Action":"output","Test":"TestA","Output":"=== RUN   TestA\n"}`,
+		`{"Action":"output","Test":"TestA","Output":"    a_test.go:7: needs DOCKER\n"}`,
+		`{"Action":"output","Test":"TestA","Output":"--- SKIP: TestA (0.00s)\n"}`,
+		`{"Action":"skip","Test":"TestA"}`,
+		`{"Action":"run","Test":"TestB"}`,
+		`{"Action":"skip","Test":"TestB"}`,
+		`{"Action":"run","Test":"TestC"}`,
+		`{"Action":"pass","Test":"TestC"}`,
+	}, "\n")
+
+	events, err := ParseRunEvents([]byte(output))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TestA", "TestB", "TestC"}, events.Tests)
+	assert.Equal(t, map[string]string{"TestA": "needs DOCKER", "TestB": ""}, events.Skipped)
+}
+
+func TestRunTests_ReportsBuildAndToolErrorsSeparately(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "go.mod"), "module example.com/sample\n\ngo 1.22\n")
+	writeFile(t, filepath.Join(root, "a_test.go"), "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) { undefinedCall() }\n")
+
+	_, err := RunTests(Runner{Binary: "go"}, root, []string{"TestA"}, RunOptions{Timeout: time.Minute})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "package does not build")
+	assert.Contains(t, err.Error(), "a_test.go:4:")
+	assert.Contains(t, err.Error(), "undefined: undefinedCall")
+	assert.NotContains(t, err.Error(), `"Action"`)
+
+	writeFile(t, filepath.Join(root, "a_test.go"), "package sample\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	_, err = RunTests(Runner{Binary: "go"}, root, []string{"TestA"}, RunOptions{Timeout: time.Minute, BinaryArgs: []string{"-no-such-flag"}})
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "package does not build")
+	assert.Contains(t, err.Error(), "flag provided but not defined: -no-such-flag")
+}
+
+func TestRunFailure_ShortensLongStderr(t *testing.T) {
+	var stderr strings.Builder
+	for i := range 500 {
+		fmt.Fprintf(&stderr, "noise line %d\n", i)
+	}
+	err := runFailure("/src/pkg", fmt.Errorf("exit status 2"), RunEvents{}, stderr.String())
+	require.Error(t, err)
+	lines := strings.Split(err.Error(), "\n")
+	assert.Equal(t, "go test discovery failed in /src/pkg: exit status 2", lines[0])
+	assert.Equal(t, "stderr:", lines[1])
+	assert.Equal(t, "noise line 0", lines[2])
+	assert.Equal(t, "... 480 lines omitted", lines[7])
+	assert.Equal(t, "noise line 485", lines[8])
+	assert.Equal(t, "noise line 499", lines[len(lines)-1])
+	assert.Len(t, lines, 3+maxFailureLines)
+}
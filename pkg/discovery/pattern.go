@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// AlternationPattern is the -run regex selecting exactly the given
+// top-level tests, in the given order.
+func AlternationPattern(tests []string) string {
+	quoted := make([]string, 0, len(tests))
+	for _, test := range tests {
+		quoted = append(quoted, regexp.QuoteMeta(test))
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
+
+// TopLevelPattern is the -run regex selecting exactly the given top-level
+// tests: one anchored name, or a sorted alternation of several.
+func TopLevelPattern(testNames []string) string {
+	if len(testNames) == 1 {
+		return "^" + regexp.QuoteMeta(testNames[0]) + "$"
+	}
+
+	parts := make([]string, 0, len(testNames))
+	for _, name := range testNames {
+		parts = append(parts, regexp.QuoteMeta(name))
+	}
+	sort.Strings(parts)
+	return "^(" + strings.Join(parts, "|") + ")$"
+}
+
+// RunPattern is the -run regex selecting exactly the test or subtest
+// testName, with each slash-separated element anchored and escaped. It
+// is also the -test.run pattern of the compiled test binary.
+func RunPattern(testName string) string {
+	if testName == "" {
+		return "^$"
+	}
+
+	segments := strings.Split(testName, "/")
+	for i, segment := range segments {
+		segments[i] = "^" + regexp.QuoteMeta(segment) + "$"
+	}
+	return strings.Join(segments, "/")
+}
+
+// SkipPattern is a compiled go test -skip regex: alternatives split at
+// unbracketed '|', each a list of per-level regexes split at unbracketed
+// '/', as the testing package splits -run and -skip.
+type SkipPattern [][]*regexp.Regexp
+
+// CompileSkip compiles expr with the -skip syntax. An empty expr skips
+// nothing.
+func CompileSkip(expr string) (SkipPattern, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	var pattern SkipPattern
+	for _, alternative := range splitUnbracketed(expr, '|') {
+		var levels []*regexp.Regexp
+		for _, level := range splitUnbracketed(alternative, '/') {
+			re, err := regexp.Compile(level)
+			if err != nil {
+				return nil, err
+			}
+			levels = append(levels, re)
+		}
+		pattern = append(pattern, levels)
+	}
+	return pattern, nil
+}
+
+// Skips reports whether go test -skip with p skips the test or subtest
+// name: every level of an alternative matches the element of name at that
+// level. A test with fewer levels than the alternative still runs, since
+// its subtests may not match.
+func (p SkipPattern) Skips(name string) bool {
+	elements := strings.Split(name, "/")
+	for _, levels := range p {
+		if len(elements) < len(levels) {
+			continue
+		}
+		matched := true
+		for i, level := range levels {
+			if !level.MatchString(elements[i]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// splitUnbracketed splits s at the sep bytes outside of character classes
+// and parentheses, skipping escaped characters.
+func splitUnbracketed(s string, sep byte) []string {
+	var parts []string
+	classes, parens := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			classes++
+		case ']':
+			classes = max(classes-1, 0)
+		case '(':
+			if classes == 0 {
+				parens++
+			}
+		case ')':
+			if classes == 0 {
+				parens--
+			}
+		case '\\':
+			i++
+		case sep:
+			if classes == 0 && parens == 0 {
+				parts = append(parts, s[:i])
+				s, i = s[i+1:], -1
+			}
+		}
+	}
+	return append(parts, s)
+}
@@ -0,0 +1,374 @@
+package discovery
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TestsCallingRun returns those of tests declared in the file at path whose
+// body calls Run on their *testing.T.
+func TestsCallingRun(path string, tests []string) ([]string, error) {
+	parsed, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	callers := make(map[string]struct{})
+	for _, decl := range parsed.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Body == nil {
+			continue
+		}
+		t := testingTParam(fn.Type)
+		if t == "" {
+			continue
+		}
+		ast.Inspect(fn.Body, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Run" {
+				if recv, ok := sel.X.(*ast.Ident); ok && recv.Name == t {
+					callers[fn.Name.Name] = struct{}{}
+					return false
+				}
+			}
+			return true
+		})
+	}
+	var calling []string
+	for _, test := range tests {
+		if _, ok := callers[test]; ok {
+			calling = append(calling, test)
+		}
+	}
+	return calling, nil
+}
+
+// StaticSubtests returns the full names, as go test reports them, of
+// the literal-named subtests of tests declared in the file at path, and of
+// the cases of tables in the file that tests range over.
+func StaticSubtests(path string, tests []string) ([]string, error) {
+	fset := token.NewFileSet()
+	parsed, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]struct{}, len(tests))
+	for _, test := range tests {
+		wanted[test] = struct{}{}
+	}
+	scanner := newStaticSubtestScanner(parsed)
+	for _, decl := range parsed.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Body == nil {
+			continue
+		}
+		if _, ok := wanted[fn.Name.Name]; !ok {
+			continue
+		}
+		if t := testingTParam(fn.Type); t != "" {
+			scanner.locals = make(map[string]*ast.CompositeLit)
+			scanner.tables = make(map[string]*ast.CompositeLit)
+			scanner.scan(fn.Name.Name, t, fn.Body)
+		}
+	}
+	return scanner.subtests, nil
+}
+
+// testingTParam is the name of the single *testing.T parameter of fn, or
+// "" when it has none.
+func testingTParam(fn *ast.FuncType) string {
+	if !hasTestingParam(fn.Params, "T") || len(fn.Params.List[0].Names) != 1 {
+		return ""
+	}
+	if name := fn.Params.List[0].Names[0].Name; name != "_" {
+		return name
+	}
+	return ""
+}
+
+// staticSubtestScanner collects the subtests of one file's tests. Besides
+// t.Run("literal", ...) it resolves t.Run(tc.name, ...) inside
+// `for _, tc := range table` when table is a slice literal in the file
+// whose elements set name to a string literal or constant.
+type staticSubtestScanner struct {
+	// structs, consts and vars are the file's top-level declarations.
+	structs map[string]*ast.StructType
+	consts  map[string]string
+	vars    map[string]*ast.CompositeLit
+	// locals are the composite literals assigned to variables in the test
+	// being scanned and tables the slice literal each range value variable
+	// iterates over.
+	locals map[string]*ast.CompositeLit
+	tables map[string]*ast.CompositeLit
+	// used counts full names, to number duplicates as the testing
+	// package does.
+	used     map[string]int
+	subtests []string
+}
+
+func newStaticSubtestScanner(file *ast.File) *staticSubtestScanner {
+	s := &staticSubtestScanner{
+		structs: make(map[string]*ast.StructType),
+		consts:  make(map[string]string),
+		vars:    make(map[string]*ast.CompositeLit),
+		used:    make(map[string]int),
+	}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			switch spec := spec.(type) {
+			case *ast.TypeSpec:
+				if st, ok := spec.Type.(*ast.StructType); ok {
+					s.structs[spec.Name.Name] = st
+				}
+			case *ast.ValueSpec:
+				if len(spec.Names) != len(spec.Values) {
+					continue
+				}
+				for i, name := range spec.Names {
+					switch value := spec.Values[i].(type) {
+					case *ast.BasicLit:
+						if gen.Tok == token.CONST && value.Kind == token.STRING {
+							if text, err := strconv.Unquote(value.Value); err == nil {
+								s.consts[name.Name] = text
+							}
+						}
+					case *ast.CompositeLit:
+						if gen.Tok == token.VAR {
+							s.vars[name.Name] = value
+						}
+					}
+				}
+			}
+		}
+	}
+	return s
+}
+
+// scan adds the subtests that body starts through the *testing.T named t,
+// and theirs in turn, below parent.
+func (s *staticSubtestScanner) scan(parent, t string, body ast.Node) {
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.AssignStmt:
+			if len(node.Lhs) == 1 && len(node.Rhs) == 1 {
+				s.assign(node.Lhs[0], node.Rhs[0])
+			}
+			return true
+		case *ast.ValueSpec:
+			if len(node.Names) == 1 && len(node.Values) == 1 {
+				s.assign(node.Names[0], node.Values[0])
+			}
+			return true
+		case *ast.RangeStmt:
+			if value, ok := node.Value.(*ast.Ident); ok {
+				if table := s.table(node.X); table != nil {
+					s.tables[value.Name] = table
+				}
+			}
+			return true
+		case *ast.CallExpr:
+			names, ok := s.runNames(node, t)
+			if !ok {
+				return true
+			}
+			// Without names, e.g. ones computed at run time, the subtest
+			// and its own subtests are left to the runtime strategy.
+			for _, name := range names {
+				full := s.unique(parent, SubtestName(name))
+				s.subtests = append(s.subtests, full)
+				if fn, ok := node.Args[1].(*ast.FuncLit); ok {
+					if inner := testingTParam(fn.Type); inner != "" {
+						s.scan(full, inner, fn.Body)
+					}
+				}
+			}
+			// The closure's t.Run calls belong to the subtest, not to parent.
+			return false
+		}
+		return true
+	})
+}
+
+func (s *staticSubtestScanner) assign(lhs, rhs ast.Expr) {
+	if ident, ok := lhs.(*ast.Ident); ok {
+		if lit, ok := rhs.(*ast.CompositeLit); ok {
+			s.locals[ident.Name] = lit
+		}
+	}
+}
+
+// runNames reports whether call is t.Run, and returns the subtest names
+// known without running the test: one for a literal, one per table case
+// for a field of the range value, none otherwise.
+func (s *staticSubtestScanner) runNames(call *ast.CallExpr, t string) ([]string, bool) {
+	if len(call.Args) != 2 {
+		return nil, false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Run" {
+		return nil, false
+	}
+	if recv, ok := sel.X.(*ast.Ident); !ok || recv.Name != t {
+		return nil, false
+	}
+	if name, ok := s.stringValue(call.Args[0]); ok {
+		return []string{name}, true
+	}
+	field, ok := call.Args[0].(*ast.SelectorExpr)
+	if !ok {
+		return nil, true
+	}
+	value, ok := field.X.(*ast.Ident)
+	if !ok {
+		return nil, true
+	}
+	table, ok := s.tables[value.Name]
+	if !ok {
+		return nil, true
+	}
+	fields := s.elementFields(table)
+	names := make([]string, 0, len(table.Elts))
+	for _, element := range table.Elts {
+		name, ok := s.fieldValue(element, fields, field.Sel.Name)
+		if !ok {
+			// One unresolved case would leave the list incomplete.
+			return nil, true
+		}
+		names = append(names, name)
+	}
+	return names, true
+}
+
+// table resolves the slice literal a range statement iterates over.
+func (s *staticSubtestScanner) table(x ast.Expr) *ast.CompositeLit {
+	switch x := x.(type) {
+	case *ast.CompositeLit:
+		if _, ok := x.Type.(*ast.ArrayType); ok {
+			return x
+		}
+	case *ast.Ident:
+		lit := s.locals[x.Name]
+		if lit == nil {
+			lit = s.vars[x.Name]
+		}
+		if lit != nil {
+			return s.table(lit)
+		}
+	}
+	return nil
+}
+
+// elementFields lists the field names of the struct elements of table in
+// declaration order, for elements written without keys.
+func (s *staticSubtestScanner) elementFields(table *ast.CompositeLit) []string {
+	elem := table.Type.(*ast.ArrayType).Elt
+	if star, ok := elem.(*ast.StarExpr); ok {
+		elem = star.X
+	}
+	var st *ast.StructType
+	switch elem := elem.(type) {
+	case *ast.StructType:
+		st = elem
+	case *ast.Ident:
+		st = s.structs[elem.Name]
+	}
+	if st == nil {
+		return nil
+	}
+	var fields []string
+	for _, field := range st.Fields.List {
+		if len(field.Names) == 0 {
+			// An embedded field is named after its type.
+			fields = append(fields, "")
+		}
+		for _, name := range field.Names {
+			fields = append(fields, name.Name)
+		}
+	}
+	return fields
+}
+
+// fieldValue is the string the table element sets field to.
+func (s *staticSubtestScanner) fieldValue(element ast.Expr, fields []string, field string) (string, bool) {
+	if unary, ok := element.(*ast.UnaryExpr); ok && unary.Op == token.AND {
+		element = unary.X
+	}
+	lit, ok := element.(*ast.CompositeLit)
+	if !ok {
+		return "", false
+	}
+	for i, elt := range lit.Elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			if key, ok := kv.Key.(*ast.Ident); ok && key.Name == field {
+				return s.stringValue(kv.Value)
+			}
+			continue
+		}
+		if i < len(fields) && fields[i] == field {
+			return s.stringValue(elt)
+		}
+	}
+	return "", false
+}
+
+// stringValue resolves a string literal or a string constant of the file.
+func (s *staticSubtestScanner) stringValue(expr ast.Expr) (string, bool) {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		if expr.Kind != token.STRING {
+			return "", false
+		}
+		text, err := strconv.Unquote(expr.Value)
+		return text, err == nil
+	case *ast.Ident:
+		text, ok := s.consts[expr.Name]
+		return text, ok
+	}
+	return "", false
+}
+
+// unique numbers a repeated or empty subtest name the way the testing
+// package does: the second TestX/case runs as TestX/case#01.
+func (s *staticSubtestScanner) unique(parent, subname string) string {
+	name := parent + "/" + subname
+	empty := subname == ""
+	for {
+		next, exists := s.used[name]
+		if !empty && !exists {
+			s.used[name] = 1
+			return name
+		}
+		empty = false
+		s.used[name] = next + 1
+		name = fmt.Sprintf("%s#%02d", name, next)
+	}
+}
+
+// SubtestName spells a subtest name the way the testing package
+// reports it: spaces become underscores and unprintable runes are escaped.
+func SubtestName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r):
+			b.WriteByte('_')
+		case !strconv.IsPrint(r):
+			quoted := strconv.QuoteRune(r)
+			b.WriteString(quoted[1 : len(quoted)-1])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,575 @@
+// Package tasks reads, merges and writes the JSON arrays editors keep
+// tasks and debug configurations in. A merge replaces the entries a
+// generator wrote before, told apart by a marker in their env, and leaves
+// hand-written entries alone; what counts as generated, and when an entry
+// is pruned or replaced, is up to the caller's Policy.
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Entry is a typed entry a merge writes, such as a zed.Task.
+type Entry interface {
+	EntryLabel() string
+	EntryEnv() map[string]string
+}
+
+// Stats counts what a merge did.
+type Stats struct {
+	Added   int
+	Updated int
+	Removed int
+	// Kept counts entries Policy.Replaces left as they were although they
+	// were regenerated.
+	Kept int
+	// Collapsed counts duplicate generated entries that were dropped, see
+	// DuplicateEntries.
+	Collapsed int
+	// Evicted lists the generated entries dropped over a budget, see
+	// File.Evict. Merge leaves it empty.
+	Evicted []string
+}
+
+// Policy holds the decisions a merge leaves to the caller. A nil func
+// gives the most conservative answer: nothing is generated or pruned,
+// everything is owned, entries never collapse and regenerated entries are
+// replaced.
+type Policy struct {
+	// Generated reports whether an entry carries the generated marker in
+	// its env or options.env; entries without either are not asked.
+	Generated func(entry map[string]any) bool
+	// Owned reports whether a generated entry looks like one the generator
+	// writes, from its command or adapter. Other entries count as not
+	// owned without asking.
+	Owned func(entry map[string]any) bool
+	// ID identifies what a generated entry runs from its env, so that
+	// copies left behind under another label collapse; "" never does.
+	ID func(env any) string
+	// Prunes reports whether an existing entry is dropped before the new
+	// entries are added; regenerated holds their labels.
+	Prunes func(label string, generated, owned bool, regenerated map[string]struct{}) bool
+	// Collapses reports whether duplicate generated entries may be dropped.
+	Collapses func(owned bool) bool
+	// Replaces reports whether a new entry overwrites the existing entry
+	// with its label.
+	Replaces func(label string, existing, generated any) bool
+	// SortGenerated orders the generated entries by label, see
+	// SortGenerated.
+	SortGenerated bool
+}
+
+func (p Policy) generated(entry map[string]any) bool {
+	return p.Generated != nil && p.Generated(entry)
+}
+
+func (p Policy) owned(entry map[string]any) bool {
+	return p.Owned == nil || p.Owned(entry)
+}
+
+func (p Policy) id(env any) string {
+	if p.ID == nil {
+		return ""
+	}
+	return p.ID(env)
+}
+
+func (p Policy) prunes(label string, generated, owned bool, regenerated map[string]struct{}) bool {
+	return p.Prunes != nil && p.Prunes(label, generated, owned, regenerated)
+}
+
+func (p Policy) collapses(owned bool) bool {
+	return p.Collapses != nil && p.Collapses(owned)
+}
+
+func (p Policy) replaces(label string, existing, generated any) bool {
+	return p.Replaces == nil || p.Replaces(label, existing, generated)
+}
+
+// StableID joins the values of keys in env, a map[string]string or
+// map[string]any, into an ID for Policy.ID. It is "" when env has none of
+// the keys.
+func StableID(env any, keys []string) string {
+	if values, ok := env.(map[string]string); ok {
+		converted := make(map[string]any, len(values))
+		for key, value := range values {
+			converted[key] = value
+		}
+		env = converted
+	}
+	parts := make([]string, len(keys))
+	found := false
+	for i, key := range keys {
+		if value, ok := EnvValue(env, key); ok {
+			parts[i], found = value, true
+		}
+	}
+	if !found {
+		return ""
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// File is an indexed view of a Zed tasks or debug array. Entries the
+// merge leaves alone keep their original encoding, so large files only pay
+// for decoding labels and markers and for re-encoding what changed.
+type File struct {
+	entries []fileEntry
+}
+
+type fileEntry struct {
+	// raw is the original encoding; value replaces it once the entry is
+	// decoded in full (a map) or generated (an Entry).
+	raw       json.RawMessage
+	value     any
+	label     string
+	hasLabel  bool
+	generated bool
+	// owned is set when the entry is generated and Policy.Owned accepts
+	// it.
+	owned bool
+	// id is the Policy.ID of a generated entry.
+	id string
+}
+
+// entryHeader is the part of an entry the merge needs to look at. The
+// rest of a generated entry is decoded for Policy.Owned.
+type entryHeader struct {
+	Label   *string        `json:"label"`
+	Env     map[string]any `json:"env"`
+	Options struct {
+		Env map[string]any `json:"env"`
+	} `json:"options"`
+}
+
+// ReadFile reads the JSON array at path, which may have comments and
+// trailing commas. A missing or empty file is an empty File.
+func ReadFile(path string, policy Policy) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &File{}, nil
+		}
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return &File{}, nil
+	}
+
+	// Files written by this tool are strict JSON with the usual entry
+	// shapes, so one decode of the headers also validates the array and the
+	// entries can be cut out of it without decoding it again. Comments,
+	// trailing commas and unusual shapes (non-string label, non-object
+	// options) take the slower path: the array is normalized and decoded
+	// first, and the headers entry by entry when they do not decode in one
+	// pass.
+	var raws []json.RawMessage
+	var headers []entryHeader
+	if err := json.Unmarshal(data, &headers); err == nil {
+		raws = splitArray(data)
+	} else {
+		headers = nil
+		if err := json.Unmarshal(data, &raws); err != nil {
+			data, err = Normalize(data)
+			if err != nil {
+				return nil, err
+			}
+			raws = nil
+			if err := json.Unmarshal(data, &raws); err != nil {
+				return nil, err
+			}
+		}
+		if err := json.Unmarshal(data, &headers); err != nil || len(headers) != len(raws) {
+			headers = nil
+		}
+	}
+
+	file := &File{entries: make([]fileEntry, 0, len(raws))}
+	for i, raw := range raws {
+		var header entryHeader
+		if headers != nil {
+			header = headers[i]
+		} else if err := json.Unmarshal(raw, &header); err != nil {
+			var value map[string]any
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, err
+			}
+			file.entries = append(file.entries, newFileEntry(value, "label", policy))
+			continue
+		}
+
+		entry := fileEntry{raw: raw}
+		if header.Label != nil {
+			entry.label, entry.hasLabel = *header.Label, true
+		}
+		// Most entries of a large file are hand-written and have no env, so
+		// they skip the predicates.
+		switch {
+		case header.Env != nil:
+			entry.generated = policy.generated(map[string]any{"env": header.Env})
+		case header.Options.Env != nil:
+			entry.generated = policy.generated(map[string]any{"options": map[string]any{"env": header.Options.Env}})
+		}
+		if entry.generated {
+			env := header.Env
+			if env == nil {
+				env = header.Options.Env
+			}
+			var value map[string]any
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, err
+			}
+			entry.owned = policy.owned(value)
+			entry.id = policy.id(env)
+		}
+		file.entries = append(file.entries, entry)
+	}
+	return file, nil
+}
+
+// splitArray returns the elements of data, a valid JSON array, without
+// decoding them.
+func splitArray(data []byte) []json.RawMessage {
+	var raws []json.RawMessage
+	depth, start := 0, -1
+	for i := 0; i < len(data); i++ {
+		switch ch := data[i]; ch {
+		case '"':
+			for i++; data[i] != '"'; i++ {
+				if data[i] == '\\' {
+					i++
+				}
+			}
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+			if depth == 0 && start >= 0 {
+				raws = append(raws, bytes.TrimSpace(data[start:i]))
+			}
+		case ',':
+			if depth == 1 {
+				raws = append(raws, bytes.TrimSpace(data[start:i]))
+				start = i + 1
+			}
+		}
+		if depth == 1 && start < 0 {
+			start = i + 1
+		}
+	}
+	if len(raws) == 1 && len(raws[0]) == 0 {
+		return nil
+	}
+	return raws
+}
+
+// newFileEntry indexes value, an entry named by its key field.
+func newFileEntry(value map[string]any, key string, policy Policy) fileEntry {
+	entry := fileEntry{value: value, generated: policy.generated(value)}
+	entry.label, entry.hasLabel = value[key].(string)
+	if entry.generated {
+		entry.owned = policy.owned(value)
+		entry.id = policy.id(EnvOf(value))
+	}
+	return entry
+}
+
+// DuplicateEntries returns the indexes of existing entries that duplicate
+// another generated entry: ids and labels describe the existing entries,
+// with "" ids for the ones that must not collapse, and regenerated maps
+// the IDs of the new entries to their labels. An entry whose ID is
+// regenerated is kept only under the new label, which the merge replaces;
+// otherwise the last entry of an ID, the newest, is kept.
+func DuplicateEntries(ids, labels []string, regenerated map[string]string) map[int]struct{} {
+	keep := make(map[string]int)
+	for i, id := range ids {
+		if id == "" {
+			continue
+		}
+		if label, ok := regenerated[id]; ok && labels[i] != label {
+			continue
+		}
+		keep[id] = i
+	}
+	duplicates := make(map[int]struct{})
+	for i, id := range ids {
+		if index, ok := keep[id]; id != "" && (!ok || index != i) {
+			duplicates[i] = struct{}{}
+		}
+	}
+	return duplicates
+}
+
+// MergeFile reads the array at path as ReadFile does and merges entries
+// into it.
+func MergeFile[E Entry](path string, entries []E, policy Policy) (*File, Stats, error) {
+	file, err := ReadFile(path, policy)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	values := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		values = append(values, entry)
+	}
+	return file, file.Merge(values, policy), nil
+}
+
+// Merge prunes previously generated entries (as policy says) and upserts
+// the entries by label.
+func (f *File) Merge(entries []Entry, policy Policy) Stats {
+	generated := make([]fileEntry, 0, len(entries))
+	for _, value := range entries {
+		generated = append(generated, fileEntry{value: value, label: value.EntryLabel(), hasLabel: true, generated: true, id: policy.id(value.EntryEnv())})
+	}
+	return f.merge(generated, policy)
+}
+
+// MergeEntries merges generated into existing as File.Merge does, for
+// entries kept as maps, such as the tasks and launch configurations of a
+// VS Code document. Entries are named by their key field, e.g. "label" or
+// "name", and read env from env or options.env.
+func MergeEntries(existing, generated []map[string]any, key string, policy Policy) ([]map[string]any, Stats) {
+	file := &File{entries: make([]fileEntry, 0, len(existing))}
+	for _, value := range existing {
+		file.entries = append(file.entries, newFileEntry(value, key, policy))
+	}
+	entries := make([]fileEntry, 0, len(generated))
+	for _, value := range generated {
+		entry := fileEntry{value: value, generated: true, id: policy.id(EnvOf(value))}
+		entry.label, entry.hasLabel = value[key].(string)
+		entries = append(entries, entry)
+	}
+	stats := file.merge(entries, policy)
+	return file.Values(), stats
+}
+
+func (f *File) merge(generated []fileEntry, policy Policy) Stats {
+	regenerated := make(map[string]struct{}, len(generated))
+	regeneratedIDs := make(map[string]string, len(generated))
+	for _, entry := range generated {
+		if !entry.hasLabel {
+			continue
+		}
+		regenerated[entry.label] = struct{}{}
+		if entry.id != "" {
+			regeneratedIDs[entry.id] = entry.label
+		}
+	}
+	kept := f.entries[:0]
+	removed := 0
+	for _, entry := range f.entries {
+		if policy.prunes(entry.label, entry.generated, entry.owned, regenerated) {
+			removed++
+			continue
+		}
+		kept = append(kept, entry)
+	}
+
+	ids := make([]string, len(kept))
+	labels := make([]string, len(kept))
+	for i, entry := range kept {
+		if policy.collapses(entry.owned) {
+			ids[i] = entry.id
+		}
+		labels[i] = entry.label
+	}
+	duplicates := DuplicateEntries(ids, labels, regeneratedIDs)
+	filtered := kept[:0]
+	for i, entry := range kept {
+		if _, ok := duplicates[i]; !ok {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	entryIndex := make(map[string]int, len(filtered)+len(generated))
+	for i, entry := range filtered {
+		if entry.hasLabel {
+			entryIndex[entry.label] = i
+		}
+	}
+
+	stats := Stats{Removed: removed, Collapsed: len(duplicates)}
+	for _, entry := range generated {
+		if idx, ok := entryIndex[entry.label]; ok {
+			existing := filtered[idx].value
+			if existing == nil {
+				existing = filtered[idx].raw
+			}
+			if !policy.replaces(entry.label, existing, entry.value) {
+				stats.Kept++
+				continue
+			}
+			filtered[idx] = entry
+			stats.Updated++
+			continue
+		}
+		filtered = append(filtered, entry)
+		entryIndex[entry.label] = len(filtered) - 1
+		stats.Added++
+	}
+
+	if policy.SortGenerated {
+		SortGenerated(filtered, func(entry fileEntry) (string, bool) { return entry.label, entry.generated })
+	}
+	f.entries = filtered
+	return stats
+}
+
+// SortGenerated orders the generated entries of entries by label within
+// the positions they already take, leaving the other entries in place, so
+// the order no longer depends on which files were generated first.
+func SortGenerated[E any](entries []E, generatedLabel func(E) (string, bool)) {
+	var slots []int
+	var generated []E
+	for i, entry := range entries {
+		if _, ok := generatedLabel(entry); ok {
+			slots = append(slots, i)
+			generated = append(generated, entry)
+		}
+	}
+	slices.SortStableFunc(generated, func(a, b E) int {
+		labelA, _ := generatedLabel(a)
+		labelB, _ := generatedLabel(b)
+		return strings.Compare(labelA, labelB)
+	})
+	for i, slot := range slots {
+		entries[slot] = generated[i]
+	}
+}
+
+// Values decodes every entry into a map.
+func (f *File) Values() []map[string]any {
+	values := make([]map[string]any, 0, len(f.entries))
+	for _, entry := range f.entries {
+		if value, ok := entry.value.(map[string]any); ok {
+			values = append(values, value)
+			continue
+		}
+		raw := entry.raw
+		if entry.value != nil {
+			raw, _ = json.Marshal(entry.value)
+		}
+		// raw already decoded into a header, so it is a JSON object.
+		var value map[string]any
+		_ = json.Unmarshal(raw, &value)
+		values = append(values, value)
+	}
+	return values
+}
+
+// Marshal encodes the file as an indented JSON array. Untouched entries
+// are only re-indented, which keeps their key order.
+func (f *File) Marshal() ([]byte, error) {
+	if len(f.entries) == 0 {
+		return []byte("[]\n"), nil
+	}
+
+	// Untouched entries are most of a large file, and re-indenting them
+	// grows them by their nesting only, so size the buffer up front.
+	size := 0
+	for _, entry := range f.entries {
+		size += len(entry.raw) + len(entry.raw)/8 + 8
+	}
+	var buf bytes.Buffer
+	buf.Grow(size)
+	buf.WriteString("[\n")
+	for i, entry := range f.entries {
+		buf.WriteString("  ")
+		if entry.value != nil {
+			data, err := json.MarshalIndent(entry.value, "  ", "  ")
+			if err != nil {
+				return nil, fmt.Errorf("serialize tasks JSON: %w", err)
+			}
+			buf.Write(data)
+		} else if err := json.Indent(&buf, entry.raw, "  ", "  "); err != nil {
+			return nil, fmt.Errorf("serialize tasks JSON: %w", err)
+		}
+		if i < len(f.entries)-1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("]\n")
+	return buf.Bytes(), nil
+}
+
+// SetGenerated replaces the generated entry labeled label with value, or
+// appends value when there is none.
+func (f *File) SetGenerated(label string, value any) {
+	entry := fileEntry{value: value, label: label, hasLabel: true, generated: true}
+	if index := f.generatedIndex(label); index >= 0 {
+		f.entries[index] = entry
+		return
+	}
+	f.entries = append(f.entries, entry)
+}
+
+// RemoveGenerated drops the generated entry labeled label, if any.
+func (f *File) RemoveGenerated(label string) {
+	if index := f.generatedIndex(label); index >= 0 {
+		f.entries = slices.Delete(f.entries, index, index+1)
+	}
+}
+
+// Evict drops the generated entries over a budget of limit, the ones used
+// longest ago first (see OverBudget), and returns their labels. Entries in
+// keep, such as the ones just merged, and entries Policy.Owned rejected
+// count towards limit but are never dropped.
+func (f *File) Evict(limit int, keep map[string]struct{}, lastUsed func(label string) time.Time) []string {
+	var labels []string
+	evictable := make(map[string]bool)
+	for _, entry := range f.entries {
+		if !entry.generated || !entry.hasLabel {
+			continue
+		}
+		labels = append(labels, entry.label)
+		_, kept := keep[entry.label]
+		evictable[entry.label] = entry.owned && !kept
+	}
+	evicted := OverBudget(labels, limit, func(label string) bool { return evictable[label] }, lastUsed)
+	drop := make(map[string]struct{}, len(evicted))
+	for _, label := range evicted {
+		drop[label] = struct{}{}
+	}
+	f.entries = slices.DeleteFunc(f.entries, func(entry fileEntry) bool {
+		_, ok := drop[entry.label]
+		return ok && entry.generated
+	})
+	return evicted
+}
+
+// OverBudget returns the labels to drop so that at most limit of labels
+// remain: the ones evictable accepts, by lastUsed and then by label, the
+// oldest first. A zero time is older than any other. Labels evictable
+// rejects count towards limit, so fewer may remain than needed. A limit of
+// 0 or less is no budget.
+func OverBudget(labels []string, limit int, evictable func(label string) bool, lastUsed func(label string) time.Time) []string {
+	if limit <= 0 || len(labels) <= limit {
+		return nil
+	}
+	var candidates []string
+	for _, label := range labels {
+		if evictable(label) {
+			candidates = append(candidates, label)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b string) int {
+		if c := lastUsed(a).Compare(lastUsed(b)); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return candidates[:min(len(labels)-limit, len(candidates))]
+}
+
+func (f *File) generatedIndex(label string) int {
+	return slices.IndexFunc(f.entries, func(entry fileEntry) bool { return entry.generated && entry.label == label })
+}
@@ -0,0 +1,261 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ReadArray reads the JSON array of objects at path, which may have
+// comments and trailing commas. A missing or empty file is an empty array.
+func ReadArray(path string) ([]map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []map[string]any{}, nil
+		}
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return []map[string]any{}, nil
+	}
+
+	normalized, err := Normalize(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []map[string]any
+	if err := json.Unmarshal(normalized, &tasks); err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// ReadObject reads the JSON object at path like ReadArray, as used by
+// VS Code's tasks.json and launch.json.
+func ReadObject(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]any{}, nil
+		}
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return map[string]any{}, nil
+	}
+
+	normalized, err := Normalize(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(normalized, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+	return doc, nil
+}
+
+// ObjectSlice returns doc[key] as a slice of objects, or an error when it
+// is not an array of objects. A missing key is an empty slice.
+func ObjectSlice(doc map[string]any, key string) ([]map[string]any, error) {
+	value, ok := doc[key]
+	if !ok || value == nil {
+		return []map[string]any{}, nil
+	}
+	raw, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%q must be an array", key)
+	}
+	entries := make([]map[string]any, 0, len(raw))
+	for i, item := range raw {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%q[%d] must be an object", key, i)
+		}
+		entries = append(entries, m)
+	}
+	return entries, nil
+}
+
+// Normalize turns relaxed JSON, with comments and trailing commas as Zed
+// and VS Code accept them, into strict JSON.
+func Normalize(data []byte) ([]byte, error) {
+	withoutComments, err := StripComments(data)
+	if err != nil {
+		return nil, err
+	}
+	return stripTrailingCommas(withoutComments), nil
+}
+
+// StripComments removes // and /* */ comments outside strings.
+func StripComments(data []byte) ([]byte, error) {
+	var out []byte
+	out = make([]byte, 0, len(data))
+
+	inString := false
+	inLineComment := false
+	inBlockComment := false
+	escape := false
+
+	for i := 0; i < len(data); i++ {
+		ch := data[i]
+
+		if inLineComment {
+			if ch == '\n' {
+				inLineComment = false
+				out = append(out, ch)
+			}
+			continue
+		}
+
+		if inBlockComment {
+			if ch == '*' && i+1 < len(data) && data[i+1] == '/' {
+				inBlockComment = false
+				i++
+			}
+			continue
+		}
+
+		if inString {
+			out = append(out, ch)
+			if escape {
+				escape = false
+				continue
+			}
+			if ch == '\\' {
+				escape = true
+				continue
+			}
+			if ch == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		if ch == '"' {
+			inString = true
+			out = append(out, ch)
+			continue
+		}
+
+		if ch == '/' && i+1 < len(data) {
+			next := data[i+1]
+			if next == '/' {
+				inLineComment = true
+				i++
+				continue
+			}
+			if next == '*' {
+				inBlockComment = true
+				i++
+				continue
+			}
+		}
+
+		out = append(out, ch)
+	}
+
+	if inBlockComment {
+		return nil, fmt.Errorf("unterminated block comment in tasks file")
+	}
+	if inString {
+		return nil, fmt.Errorf("unterminated string in tasks file")
+	}
+	return out, nil
+}
+
+func stripTrailingCommas(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString := false
+	escape := false
+
+	for i := 0; i < len(data); i++ {
+		ch := data[i]
+
+		if inString {
+			out = append(out, ch)
+			if escape {
+				escape = false
+				continue
+			}
+			if ch == '\\' {
+				escape = true
+				continue
+			}
+			if ch == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		if ch == '"' {
+			inString = true
+			out = append(out, ch)
+			continue
+		}
+
+		if ch == ',' {
+			j := i + 1
+			for j < len(data) && isJSONWhitespace(data[j]) {
+				j++
+			}
+			if j < len(data) && (data[j] == '}' || data[j] == ']') {
+				continue
+			}
+		}
+
+		out = append(out, ch)
+	}
+
+	return out
+}
+
+func isJSONWhitespace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
+
+// EnvValue returns the string value of key in an env block, a
+// map[string]string or map[string]any.
+func EnvValue(value any, key string) (string, bool) {
+	if env, ok := value.(map[string]string); ok {
+		val, ok := env[key]
+		return val, ok
+	}
+	env, ok := value.(map[string]any)
+	if !ok {
+		return "", false
+	}
+	valAny, ok := env[key]
+	if !ok {
+		return "", false
+	}
+	val, ok := valAny.(string)
+	if !ok {
+		return "", false
+	}
+	return val, true
+}
+
+// EnvOf returns the env block of a task or debug config, looking at
+// options.env for VS Code tasks.
+func EnvOf(entry map[string]any) any {
+	if envMap, ok := entry["env"].(map[string]any); ok {
+		return envMap
+	}
+	if options, ok := entry["options"].(map[string]any); ok {
+		return options["env"]
+	}
+	return nil
+}
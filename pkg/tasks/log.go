@@ -0,0 +1,75 @@
+package tasks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Log is where tasks wrapped by Tee keep a copy of their output, one file
+// per label.
+type Log struct {
+	// Dir is the log directory as the task's shell sees it, e.g. under
+	// $ZED_WORKTREE_ROOT.
+	Dir string
+	// Keep is the number of earlier logs of a label that are kept next to
+	// the current one, as <file>.1, <file>.2 and so on.
+	Keep int
+}
+
+// LogFile is the log file name of the task labeled label, with every
+// character that is not safe in file names replaced by an underscore. A
+// replaced name gets a short hash of label, so that labels such as
+// "go:Test/a" and "go:Test_a" do not share a log.
+func LogFile(label string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.", r) {
+			return r
+		}
+		return '_'
+	}, label)
+	if name != label {
+		sum := sha256.Sum256([]byte(label))
+		name += "-" + hex.EncodeToString(sum[:])[:7]
+	}
+	return name + ".log"
+}
+
+// teeStart and teeEnd surround the wrapped command in a Tee command, so
+// Untee can find it again.
+const (
+	teeStart = "; { "
+	teeEnd   = " 2>&1; echo $? >"
+)
+
+// Tee wraps command, a POSIX shell string, so that its output also goes to
+// the log file of label. The Keep earlier logs move one step back first,
+// and the task still exits with the status of command.
+func (l Log) Tee(label, command string) string {
+	log := l.Dir + "/" + LogFile(label)
+	var out strings.Builder
+	_, _ = fmt.Fprintf(&out, `mkdir -p "%s"`, l.Dir)
+	for i := l.Keep; i > 0; i-- {
+		from := log
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", log, i-1)
+		}
+		_, _ = fmt.Fprintf(&out, `; mv -f "%s" "%s.%d" 2>/dev/null`, from, log, i)
+	}
+	_, _ = fmt.Fprintf(&out, `%s%s%s"%s.status"; } | tee "%s"; exit "$(cat "%s.status")"`, teeStart, command, teeEnd, log, log, log)
+	return out.String()
+}
+
+// Untee returns the command a Tee command wraps.
+func Untee(command string) (string, bool) {
+	if !strings.HasPrefix(command, "mkdir -p ") {
+		return "", false
+	}
+	_, rest, ok := strings.Cut(command, teeStart)
+	if !ok {
+		return "", false
+	}
+	inner, _, ok := strings.Cut(rest, teeEnd)
+	return inner, ok
+}
@@ -0,0 +1,158 @@
+package tasks
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEntry struct {
+	Label string            `json:"label"`
+	Env   map[string]string `json:"env"`
+}
+
+func (e testEntry) EntryLabel() string { return e.Label }
+
+func (e testEntry) EntryEnv() map[string]string { return e.Env }
+
+func TestFile_MergeFollowsPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+  // kept: no marker
+  {"label": "manual", "command": "make"},
+  {"label": "old:TestA", "env": {"GEN": "1", "TEST": "TestA"}},
+  {"label": "gone:TestB", "env": {"GEN": "1", "TEST": "TestB"}},
+]`), 0o644))
+	policy := Policy{
+		Generated: func(entry map[string]any) bool {
+			value, _ := EnvValue(EnvOf(entry), "GEN")
+			return value == "1"
+		},
+		ID: func(env any) string { return StableID(env, []string{"TEST"}) },
+		Prunes: func(label string, generated, _ bool, _ map[string]struct{}) bool {
+			return generated && label == "gone:TestB"
+		},
+		Collapses: func(bool) bool { return true },
+	}
+
+	file, err := ReadFile(path, policy)
+	require.NoError(t, err)
+	stats := file.Merge([]Entry{testEntry{Label: "new:TestA", Env: map[string]string{"GEN": "1", "TEST": "TestA"}}}, policy)
+	assert.Equal(t, Stats{Added: 1, Removed: 1, Collapsed: 1}, stats)
+
+	var labels []string
+	for _, value := range file.Values() {
+		labels = append(labels, value["label"].(string))
+	}
+	assert.Equal(t, []string{"manual", "new:TestA"}, labels)
+
+	file.RemoveGenerated("new:TestA")
+	data, err := file.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, "[\n  {\n    \"label\": \"manual\",\n    \"command\": \"make\"\n  }\n]\n", string(data))
+}
+
+func TestMergeEntries_MergesMapsByKey(t *testing.T) {
+	existing := []map[string]any{
+		{"name": "manual", "type": "go"},
+		{"name": "old:TestA", "options": map[string]any{"env": map[string]any{"GEN": "1", "TEST": "TestA"}}},
+		{"name": "gone:TestB", "options": map[string]any{"env": map[string]any{"GEN": "1", "TEST": "TestB"}}},
+		{"name": "keep:TestC", "options": map[string]any{"env": map[string]any{"GEN": "1", "TEST": "TestC"}}},
+	}
+	policy := Policy{
+		Generated: func(entry map[string]any) bool {
+			value, _ := EnvValue(EnvOf(entry), "GEN")
+			return value == "1"
+		},
+		ID: func(env any) string { return StableID(env, []string{"TEST"}) },
+		Prunes: func(label string, generated, _ bool, _ map[string]struct{}) bool {
+			return generated && label == "gone:TestB"
+		},
+		Collapses: func(bool) bool { return true },
+		Replaces:  func(label string, _, _ any) bool { return label != "keep:TestC" },
+	}
+
+	merged, stats := MergeEntries(existing, []map[string]any{
+		{"name": "new:TestA", "options": map[string]any{"env": map[string]any{"GEN": "1", "TEST": "TestA"}}},
+		{"name": "keep:TestC", "options": map[string]any{"env": map[string]any{"GEN": "1", "TEST": "TestC"}}, "args": []string{"new"}},
+	}, "name", policy)
+	assert.Equal(t, Stats{Added: 1, Removed: 1, Kept: 1, Collapsed: 1}, stats)
+
+	var names []string
+	for _, value := range merged {
+		names = append(names, value["name"].(string))
+	}
+	assert.Equal(t, []string{"manual", "keep:TestC", "new:TestA"}, names)
+	assert.NotContains(t, merged[1], "args")
+}
+
+func TestFile_EvictDropsLeastRecentlyUsedOverBudget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+  {"label": "manual", "command": "make"},
+  {"label": "TestOld", "command": "go", "env": {"GEN": "1"}},
+  {"label": "TestNever", "command": "go", "env": {"GEN": "1"}},
+  {"label": "TestForeign", "command": "make", "env": {"GEN": "1"}},
+  {"label": "TestRecent", "command": "go", "env": {"GEN": "1"}},
+  {"label": "TestNew", "command": "go", "env": {"GEN": "1"}}
+]`), 0o644))
+	policy := Policy{
+		Generated: func(entry map[string]any) bool {
+			value, _ := EnvValue(EnvOf(entry), "GEN")
+			return value == "1"
+		},
+		Owned: func(entry map[string]any) bool { return entry["command"] == "go" },
+	}
+	file, err := ReadFile(path, policy)
+	require.NoError(t, err)
+
+	now := time.Now()
+	used := map[string]time.Time{"TestOld": now.Add(-time.Hour), "TestRecent": now, "TestNew": now.Add(-2 * time.Hour)}
+	evicted := file.Evict(3, map[string]struct{}{"TestNew": {}}, func(label string) time.Time { return used[label] })
+	assert.Equal(t, []string{"TestNever", "TestOld"}, evicted)
+
+	var labels []string
+	for _, value := range file.Values() {
+		labels = append(labels, value["label"].(string))
+	}
+	assert.Equal(t, []string{"manual", "TestForeign", "TestRecent", "TestNew"}, labels)
+	assert.Empty(t, file.Evict(0, nil, func(string) time.Time { return time.Time{} }))
+}
+
+func TestStripComments_UnterminatedBlockCommentReturnsError(t *testing.T) {
+	_, err := StripComments([]byte(`[{/* broken`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unterminated block comment")
+}
+
+func TestSplitArray_CutsTopLevelElements(t *testing.T) {
+	raws := splitArray([]byte(`[ {"label": "a,]\"}", "args": [1, {"x": []}]} , null,"s"]`))
+	require.Len(t, raws, 3)
+	assert.Equal(t, `{"label": "a,]\"}", "args": [1, {"x": []}]}`, string(raws[0]))
+	assert.Equal(t, `null`, string(raws[1]))
+	assert.Equal(t, `"s"`, string(raws[2]))
+	assert.Empty(t, splitArray([]byte(`[ ]`)))
+}
+
+func TestLog_TeeKeepsEarlierLogsAndUnteeFindsCommand(t *testing.T) {
+	log := Log{Dir: "$ZED_WORKTREE_ROOT/logs", Keep: 2}
+	command := log.Tee("go:Test/a b", "'go' 'test' './a'")
+	assert.Equal(t, `mkdir -p "$ZED_WORKTREE_ROOT/logs"`+
+		`; mv -f "$ZED_WORKTREE_ROOT/logs/go_Test_a_b-774ad6d.log.1" "$ZED_WORKTREE_ROOT/logs/go_Test_a_b-774ad6d.log.2" 2>/dev/null`+
+		`; mv -f "$ZED_WORKTREE_ROOT/logs/go_Test_a_b-774ad6d.log" "$ZED_WORKTREE_ROOT/logs/go_Test_a_b-774ad6d.log.1" 2>/dev/null`+
+		`; { 'go' 'test' './a' 2>&1; echo $? >"$ZED_WORKTREE_ROOT/logs/go_Test_a_b-774ad6d.log.status"; }`+
+		` | tee "$ZED_WORKTREE_ROOT/logs/go_Test_a_b-774ad6d.log"; exit "$(cat "$ZED_WORKTREE_ROOT/logs/go_Test_a_b-774ad6d.log.status")"`, command)
+
+	inner, ok := Untee(command)
+	require.True(t, ok)
+	assert.Equal(t, "'go' 'test' './a'", inner)
+	_, ok = Untee("go test ./a")
+	assert.False(t, ok)
+
+	assert.Equal(t, "go_Test_a.log", LogFile("go_Test_a"))
+	assert.NotEqual(t, LogFile("go:Test/a"), LogFile("go:Test_a"))
+}
@@ -0,0 +1,88 @@
+package zed
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ResolveWorkspaceRoot returns the absolute workspace root, auto-detecting it
+// from the current directory when rootPath is empty.
+func ResolveWorkspaceRoot(rootPath string) (string, error) {
+	if rootPath == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("get cwd: %w", err)
+		}
+		rootPath = DetectWorkspaceRoot(cwd)
+	}
+
+	absRootPath, err := filepath.Abs(rootPath)
+	if err != nil {
+		return "", fmt.Errorf("resolve root path: %w", err)
+	}
+	return absRootPath, nil
+}
+
+// DetectWorkspaceRoot finds the root of the workspace containing start:
+// the outermost directory with a go.mod inside the git checkout of start,
+// or the top of the checkout when none has one. A submodule or linked
+// worktree is a checkout of its own, so it ends the walk like a
+// repository does. Outside a checkout the nearest go.mod wins.
+func DetectWorkspaceRoot(start string) string {
+	nearest, outermost := "", ""
+	for current := start; ; {
+		if isFile(filepath.Join(current, "go.mod")) {
+			if nearest == "" {
+				nearest = current
+			}
+			outermost = current
+		}
+		if isCheckoutRoot(current) {
+			if outermost != "" {
+				return outermost
+			}
+			return current
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current {
+			break
+		}
+		current = parent
+	}
+	if nearest != "" {
+		return nearest
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return start
+	}
+	return cwd
+}
+
+// isCheckoutRoot reports whether dir is the top of a git checkout: it has
+// a .git directory, or a .git file pointing at one ("gitdir: ..."), as
+// submodules and linked worktrees have. Any other .git file is ignored.
+func isCheckoutRoot(dir string) bool {
+	gitPath := filepath.Join(dir, ".git")
+	info, err := os.Stat(gitPath)
+	if err != nil {
+		return false
+	}
+	if info.IsDir() {
+		return true
+	}
+	data, err := os.ReadFile(gitPath)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(string(data)), "gitdir:")
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
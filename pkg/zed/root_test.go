@@ -0,0 +1,74 @@
+package zed
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func TestDetectWorkspaceRoot_Checkouts(t *testing.T) {
+	gomod := "module example.com/sample\n\ngo 1.22\n"
+	cases := []struct {
+		name  string
+		files map[string]string
+		start string
+		want  string
+	}{
+		{
+			name:  "nested module in repository",
+			files: map[string]string{".git/HEAD": "ref: refs/heads/main\n", "go.mod": gomod, "tools/go.mod": gomod},
+			start: "tools/lint",
+			want:  ".",
+		},
+		{
+			name:  "submodule",
+			files: map[string]string{".git/HEAD": "ref: refs/heads/main\n", "go.mod": gomod, "third_party/lib/.git": "gitdir: ../../.git/modules/lib\n", "third_party/lib/go.mod": gomod},
+			start: "third_party/lib/pkg",
+			want:  "third_party/lib",
+		},
+		{
+			name:  "submodule without go.mod",
+			files: map[string]string{".git/HEAD": "ref: refs/heads/main\n", "go.mod": gomod, "vendor/lib/.git": "gitdir: ../../.git/modules/lib\n"},
+			start: "vendor/lib/pkg",
+			want:  "vendor/lib",
+		},
+		{
+			name:  "linked worktree inside repository",
+			files: map[string]string{".git/HEAD": "ref: refs/heads/main\n", "go.mod": gomod, ".worktrees/feature/.git": "gitdir: /src/repo/.git/worktrees/feature\n", ".worktrees/feature/go.mod": gomod},
+			start: ".worktrees/feature/internal/foo",
+			want:  ".worktrees/feature",
+		},
+		{
+			name:  "non-pointer .git file",
+			files: map[string]string{".git/HEAD": "ref: refs/heads/main\n", "go.mod": gomod, "sub/.git": "not a pointer\n", "sub/go.mod": gomod},
+			start: "sub/pkg",
+			want:  ".",
+		},
+		{
+			name:  "no repository",
+			files: map[string]string{"go.mod": gomod, "nested/go.mod": gomod},
+			start: "nested/pkg",
+			want:  "nested",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, content := range tc.files {
+				writeFile(t, filepath.Join(root, filepath.FromSlash(name)), content)
+			}
+			start := filepath.Join(root, filepath.FromSlash(tc.start))
+			require.NoError(t, os.MkdirAll(start, 0o755))
+			assert.Equal(t, filepath.Join(root, filepath.FromSlash(tc.want)), DetectWorkspaceRoot(start))
+		})
+	}
+}
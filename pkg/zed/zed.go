@@ -0,0 +1,252 @@
+// Package zed models the files Zed reads tasks and debug configurations
+// from, and finds the workspace root they belong to.
+package zed
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/VashingMachine/go-zed-test/pkg/discovery"
+)
+
+// Default paths of the tasks and debug files, relative to the workspace
+// root.
+const (
+	TasksPath = ".zed/tasks.json"
+	DebugPath = ".zed/debug.json"
+)
+
+// Task is a Zed task entry. Extra holds fields the type does not model;
+// they are written next to the typed fields and never override them.
+type Task struct {
+	Label               string            `json:"label"`
+	Command             string            `json:"command"`
+	Args                []string          `json:"args,omitempty"`
+	Env                 map[string]string `json:"env,omitempty"`
+	Cwd                 string            `json:"cwd,omitempty"`
+	UseNewTerminal      bool              `json:"use_new_terminal"`
+	AllowConcurrentRuns bool              `json:"allow_concurrent_runs"`
+	Reveal              string            `json:"reveal,omitempty"`
+	Hide                string            `json:"hide,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// taskFields is Task without its JSON methods.
+type taskFields Task
+
+func (t Task) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(taskFields(t), t.Extra)
+}
+
+func (t *Task) UnmarshalJSON(data []byte) error {
+	extra, err := unmarshalWithExtra(data, (*taskFields)(t))
+	t.Extra = extra
+	return err
+}
+
+// EntryLabel and EntryEnv make Task a tasks.Entry.
+func (t Task) EntryLabel() string { return t.Label }
+
+func (t Task) EntryEnv() map[string]string { return t.Env }
+
+// ApplyFields sets task fields from raw JSON values. Known fields replace
+// the typed value and unknown ones land in Extra.
+func (t *Task) ApplyFields(fields map[string]json.RawMessage) error {
+	data, err := marshalWithExtra(taskFields(*t), t.Extra)
+	if err != nil {
+		return err
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	for key, value := range fields {
+		object[key] = value
+	}
+	data, err = json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	*t = Task{}
+	return json.Unmarshal(data, t)
+}
+
+// TaskSettings are the fields every generated task shares.
+type TaskSettings struct {
+	UseNewTerminal bool
+	Reveal         string
+	Hide           string
+	// Fields are extra task fields as raw JSON values, see ApplyFields.
+	Fields map[string]json.RawMessage
+}
+
+// Apply sets the shared fields of task. It fails, leaving task unusable,
+// when one of Fields does not decode into the task field of its name.
+func (s TaskSettings) Apply(task *Task) error {
+	task.UseNewTerminal = s.UseNewTerminal
+	task.Reveal = s.Reveal
+	task.Hide = s.Hide
+	if len(s.Fields) == 0 {
+		return nil
+	}
+	return task.ApplyFields(s.Fields)
+}
+
+// GoTest is one test a generated entry runs.
+type GoTest struct {
+	// Name is the test, e.g. TestA or TestA/sub; RunPattern selects it.
+	Name string
+	// Package is the go test package argument, e.g. ./internal/a.
+	Package string
+	// Chdir, when set, runs `go -C Chdir test .` instead of naming
+	// Package.
+	Chdir string
+	// GoTestArgs are build and go test flags.
+	GoTestArgs []string
+	// BinaryArgs are passed to the test binary.
+	BinaryArgs []string
+}
+
+// Args builds the go test args of the test. BinaryArgs go after -args so
+// go test passes them through untouched.
+func (t GoTest) Args() []string {
+	pkgArg := t.Package
+	args := make([]string, 0, 7+len(t.GoTestArgs)+len(t.BinaryArgs))
+	if t.Chdir != "" {
+		args = append(args, "-C", t.Chdir)
+		pkgArg = "."
+	}
+	args = append(args, "test")
+	args = append(args, t.GoTestArgs...)
+	args = append(args, pkgArg, "-run", discovery.RunPattern(t.Name))
+	if len(t.BinaryArgs) > 0 {
+		args = append(args, "-args")
+		args = append(args, t.BinaryArgs...)
+	}
+	return args
+}
+
+// DelveArgs builds the test binary args of the test. Delve launches the
+// test binary directly, so there is no -args separator and GoTestArgs
+// must already be test binary flags such as -test.v.
+func (t GoTest) DelveArgs() []string {
+	args := make([]string, 0, len(t.GoTestArgs)+2+len(t.BinaryArgs))
+	args = append(args, t.GoTestArgs...)
+	args = append(args, "-test.run", discovery.RunPattern(t.Name))
+	args = append(args, t.BinaryArgs...)
+	return args
+}
+
+// NewGoTestTask returns a task labeled label that runs test with the go
+// command goBinary.
+func NewGoTestTask(label, goBinary string, test GoTest) Task {
+	return Task{Label: label, Command: goBinary, Args: test.Args()}
+}
+
+// DelveAdapter is the Zed debug adapter of Go programs.
+const DelveAdapter = "Delve"
+
+// NewDelveTest returns a debug config labeled label that launches the
+// tests of program, a package path, under Delve with args for the test
+// binary. GoTest.DelveArgs builds args that run a single test.
+func NewDelveTest(label, program string, args []string) DebugConfig {
+	return DebugConfig{
+		Label:   label,
+		Adapter: DelveAdapter,
+		Request: "launch",
+		Mode:    "test",
+		Program: program,
+		Args:    args,
+	}
+}
+
+// DebugConfig is a Zed debug.json entry for the Delve adapter. Extra works
+// as in Task.
+type DebugConfig struct {
+	Label      string            `json:"label"`
+	Adapter    string            `json:"adapter"`
+	Request    string            `json:"request"`
+	Mode       string            `json:"mode,omitempty"`
+	Program    string            `json:"program,omitempty"`
+	Args       []string          `json:"args,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Cwd        string            `json:"cwd,omitempty"`
+	BuildFlags string            `json:"buildFlags,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// debugConfigFields is DebugConfig without its JSON methods.
+type debugConfigFields DebugConfig
+
+func (c DebugConfig) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(debugConfigFields(c), c.Extra)
+}
+
+func (c *DebugConfig) UnmarshalJSON(data []byte) error {
+	extra, err := unmarshalWithExtra(data, (*debugConfigFields)(c))
+	c.Extra = extra
+	return err
+}
+
+// EntryLabel and EntryEnv make DebugConfig a tasks.Entry.
+func (c DebugConfig) EntryLabel() string { return c.Label }
+
+func (c DebugConfig) EntryEnv() map[string]string { return c.Env }
+
+// marshalWithExtra encodes fields and adds the extra keys it does not set.
+// Keys come out sorted, as they did when entries were plain maps.
+func marshalWithExtra(fields any, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	for key, value := range extra {
+		if _, ok := object[key]; !ok {
+			object[key] = value
+		}
+	}
+	return json.Marshal(object)
+}
+
+// unmarshalWithExtra decodes data into fields, a pointer to a struct, and
+// returns the keys that struct has no field for.
+func unmarshalWithExtra(data []byte, fields any) (map[string]json.RawMessage, error) {
+	if err := json.Unmarshal(data, fields); err != nil {
+		return nil, err
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	for _, name := range jsonFieldNames(reflect.TypeOf(fields).Elem()) {
+		delete(object, name)
+	}
+	if len(object) == 0 {
+		return nil, nil
+	}
+	return object, nil
+}
+
+// jsonFieldNames lists the JSON keys of the exported fields of t.
+func jsonFieldNames(t reflect.Type) []string {
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,49 @@
+package zed
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskSettings_ApplySetsSharedFieldsAndExtras(t *testing.T) {
+	settings := TaskSettings{
+		UseNewTerminal: true,
+		Reveal:         "always",
+		Hide:           "never",
+		Fields:         map[string]json.RawMessage{"hide": json.RawMessage(`"on_success"`), "tags": json.RawMessage(`["go"]`)},
+	}
+	task := Task{Label: "go:TestA", Command: "go", Args: []string{"test"}}
+	require.NoError(t, settings.Apply(&task))
+	assert.True(t, task.UseNewTerminal)
+	assert.Equal(t, "always", task.Reveal)
+	// Fields win over the typed settings.
+	assert.Equal(t, "on_success", task.Hide)
+	assert.Equal(t, map[string]json.RawMessage{"tags": json.RawMessage(`["go"]`)}, task.Extra)
+	assert.Equal(t, []string{"test"}, task.Args)
+
+	settings.Fields = map[string]json.RawMessage{"reveal": json.RawMessage(`1`)}
+	assert.Error(t, settings.Apply(&Task{}))
+}
+
+func TestNewDelveTest_LaunchesTestMode(t *testing.T) {
+	config := NewDelveTest("debug:TestA", "./pkg", []string{"-test.run", "^TestA$"})
+	data, err := json.Marshal(config)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"label": "debug:TestA", "adapter": "Delve", "request": "launch", "mode": "test", "program": "./pkg", "args": ["-test.run", "^TestA$"]}`, string(data))
+}
+
+func TestGoTest_BuildsTaskAndDelveArgs(t *testing.T) {
+	test := GoTest{Name: "TestA/case_1", Package: "./pkg", GoTestArgs: []string{"-v"}, BinaryArgs: []string{"-update"}}
+	task := NewGoTestTask("go:TestA/case_1", "go", test)
+	assert.Equal(t, "go", task.Command)
+	assert.Equal(t, []string{"test", "-v", "./pkg", "-run", "^TestA$/^case_1$", "-args", "-update"}, task.Args)
+
+	test.Chdir = "$ZED_WORKTREE_ROOT/pkg"
+	assert.Equal(t, []string{"-C", "$ZED_WORKTREE_ROOT/pkg", "test", "-v", ".", "-run", "^TestA$/^case_1$", "-args", "-update"}, test.Args())
+
+	test.GoTestArgs = []string{"-test.v"}
+	assert.Equal(t, []string{"-test.v", "-test.run", "^TestA$/^case_1$", "-update"}, test.DelveArgs())
+}